@@ -0,0 +1,92 @@
+package acme
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/digitalocean/godo"
+	"github.com/libdns/libdns"
+	"golang.org/x/oauth2"
+)
+
+// DigitalOceanProvider solves DNS-01 challenges for zones hosted at
+// DigitalOcean, using its official API client. Its settings are those of
+// libdns/digitalocean.
+type DigitalOceanProvider struct {
+	// APIToken is a DigitalOcean personal access token with write access to
+	// the domain.
+	APIToken string `json:"auth_token"`
+
+	baseURL string
+	once    sync.Once
+	client  *godo.Client
+	err     error
+}
+
+func (p *DigitalOceanProvider) getClient() (*godo.Client, error) {
+	p.once.Do(func() {
+		if p.APIToken == "" {
+			p.err = errors.New("digitalocean auth_token is required")
+			return
+		}
+		var opts []godo.ClientOpt
+		if p.baseURL != "" {
+			opts = append(opts, godo.SetBaseURL(p.baseURL))
+		}
+		tokens := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: p.APIToken})
+		p.client, p.err = godo.New(oauth2.NewClient(context.Background(), tokens), opts...)
+	})
+	return p.client, p.err
+}
+
+func (p *DigitalOceanProvider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	client, err := p.getClient()
+	if err != nil {
+		return nil, err
+	}
+	domain := strings.TrimSuffix(zone, ".")
+	created := make([]libdns.Record, 0, len(recs))
+	for _, rec := range recs {
+		rr := rec.RR()
+		_, _, err := client.Domains.CreateRecord(ctx, domain, &godo.DomainRecordEditRequest{
+			Type: rr.Type,
+			Name: rr.Name,
+			Data: rr.Data,
+			TTL:  int(rr.TTL.Seconds()),
+		})
+		if err != nil {
+			return created, errors.Wrapf(err, "failed to create %s record %s in %s", rr.Type, rr.Name, domain)
+		}
+		created = append(created, rec)
+	}
+	return created, nil
+}
+
+func (p *DigitalOceanProvider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	client, err := p.getClient()
+	if err != nil {
+		return nil, err
+	}
+	domain := strings.TrimSuffix(zone, ".")
+	deleted := make([]libdns.Record, 0, len(recs))
+	for _, rec := range recs {
+		rr := rec.RR()
+		name := strings.TrimSuffix(libdns.AbsoluteName(rr.Name, zone), ".")
+		existing, _, err := client.Domains.RecordsByTypeAndName(ctx, domain, rr.Type, name, &godo.ListOptions{PerPage: 200})
+		if err != nil {
+			return deleted, errors.Wrapf(err, "failed to list %s records %s in %s", rr.Type, rr.Name, domain)
+		}
+		for _, record := range existing {
+			if record.Data != rr.Data {
+				continue
+			}
+			if _, err := client.Domains.DeleteRecord(ctx, domain, record.ID); err != nil {
+				return deleted, errors.Wrapf(err, "failed to delete %s record %s in %s", rr.Type, rr.Name, domain)
+			}
+			deleted = append(deleted, rec)
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,102 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDigitalOcean serves the domain records endpoints of the DigitalOcean
+// API for example.com.
+type fakeDigitalOcean struct {
+	mu      sync.Mutex
+	records map[int]godo.DomainRecord
+	nextID  int
+}
+
+func (f *fakeDigitalOcean) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"id":"unauthorized","message":"Unable to authenticate you"}`))
+		return
+	}
+	const path = "/v2/domains/example.com/records"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == path:
+		var req godo.DomainRecordEditRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		record := godo.DomainRecord{ID: f.nextID, Type: req.Type, Name: req.Name, Data: req.Data, TTL: req.TTL}
+		f.records[record.ID] = record
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"domain_record": record})
+	case r.Method == http.MethodGet && r.URL.Path == path:
+		name := strings.TrimSuffix(r.URL.Query().Get("name"), ".example.com")
+		records := []godo.DomainRecord{}
+		for _, record := range f.records {
+			if record.Type == r.URL.Query().Get("type") && record.Name == name {
+				records = append(records, record)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"domain_records": records, "meta": map[string]any{"total": len(records)}})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, path+"/"):
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, path+"/"))
+		delete(f.records, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDigitalOceanProvider(t *testing.T) {
+	fake := &fakeDigitalOcean{records: make(map[int]godo.DomainRecord)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	provider := &DigitalOceanProvider{APIToken: "secret", baseURL: srv.URL + "/"}
+
+	recs := []libdns.Record{libdns.TXT{Name: "_acme-challenge", TTL: 2 * time.Minute, Text: "token"}}
+	created, err := provider.AppendRecords(context.Background(), "example.com.", recs)
+	require.NoError(t, err)
+	assert.Equal(t, recs, created)
+	require.Len(t, fake.records, 1)
+	assert.Equal(t, godo.DomainRecord{ID: 1, Type: "TXT", Name: "_acme-challenge", Data: "token", TTL: 120}, fake.records[1])
+
+	// Only the record with the same data is deleted
+	_, err = provider.AppendRecords(context.Background(), "example.com.", []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "other"}})
+	require.NoError(t, err)
+	deleted, err := provider.DeleteRecords(context.Background(), "example.com.", recs)
+	require.NoError(t, err)
+	assert.Equal(t, recs, deleted)
+	require.Len(t, fake.records, 1)
+	assert.Equal(t, "other", fake.records[2].Data)
+}
+
+func TestDigitalOceanProvider_Unauthorized(t *testing.T) {
+	srv := httptest.NewServer(&fakeDigitalOcean{records: make(map[int]godo.DomainRecord)})
+	defer srv.Close()
+	provider := &DigitalOceanProvider{APIToken: "wrong", baseURL: srv.URL + "/"}
+
+	_, err := provider.AppendRecords(context.Background(), "example.com.", []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "token"}})
+	assert.ErrorContains(t, err, "Unable to authenticate you")
+}
+
+func TestDigitalOceanProvider_MissingToken(t *testing.T) {
+	_, err := (&DigitalOceanProvider{}).AppendRecords(context.Background(), "example.com.", nil)
+	assert.ErrorContains(t, err, "auth_token is required")
+}
@@ -0,0 +1,59 @@
+// Package acme provides the DNS providers that can solve ACME DNS-01
+// challenges, selected by name from the configuration.
+package acme
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/cockroachdb/errors"
+	"github.com/libdns/cloudflare"
+	"github.com/libdns/desec"
+	"github.com/libdns/rfc2136"
+	"github.com/libdns/route53"
+)
+
+// dnsProviders are the supported DNS providers. Their settings are decoded
+// from the configuration into the provider's JSON fields, as with Caddy's DNS
+// modules.
+var dnsProviders = map[string]func() certmagic.DNSProvider{
+	"cloudflare":   func() certmagic.DNSProvider { return &cloudflare.Provider{} },
+	"desec":        func() certmagic.DNSProvider { return &desec.Provider{} },
+	"digitalocean": func() certmagic.DNSProvider { return &DigitalOceanProvider{} },
+	"rfc2136":      func() certmagic.DNSProvider { return &rfc2136.Provider{} },
+	"route53":      func() certmagic.DNSProvider { return &route53.Provider{} },
+}
+
+// DNSProviders returns the names of the supported DNS providers.
+func DNSProviders() []string {
+	names := make([]string, 0, len(dnsProviders))
+	for name := range dnsProviders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// NewDNSProvider returns the named DNS provider, configured with the
+// settings.
+func NewDNSProvider(name string, settings map[string]any) (certmagic.DNSProvider, error) {
+	newProvider, ok := dnsProviders[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.Newf("unknown ACME DNS provider %q (expected one of %s)", name, strings.Join(DNSProviders(), ", "))
+	}
+	provider := newProvider()
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s DNS provider settings", name)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(provider); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s DNS provider settings", name)
+	}
+	return provider, nil
+}
@@ -0,0 +1,93 @@
+package acme
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libdns/cloudflare"
+	"github.com/libdns/desec"
+	"github.com/libdns/rfc2136"
+	"github.com/libdns/route53"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSProviders(t *testing.T) {
+	assert.Equal(t, []string{"cloudflare", "desec", "digitalocean", "rfc2136", "route53"}, DNSProviders())
+}
+
+func TestNewDNSProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]any
+		want     any
+	}{
+		{
+			name:     "Cloudflare",
+			settings: map[string]any{"api_token": "secret"},
+			want:     &cloudflare.Provider{APIToken: "secret"},
+		},
+		{
+			name:     "desec",
+			settings: map[string]any{"token": "secret"},
+			want:     &desec.Provider{Token: "secret"},
+		},
+		{
+			name:     "digitalocean",
+			settings: map[string]any{"auth_token": "secret"},
+			want:     &DigitalOceanProvider{APIToken: "secret"},
+		},
+		{
+			name: "rfc2136",
+			settings: map[string]any{
+				"server":   "192.0.2.1",
+				"key_name": "acme",
+				"key_alg":  "hmac-sha512",
+				"key":      "c2VjcmV0",
+			},
+			want: &rfc2136.Provider{Server: "192.0.2.1", KeyName: "acme", KeyAlg: "hmac-sha512", Key: "c2VjcmV0"},
+		},
+		{
+			name: "route53",
+			settings: map[string]any{
+				"region":            "eu-west-2",
+				"access_key_id":     "AKIAEXAMPLE",
+				"secret_access_key": "secret",
+				"hosted_zone_id":    "Z0123456789",
+				"route53_max_wait":  int64(2 * time.Minute),
+			},
+			want: &route53.Provider{
+				Region:          "eu-west-2",
+				AccessKeyId:     "AKIAEXAMPLE",
+				SecretAccessKey: "secret",
+				HostedZoneID:    "Z0123456789",
+				Route53MaxWait:  2 * time.Minute,
+			},
+		},
+	}
+
+	tested := make(map[string]bool)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewDNSProvider(tt.name, tt.settings)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, provider)
+		})
+		tested[strings.ToLower(tt.name)] = true
+	}
+	for _, name := range DNSProviders() {
+		assert.True(t, tested[name], "no decode test for %s", name)
+	}
+}
+
+func TestNewDNSProvider_Invalid(t *testing.T) {
+	_, err := NewDNSProvider("desec", map[string]any{"api_token": "secret"})
+	assert.ErrorContains(t, err, "unknown field")
+
+	_, err = NewDNSProvider("rfc2136", map[string]any{"nameserver": "192.0.2.1"})
+	assert.ErrorContains(t, err, "unknown field")
+
+	_, err = NewDNSProvider("gandi", nil)
+	assert.ErrorContains(t, err, `unknown ACME DNS provider "gandi" (expected one of cloudflare, desec, digitalocean, rfc2136, route53)`)
+}
@@ -3,15 +3,18 @@ package internal
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Depado/ginprom"
-	"github.com/caddyserver/certmagic"
 	"github.com/cockroachdb/errors"
 	"github.com/earthboundkid/versioninfo/v2"
 	"github.com/getsentry/sentry-go"
@@ -19,12 +22,15 @@ import (
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"github.com/libdns/cloudflare"
 	"github.com/miekg/dns"
 	"github.com/pires/go-proxyproto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/rm-hull/dot-block/internal/blocklist"
+	"github.com/rm-hull/dot-block/internal/clients"
 	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/dnscrypt"
+	"github.com/rm-hull/dot-block/internal/doq"
 	"github.com/rm-hull/dot-block/internal/forwarder"
 	"github.com/rm-hull/dot-block/internal/geoblock"
 	"github.com/rm-hull/dot-block/internal/http/handlers"
@@ -34,8 +40,12 @@ import (
 	"github.com/rm-hull/dot-block/internal/limiter"
 	"github.com/rm-hull/dot-block/internal/logging"
 	"github.com/rm-hull/dot-block/internal/metrics"
+	"github.com/rm-hull/dot-block/internal/mobileconfig"
 	"github.com/rm-hull/dot-block/internal/noisefilter"
+	"github.com/rm-hull/dot-block/internal/odoh"
+	"github.com/rm-hull/dot-block/internal/setup"
 	"github.com/rm-hull/dot-block/internal/telemetry"
+	"github.com/rm-hull/dot-block/internal/tlspolicy"
 	"github.com/rm-hull/godx"
 	"github.com/robfig/cron/v3"
 	sloggin "github.com/samber/slog-gin"
@@ -122,30 +132,9 @@ func (app *App) RunServer(ctx context.Context) error {
 	if err := os.MkdirAll(certCacheDir, 0700); err != nil {
 		return errors.Wrap(err, "failed to create certcache directory")
 	}
-	// certmagic setup
-	zapLogger := logging.NewZapLoggerAdapter(app.Logger, "certmagic")
-	certmagic.Default.Logger = zapLogger
-	certmagic.DefaultACME.Logger = zapLogger
-	certmagic.DefaultACME.Agreed = true
-	certmagic.DefaultACME.Email = app.Config.Server.LetsEncrypt.Email
-	certmagic.Default.Storage = &certmagic.FileStorage{Path: certCacheDir}
-	var magic *certmagic.Config
-	if app.Config.Server.LetsEncrypt.Enabled {
-		token := app.Config.Server.LetsEncrypt.CloudflareApiToken
-		if token == "" {
-			return errors.New("cloudflare_api_token is required for DNS-01 challenge (configure under server.lets_encrypt)")
-		}
-		certmagic.DefaultACME.DNS01Solver = &certmagic.DNS01Solver{
-			DNSManager: certmagic.DNSManager{
-				DNSProvider: &cloudflare.Provider{
-					APIToken: token,
-				},
-			},
-		}
-		magic = certmagic.NewDefault()
-		if err := magic.ManageSync(context.Background(), app.Config.Server.LetsEncrypt.AllowedHosts); err != nil {
-			return errors.Wrap(err, "failed to manage certificates")
-		}
+	getCertificate, acmeIssuer, err := app.newCertificates(context.Background(), certCacheDir)
+	if err != nil {
+		return err
 	}
 	cache := forwarder.NewDNSCache(app.Config.DNS.Cache.MaxSize, app.Logger)
 
@@ -158,28 +147,103 @@ func (app *App) RunServer(ctx context.Context) error {
 		return errors.Wrap(err, "failed to initialize metrics")
 	}
 
-	// Rate limiter — shared across all four listeners (UDP, TCP, DoT, DoH).
-	// DoH is gated by the Gin middleware; UDP/TCP/DoT by the dispatcher.
+	tlsPolicy, err := app.newTLSPolicy(crontab, getCertificate, metrics)
+	if err != nil {
+		return err
+	}
+
+	// Rate limiter — shared across all listeners (UDP, TCP, DoT, DoQ, DNSCrypt, DoH).
+	// DoH is gated by the Gin middleware; UDP/TCP/DoT/DoQ by the dispatcher.
 	// Metrics are wired in via WithMetrics so Prometheus counters are populated.
-	rateLimiter, err := limiter.New(app.Config.Server.RateLimit, metrics)
+	accessList, redisStore, err := app.newLimiterState()
+	if err != nil {
+		return err
+	}
+	var store limiter.Store
+	if redisStore != nil {
+		store = redisStore
+		defer func() {
+			if err := redisStore.Close(); err != nil {
+				app.Logger.Warn("Failed to close Redis connection", "error", err)
+			}
+		}()
+	}
+	rateLimiter, err := limiter.New(app.Config.Server.RateLimit, metrics, geoIpLookup, accessList, store)
 	if err != nil {
 		return errors.Wrap(err, "failed to initialize rate limiter")
 	}
-	app.Logger.Info("Rate limiter initialized", "enabled", app.Config.Server.RateLimit.Enabled)
+	app.Logger.Info("Rate limiter initialized", "enabled", app.Config.Server.RateLimit.Enabled, "redis", store != nil)
 
 	dnsClient, err := forwarder.NewRoundRobinClient(metrics, app.Config.DNS.Timeouts.Read, app.Config.DNS.Timeouts.Write, app.Config.DNS.Timeouts.Dial, app.Logger, app.Config.DNS.Upstreams...)
 	if err != nil {
 		return errors.Wrap(err, "failed to initialize upstream DNS client")
 	}
 
+	hosts, err := newListenHosts(app.Config.Server.Listeners)
+	if err != nil {
+		return err
+	}
+
+	clientRegistry, err := app.newClientRegistry()
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize client registry")
+	}
+
 	broadcaster := sse.NewBroadcaster(app.Logger, metrics.DroppedSSEEvents)
-	dispatcher, err := forwarder.NewDNSDispatcher(cache, metrics, dnsClient, blockLists, noiseFilter, broadcaster, app.Config.DNS.Cache.TtlFloor, app.Logger, app.Config.DNS.ECS.Enabled, rateLimiter)
+	dispatcher, err := forwarder.NewDNSDispatcher(cache, metrics, dnsClient, blockLists, noiseFilter, broadcaster, app.Config.DNS, app.Config.Server.Listeners, app.Logger, rateLimiter, clientRegistry)
 	if err != nil {
 		return errors.Wrap(err, "failed to create dispatcher")
 	}
 	defer dispatcher.Close()
 
-	r, err := app.startHttpServer(dnsClient, blockLists, dispatcher, geoIpLookup, handlers.NewVersionInfoHandler(app.StartTime), rateLimiter)
+	odohHandler, err := app.newODoHHandler(crontab, dispatcher)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize ODoH handler")
+	}
+
+	dnscryptProvider, err := app.loadDNSCryptProvider()
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize DNSCrypt provider")
+	}
+
+	setupGenerator, err := setup.New(app.Config, dnscryptProvider)
+	if err != nil {
+		return err
+	}
+
+	dnscryptStamp := setupGenerator.DNSCryptStamp()
+	if dnscryptProvider == nil {
+		app.Logger.Warn("Skipping DNSCrypt server: dnscrypt-port not specified")
+	} else {
+		interval := app.Config.Server.DNSCrypt.CertRotation
+		app.Logger.Info("Creating DNSCrypt certificate rotation cron job", "interval", interval)
+		crontab.Schedule(cron.Every(interval), dnscryptRotationJob{dnscryptProvider, app.Logger})
+		if app.Config.Server.DNSCrypt.StampAddress == "" {
+			app.Logger.Warn("dnscrypt.stamp_address not set, most DNSCrypt clients require an IP address in the stamp")
+		}
+		app.Logger.Info("DNSCrypt provider ready", "provider_name", dnscryptProvider.Name(), "stamp", dnscryptStamp)
+	}
+
+	// Resolve our own hostname through the dispatcher rather than the system
+	// resolver, which may not know it (split-horizon) or may be us
+	addressResolver, err := setup.NewAddressResolver(setupGenerator.ServerName(), app.Config.Server.PublicAddresses,
+		dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceInternal)))
+	if err != nil {
+		return err
+	}
+
+	mobileconfigOptions, err := app.newMobileconfigOptions(setupGenerator, addressResolver)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize mobileconfig handler")
+	}
+
+	r, err := app.startHttpServer(dnsClient, blockLists, dispatcher, geoIpLookup, handlers.NewVersionInfoHandler(app.StartTime), rateLimiter, odohHandler,
+		handlers.NewDNSCryptInfoHandler(dnscryptProvider, dnscryptStamp), handlers.NewSetupHandler(setupGenerator, addressResolver), mobileconfigOptions,
+		handlers.NewPolicyHandler(handlers.PolicyOptions{
+			DoHBaseURL:      setupGenerator.BaseURL(),
+			ExcludedDomains: app.Config.Server.Mobileconfig.ExcludedDomains,
+			Addresses:       addressResolver,
+		}), handlers.NewClientsHandler(clientRegistry))
 	if err != nil {
 		return errors.Wrap(err, "failed to initialize HTTP server")
 	}
@@ -191,106 +255,251 @@ func (app *App) RunServer(ctx context.Context) error {
 
 	// Rate limiter reaper — reuses the existing cron scheduler instead of a
 	// dedicated goroutine, so there's no extra background goroutine to manage.
-	if app.Config.Server.RateLimit.Enabled && app.Config.Server.RateLimit.ReapInterval > 0 {
-		interval := app.Config.Server.RateLimit.ReapInterval
+	// It runs even with rate limiting disabled, as RRL buckets and expired
+	// manual bans and exemptions still need reaping. With Redis, it also
+	// picks up the access list changes of other replicas.
+	if interval := app.Config.Server.RateLimit.ReapInterval; interval > 0 {
 		app.Logger.Info("Creating rate limiter reaper cron job", "interval", interval)
 		entryID := crontab.Schedule(cron.Every(interval), rateLimiterJob{rateLimiter})
 		app.Logger.Debug("Scheduled rate limiter reaper", "entry_id", entryID)
 	}
-	group, groupCtx := errgroup.WithContext(ctx)
-	group.Go(func() error {
-		app.Logger.Info("Starting HTTP server for mobileconfig, metrics & healthcheck", "port", app.Config.Server.HttpPort)
-		srv := &http.Server{
-			Addr:    fmt.Sprintf(":%d", app.Config.Server.HttpPort),
-			Handler: r,
+	// Once the HTTP and HTTPS servers are running, they answer the HTTP-01 and
+	// TLS-ALPN-01 challenges of certificate renewals
+	var httpHandler http.Handler = r
+	httpsProtos := []string{"h2", "http/1.1"}
+	if acmeIssuer != nil {
+		httpHandler = acmeIssuer.HTTPChallengeHandler(r)
+		if app.Config.Server.LetsEncrypt.Challenge == "tls-alpn-01" {
+			httpsProtos = append(httpsProtos, acmeTLSALPNProto)
 		}
-		app.monitorShutdown(groupCtx, "HTTP server", func() error {
-			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			return srv.Shutdown(shutdownCtx)
+	}
+	group, groupCtx := errgroup.WithContext(ctx)
+	for _, host := range hosts.http {
+		group.Go(func() error {
+			addr := host.addr(app.Config.Server.HttpPort)
+			app.Logger.Info("Starting HTTP server for mobileconfig, metrics & healthcheck", "addr", addr)
+			listener, err := net.Listen(host.network("tcp"), addr)
+			if err != nil {
+				return errors.Wrap(err, "failed to create HTTP listener")
+			}
+			srv := &http.Server{
+				Addr:    addr,
+				Handler: httpHandler,
+			}
+			app.monitorShutdown(groupCtx, "HTTP server "+addr, func() error {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				return srv.Shutdown(shutdownCtx)
+			})
+			if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+				return errors.Wrap(err, "HTTP server failed")
+			}
+			return nil
 		})
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			return errors.Wrap(err, "HTTP server failed")
-		}
-		return nil
-	})
-	group.Go(func() error {
-		if app.Config.Server.DnsPort == 0 {
-			app.Logger.Warn("Skipping UDP DNS server: dns-port not specified")
+		group.Go(func() error {
+			if app.Config.Server.HttpsPort == 0 {
+				return nil
+			}
+			if getCertificate == nil {
+				app.Logger.Warn("Skipping HTTPS server: requires TLS certificates (enable server.lets_encrypt or set server.tls.cert_file)")
+				return nil
+			}
+			addr := host.addr(app.Config.Server.HttpsPort)
+			app.Logger.Info("Starting HTTPS server", "addr", addr)
+			listener, err := net.Listen(host.network("tcp"), addr)
+			if err != nil {
+				return errors.Wrap(err, "failed to create HTTPS listener")
+			}
+			srv := &http.Server{
+				Addr:      addr,
+				Handler:   httpHandler,
+				TLSConfig: tlsPolicy.Config("https", httpsProtos...),
+			}
+			app.monitorShutdown(groupCtx, "HTTPS server "+addr, func() error {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				return srv.Shutdown(shutdownCtx)
+			})
+			// Certificates come from certmagic via TLSConfig.GetCertificate
+			if err := srv.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+				return errors.Wrap(err, "HTTPS server failed")
+			}
 			return nil
-		}
-		app.Logger.Info("Starting UDP DNS server", "port", app.Config.Server.DnsPort)
-		srv := &dns.Server{
-			Addr:    fmt.Sprintf(":%d", app.Config.Server.DnsPort),
-			Net:     "udp",
-			Handler: dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceUDP)),
-		}
-		app.monitorShutdown(groupCtx, "UDP DNS server", srv.Shutdown)
-		return srv.ListenAndServe()
-	})
-	group.Go(func() error {
-		if app.Config.Server.DnsPort == 0 {
-			app.Logger.Warn("Skipping TCP DNS server: dns-port not specified")
+		})
+		group.Go(func() error {
+			if !app.Config.Server.Http3 || app.Config.Server.HttpsPort == 0 {
+				return nil
+			}
+			if getCertificate == nil {
+				app.Logger.Warn("Skipping HTTP/3 server: requires TLS certificates (enable server.lets_encrypt or set server.tls.cert_file)")
+				return nil
+			}
+			addr := host.addr(app.Config.Server.HttpsPort)
+			app.Logger.Info("Starting HTTP/3 server", "addr", addr)
+			// Bind the UDP socket up front, as http3.Server.Shutdown can race with
+			// ListenAndServe before the socket has been created.
+			conn, err := net.ListenPacket(host.network("udp"), addr)
+			if err != nil {
+				return errors.Wrap(err, "failed to create HTTP/3 listener")
+			}
+			defer func() {
+				if err := conn.Close(); err != nil {
+					app.Logger.Warn("error closing HTTP/3 listener", "error", err)
+				}
+			}()
+			srv := &http3.Server{
+				Handler:   r,
+				TLSConfig: http3.ConfigureTLSConfig(tlsPolicy.Config("http3")),
+			}
+			app.monitorShutdown(groupCtx, "HTTP/3 server "+addr, func() error {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				return srv.Shutdown(shutdownCtx)
+			})
+			if err := srv.Serve(conn); err != nil && err != http.ErrServerClosed {
+				return errors.Wrap(err, "HTTP/3 server failed")
+			}
 			return nil
+		})
+	}
+	connLimiter := newConnLimiter(app.Config.Server.Connections, metrics.OpenConnections, metrics.RejectedConnections)
+	if app.Config.Server.DnsPort == 0 {
+		app.Logger.Warn("Skipping UDP/TCP DNS servers: dns-port not specified")
+	} else {
+		for _, host := range hosts.dns {
+			for network, source := range map[string]forwarder.DNSSource{"udp": forwarder.SourceUDP, "tcp": forwarder.SourceTCP} {
+				group.Go(func() error {
+					addr := host.addr(app.Config.Server.DnsPort)
+					name := strings.ToUpper(network) + " DNS server " + addr
+					app.Logger.Info("Starting " + name)
+					srv := &dns.Server{
+						Addr:    addr,
+						Net:     host.network(network),
+						Handler: dns.HandlerFunc(dispatcher.HandleDNSRequest(source)),
+					}
+					if network == "tcp" {
+						configureTCPServer(srv, app.Config.Server.Connections)
+					}
+					if pp := app.Config.Server.ProxyProtocol; pp != nil && pp.DNS {
+						if err := app.listenWithProxyProtocol(srv); err != nil {
+							return err
+						}
+					} else if network == "tcp" {
+						listener, err := net.Listen(srv.Net, srv.Addr)
+						if err != nil {
+							return errors.Wrap(err, "failed to create TCP DNS listener")
+						}
+						srv.Listener = listener
+					}
+					if srv.Listener != nil {
+						srv.Listener = connLimiter.Listener(srv.Listener, source)
+					}
+					app.monitorShutdown(groupCtx, name, srv.Shutdown)
+					if srv.Listener == nil && srv.PacketConn == nil {
+						return srv.ListenAndServe()
+					}
+					return srv.ActivateAndServe()
+				})
+			}
 		}
-		app.Logger.Info("Starting TCP DNS server", "port", app.Config.Server.DnsPort)
-		srv := &dns.Server{
-			Addr:    fmt.Sprintf(":%d", app.Config.Server.DnsPort),
-			Net:     "tcp",
-			Handler: dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceTCP)),
-		}
-		app.monitorShutdown(groupCtx, "TCP DNS server", srv.Shutdown)
-		return srv.ListenAndServe()
-	})
-	group.Go(func() error {
-		dotPort := fmt.Sprintf(":%d", app.Config.Server.DotPort)
-		listener, err := net.Listen("tcp", dotPort)
-		if err != nil {
-			return errors.Wrap(err, "failed to create DoT listener")
-		}
-		defer func() {
-			err := listener.Close()
+	}
+	for _, host := range hosts.dot {
+		group.Go(func() error {
+			dotAddr := host.addr(app.Config.Server.DotPort)
+			listener, err := net.Listen(host.network("tcp"), dotAddr)
 			if err != nil {
-				app.Logger.Warn("error closing DoT listener", "error", err)
+				return errors.Wrap(err, "failed to create DoT listener")
 			}
-		}()
-		if app.Config.Server.DevMode {
-			app.Logger.Info("Starting DoT server (plain TCP) in DEV mode", "port", app.Config.Server.DotPort)
-		} else {
-			app.Logger.Info("Starting DNS-over-TLS server", "port", app.Config.Server.DotPort)
-			proxyListener, err := app.newProxyListener(listener)
-			if err != nil {
-				return err
+			defer func() {
+				err := listener.Close()
+				if err != nil {
+					app.Logger.Warn("error closing DoT listener", "error", err)
+				}
+			}()
+			if app.Config.Server.DevMode {
+				app.Logger.Info("Starting DoT server (plain TCP) in DEV mode", "addr", dotAddr)
+				listener = connLimiter.Listener(listener, forwarder.SourceDoT)
+			} else {
+				app.Logger.Info("Starting DNS-over-TLS server", "addr", dotAddr)
+				proxyListener, err := app.newProxyListener(listener)
+				if err != nil {
+					return err
+				}
+				listener = tls.NewListener(connLimiter.Listener(proxyListener, forwarder.SourceDoT), tlsPolicy.Config("dot", "dot"))
+			}
+			srv := &dns.Server{
+				Addr:     dotAddr,
+				Net:      "tcp",
+				Listener: listener,
+				Handler:  dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceDoT)),
 			}
-			listener = tls.NewListener(proxyListener, &tls.Config{
-				MinVersion: tls.VersionTLS12,
-				MaxVersion: tls.VersionTLS13,
-				CipherSuites: []uint16{
-					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-					tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-					tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-					tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
-					tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
-				},
-				NextProtos:     []string{"dot"},
-				GetCertificate: magic.GetCertificate,
+			configureTCPServer(srv, app.Config.Server.Connections)
+			app.monitorShutdown(groupCtx, "DoT server "+dotAddr, srv.Shutdown)
+			return srv.ActivateAndServe()
+		})
+	}
+	if app.Config.Server.DoqPort == 0 {
+		app.Logger.Warn("Skipping DNS-over-QUIC server: doq-port not specified")
+	} else if getCertificate == nil {
+		// QUIC mandates TLS 1.3, so there is no plain-text dev mode equivalent
+		app.Logger.Warn("Skipping DNS-over-QUIC server: requires TLS certificates (enable server.lets_encrypt or set server.tls.cert_file)")
+	} else {
+		for _, host := range hosts.doq {
+			group.Go(func() error {
+				addr := host.addr(app.Config.Server.DoqPort)
+				app.Logger.Info("Starting DNS-over-QUIC server", "addr", addr)
+				srv := &doq.Server{
+					Addr:      addr,
+					Net:       host.network("udp"),
+					TLSConfig: tlsPolicy.Config("doq", doq.ALPN),
+					Handler:   dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceDoQ)),
+					Logger:    app.Logger,
+				}
+				app.monitorShutdown(groupCtx, "DoQ server "+addr, srv.Shutdown)
+				return srv.ListenAndServe()
 			})
 		}
-		srv := &dns.Server{
-			Addr:     dotPort,
-			Net:      "tcp",
-			Listener: listener,
-			Handler:  dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceDoT)),
+	}
+	if dnscryptProvider != nil {
+		for _, host := range hosts.dnscrypt {
+			for _, network := range []string{"udp", "tcp"} {
+				group.Go(func() error {
+					addr := host.addr(app.Config.Server.DNSCryptPort)
+					app.Logger.Info("Starting DNSCrypt server", "addr", addr, "net", network)
+					srv := &dnscrypt.Server{
+						Addr:     addr,
+						Net:      host.network(network),
+						Provider: dnscryptProvider,
+						Handler:  dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceDNSCrypt)),
+						Allow: func(ip string) bool {
+							ok, _ := rateLimiter.Allow(ip)
+							return ok
+						},
+						Logger: app.Logger,
+					}
+					app.monitorShutdown(groupCtx, "DNSCrypt "+strings.ToUpper(network)+" server "+addr, srv.Shutdown)
+					return srv.ListenAndServe()
+				})
+			}
 		}
-		app.monitorShutdown(groupCtx, "DoT server", srv.Shutdown)
-		return srv.ActivateAndServe()
-	})
+	}
 	return group.Wait()
 }
 
 func (app *App) newProxyListener(base net.Listener) (*proxyproto.Listener, error) {
-	var proxyListener *proxyproto.Listener
+	policy, err := app.proxyConnPolicy()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyproto.Listener{
+		Listener:   base,
+		ConnPolicy: policy,
+	}, nil
+}
+
+// proxyConnPolicy returns the policy for PROXY protocol headers from a
+// connection's upstream address.
+func (app *App) proxyConnPolicy() (proxyproto.ConnPolicyFunc, error) {
 	pp := app.Config.Server.ProxyProtocol
 	if pp != nil && len(pp.TrustedProxies) > 0 {
 		// If trusted proxies are specified, use a whitelist policy
@@ -299,29 +508,18 @@ func (app *App) newProxyListener(base net.Listener) (*proxyproto.Listener, error
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to create trusted proxy whitelist policy")
 		}
-		proxyListener = &proxyproto.Listener{
-			Listener:   base,
-			ConnPolicy: policy,
-		}
+		return policy, nil
 	} else if pp != nil && pp.Enabled {
 		// If no trusted proxies specified but requirement is on, use REQUIRE policy
-		proxyListener = &proxyproto.Listener{
-			Listener: base,
-			ConnPolicy: func(options proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
-				return proxyproto.REQUIRE, nil
-			},
-		}
-	} else {
-		// If requirement is off, use USE policy (optional)
-		app.Logger.Warn("Running with PROXY protocol optional; client IPs may be spoofed if not behind a trusted proxy")
-		proxyListener = &proxyproto.Listener{
-			Listener: base,
-			ConnPolicy: func(options proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
-				return proxyproto.USE, nil
-			},
-		}
+		return func(options proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		}, nil
 	}
-	return proxyListener, nil
+	// If requirement is off, use USE policy (optional)
+	app.Logger.Warn("Running with PROXY protocol optional; client IPs may be spoofed if not behind a trusted proxy")
+	return func(options proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+		return proxyproto.USE, nil
+	}, nil
 }
 
 func (app *App) startHttpServer(
@@ -331,12 +529,23 @@ func (app *App) startHttpServer(
 	geoIpLookup geoblock.GeoIpLookup,
 	versionInfoHandler *handlers.VersionInfoHandler,
 	rateLimiter *limiter.Limiter,
+	odohHandler *handlers.ODoHHandler,
+	dnscryptInfoHandler gin.HandlerFunc,
+	setupHandler *handlers.SetupHandler,
+	mobileconfigOptions handlers.MobileconfigOptions,
+	policyHandler *handlers.PolicyHandler,
+	clientsHandler *handlers.ClientsHandler,
 ) (*gin.Engine, error) {
 
 	if !app.Config.Server.DevMode {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	r := gin.New()
+	// Only trust X-Forwarded-For and X-Real-IP from known reverse proxies,
+	// otherwise clients could spoof their way past the per-IP limits
+	if err := r.SetTrustedProxies(app.Config.Server.HTTPTrustedProxies); err != nil {
+		return nil, errors.Wrap(err, "invalid http_trusted_proxies")
+	}
 	if app.Config.Server.DevMode {
 		app.Logger.Warn("pprof endpoints are enabled and exposed. Do not run with this flag in production.")
 		pprof.Register(r)
@@ -356,6 +565,9 @@ func (app *App) startHttpServer(
 		prometheus.Instrument(),
 		middlewares.SentryErrorHandler(app.Logger),
 	)
+	if app.Config.Server.Http3 && app.Config.Server.HttpsPort != 0 {
+		r.Use(middlewares.AdvertiseHTTP3(app.Config.Server.HttpsPort))
+	}
 	if err := healthcheck.New(r, hc_config.DefaultConfig(), dnsClient.Healthchecks()); err != nil {
 		return nil, errors.Wrap(err, "failed to initialize healthcheck")
 	}
@@ -373,9 +585,17 @@ func (app *App) startHttpServer(
 
 	requestHandler := dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceDoH))
 
+	waterTortureHandler := handlers.NewWaterTortureHandler(nil)
+	if wt := app.Config.DNS.WaterTorture; wt != nil && wt.Enabled {
+		waterTortureHandler = handlers.NewWaterTortureHandler(dispatcher)
+	}
+
 	routes.NewPublicGroup(r, serverName, rateLimiter,
-		handlers.NewMobileconfigHandler(serverName),
-		handlers.NewDoHHandler(requestHandler))
+		handlers.NewMobileconfigHandler(serverName, mobileconfigOptions),
+		handlers.NewDoHHandler(requestHandler),
+		odohHandler,
+		setupHandler,
+		policyHandler)
 
 	routes.NewAdminGroup(r,
 		"admin."+serverName,
@@ -386,11 +606,193 @@ func (app *App) startHttpServer(
 		geoIpLookup,
 		versionInfoHandler,
 		rateLimiter,
+		dnscryptInfoHandler,
+		clientsHandler,
+		handlers.NewBansHandler(rateLimiter),
+		waterTortureHandler,
 	)
 
 	return r, nil
 }
 
+// newMobileconfigOptions returns the options for the mobileconfig handler,
+// loading the profile signing certificate if one is configured.
+func (app *App) newMobileconfigOptions(setupGenerator *setup.Generator, addressResolver *setup.AddressResolver) (handlers.MobileconfigOptions, error) {
+	cfg := app.Config.Server.Mobileconfig
+	opts := handlers.MobileconfigOptions{
+		DoHBaseURL:      setupGenerator.BaseURL(),
+		DisconnectSSIDs: cfg.DisconnectSSIDs,
+		ExcludedDomains: cfg.ExcludedDomains,
+		Addresses:       addressResolver,
+	}
+
+	signing := cfg.Signing
+	if signing.CertFile == "" && signing.KeyFile == "" {
+		app.Logger.Info("mobileconfig.signing not configured, profiles will be shown as unverified")
+		return opts, nil
+	}
+	signer, err := mobileconfig.NewSigner(signing.CertFile, signing.KeyFile)
+	if err != nil {
+		return opts, err
+	}
+	opts.Signer = signer
+	return opts, nil
+}
+
+// newClientRegistry returns the registry of named clients, or nil if client
+// identification is disabled. Client IDs in the DoT/DoQ server name are
+// subdomains of the allowed hosts, so a wildcard certificate is needed for
+// them (e.g. *.dot.example.com).
+func (app *App) newClientRegistry() (*clients.Registry, error) {
+	maxClients := app.Config.Server.Clients.MaxClients
+	if maxClients == 0 {
+		app.Logger.Info("Client identification disabled")
+		return nil, nil
+	}
+	file := filepath.Join(app.Config.Server.DataDir, "clients.json")
+	return clients.NewRegistry(file, maxClients, app.Config.Server.LetsEncrypt.AllowedHosts)
+}
+
+// newLimiterState returns the access list of the rate limiter and, if Redis
+// is enabled, the store they share with the other replicas. Without Redis,
+// the access list is kept in the data directory and the rest of the limiter
+// state in memory.
+func (app *App) newLimiterState() (*limiter.AccessList, *limiter.RedisStore, error) {
+	cfg := app.Config.Server.RateLimit
+	if cfg.Redis == nil || !cfg.Redis.Enabled {
+		accessList, err := limiter.NewAccessList(filepath.Join(app.Config.Server.DataDir, "access-list.json"))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to load access list")
+		}
+		return accessList, nil, nil
+	}
+
+	store, err := limiter.NewRedisStore(cfg.Redis, cfg.MaxTrackedIPs, app.Logger)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to initialize Redis rate limiter store")
+	}
+	app.Logger.Info("Sharing rate limiter state via Redis", "address", cfg.Redis.Address, "key_prefix", cfg.Redis.KeyPrefix)
+	return limiter.NewRedisAccessList(store), store, nil
+}
+
+// loadDNSCryptProvider returns the DNSCrypt provider, or nil if the DNSCrypt
+// listener is disabled. The provider key is persisted in the data directory so
+// that the stamp stays stable across restarts.
+func (app *App) loadDNSCryptProvider() (*dnscrypt.Provider, error) {
+	if app.Config.Server.DNSCryptPort == 0 {
+		return nil, nil
+	}
+
+	cfg := app.Config.Server.DNSCrypt
+	providerName := cfg.ProviderName
+	if providerName == "" {
+		if len(app.Config.Server.LetsEncrypt.AllowedHosts) == 0 {
+			return nil, errors.New("dnscrypt.provider_name or server.lets_encrypt.allowed_hosts must be set")
+		}
+		providerName = app.Config.Server.LetsEncrypt.AllowedHosts[0]
+	}
+
+	keyFile := filepath.Join(app.Config.Server.DataDir, "dnscrypt", "provider.key")
+	return dnscrypt.NewProvider(dnscrypt.ProviderName(providerName), keyFile, app.Config.Server.DNSCrypt.CertRotation)
+}
+
+// WriteSetupGuide writes the client setup instructions in the given format
+// (text or json).
+func (app *App) WriteSetupGuide(ctx context.Context, w io.Writer, format string) error {
+	provider, err := app.loadDNSCryptProvider()
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize DNSCrypt provider")
+	}
+	generator, err := setup.New(app.Config, provider)
+	if err != nil {
+		return err
+	}
+	addressResolver, err := setup.NewAddressResolver(generator.ServerName(), app.Config.Server.PublicAddresses, nil)
+	if err != nil {
+		return err
+	}
+	guide := generator.Guide(addressResolver.Lookup(ctx))
+
+	switch format {
+	case "text":
+		return guide.WriteText(w)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return errors.Wrap(enc.Encode(guide), "failed to encode setup guide")
+	default:
+		return errors.Newf("unsupported format %q (expected text or json)", format)
+	}
+}
+
+// ticketKeysRefreshInterval is how often the session ticket keys are reloaded,
+// so that a key rotated by another replica is picked up promptly.
+const ticketKeysRefreshInterval = time.Minute
+
+func (app *App) newTLSPolicy(crontab *cron.Cron, getCertificate getCertificateFunc, metrics *metrics.DnsMetrics) (*tlspolicy.Policy, error) {
+	if getCertificate == nil {
+		getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return nil, errors.New("no TLS certificates configured (enable server.lets_encrypt or set server.tls.cert_file)")
+		}
+	}
+
+	cfg := app.Config.Server.TLS
+	var tickets *tlspolicy.TicketKeys
+	if cfg.SessionTickets != nil && cfg.SessionTickets.Enabled {
+		keyFile := cfg.SessionTickets.KeyFile
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(app.Config.Server.DataDir, keyFile)
+		}
+		var err error
+		if tickets, err = tlspolicy.NewTicketKeys(keyFile, cfg.SessionTickets.Rotation); err != nil {
+			return nil, errors.Wrap(err, "failed to load TLS session ticket keys")
+		}
+		app.Logger.Info("TLS session tickets enabled", "key_file", keyFile, "rotation", cfg.SessionTickets.Rotation)
+		crontab.Schedule(cron.Every(ticketKeysRefreshInterval), ticketKeysJob{tickets, app.Logger})
+	}
+
+	policy, err := tlspolicy.New(cfg, getCertificate, tickets, metrics.TLSHandshakes)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid TLS policy")
+	}
+	return policy, nil
+}
+
+// newODoHHandler returns the Oblivious DoH handler, or nil if the server is
+// neither an ODoH target nor a relay. Target keys are rotated by a cron job.
+func (app *App) newODoHHandler(crontab *cron.Cron, dispatcher *forwarder.DNSDispatcher) (*handlers.ODoHHandler, error) {
+	cfg := app.Config.Server.ODoH
+	if !cfg.Enabled && !cfg.Relay.Enabled {
+		return nil, nil
+	}
+
+	var keys *odoh.KeyRing
+	if cfg.Enabled {
+		if cfg.KeyRotation <= 0 {
+			return nil, errors.New("odoh.key_rotation must be positive")
+		}
+		var err error
+		if keys, err = odoh.NewKeyRing(); err != nil {
+			return nil, errors.Wrap(err, "failed to create ODoH key ring")
+		}
+		app.Logger.Info("Creating ODoH key rotation cron job", "interval", cfg.KeyRotation)
+		crontab.Schedule(cron.Every(cfg.KeyRotation), odohKeyRotationJob{keys, app.Logger})
+	}
+
+	var relay *handlers.ODoHRelay
+	if cfg.Relay.Enabled {
+		if len(cfg.Relay.AllowedTargets) == 0 {
+			return nil, errors.New("odoh.relay.allowed_targets must list at least one target when the relay is enabled")
+		}
+		app.Logger.Info("ODoH relay enabled", "allowed_targets", cfg.Relay.AllowedTargets)
+		relay = handlers.NewODoHRelay(cfg.Relay.AllowedTargets, cfg.Relay.Timeout)
+	}
+
+	requestHandler := dns.HandlerFunc(dispatcher.HandleDNSRequest(forwarder.SourceODoH))
+	return handlers.NewODoHHandler(requestHandler, keys, cfg.KeyRotation, relay, app.Logger), nil
+}
+
 func (app *App) environment() string {
 	if app.Config.Server.DevMode {
 		return "DEVELOPMENT"
@@ -454,3 +856,48 @@ func (app *App) NewBlockLists(crontab *cron.Cron) ([]*blocklist.BlockList, error
 type rateLimiterJob struct{ limiter *limiter.Limiter }
 
 func (j rateLimiterJob) Run() { j.limiter.Reap() }
+
+// dnscryptRotationJob adapts dnscrypt.Provider.Rotate into a cron.Job.
+type dnscryptRotationJob struct {
+	provider *dnscrypt.Provider
+	logger   *slog.Logger
+}
+
+func (j dnscryptRotationJob) Run() {
+	if err := j.provider.Rotate(); err != nil {
+		j.logger.Error("failed to rotate DNSCrypt certificate", "error", err)
+		return
+	}
+	j.logger.Info("Rotated DNSCrypt certificate")
+}
+
+// ticketKeysJob adapts tlspolicy.TicketKeys.Refresh into a cron.Job.
+type ticketKeysJob struct {
+	keys   *tlspolicy.TicketKeys
+	logger *slog.Logger
+}
+
+func (j ticketKeysJob) Run() {
+	rotated, err := j.keys.Refresh()
+	if err != nil {
+		j.logger.Error("failed to refresh TLS session ticket keys", "error", err)
+		return
+	}
+	if rotated {
+		j.logger.Info("Rotated TLS session ticket key")
+	}
+}
+
+// odohKeyRotationJob adapts odoh.KeyRing.Rotate into a cron.Job.
+type odohKeyRotationJob struct {
+	keys   *odoh.KeyRing
+	logger *slog.Logger
+}
+
+func (j odohKeyRotationJob) Run() {
+	if err := j.keys.Rotate(); err != nil {
+		j.logger.Error("failed to rotate ODoH keys", "error", err)
+		return
+	}
+	j.logger.Info("Rotated ODoH keys")
+}
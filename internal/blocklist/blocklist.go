@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"log/slog"
+	"net/netip"
 	"os"
 	"strings"
 	"sync"
@@ -26,6 +27,7 @@ type BlockList struct {
 	minFpRate       float64
 	estimatedFpRate float64
 	bloomFilter     *bloom.BloomFilter
+	ips             *ipSet
 	size            uint
 	metrics         *metrics.BlockListMetrics
 	logger          *slog.Logger
@@ -127,6 +129,19 @@ func (blockList *BlockList) IsBlocked(fqdn string) (bool, error) {
 	return false, nil
 }
 
+// Returns whether the IP address is on the block list, either as an exact
+// entry or as part of a CIDR range. Unlike hostnames, IP matches are exact.
+func (blockList *BlockList) IsBlockedIP(addr netip.Addr) (bool, error) {
+	blockList.mutex.RLock()
+	defer blockList.mutex.RUnlock()
+
+	if blockList.ips == nil || !blockList.ips.contains(addr) {
+		return false, nil
+	}
+
+	return blockList.checkDisabled()
+}
+
 func (blockList *BlockList) checkDisabled() (bool, error) {
 	if blockList.disabledUntil != nil && time.Now().Before(*blockList.disabledUntil) {
 		return false, nil
@@ -135,13 +150,21 @@ func (blockList *BlockList) checkDisabled() (bool, error) {
 }
 
 func (blocklist *BlockList) Load(items []string) {
-	n := uint(len(items))
-	bf := bloom.NewWithEstimates(n, blocklist.minFpRate)
+	ips := newIPSet()
+	hosts := make([]string, 0, len(items))
 	for _, item := range items {
-		bf.AddString(item)
+		if !ips.add([]byte(item)) {
+			hosts = append(hosts, item)
+		}
 	}
 
-	blocklist.applyBloomFilter(bf, n, nil)
+	n := uint(len(hosts))
+	bf := bloom.NewWithEstimates(n, blocklist.minFpRate)
+	for _, host := range hosts {
+		bf.AddString(host)
+	}
+
+	blocklist.applyBloomFilter(bf, ips, n, nil)
 }
 
 func (blocklist *BlockList) Disable(duration time.Duration) time.Time {
@@ -199,13 +222,15 @@ func (blocklist *BlockList) Status() *BlocklistStatus {
 	return &status
 }
 
-func (blocklist *BlockList) applyBloomFilter(bf *bloom.BloomFilter, n uint, metadata map[string]string) {
+func (blocklist *BlockList) applyBloomFilter(bf *bloom.BloomFilter, ips *ipSet, n uint, metadata map[string]string) {
 	m, k := bloom.EstimateParameters(n, blocklist.minFpRate)
 	estimatedFpRate := bloom.EstimateFalsePositiveRate(m, k, n)
+	size := n + uint(ips.len())
 
 	blocklist.mutex.Lock()
 	blocklist.bloomFilter = bf
-	blocklist.size = n
+	blocklist.ips = ips
+	blocklist.size = size
 	blocklist.metadata = metadata
 	blocklist.lastFetched = new(time.Now())
 	blocklist.estimatedFpRate = estimatedFpRate
@@ -215,9 +240,10 @@ func (blocklist *BlockList) applyBloomFilter(bf *bloom.BloomFilter, n uint, meta
 		"name", blocklist.Name(),
 		"actual_size", n,
 		"estimated_size", bf.ApproximatedSize(),
-		"estimated_fp_rate", estimatedFpRate)
+		"estimated_fp_rate", estimatedFpRate,
+		"ip_entries", ips.len())
 
-	blocklist.metrics.Update(n)
+	blocklist.metrics.Update(size)
 }
 
 func (blockList *BlockList) Fetch(ctx context.Context) error {
@@ -267,10 +293,15 @@ func (blockList *BlockList) processFile(path string) error {
 	bloomFilter := bloom.NewWithEstimates(estimate+1, blockList.minFpRate)
 
 	// Stream the file in a single pass: add hostnames directly to the bloom
-	// filter and extract metadata comments into a map. Rather than logging
-	// metadata as it is encountered, we dump it in a single log message afterwards.
+	// filter (and IP/CIDR entries to the IP set) and extract metadata comments
+	// into a map. Rather than logging metadata as it is encountered, we dump it
+	// in a single log message afterwards.
+	ips := newIPSet()
 	var hostCount uint
 	metadata, err := stream(file, func(host []byte) bool {
+		if ips.add(host) {
+			return false
+		}
 		bloomFilter.Add(host)
 		hostCount++
 		return false
@@ -283,6 +314,6 @@ func (blockList *BlockList) processFile(path string) error {
 		blockList.logger.Info("Loaded hosts into blocklist", "metadata", metadata)
 	}
 
-	blockList.applyBloomFilter(bloomFilter, hostCount, metadata)
+	blockList.applyBloomFilter(bloomFilter, ips, hostCount, metadata)
 	return nil
 }
@@ -3,6 +3,7 @@ package blocklist
 import (
 	"io"
 	"log/slog"
+	"net/netip"
 	"testing"
 	"time"
 
@@ -62,3 +63,42 @@ func TestBlocklist_SubdomainHierarchy(t *testing.T) {
 		assert.Equal(t, tc.expectBlocked, isBlocked, "domain %s expected blocked=%v", tc.domain, tc.expectBlocked)
 	}
 }
+
+func TestBlocklist_IsBlockedIP(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	source := &config.BlocklistSource{Name: "test", URL: "http://dummy_url"}
+	blockList := NewBlockList(source, 0.0001, logger)
+	blockList.Load([]string{"example.com", "203.0.113.7", "198.51.100.0/24", "2001:db8:bad::/48", "0.0.0.0"})
+
+	testCases := []struct {
+		addr          string
+		expectBlocked bool
+	}{
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"198.51.100.42", true},
+		{"198.51.101.1", false},
+		{"::ffff:198.51.100.42", true},
+		{"2001:db8:bad::1", true},
+		{"2001:db8:beef::1", false},
+		{"0.0.0.0", false},
+	}
+
+	for _, tc := range testCases {
+		isBlocked, err := blockList.IsBlockedIP(netip.MustParseAddr(tc.addr))
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectBlocked, isBlocked, "addr %s expected blocked=%v", tc.addr, tc.expectBlocked)
+	}
+
+	// Hostname entries are unaffected by IP entries
+	isBlocked, err := blockList.IsBlocked("example.com.")
+	assert.NoError(t, err)
+	assert.True(t, isBlocked)
+	assert.Equal(t, uint(4), blockList.Status().Size, "unspecified addresses are not counted")
+
+	// IP matches honour the disabled state in the same way as hostnames
+	blockList.Disable(time.Minute)
+	isBlocked, err = blockList.IsBlockedIP(netip.MustParseAddr("203.0.113.7"))
+	assert.NoError(t, err)
+	assert.False(t, isBlocked)
+}
@@ -0,0 +1,88 @@
+package blocklist
+
+import (
+	"bytes"
+	"net/netip"
+)
+
+// ipSet holds the IP address and CIDR entries of a blocklist. Unlike hostnames,
+// these are matched exactly (no false positives), so single addresses are kept
+// in a map and prefixes in a slice - IP-based lists tend to be small compared
+// to domain lists, so a linear scan over the prefixes is acceptable.
+type ipSet struct {
+	addrs    map[netip.Addr]struct{}
+	prefixes []netip.Prefix
+}
+
+func newIPSet() *ipSet {
+	return &ipSet{addrs: make(map[netip.Addr]struct{})}
+}
+
+// add attempts to parse the entry as an IP address or CIDR prefix. It returns
+// false if the entry is not IP-like, in which case it should be treated as a
+// hostname instead. Unspecified addresses (0.0.0.0 and ::) are recognized but
+// never added, as host-file style lists use them as sinkhole placeholders.
+func (s *ipSet) add(entry []byte) bool {
+	if !looksLikeIP(entry) {
+		return false
+	}
+
+	if bytes.IndexByte(entry, '/') != -1 {
+		prefix, err := netip.ParsePrefix(string(entry))
+		if err != nil {
+			return false
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+		if prefix.Bits() == prefix.Addr().BitLen() {
+			s.addrs[prefix.Addr()] = struct{}{}
+		} else {
+			s.prefixes = append(s.prefixes, prefix)
+		}
+		return true
+	}
+
+	addr, err := netip.ParseAddr(string(entry))
+	if err != nil {
+		return false
+	}
+	if !addr.IsUnspecified() {
+		s.addrs[addr.Unmap()] = struct{}{}
+	}
+	return true
+}
+
+func (s *ipSet) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if _, ok := s.addrs[addr]; ok {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ipSet) len() int {
+	return len(s.addrs) + len(s.prefixes)
+}
+
+// looksLikeIP is a cheap pre-check to avoid attempting to parse every hostname
+// in a multi-million line blocklist as an IP address.
+func looksLikeIP(entry []byte) bool {
+	if len(entry) == 0 {
+		return false
+	}
+	hasDigitOrColon := false
+	for _, c := range entry {
+		switch {
+		case c >= '0' && c <= '9', c == ':':
+			hasDigitOrColon = true
+		case c == '.', c == '/', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return hasDigitOrColon
+}
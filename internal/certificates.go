@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"maps"
+	"os"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/cockroachdb/errors"
+	"github.com/rm-hull/dot-block/internal/acme"
+	"github.com/rm-hull/dot-block/internal/logging"
+)
+
+// acmeTLSALPNProto is the ALPN protocol of TLS-ALPN-01 challenges (RFC 8737).
+const acmeTLSALPNProto = "acme-tls/1"
+
+// getCertificateFunc returns the certificate for a TLS handshake.
+type getCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// newCertificates returns the source of the server's TLS certificates, which
+// is nil if none are configured, and the ACME issuer if they are obtained with
+// ACME. Certificates are either loaded from server.tls.cert_file, or obtained
+// for server.lets_encrypt.allowed_hosts before returning.
+func (app *App) newCertificates(ctx context.Context, certCacheDir string) (getCertificateFunc, *certmagic.ACMEIssuer, error) {
+	tlsCfg := app.Config.Server.TLS
+	le := app.Config.Server.LetsEncrypt
+	if tlsCfg.CertFile != "" || tlsCfg.KeyFile != "" {
+		if le.Enabled {
+			return nil, nil, errors.New("server.tls.cert_file cannot be combined with server.lets_encrypt")
+		}
+		if tlsCfg.CertFile == "" || tlsCfg.KeyFile == "" {
+			return nil, nil, errors.New("server.tls.cert_file and server.tls.key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to load TLS certificate")
+		}
+		app.Logger.Info("Using static TLS certificate", "cert_file", tlsCfg.CertFile)
+		return func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil }, nil, nil
+	}
+	if !le.Enabled {
+		return nil, nil, nil
+	}
+
+	// certmagic setup
+	zapLogger := logging.NewZapLoggerAdapter(app.Logger, "certmagic")
+	certmagic.Default.Logger = zapLogger
+	certmagic.Default.Storage = &certmagic.FileStorage{Path: certCacheDir}
+	certmagic.Default.OCSP.DisableStapling = !tlsCfg.OCSPStapling
+	certmagic.DefaultACME.Logger = zapLogger
+	certmagic.DefaultACME.Agreed = true
+	certmagic.DefaultACME.Email = le.Email
+	if le.CA != "" && le.CA != certmagic.DefaultACME.CA {
+		certmagic.DefaultACME.CA = le.CA
+		// Otherwise certmagic would first try the staging CA of Let's Encrypt
+		certmagic.DefaultACME.TestCA = ""
+	}
+	if le.CARootFile != "" {
+		roots, err := loadCertPool(le.CARootFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		certmagic.DefaultACME.TrustedRoots = roots
+	}
+
+	// The HTTP-01 and TLS-ALPN-01 challenges are answered by the HTTP and
+	// HTTPS servers once they are running; before then, certmagic listens on
+	// the same ports itself
+	switch le.Challenge {
+	case "", "dns-01":
+		provider, err := app.newDNSProvider()
+		if err != nil {
+			return nil, nil, err
+		}
+		certmagic.DefaultACME.DNS01Solver = &certmagic.DNS01Solver{
+			DNSManager: certmagic.DNSManager{DNSProvider: provider},
+		}
+	case "http-01":
+		certmagic.DefaultACME.DisableTLSALPNChallenge = true
+		certmagic.DefaultACME.AltHTTPPort = app.Config.Server.HttpPort
+	case "tls-alpn-01":
+		if app.Config.Server.HttpsPort == 0 {
+			return nil, nil, errors.New("tls-alpn-01 challenge requires server.https_port")
+		}
+		certmagic.DefaultACME.DisableHTTPChallenge = true
+		certmagic.DefaultACME.AltTLSALPNPort = app.Config.Server.HttpsPort
+	default:
+		return nil, nil, errors.Newf("unknown ACME challenge %q (expected dns-01, http-01 or tls-alpn-01)", le.Challenge)
+	}
+
+	magic := certmagic.NewDefault()
+	issuer, ok := magic.Issuers[0].(*certmagic.ACMEIssuer)
+	if !ok {
+		return nil, nil, errors.New("unexpected certmagic issuer")
+	}
+	app.Logger.Info("Managing TLS certificates with ACME", "ca", issuer.CA, "challenge", le.Challenge, "hosts", le.AllowedHosts)
+	if err := magic.ManageSync(ctx, le.AllowedHosts); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to manage certificates")
+	}
+	return magic.GetCertificate, issuer, nil
+}
+
+// newDNSProvider returns the DNS provider that solves DNS-01 challenges.
+func (app *App) newDNSProvider() (certmagic.DNSProvider, error) {
+	le := app.Config.Server.LetsEncrypt
+	name := le.DNSProvider
+	if name == "" {
+		name = "cloudflare"
+	}
+	settings := le.DNSProviderConfig
+	if name == "cloudflare" && settings["api_token"] == nil {
+		if le.CloudflareApiToken == "" {
+			return nil, errors.New("cloudflare_api_token is required for DNS-01 challenge (configure under server.lets_encrypt)")
+		}
+		settings = make(map[string]any, len(le.DNSProviderConfig)+1)
+		maps.Copy(settings, le.DNSProviderConfig)
+		settings["api_token"] = le.CloudflareApiToken
+	}
+	provider, err := acme.NewDNSProvider(name, settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid server.lets_encrypt.dns_provider_config")
+	}
+	return provider, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read ACME CA root file")
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errors.Newf("no certificates found in %s", file)
+	}
+	return roots, nil
+}
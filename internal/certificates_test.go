@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libdns/cloudflare"
+	"github.com/libdns/desec"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCertificatesTestApp() *App {
+	cfg := config.DefaultConfig()
+	return &App{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Config: cfg}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key to PEM
+// files in a temporary directory.
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		DNSNames:     []string{"dns.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestNewCertificates_None(t *testing.T) {
+	getCertificate, issuer, err := newCertificatesTestApp().newCertificates(context.Background(), t.TempDir())
+	require.NoError(t, err)
+	assert.Nil(t, getCertificate)
+	assert.Nil(t, issuer)
+}
+
+func TestNewCertificates_StaticFiles(t *testing.T) {
+	app := newCertificatesTestApp()
+	app.Config.Server.TLS.CertFile, app.Config.Server.TLS.KeyFile = writeTestCertificate(t)
+
+	getCertificate, issuer, err := app.newCertificates(context.Background(), t.TempDir())
+	require.NoError(t, err)
+	assert.Nil(t, issuer)
+	cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: "dns.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "dns.example.com", cert.Leaf.Subject.CommonName)
+}
+
+func TestNewCertificates_InvalidConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	tests := map[string]struct {
+		configure func(cfg *config.ServerConfig)
+		err       string
+	}{
+		"cert file without key file": {
+			configure: func(cfg *config.ServerConfig) { cfg.TLS.CertFile = certFile },
+			err:       "server.tls.cert_file and server.tls.key_file must be set together",
+		},
+		"cert file with lets encrypt": {
+			configure: func(cfg *config.ServerConfig) {
+				cfg.TLS.CertFile, cfg.TLS.KeyFile = certFile, keyFile
+				cfg.LetsEncrypt.Enabled = true
+			},
+			err: "server.tls.cert_file cannot be combined with server.lets_encrypt",
+		},
+		"unknown challenge": {
+			configure: func(cfg *config.ServerConfig) {
+				cfg.LetsEncrypt.Enabled = true
+				cfg.LetsEncrypt.Challenge = "dns-02"
+			},
+			err: `unknown ACME challenge "dns-02"`,
+		},
+		"unknown dns provider": {
+			configure: func(cfg *config.ServerConfig) {
+				cfg.LetsEncrypt.Enabled = true
+				cfg.LetsEncrypt.DNSProvider = "gandi"
+			},
+			err: `unknown ACME DNS provider "gandi"`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			app := newCertificatesTestApp()
+			tt.configure(app.Config.Server)
+			_, _, err := app.newCertificates(context.Background(), t.TempDir())
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestNewDNSProvider_CloudflareToken(t *testing.T) {
+	app := newCertificatesTestApp()
+	_, err := app.newDNSProvider()
+	assert.ErrorContains(t, err, "cloudflare_api_token is required")
+
+	app.Config.Server.LetsEncrypt.CloudflareApiToken = "legacy"
+	provider, err := app.newDNSProvider()
+	require.NoError(t, err)
+	assert.Equal(t, &cloudflare.Provider{APIToken: "legacy"}, provider)
+
+	app.Config.Server.LetsEncrypt.DNSProviderConfig = map[string]any{"api_token": "explicit"}
+	provider, err = app.newDNSProvider()
+	require.NoError(t, err)
+	assert.Equal(t, &cloudflare.Provider{APIToken: "explicit"}, provider)
+
+	app.Config.Server.LetsEncrypt.DNSProvider = "desec"
+	app.Config.Server.LetsEncrypt.DNSProviderConfig = map[string]any{"token": "secret"}
+	provider, err = app.newDNSProvider()
+	require.NoError(t, err)
+	assert.Equal(t, &desec.Provider{Token: "secret"}, provider)
+}
@@ -0,0 +1,284 @@
+package clients
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/miekg/dns"
+)
+
+// ErrNotFound is returned when managing a client that is not known.
+var ErrNotFound = errors.New("client not found")
+
+// ErrFull is returned when adding a client to a registry whose clients are
+// all named.
+var ErrFull = errors.New("client registry is full")
+
+// validID matches a client ID: a single lower-case DNS label, so that the
+// same ID can be used in a DoH path and as a DoT server name.
+var validID = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// MaxNameLength bounds the names given to clients.
+const MaxNameLength = 64
+
+// Identifier is implemented by response writers that know the client ID of
+// the query, e.g. from the DoH request path.
+type Identifier interface {
+	ClientID() string
+}
+
+// IsValidID reports whether id can be used as a client ID.
+func IsValidID(id string) bool {
+	return validID.MatchString(id)
+}
+
+// Client is a device identified by a client ID rather than its IP address,
+// which for mobile devices changes constantly.
+type Client struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	FirstSeen time.Time `json:"first_seen,omitzero"`
+	LastSeen  time.Time `json:"last_seen,omitzero"`
+	LastIP    string    `json:"last_ip,omitempty"`
+	Queries   uint64    `json:"queries"`
+}
+
+// persistedClient is the part of a client that survives restarts.
+type persistedClient struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Registry tracks the named clients. Clients identify themselves, either by
+// a token in the DoH path (/dns-query/{client-id}) or by connecting to a
+// subdomain of the server name ({client-id}.dot.example.com) over DoT or
+// DoQ. Names given to clients through the admin API are persisted; the
+// query counts are not.
+//
+// Client IDs are chosen by the clients, so anyone can make them up. Once the
+// registry is full, the least recently seen unnamed client makes way for a
+// new one; named clients are only removed through the admin API.
+type Registry struct {
+	file        string
+	maxClients  int
+	serverNames []string
+
+	mu      sync.Mutex
+	named   map[string]*Client
+	unnamed *simplelru.LRU[string, *Client]
+}
+
+// NewRegistry returns a registry tracking up to maxClients clients, loading
+// the client names from file if it exists. serverNames are the hosts that
+// client IDs are subdomains of; any wildcard prefix is ignored.
+func NewRegistry(file string, maxClients int, serverNames []string) (*Registry, error) {
+	unnamed, err := simplelru.NewLRU[string, *Client](max(maxClients, 1), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create client registry")
+	}
+	r := &Registry{
+		file:       file,
+		maxClients: maxClients,
+		named:      make(map[string]*Client),
+		unnamed:    unnamed,
+	}
+	for _, name := range serverNames {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, "*."), "."))
+		if name != "" && !slices.Contains(r.serverNames, name) {
+			r.serverNames = append(r.serverNames, name)
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read clients file")
+	}
+	var persisted []persistedClient
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse clients file %s", file)
+	}
+	for _, p := range persisted {
+		if !IsValidID(p.ID) {
+			return nil, errors.Newf("invalid client ID %q in %s", p.ID, file)
+		}
+		r.named[p.ID] = &Client{ID: p.ID, Name: p.Name}
+	}
+	return r, nil
+}
+
+// Track records a query from the client identified by the response writer,
+// returning the client ID. It returns an empty string if the query carries
+// no valid client ID, or if the ID is new and every client is named. Track
+// is safe to call on a nil registry, which identifies no clients.
+func (r *Registry) Track(w dns.ResponseWriter, ipAddr string) string {
+	if r == nil {
+		return ""
+	}
+
+	// Wrapping writers may forward both, so fall back to the server name if
+	// there is no explicit client ID
+	var id string
+	if identifier, ok := w.(Identifier); ok {
+		id = identifier.ClientID()
+	}
+	if stater, ok := w.(dns.ConnectionStater); ok && id == "" {
+		if state := stater.ConnectionState(); state != nil {
+			id = r.fromServerName(state.ServerName)
+		}
+	}
+	id = strings.ToLower(id)
+	if !IsValidID(id) {
+		return ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.get(id)
+	if !ok {
+		if !r.makeRoom() {
+			return ""
+		}
+		client = &Client{ID: id}
+		r.unnamed.Add(id, client)
+	}
+
+	now := time.Now()
+	if client.FirstSeen.IsZero() {
+		client.FirstSeen = now
+	}
+	client.LastSeen = now
+	client.LastIP = ipAddr
+	client.Queries++
+	return id
+}
+
+// get returns the client, marking an unnamed client as recently seen. The
+// caller must hold the lock.
+func (r *Registry) get(id string) (*Client, bool) {
+	if client, ok := r.named[id]; ok {
+		return client, true
+	}
+	return r.unnamed.Get(id)
+}
+
+// makeRoom evicts the least recently seen unnamed client if the registry is
+// full, returning false if there is no room as every client is named. The
+// caller must hold the lock.
+func (r *Registry) makeRoom() bool {
+	if len(r.named)+r.unnamed.Len() < r.maxClients {
+		return true
+	}
+	_, _, ok := r.unnamed.RemoveOldest()
+	return ok
+}
+
+// fromServerName returns the client ID from a TLS server name of the form
+// {client-id}.{server name}, or an empty string if it has no such prefix.
+func (r *Registry) fromServerName(serverName string) string {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	for _, name := range r.serverNames {
+		if id, ok := strings.CutSuffix(serverName, "."+name); ok && !strings.Contains(id, ".") {
+			return id
+		}
+	}
+	return ""
+}
+
+// List returns the known clients, ordered by ID.
+func (r *Registry) List() []Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]Client, 0, len(r.named)+r.unnamed.Len())
+	for _, client := range r.named {
+		list = append(list, *client)
+	}
+	for _, client := range r.unnamed.Values() {
+		list = append(list, *client)
+	}
+	slices.SortFunc(list, func(a, b Client) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+// Rename sets the name of a client, adding it if it has not been seen yet,
+// and persists the names. An empty name clears it, after which the client
+// may be evicted like any other unnamed client.
+func (r *Registry) Rename(id, name string) (Client, error) {
+	if !IsValidID(id) {
+		return Client{}, errors.Newf("invalid client ID %q", id)
+	}
+	if len(name) > MaxNameLength {
+		return Client{}, errors.Newf("client name longer than %d characters", MaxNameLength)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.get(id)
+	if !ok {
+		if !r.makeRoom() {
+			return Client{}, ErrFull
+		}
+		client = &Client{ID: id}
+	}
+	client.Name = name
+	if name == "" {
+		delete(r.named, id)
+		r.unnamed.Add(id, client)
+	} else {
+		r.unnamed.Remove(id)
+		r.named[id] = client
+	}
+	return *client, r.save()
+}
+
+// Delete forgets a client. It reappears, without a name, if it queries
+// again.
+func (r *Registry) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unnamed.Remove(id) {
+		return nil
+	}
+	if _, ok := r.named[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.named, id)
+	return r.save()
+}
+
+// save writes the named clients to the file. The caller must hold the lock.
+func (r *Registry) save() error {
+	persisted := []persistedClient{}
+	for _, client := range r.named {
+		persisted = append(persisted, persistedClient{ID: client.ID, Name: client.Name})
+	}
+	slices.SortFunc(persisted, func(a, b persistedClient) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode clients")
+	}
+	if err := os.MkdirAll(filepath.Dir(r.file), 0700); err != nil {
+		return errors.Wrap(err, "failed to create clients directory")
+	}
+	// Write to a temporary file first so a crash cannot truncate the names
+	tmp := r.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write clients file")
+	}
+	return errors.Wrap(os.Rename(tmp, r.file), "failed to write clients file")
+}
@@ -0,0 +1,198 @@
+package clients
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testWriter is a response writer carrying a DoH client ID or, if
+// serverName is set, the TLS state of a DoT connection.
+type testWriter struct {
+	dns.ResponseWriter
+	clientID   string
+	serverName string
+}
+
+type dohWriter struct{ testWriter }
+
+func (w *dohWriter) ClientID() string { return w.clientID }
+
+type dotWriter struct{ testWriter }
+
+func (w *dotWriter) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{ServerName: w.serverName}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+}
+
+func newTestRegistry(t *testing.T, maxClients int) (*Registry, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "clients.json")
+	r, err := NewRegistry(file, maxClients, []string{"dns.example.com", "*.dot.example.com", "dot.example.com"})
+	require.NoError(t, err)
+	return r, file
+}
+
+func TestIsValidID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"phone":                 true,
+		"laptop-2":              true,
+		"0":                     true,
+		"":                      false,
+		"-phone":                false,
+		"phone-":                false,
+		"Phone":                 false,
+		"my.phone":              false,
+		"my_phone":              false,
+		strings.Repeat("a", 63): true,
+		strings.Repeat("a", 64): false,
+	} {
+		assert.Equal(t, valid, IsValidID(id), id)
+	}
+}
+
+func TestRegistry_TrackDoHClientID(t *testing.T) {
+	r, _ := newTestRegistry(t, 10)
+
+	assert.Equal(t, "phone", r.Track(&dohWriter{testWriter{clientID: "Phone"}}, "192.0.2.1"))
+	assert.Equal(t, "phone", r.Track(&dohWriter{testWriter{clientID: "phone"}}, "192.0.2.2"))
+	assert.Empty(t, r.Track(&dohWriter{testWriter{clientID: "not_valid"}}, "192.0.2.1"))
+	assert.Empty(t, r.Track(&dohWriter{}, "192.0.2.1"))
+
+	list := r.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, "phone", list[0].ID)
+	assert.Equal(t, "192.0.2.2", list[0].LastIP)
+	assert.Equal(t, uint64(2), list[0].Queries)
+	assert.False(t, list[0].FirstSeen.IsZero())
+}
+
+func TestRegistry_TrackDoTServerName(t *testing.T) {
+	r, _ := newTestRegistry(t, 10)
+
+	tests := map[string]string{
+		"laptop.dot.example.com":   "laptop",
+		"tablet.dns.example.com.":  "tablet",
+		"dot.example.com":          "",
+		"a.b.dot.example.com":      "",
+		"laptop.other.example.com": "",
+		"":                         "",
+	}
+	for serverName, expected := range tests {
+		assert.Equal(t, expected, r.Track(&dotWriter{testWriter{serverName: serverName}}, "192.0.2.1"), serverName)
+	}
+}
+
+func TestRegistry_TrackNilRegistry(t *testing.T) {
+	var r *Registry
+	assert.Empty(t, r.Track(&dohWriter{testWriter{clientID: "phone"}}, "192.0.2.1"))
+}
+
+func TestRegistry_TrackEvictsLeastRecentlySeen(t *testing.T) {
+	r, _ := newTestRegistry(t, 2)
+
+	assert.Equal(t, "one", r.Track(&dohWriter{testWriter{clientID: "one"}}, "192.0.2.1"))
+	assert.Equal(t, "two", r.Track(&dohWriter{testWriter{clientID: "two"}}, "192.0.2.1"))
+	assert.Equal(t, "one", r.Track(&dohWriter{testWriter{clientID: "one"}}, "192.0.2.1"))
+	assert.Equal(t, "three", r.Track(&dohWriter{testWriter{clientID: "three"}}, "192.0.2.1"), "new clients are tracked once full")
+
+	list := r.List()
+	require.Len(t, list, 2)
+	assert.Equal(t, "one", list[0].ID)
+	assert.Equal(t, "three", list[1].ID, "the least recently seen client is evicted")
+}
+
+func TestRegistry_TrackKeepsNamedClients(t *testing.T) {
+	r, _ := newTestRegistry(t, 2)
+	_, err := r.Rename("phone", "Phone")
+	require.NoError(t, err)
+
+	// Made-up IDs only ever evict each other
+	for _, id := range []string{"a", "b", "c", "d"} {
+		assert.Equal(t, id, r.Track(&dohWriter{testWriter{clientID: id}}, "192.0.2.1"))
+	}
+	list := r.List()
+	require.Len(t, list, 2)
+	assert.Equal(t, "d", list[0].ID)
+	assert.Equal(t, "phone", list[1].ID)
+
+	_, err = r.Rename("tablet", "Tablet")
+	require.NoError(t, err, "naming a client evicts an unnamed one")
+	assert.Empty(t, r.Track(&dohWriter{testWriter{clientID: "e"}}, "192.0.2.1"), "no room when every client is named")
+	assert.Equal(t, "phone", r.Track(&dohWriter{testWriter{clientID: "phone"}}, "192.0.2.1"))
+}
+
+func TestRegistry_RenameStopsAtMaxClients(t *testing.T) {
+	r, _ := newTestRegistry(t, 2)
+
+	_, err := r.Rename("one", "One")
+	require.NoError(t, err)
+	_, err = r.Rename("two", "Two")
+	require.NoError(t, err)
+	_, err = r.Rename("three", "Three")
+	assert.ErrorIs(t, err, ErrFull)
+	_, err = r.Rename("one", "Uno")
+	assert.NoError(t, err, "known clients can still be renamed")
+
+	_, err = r.Rename("two", "")
+	require.NoError(t, err)
+	_, err = r.Rename("three", "Three")
+	assert.NoError(t, err, "clients whose name was cleared can be evicted")
+	assert.Len(t, r.List(), 2)
+}
+
+func TestRegistry_RenamePersistsNames(t *testing.T) {
+	r, file := newTestRegistry(t, 10)
+	r.Track(&dohWriter{testWriter{clientID: "phone"}}, "192.0.2.1")
+	r.Track(&dohWriter{testWriter{clientID: "laptop"}}, "192.0.2.1")
+
+	client, err := r.Rename("phone", "Alex's phone")
+	require.NoError(t, err)
+	assert.Equal(t, "Alex's phone", client.Name)
+	assert.Equal(t, uint64(1), client.Queries)
+
+	_, err = r.Rename("tablet", "Kitchen tablet")
+	require.NoError(t, err, "clients can be named before they first query")
+
+	_, err = r.Rename("not valid", "x")
+	assert.Error(t, err)
+
+	reloaded, err := NewRegistry(file, 10, nil)
+	require.NoError(t, err)
+	list := reloaded.List()
+	require.Len(t, list, 2, "only named clients are persisted")
+	assert.Equal(t, Client{ID: "phone", Name: "Alex's phone"}, list[0])
+	assert.Equal(t, Client{ID: "tablet", Name: "Kitchen tablet"}, list[1])
+}
+
+func TestRegistry_Delete(t *testing.T) {
+	r, file := newTestRegistry(t, 10)
+	_, err := r.Rename("phone", "Phone")
+	require.NoError(t, err)
+
+	require.NoError(t, r.Delete("phone"))
+	assert.ErrorIs(t, r.Delete("phone"), ErrNotFound)
+	assert.Empty(t, r.List())
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.JSONEq(t, "[]", string(data))
+}
+
+func TestNewRegistry_InvalidFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "clients.json")
+	require.NoError(t, os.WriteFile(file, []byte(`[{"id":"Not Valid","name":"x"}]`), 0600))
+
+	_, err := NewRegistry(file, 10, nil)
+	assert.Error(t, err)
+}
@@ -27,36 +27,131 @@ func (LogLevel) JSONSchema() *jsonschema.Type {
 }
 
 type ServerConfig struct {
-	DevMode       bool                 `yaml:"dev_mode,omitempty" json:"dev_mode,omitempty" descr:"Run server in dev mode (no TLS, plain TCP)."`
-	LogLevel      LogLevel             `yaml:"log_level,omitempty" json:"log_level,omitempty" descr:"The logging level (DEBUG, INFO, WARN, ERROR)."`
-	DataDir       string               `yaml:"data_dir,omitempty" json:"data_dir,omitempty" descr:"Directory for storing persistent data (e.g., TLS certificate cache)."`
-	HttpPort      int                  `yaml:"http_port,omitempty" json:"http_port,omitempty" descr:"The port to run HTTP server on."`
-	DnsPort       int                  `yaml:"dns_port,omitempty" json:"dns_port,omitempty" descr:"The port to run regular DNS (UDP/TCP) server on."`
-	DotPort       int                  `yaml:"dot_port,omitempty" json:"dot_port,omitempty" descr:"The port to run DNS-over-TLS server on."`
-	ProxyProtocol *ProxyProtocolConfig `yaml:"proxy_protocol,omitempty" json:"proxy_protocol,omitempty"`
-	LetsEncrypt   *LetsEncryptConfig   `yaml:"lets_encrypt,omitempty" json:"lets_encrypt,omitempty"`
-	ApiKeys       map[string]string    `yaml:"api_keys,omitempty" json:"api_keys,omitempty" log:"redacted" descr:"Map of API keys to user descriptions for admin API access."`
-	RateLimit     *RateLimitConfig     `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty" descr:"Rate limiting configuration for client IPs."`
+	DevMode            bool                 `yaml:"dev_mode,omitempty" json:"dev_mode,omitempty" descr:"Run server in dev mode (no TLS, plain TCP)."`
+	LogLevel           LogLevel             `yaml:"log_level,omitempty" json:"log_level,omitempty" descr:"The logging level (DEBUG, INFO, WARN, ERROR)."`
+	DataDir            string               `yaml:"data_dir,omitempty" json:"data_dir,omitempty" descr:"Directory for storing persistent data (e.g., TLS certificate cache)."`
+	HttpPort           int                  `yaml:"http_port,omitempty" json:"http_port,omitempty" descr:"The port to run HTTP server on."`
+	HttpsPort          int                  `yaml:"https_port,omitempty" json:"https_port,omitempty" descr:"The port to run the built-in HTTPS server (HTTP/1.1 and HTTP/2) on, serving the same routes as the HTTP server (0 = disabled)."`
+	Http3              bool                 `yaml:"http3,omitempty" json:"http3,omitempty" descr:"Also serve HTTP/3 over QUIC on the HTTPS port (UDP), advertised to clients via the Alt-Svc header."`
+	DnsPort            int                  `yaml:"dns_port,omitempty" json:"dns_port,omitempty" descr:"The port to run regular DNS (UDP/TCP) server on."`
+	DotPort            int                  `yaml:"dot_port,omitempty" json:"dot_port,omitempty" descr:"The port to run DNS-over-TLS server on."`
+	DoqPort            int                  `yaml:"doq_port,omitempty" json:"doq_port,omitempty" descr:"The UDP port to run DNS-over-QUIC server on (0 = disabled)."`
+	DNSCryptPort       int                  `yaml:"dnscrypt_port,omitempty" json:"dnscrypt_port,omitempty" descr:"The port to run the DNSCrypt v2 server (UDP and TCP) on (0 = disabled)."`
+	DNSCrypt           *DNSCryptConfig      `yaml:"dnscrypt,omitempty" json:"dnscrypt,omitempty"`
+	ProxyProtocol      *ProxyProtocolConfig `yaml:"proxy_protocol,omitempty" json:"proxy_protocol,omitempty"`
+	HTTPTrustedProxies []string             `yaml:"http_trusted_proxies,omitempty" json:"http_trusted_proxies,omitempty" descr:"IP addresses or CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-IP headers are trusted for the client IP of HTTP requests. If empty, the connection's address is always used."`
+	LetsEncrypt        *LetsEncryptConfig   `yaml:"lets_encrypt,omitempty" json:"lets_encrypt,omitempty"`
+	TLS                *TLSConfig           `yaml:"tls,omitempty" json:"tls,omitempty" descr:"TLS policy for the DoT, DoQ, HTTPS and HTTP/3 listeners."`
+	Connections        *ConnectionsConfig   `yaml:"connections,omitempty" json:"connections,omitempty" descr:"TCP connection management for the DoT and regular DNS over TCP listeners."`
+	PublicAddresses    []string             `yaml:"public_addresses,omitempty" json:"public_addresses,omitempty" descr:"Public IPv4 and IPv6 addresses of the server, used in /.mobileconfig profiles and the /setup guide. If empty, the first allowed host is resolved through dot-block's own resolver."`
+	ApiKeys            map[string]string    `yaml:"api_keys,omitempty" json:"api_keys,omitempty" log:"redacted" descr:"Map of API keys to user descriptions for admin API access."`
+	RateLimit          *RateLimitConfig     `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty" descr:"Rate limiting configuration for client IPs."`
+	ODoH               *ODoHConfig          `yaml:"odoh,omitempty" json:"odoh,omitempty" descr:"Oblivious DNS-over-HTTPS (RFC 9230) target and relay configuration."`
+	Mobileconfig       *MobileconfigConfig  `yaml:"mobileconfig,omitempty" json:"mobileconfig,omitempty" descr:"Apple configuration profile (/.mobileconfig) settings."`
+	Clients            *ClientsConfig       `yaml:"clients,omitempty" json:"clients,omitempty" descr:"Named clients, identified by a DoH path token or DoT/DoQ server name rather than their IP address."`
+	Listeners          *ListenersConfig     `yaml:"listeners,omitempty" json:"listeners,omitempty" descr:"Per-listener bind addresses and client access control."`
+}
+
+type ListenersConfig struct {
+	DNS      *ListenerConfig `yaml:"dns,omitempty" json:"dns,omitempty" descr:"Regular DNS (UDP and TCP) on dns_port."`
+	DoT      *ListenerConfig `yaml:"dot,omitempty" json:"dot,omitempty" descr:"DNS-over-TLS on dot_port."`
+	DoQ      *ListenerConfig `yaml:"doq,omitempty" json:"doq,omitempty" descr:"DNS-over-QUIC on doq_port."`
+	DNSCrypt *ListenerConfig `yaml:"dnscrypt,omitempty" json:"dnscrypt,omitempty" descr:"DNSCrypt (UDP and TCP) on dnscrypt_port."`
+	HTTP     *ListenerConfig `yaml:"http,omitempty" json:"http,omitempty" descr:"HTTP, HTTPS and HTTP/3 on http_port and https_port. Its allowed_networks only restrict DoH queries, by the client IP as seen behind any reverse proxy; ODoH queries are not restricted."`
+}
+
+type ListenerConfig struct {
+	Listen          []string `yaml:"listen,omitempty" json:"listen,omitempty" descr:"IPv4 and IPv6 addresses to bind to. Each binds only its own address family (so 0.0.0.0 and :: can be bound side by side); if empty, all interfaces are bound, dual-stack."`
+	AllowedNetworks []string `yaml:"allowed_networks,omitempty" json:"allowed_networks,omitempty" descr:"IP addresses or CIDR ranges of the clients allowed to query the listener. Other clients are refused (or, over UDP, ignored). If empty, any client is allowed."`
+}
+
+type DNSCryptConfig struct {
+	ProviderName string        `yaml:"provider_name,omitempty" json:"provider_name,omitempty" descr:"DNSCrypt provider name. Defaults to 2.dnscrypt-cert.<first allowed host>."`
+	CertRotation time.Duration `yaml:"cert_rotation,omitempty" json:"cert_rotation,omitempty" descr:"How often a new short-term resolver certificate is issued. Each certificate is valid for two rotation periods."`
+	StampAddress string        `yaml:"stamp_address,omitempty" json:"stamp_address,omitempty" descr:"Public IP address (and port, if not 443) advertised in the DNSCrypt stamp. Defaults to the first allowed host and the DNSCrypt port, although most clients require an IP address."`
+}
+
+type ODoHConfig struct {
+	Enabled     bool             `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Act as an ODoH target: publish HPKE key configs at /.well-known/odohconfigs and accept encrypted queries at /dns-query."`
+	KeyRotation time.Duration    `yaml:"key_rotation,omitempty" json:"key_rotation,omitempty" descr:"How often the HPKE key pair is rotated. Queries encrypted to the previous key are accepted for one further period."`
+	Relay       *ODoHRelayConfig `yaml:"relay,omitempty" json:"relay,omitempty"`
+}
+
+type ODoHRelayConfig struct {
+	Enabled        bool          `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Act as an ODoH relay, forwarding encrypted queries to the target given by the targethost and targetpath query parameters."`
+	AllowedTargets []string      `yaml:"allowed_targets,omitempty" json:"allowed_targets,omitempty" descr:"Hostnames of the ODoH targets the relay may forward queries to; all other targets are refused."`
+	Timeout        time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty" descr:"Timeout for forwarding a query to the target."`
+}
+
+type MobileconfigConfig struct {
+	DisconnectSSIDs []string                   `yaml:"disconnect_ssids,omitempty" json:"disconnect_ssids,omitempty" descr:"Wi-Fi networks (SSIDs) on which the profile's encrypted DNS settings are not used, e.g. a home network already filtered by dot-block."`
+	ExcludedDomains []string                   `yaml:"excluded_domains,omitempty" json:"excluded_domains,omitempty" descr:"Domains that are never resolved through the encrypted DNS settings, e.g. captive portal login pages. Also excluded in the Firefox policy."`
+	Signing         *MobileconfigSigningConfig `yaml:"signing,omitempty" json:"signing,omitempty"`
+}
+
+type MobileconfigSigningConfig struct {
+	CertFile string `yaml:"cert_file,omitempty" json:"cert_file,omitempty" descr:"PEM certificate used to sign profiles, followed by any intermediate certificates. Profiles are unsigned if not set."`
+	KeyFile  string `yaml:"key_file,omitempty" json:"key_file,omitempty" descr:"PEM private key for the signing certificate."`
+}
+
+type ClientsConfig struct {
+	MaxClients int `yaml:"max_clients,omitempty" json:"max_clients,omitempty" descr:"Maximum number of client IDs to track; once reached, the least recently seen unnamed client is forgotten to make room for a new one (0 = client identification disabled)."`
 }
 
 type ProxyProtocolConfig struct {
 	Enabled        bool     `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Require PROXY protocol header for DoT connections."`
 	TrustedProxies []string `yaml:"trusted_proxies,omitempty" json:"trusted_proxies,omitempty" descr:"Comma-separated list of trusted proxy IP addresses or CIDR ranges."`
+	DNS            bool     `yaml:"dns,omitempty" json:"dns,omitempty" descr:"Also accept PROXY protocol headers on the regular DNS listeners: v1 or v2 on TCP, as for DoT, and v2 on UDP, which requires trusted_proxies and only accepts headers from them."`
+}
+
+type ConnectionsConfig struct {
+	IdleTimeout             time.Duration `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty" descr:"How long an idle connection is kept open awaiting further queries. It is advertised to clients that send the edns-tcp-keepalive option (RFC 7828)."`
+	MaxQueriesPerConnection int           `yaml:"max_queries_per_connection,omitempty" json:"max_queries_per_connection,omitempty" descr:"Maximum number of queries answered on a connection before it is closed (0 = unlimited)."`
+	MaxConnections          int           `yaml:"max_connections,omitempty" json:"max_connections,omitempty" descr:"Maximum number of open connections across the DoT and TCP listeners; further connections are closed as soon as they are accepted (0 = unlimited)."`
+	MaxConnectionsPerIP     int           `yaml:"max_connections_per_ip,omitempty" json:"max_connections_per_ip,omitempty" descr:"Maximum number of open connections from a single client IP, as seen behind any PROXY protocol header (0 = unlimited)."`
+}
+
+type TLSConfig struct {
+	MinVersion     string                `yaml:"min_version,omitempty" json:"min_version,omitempty" descr:"Minimum TLS version (1.0, 1.1, 1.2 or 1.3). QUIC listeners always require TLS 1.3."`
+	MaxVersion     string                `yaml:"max_version,omitempty" json:"max_version,omitempty" descr:"Maximum TLS version (1.0, 1.1, 1.2 or 1.3)."`
+	CipherSuites   []string              `yaml:"cipher_suites,omitempty" json:"cipher_suites,omitempty" descr:"TLS 1.0-1.2 cipher suites, by their Go names (e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256). TLS 1.3 cipher suites are not configurable. If empty, Go's defaults are used."`
+	Curves         []string              `yaml:"curves,omitempty" json:"curves,omitempty" descr:"Key exchange mechanisms, in order of preference (e.g. X25519MLKEM768, X25519, CurveP256). If empty, Go's defaults are used, which prefer hybrid post-quantum key exchange with TLS 1.3 clients."`
+	OCSPStapling   bool                  `yaml:"ocsp_stapling,omitempty" json:"ocsp_stapling,omitempty" descr:"Staple OCSP responses for the managed certificates to the handshake, so clients need not query the CA."`
+	SessionTickets *SessionTicketsConfig `yaml:"session_tickets,omitempty" json:"session_tickets,omitempty" descr:"TLS session resumption with session tickets."`
+	CertFile       string                `yaml:"cert_file,omitempty" json:"cert_file,omitempty" descr:"PEM certificate chain to serve instead of ACME-managed certificates, for users with their own PKI. Requires key_file, and cannot be combined with lets_encrypt."`
+	KeyFile        string                `yaml:"key_file,omitempty" json:"key_file,omitempty" descr:"PEM private key of cert_file."`
+}
+
+type SessionTicketsConfig struct {
+	Enabled  bool          `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Enable session tickets, so that returning clients can skip the full handshake."`
+	KeyFile  string        `yaml:"key_file,omitempty" json:"key_file,omitempty" descr:"File the session ticket keys are kept in, relative to data_dir unless absolute. Replicas that share the file can resume each other's sessions."`
+	Rotation time.Duration `yaml:"rotation,omitempty" json:"rotation,omitempty" descr:"How often a new session ticket key is generated; the previous two keys are still accepted, so tickets are valid for up to three rotations (e.g. 12h)."`
 }
 
 type LetsEncryptConfig struct {
-	Enabled            bool     `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Enable automatic TLS certificate management via Let's Encrypt / ACME."`
-	Email              string   `yaml:"email,omitempty" json:"email,omitempty" descr:"Email address for Let's Encrypt registration."`
-	CloudflareApiToken string   `yaml:"cloudflare_api_token,omitempty" json:"cloudflare_api_token,omitempty" log:"redacted" descr:"Cloudflare API token for DNS-01 challenge."`
-	AllowedHosts       []string `yaml:"allowed_hosts,omitempty" json:"allowed_hosts,omitempty" descr:"List of domains used for CertManager allow policy / mobileconfig."`
+	Enabled            bool           `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Enable automatic TLS certificate management via Let's Encrypt / ACME."`
+	Email              string         `yaml:"email,omitempty" json:"email,omitempty" descr:"Email address for Let's Encrypt registration."`
+	CA                 string         `yaml:"ca,omitempty" json:"ca,omitempty" descr:"ACME directory URL of the certificate authority, e.g. a local Pebble instance for testing. If empty, Let's Encrypt's production directory is used."`
+	CARootFile         string         `yaml:"ca_root_file,omitempty" json:"ca_root_file,omitempty" descr:"PEM file of root certificates to trust when connecting to the ACME directory, in addition to the system roots (e.g. Pebble's minica root)."`
+	Challenge          string         `yaml:"challenge,omitempty" json:"challenge,omitempty" descr:"ACME challenge type: dns-01 (via dns_provider), http-01 (served on http_port, which must be reachable on port 80) or tls-alpn-01 (served on https_port, which must be reachable on port 443)."`
+	DNSProvider        string         `yaml:"dns_provider,omitempty" json:"dns_provider,omitempty" descr:"DNS provider used to solve dns-01 challenges: cloudflare, desec, digitalocean, rfc2136 or route53."`
+	DNSProviderConfig  map[string]any `yaml:"dns_provider_config,omitempty" json:"dns_provider_config,omitempty" log:"redacted" descr:"Settings of the DNS provider, e.g. api_token for cloudflare; token for desec; auth_token for digitalocean; server, key_name, key_alg and key for rfc2136; region, access_key_id, secret_access_key and hosted_zone_id for route53."`
+	CloudflareApiToken string         `yaml:"cloudflare_api_token,omitempty" json:"cloudflare_api_token,omitempty" log:"redacted" descr:"Cloudflare API token for DNS-01 challenge, if not given as api_token in dns_provider_config."`
+	AllowedHosts       []string       `yaml:"allowed_hosts,omitempty" json:"allowed_hosts,omitempty" descr:"List of domains used for CertManager allow policy / mobileconfig."`
 }
 
 type DNSConfig struct {
-	Upstreams   []string        `yaml:"upstreams,omitempty" json:"upstreams,omitempty" descr:"Upstream DNS resolvers to forward queries to."`
-	ECS         *ECSConfig      `yaml:"ecs,omitempty" json:"ecs,omitempty"`
-	Cache       *CacheConfig    `yaml:"cache,omitempty" json:"cache,omitempty"`
-	NoiseFilter *NoiseFilter    `yaml:"noise_filter,omitempty" json:"noise_filter,omitempty"`
-	Timeouts    *TimeoutsConfig `yaml:"timeouts,omitempty" json:"timeouts,omitempty"`
+	Upstreams        []string                `yaml:"upstreams,omitempty" json:"upstreams,omitempty" descr:"Upstream DNS resolvers to forward queries to."`
+	ECS              *ECSConfig              `yaml:"ecs,omitempty" json:"ecs,omitempty"`
+	Cache            *CacheConfig            `yaml:"cache,omitempty" json:"cache,omitempty"`
+	NoiseFilter      *NoiseFilter            `yaml:"noise_filter,omitempty" json:"noise_filter,omitempty"`
+	Timeouts         *TimeoutsConfig         `yaml:"timeouts,omitempty" json:"timeouts,omitempty"`
+	ResponseBlocking *ResponseBlockingConfig `yaml:"response_blocking,omitempty" json:"response_blocking,omitempty"`
+	Rebinding        *RebindingConfig        `yaml:"rebinding_protection,omitempty" json:"rebinding_protection,omitempty"`
+	DNSSEC           *DNSSECConfig           `yaml:"dnssec,omitempty" json:"dnssec,omitempty"`
+	QueryTypes       *QueryTypesConfig       `yaml:"query_types,omitempty" json:"query_types,omitempty"`
+	WaterTorture     *WaterTortureConfig     `yaml:"water_torture,omitempty" json:"water_torture,omitempty"`
+	LoadShedding     *LoadSheddingConfig     `yaml:"load_shedding,omitempty" json:"load_shedding,omitempty"`
 }
 
 type RateLimitConfig struct {
@@ -74,10 +169,96 @@ type RateLimitConfig struct {
 	MaxTrackedIPs int           `yaml:"max_tracked_ips,omitempty" json:"max_tracked_ips,omitempty" descr:"Maximum number of client IPs to track for rate limiting."`
 	ReapInterval  time.Duration `yaml:"reap_interval,omitempty" json:"reap_interval,omitempty" descr:"Interval for reaping stale entries from the rate limiter."`
 	IdleTTL       time.Duration `yaml:"idle_ttl,omitempty" json:"idle_ttl,omitempty" descr:"Time-to-live for idle entries before eviction."`
+
+	// Aggregate limits, checked after the per-IP limit.
+	Subnet *SubnetRateLimitConfig `yaml:"subnet,omitempty" json:"subnet,omitempty" descr:"Rate limit shared by all client IPs in the same subnet, so that clients with a whole IPv6 prefix can't sidestep the per-IP limit."`
+	ASN    *ASNRateLimitConfig    `yaml:"asn,omitempty" json:"asn,omitempty" descr:"Rate limit shared by all client IPs in the same autonomous system (requires geoblock.ipinfo)."`
+
+	RRL *RRLConfig `yaml:"rrl,omitempty" json:"rrl,omitempty" descr:"Response Rate Limiting (RRL) for the UDP listener, mitigating reflection/amplification attacks from spoofed source addresses."`
+
+	Redis *RedisConfig `yaml:"redis,omitempty" json:"redis,omitempty" descr:"Redis server holding the token buckets, bans and exemptions, so that they are shared by all replicas behind a load balancer rather than kept per instance."`
+}
+
+type RedisConfig struct {
+	Enabled   bool          `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to keep the rate limiter state in Redis. Without it, the state is kept in memory (and the access list in data_dir)."`
+	Address   string        `yaml:"address,omitempty" json:"address,omitempty" descr:"Address (host:port) of the Redis server."`
+	Username  string        `yaml:"username,omitempty" json:"username,omitempty" descr:"Username for Redis ACL authentication."`
+	Password  string        `yaml:"password,omitempty" json:"password,omitempty" log:"redacted" descr:"Password for Redis authentication."`
+	DB        int           `yaml:"db,omitempty" json:"db,omitempty" descr:"Redis database number."`
+	TLS       bool          `yaml:"tls,omitempty" json:"tls,omitempty" descr:"Whether to connect to Redis over TLS."`
+	KeyPrefix string        `yaml:"key_prefix,omitempty" json:"key_prefix,omitempty" descr:"Prefix of the Redis keys, so that several deployments can share a server."`
+	Timeout   time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty" descr:"Timeout for each Redis operation. On timeouts and other errors, the replica falls back to its own in-memory state until Redis recovers."`
+}
+
+type SubnetRateLimitConfig struct {
+	Enabled           bool    `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to enable per-subnet rate limiting."`
+	RequestsPerSecond float64 `yaml:"requests_per_second,omitempty" json:"requests_per_second,omitempty" descr:"Maximum allowed requests per second per subnet."`
+	Burst             int     `yaml:"burst,omitempty" json:"burst,omitempty" descr:"Maximum burst size per subnet."`
+	IPv4Prefix        int     `yaml:"ipv4_prefix,omitempty" json:"ipv4_prefix,omitempty" descr:"Prefix length IPv4 clients are aggregated by."`
+	IPv6Prefix        int     `yaml:"ipv6_prefix,omitempty" json:"ipv6_prefix,omitempty" descr:"Prefix length IPv6 clients are aggregated by (typically 56 or 64)."`
+}
+
+type ASNRateLimitConfig struct {
+	Enabled           bool    `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to enable per-ASN rate limiting. Clients whose ASN is not known are only limited per IP and subnet."`
+	RequestsPerSecond float64 `yaml:"requests_per_second,omitempty" json:"requests_per_second,omitempty" descr:"Maximum allowed requests per second per ASN."`
+	Burst             int     `yaml:"burst,omitempty" json:"burst,omitempty" descr:"Maximum burst size per ASN."`
+}
+
+type RRLConfig struct {
+	Enabled            bool          `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to enable Response Rate Limiting. Independent of rate_limit.enabled."`
+	ResponsesPerSecond float64       `yaml:"responses_per_second,omitempty" json:"responses_per_second,omitempty" descr:"Maximum identical responses per second to a client network. Responses are identical if they have the same name, type and rcode; NXDOMAIN and NODATA responses are grouped by zone, and errors by rcode alone."`
+	Window             time.Duration `yaml:"window,omitempty" json:"window,omitempty" descr:"Period over which the response rate is averaged: a client network exceeding the limit must slow down for up to this long before its responses are sent again."`
+	Slip               int           `yaml:"slip,omitempty" json:"slip,omitempty" descr:"Every Nth rate-limited response is sent as an empty truncated (TC=1) response instead of being dropped, so that real clients retry over TCP. 0 drops every rate-limited response, 1 truncates all of them."`
+	IPv4Prefix         int           `yaml:"ipv4_prefix,omitempty" json:"ipv4_prefix,omitempty" descr:"Prefix length IPv4 clients are grouped by."`
+	IPv6Prefix         int           `yaml:"ipv6_prefix,omitempty" json:"ipv6_prefix,omitempty" descr:"Prefix length IPv6 clients are grouped by."`
+	MaxEntries         int           `yaml:"max_entries,omitempty" json:"max_entries,omitempty" descr:"Maximum number of response buckets to track."`
 }
 
 type ECSConfig struct {
-	Enabled bool `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to enable EDNS0 Client Subnet (ECS) forwarding."`
+	Enabled    bool     `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to enable EDNS0 Client Subnet (ECS) forwarding."`
+	IPv4Prefix int      `yaml:"ipv4_prefix,omitempty" json:"ipv4_prefix,omitempty" descr:"Source prefix length of the client subnet sent upstream for IPv4 clients (0-32). 0 sends an empty subnet, so no part of the client address is revealed."`
+	IPv6Prefix int      `yaml:"ipv6_prefix,omitempty" json:"ipv6_prefix,omitempty" descr:"Source prefix length of the client subnet sent upstream for IPv6 clients (0-128). 0 sends an empty subnet, so no part of the client address is revealed."`
+	ClientECS  string   `yaml:"client_ecs,omitempty" json:"client_ecs,omitempty" descr:"How to treat ECS options supplied by clients: 'override' replaces them with the client's own subnet, 'honour' forwards them (truncated to the configured prefix lengths), 'strip' removes them without substitution."`
+	Domains    []string `yaml:"domains,omitempty" json:"domains,omitempty" descr:"If set, ECS is only sent for these domains and their subdomains (e.g. CDN-hosted names); all other queries are forwarded without a client subnet."`
+}
+
+type ResponseBlockingConfig struct {
+	Enabled bool `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to check CNAME targets and A/AAAA addresses in upstream answers against the blocklists (defeats CNAME cloaking)."`
+}
+
+type RebindingConfig struct {
+	Enabled         bool     `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to filter upstream answers that resolve public names to private, loopback, link-local or CGNAT addresses."`
+	Mode            string   `yaml:"mode,omitempty" json:"mode,omitempty" descr:"How to handle offending answers: 'strip' removes the offending A/AAAA records, 'refuse' answers REFUSED."`
+	AllowedSuffixes []string `yaml:"allowed_suffixes,omitempty" json:"allowed_suffixes,omitempty" descr:"Domain suffixes (e.g. lan, corp.example.com) that are allowed to resolve to private addresses."`
+}
+
+type DNSSECConfig struct {
+	Enabled      bool     `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to validate upstream responses locally with DNSSEC (sets the AD bit on secure answers, SERVFAIL on bogus answers)."`
+	TrustAnchors []string `yaml:"trust_anchors,omitempty" json:"trust_anchors,omitempty" descr:"Root trust anchors as DS records in presentation format. Defaults to the IANA root zone KSKs."`
+}
+
+type QueryTypesConfig struct {
+	MinimalANY        bool     `yaml:"minimal_any,omitempty" json:"minimal_any,omitempty" descr:"Answer ANY queries with a minimal synthesised HINFO record (RFC 8482) instead of forwarding them upstream."`
+	AllowZoneTransfer bool     `yaml:"allow_zone_transfer,omitempty" json:"allow_zone_transfer,omitempty" descr:"Forward AXFR/IXFR zone transfer requests upstream instead of refusing them."`
+	Blocked           []string `yaml:"blocked,omitempty" json:"blocked,omitempty" descr:"Query types (e.g. AAAA on IPv4-only networks, or HTTPS and SVCB) that are answered with an empty NOERROR response instead of being resolved."`
+}
+
+type WaterTortureConfig struct {
+	Enabled            bool          `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to detect random-subdomain (water torture) attacks against a domain, and answer its uncached subdomains locally with NXDOMAIN while they last."`
+	Window             time.Duration `yaml:"window,omitempty" json:"window,omitempty" descr:"Window over which the queries forwarded for each registrable domain are counted, after which the counts are reset."`
+	MinQueries         int           `yaml:"min_queries,omitempty" json:"min_queries,omitempty" descr:"Minimum number of forwarded queries for a domain within the window before it is evaluated."`
+	UniqueNames        int           `yaml:"unique_names,omitempty" json:"unique_names,omitempty" descr:"Minimum (estimated) number of distinct names queried under a domain within the window to trigger mitigation."`
+	NXDOMAINThreshold  float64       `yaml:"nxdomain_threshold,omitempty" json:"nxdomain_threshold,omitempty" descr:"Minimum ratio of NXDOMAIN responses for a domain within the window to trigger mitigation."`
+	MitigationDuration time.Duration `yaml:"mitigation_duration,omitempty" json:"mitigation_duration,omitempty" descr:"How long a domain's uncached subdomains are answered locally once mitigation is triggered."`
+	MaxDomains         int           `yaml:"max_domains,omitempty" json:"max_domains,omitempty" descr:"Maximum number of registrable domains to track."`
+	ExcludedDomains    []string      `yaml:"excluded_domains,omitempty" json:"excluded_domains,omitempty" descr:"Domains whose names are never tracked or mitigated, e.g. reverse DNS zones or DNS blocklists, which legitimately see many distinct names and NXDOMAIN answers."`
+}
+
+type LoadSheddingConfig struct {
+	Enabled      bool          `yaml:"enabled,omitempty" json:"enabled,omitempty" descr:"Whether to bound the number of outstanding upstream queries. Once the bound is reached, queries only wait briefly for a slot: those that cannot get one are only answered from the cache."`
+	MaxInFlight  int           `yaml:"max_in_flight,omitempty" json:"max_in_flight,omitempty" descr:"Maximum number of upstream queries outstanding at once."`
+	QueueTimeout time.Duration `yaml:"queue_timeout,omitempty" json:"queue_timeout,omitempty" descr:"Maximum time a query waits for an upstream slot before it is shed."`
+	Rcode        string        `yaml:"rcode,omitempty" json:"rcode,omitempty" descr:"Response code for shed queries: 'servfail' or 'refused'."`
 }
 
 type CacheConfig struct {
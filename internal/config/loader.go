@@ -17,22 +17,59 @@ import (
 func DefaultConfig() *Config {
 	return &Config{
 		Server: &ServerConfig{
-			DevMode:  false,
-			LogLevel: "INFO",
-			DataDir:  "./data",
-			HttpPort: 80,
-			DnsPort:  0,
-			DotPort:  853,
+			DevMode:      false,
+			LogLevel:     "INFO",
+			DataDir:      "./data",
+			HttpPort:     80,
+			HttpsPort:    0,
+			Http3:        false,
+			DnsPort:      0,
+			DotPort:      853,
+			DoqPort:      853,
+			DNSCryptPort: 0,
+			DNSCrypt: &DNSCryptConfig{
+				CertRotation: 24 * time.Hour,
+			},
 			ProxyProtocol: &ProxyProtocolConfig{
 				Enabled:        false,
 				TrustedProxies: []string{},
+				DNS:            false,
+			},
+			HTTPTrustedProxies: []string{},
+			Connections: &ConnectionsConfig{
+				IdleTimeout:             10 * time.Second,
+				MaxQueriesPerConnection: 128,
+				MaxConnections:          10000,
+				MaxConnectionsPerIP:     64,
+			},
+			TLS: &TLSConfig{
+				MinVersion: "1.2",
+				MaxVersion: "1.3",
+				CipherSuites: []string{
+					"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+					"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+					"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+					"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+					"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+					"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+				},
+				Curves:       []string{},
+				OCSPStapling: true,
+				SessionTickets: &SessionTicketsConfig{
+					Enabled:  true,
+					KeyFile:  "tls/session-ticket-keys.json",
+					Rotation: 12 * time.Hour,
+				},
 			},
 			LetsEncrypt: &LetsEncryptConfig{
 				Enabled:            false,
 				Email:              "",
+				Challenge:          "dns-01",
+				DNSProvider:        "cloudflare",
 				CloudflareApiToken: "",
 				AllowedHosts:       []string{},
 			},
+			PublicAddresses: []string{},
 			RateLimit: &RateLimitConfig{
 				Enabled:            true,
 				RequestsPerSecond:  50,
@@ -44,6 +81,57 @@ func DefaultConfig() *Config {
 				MaxTrackedIPs:      100_000,
 				ReapInterval:       1 * time.Minute,
 				IdleTTL:            10 * time.Minute,
+				Subnet: &SubnetRateLimitConfig{
+					Enabled:           true,
+					RequestsPerSecond: 200,
+					Burst:             400,
+					IPv4Prefix:        24,
+					IPv6Prefix:        56,
+				},
+				ASN: &ASNRateLimitConfig{
+					Enabled:           false,
+					RequestsPerSecond: 1000,
+					Burst:             2000,
+				},
+				RRL: &RRLConfig{
+					Enabled:            false,
+					ResponsesPerSecond: 5,
+					Window:             15 * time.Second,
+					Slip:               2,
+					IPv4Prefix:         24,
+					IPv6Prefix:         56,
+					MaxEntries:         100_000,
+				},
+				Redis: &RedisConfig{
+					Enabled:   false,
+					Address:   "localhost:6379",
+					KeyPrefix: "dot-block:",
+					Timeout:   100 * time.Millisecond,
+				},
+			},
+			ODoH: &ODoHConfig{
+				Enabled:     false,
+				KeyRotation: 24 * time.Hour,
+				Relay: &ODoHRelayConfig{
+					Enabled:        false,
+					AllowedTargets: []string{},
+					Timeout:        5 * time.Second,
+				},
+			},
+			Mobileconfig: &MobileconfigConfig{
+				DisconnectSSIDs: []string{},
+				ExcludedDomains: []string{},
+				Signing:         &MobileconfigSigningConfig{},
+			},
+			Clients: &ClientsConfig{
+				MaxClients: 1000,
+			},
+			Listeners: &ListenersConfig{
+				DNS:      &ListenerConfig{Listen: []string{}, AllowedNetworks: []string{}},
+				DoT:      &ListenerConfig{Listen: []string{}, AllowedNetworks: []string{}},
+				DoQ:      &ListenerConfig{Listen: []string{}, AllowedNetworks: []string{}},
+				DNSCrypt: &ListenerConfig{Listen: []string{}, AllowedNetworks: []string{}},
+				HTTP:     &ListenerConfig{Listen: []string{}, AllowedNetworks: []string{}},
 			},
 		},
 		DNS: &DNSConfig{
@@ -54,7 +142,10 @@ func DefaultConfig() *Config {
 				"1.0.0.1",
 			},
 			ECS: &ECSConfig{
-				Enabled: false,
+				Enabled:    false,
+				IPv4Prefix: 24,
+				IPv6Prefix: 48,
+				ClientECS:  "override",
 			},
 			Cache: &CacheConfig{
 				MaxSize:      1_000_000,
@@ -70,6 +161,40 @@ func DefaultConfig() *Config {
 				Write: 100 * time.Millisecond,
 				Dial:  300 * time.Millisecond,
 			},
+			ResponseBlocking: &ResponseBlockingConfig{
+				Enabled: true,
+			},
+			Rebinding: &RebindingConfig{
+				Enabled: false,
+				Mode:    "strip",
+			},
+			DNSSEC: &DNSSECConfig{
+				Enabled: false,
+				TrustAnchors: []string{
+					". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+					". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+				},
+			},
+			QueryTypes: &QueryTypesConfig{
+				MinimalANY:        true,
+				AllowZoneTransfer: false,
+			},
+			WaterTorture: &WaterTortureConfig{
+				Enabled:            false,
+				Window:             1 * time.Minute,
+				MinQueries:         100,
+				UniqueNames:        50,
+				NXDOMAINThreshold:  0.8,
+				MitigationDuration: 10 * time.Minute,
+				MaxDomains:         10_000,
+				ExcludedDomains:    []string{"in-addr.arpa", "ip6.arpa"},
+			},
+			LoadShedding: &LoadSheddingConfig{
+				Enabled:      true,
+				MaxInFlight:  1024,
+				QueueTimeout: 250 * time.Millisecond,
+				Rcode:        "servfail",
+			},
 		},
 		Blocklist: &BlocklistConfig{
 			Sources: []BlocklistSource{
@@ -248,6 +373,14 @@ func ApplyEnvOverrides(cfg *Config) {
 			cfg.Server.HttpPort = port
 		}
 	}
+	if v := os.Getenv("HTTPS_PORT"); v != "" {
+		if port, err := strconv.Atoi(v); err == nil {
+			cfg.Server.HttpsPort = port
+		}
+	}
+	if v := os.Getenv("ENABLE_HTTP3"); v != "" {
+		cfg.Server.Http3 = v == "true"
+	}
 	if v := os.Getenv("DNS_PORT"); v != "" {
 		if port, err := strconv.Atoi(v); err == nil {
 			cfg.Server.DnsPort = port
@@ -258,6 +391,19 @@ func ApplyEnvOverrides(cfg *Config) {
 			cfg.Server.DotPort = port
 		}
 	}
+	if v := os.Getenv("DOQ_PORT"); v != "" {
+		if port, err := strconv.Atoi(v); err == nil {
+			cfg.Server.DoqPort = port
+		}
+	}
+	if v := os.Getenv("DNSCRYPT_PORT"); v != "" {
+		if port, err := strconv.Atoi(v); err == nil {
+			cfg.Server.DNSCryptPort = port
+		}
+	}
+	if v := os.Getenv("PUBLIC_ADDRESSES"); v != "" {
+		cfg.Server.PublicAddresses = strings.Split(v, ",")
+	}
 	if v := os.Getenv("REQUIRE_PROXY_PROTOCOL"); v != "" {
 		if cfg.Server.ProxyProtocol == nil {
 			cfg.Server.ProxyProtocol = &ProxyProtocolConfig{}
@@ -269,7 +415,7 @@ func ApplyEnvOverrides(cfg *Config) {
 	}
 	if v := os.Getenv("ENABLE_ECS"); v != "" {
 		if cfg.DNS.ECS == nil {
-			cfg.DNS.ECS = &ECSConfig{}
+			cfg.DNS.ECS = DefaultConfig().DNS.ECS
 		}
 		cfg.DNS.ECS.Enabled = v == "true"
 	}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rm-hull/dot-block/internal/clients"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/forwarder"
+)
+
+var errTooManyConnections = errors.New("too many connections from client IP")
+
+// connLimiter caps the number of open TCP connections, in total and per
+// client IP, so that clients holding connections open (e.g. slowloris) cannot
+// exhaust file descriptors. It is shared by all the DoT and TCP listeners.
+type connLimiter struct {
+	maxConns int
+	maxPerIP int
+	open     *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(cfg *config.ConnectionsConfig, open *prometheus.GaugeVec, rejected *prometheus.CounterVec) *connLimiter {
+	if cfg == nil {
+		cfg = &config.ConnectionsConfig{}
+	}
+	return &connLimiter{
+		maxConns: cfg.MaxConnections,
+		maxPerIP: cfg.MaxConnectionsPerIP,
+		open:     open,
+		rejected: rejected,
+		perIP:    make(map[string]int),
+	}
+}
+
+// Listener wraps the listener of the source to enforce the limits.
+func (l *connLimiter) Listener(base net.Listener, source forwarder.DNSSource) net.Listener {
+	return &limitListener{Listener: base, limiter: l, source: string(source)}
+}
+
+func (l *connLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConns > 0 && l.total >= l.maxConns {
+		return false
+	}
+	l.total++
+	return true
+}
+
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+}
+
+func (l *connLimiter) acquireIP(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+func (l *connLimiter) releaseIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+	source  string
+}
+
+// Accept enforces the global limit, closing excess connections as soon as
+// they are accepted. The per-IP limit is enforced on the connection's first
+// read instead, as the client IP may only be known once a PROXY protocol
+// header has been read, which must not block the accept loop.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.limiter.acquire() {
+			l.limiter.rejected.WithLabelValues(l.source, "max_connections").Inc()
+			_ = conn.Close()
+			continue
+		}
+		l.limiter.open.WithLabelValues(l.source).Inc()
+		return &limitedConn{Conn: conn, listener: l}, nil
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	listener *limitListener
+
+	admit     sync.Once
+	admitErr  error
+	ip        string
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	c.admit.Do(func() {
+		ip, _, err := net.SplitHostPort(c.Conn.RemoteAddr().String())
+		if err != nil {
+			return
+		}
+		if !c.listener.limiter.acquireIP(ip) {
+			c.listener.limiter.rejected.WithLabelValues(c.listener.source, "max_connections_per_ip").Inc()
+			c.admitErr = errTooManyConnections
+			return
+		}
+		c.ip = ip
+	})
+	if c.admitErr != nil {
+		return 0, c.admitErr
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		// Wait for a first read in progress, which the close has unblocked,
+		// to finish admitting the client
+		c.admit.Do(func() {})
+		if c.ip != "" {
+			c.listener.limiter.releaseIP(c.ip)
+		}
+		c.listener.limiter.release()
+		c.listener.limiter.open.WithLabelValues(c.listener.source).Dec()
+	})
+	return err
+}
+
+// configureTCPServer applies the idle timeout and query limit of TCP
+// connections to the server, advertising the idle timeout to clients.
+func configureTCPServer(srv *dns.Server, cfg *config.ConnectionsConfig) {
+	if cfg == nil {
+		return
+	}
+	if cfg.IdleTimeout > 0 {
+		idleTimeout := cfg.IdleTimeout
+		srv.IdleTimeout = func() time.Duration { return idleTimeout }
+		srv.Handler = withTCPKeepalive(srv.Handler, idleTimeout)
+	}
+	srv.MaxTCPQueries = cfg.MaxQueriesPerConnection
+	if srv.MaxTCPQueries <= 0 {
+		srv.MaxTCPQueries = -1
+	}
+}
+
+// withTCPKeepalive advertises the idle timeout of TCP connections to clients
+// that send the edns-tcp-keepalive option (RFC 7828), so that they can reuse
+// the connection rather than reconnecting for every query.
+func withTCPKeepalive(handler dns.Handler, idleTimeout time.Duration) dns.Handler {
+	// The timeout is in units of 100 milliseconds
+	timeout := uint16(min(idleTimeout/(100*time.Millisecond), math.MaxUint16))
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if opt := req.IsEdns0(); opt != nil && slices.ContainsFunc(opt.Option, isTCPKeepalive) {
+			w = &keepaliveWriter{ResponseWriter: w, req: opt, timeout: timeout}
+		}
+		handler.ServeDNS(w, req)
+	})
+}
+
+func isTCPKeepalive(option dns.EDNS0) bool {
+	return option.Option() == dns.EDNS0TCPKEEPALIVE
+}
+
+type keepaliveWriter struct {
+	dns.ResponseWriter
+	req     *dns.OPT
+	timeout uint16
+}
+
+// ConnectionState forwards the TLS state of the wrapped writer, which
+// identifies DoT clients by their server name.
+func (w *keepaliveWriter) ConnectionState() *tls.ConnectionState {
+	if stater, ok := w.ResponseWriter.(dns.ConnectionStater); ok {
+		return stater.ConnectionState()
+	}
+	return nil
+}
+
+// ClientID forwards the client ID of the wrapped writer, if it has one.
+func (w *keepaliveWriter) ClientID() string {
+	if identifier, ok := w.ResponseWriter.(clients.Identifier); ok {
+		return identifier.ClientID()
+	}
+	return ""
+}
+
+func (w *keepaliveWriter) WriteMsg(msg *dns.Msg) error {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(w.req.UDPSize())
+		opt.SetVersion(w.req.Version())
+		opt.SetDo(w.req.Do())
+		msg.Extra = append(msg.Extra, opt)
+	}
+	opt.Option = append(slices.DeleteFunc(opt.Option, isTCPKeepalive), &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Timeout: w.timeout,
+	})
+	return w.ResponseWriter.WriteMsg(msg)
+}
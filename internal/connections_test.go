@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rm-hull/dot-block/internal/clients"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConnLimiter(maxConns, maxPerIP int) *connLimiter {
+	return newConnLimiter(
+		&config.ConnectionsConfig{MaxConnections: maxConns, MaxConnectionsPerIP: maxPerIP},
+		prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "open"}, []string{"source"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rejected"}, []string{"source", "reason"}),
+	)
+}
+
+// acceptConns accepts connections on the listener, echoing the first byte
+// each one sends, until it is closed.
+func acceptConns(t *testing.T, listener net.Listener) {
+	t.Helper()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				buf := make([]byte, 1)
+				if _, err := conn.Read(buf); err == nil {
+					_, _ = conn.Write(buf)
+				}
+				// Hold the connection open until the client closes it
+				_, _ = conn.Read(buf)
+			}()
+		}
+	}()
+}
+
+// echo reports whether the server echoed a byte on the connection.
+func echo(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return false
+	}
+	_, err := io.ReadFull(conn, make([]byte, 1))
+	return err == nil
+}
+
+func TestConnLimiter_MaxConnections(t *testing.T) {
+	limiter := newTestConnLimiter(1, 0)
+	base, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := limiter.Listener(base, "dot")
+	defer func() { _ = listener.Close() }()
+	acceptConns(t, listener)
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	assert.True(t, echo(t, first))
+	assert.Equal(t, 1.0, testutil.ToFloat64(limiter.open.WithLabelValues("dot")))
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = second.Close() }()
+	assert.False(t, echo(t, second))
+	assert.Equal(t, 1.0, testutil.ToFloat64(limiter.rejected.WithLabelValues("dot", "max_connections")))
+
+	// Closing the first connection frees its slot
+	require.NoError(t, first.Close())
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(limiter.open.WithLabelValues("dot")) == 0
+	}, time.Second, 10*time.Millisecond)
+	third, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = third.Close() }()
+	assert.True(t, echo(t, third))
+}
+
+func TestConnLimiter_MaxConnectionsPerIP(t *testing.T) {
+	limiter := newTestConnLimiter(0, 2)
+	base, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := limiter.Listener(base, "tcp")
+	defer func() { _ = listener.Close() }()
+	acceptConns(t, listener)
+
+	var conns []net.Conn
+	for range 2 {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		assert.True(t, echo(t, conn))
+		conns = append(conns, conn)
+	}
+
+	excess, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = excess.Close() }()
+	assert.False(t, echo(t, excess))
+	assert.Equal(t, 1.0, testutil.ToFloat64(limiter.rejected.WithLabelValues("tcp", "max_connections_per_ip")))
+
+	for _, conn := range conns {
+		require.NoError(t, conn.Close())
+	}
+	assert.Eventually(t, func() bool {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return len(limiter.perIP) == 0 && limiter.total == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+type keepaliveTestWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *keepaliveTestWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func TestWithTCPKeepalive(t *testing.T) {
+	handler := withTCPKeepalive(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		_ = w.WriteMsg(new(dns.Msg).SetReply(req))
+	}), 10*time.Second)
+
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, true)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	w := &keepaliveTestWriter{}
+	handler.ServeDNS(w, req)
+
+	opt := w.msg.IsEdns0()
+	require.NotNil(t, opt)
+	assert.True(t, opt.Do())
+	require.Len(t, opt.Option, 1)
+	assert.Equal(t, uint16(100), opt.Option[0].(*dns.EDNS0_TCP_KEEPALIVE).Timeout)
+
+	// Clients that did not ask are not told
+	req = new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	handler.ServeDNS(w, req)
+	assert.Nil(t, w.msg.IsEdns0())
+}
+
+func TestWithTCPKeepalive_IdentifiesDoTClients(t *testing.T) {
+	registry, err := clients.NewRegistry("", 10, []string{"dns.example.com"})
+	require.NoError(t, err)
+
+	certFile, keyFile := writeTestCertificate(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+
+	ids := make(chan string, 1)
+	srv := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		ids <- registry.Track(w, "127.0.0.1")
+		_ = w.WriteMsg(new(dns.Msg).SetReply(req))
+	})}
+	configureTCPServer(srv, &config.ConnectionsConfig{IdleTimeout: 10 * time.Second})
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: "laptop.dns.example.com", InsecureSkipVerify: true}}
+	resp, _, err := client.Exchange(req, listener.Addr().String())
+	require.NoError(t, err)
+
+	require.NotNil(t, resp.IsEdns0())
+	assert.True(t, slices.ContainsFunc(resp.IsEdns0().Option, isTCPKeepalive))
+	assert.Equal(t, "laptop", <-ids, "the client ID survives the keepalive wrapper")
+}
+
+func TestConfigureTCPServer(t *testing.T) {
+	srv := &dns.Server{Handler: dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {})}
+	configureTCPServer(srv, &config.ConnectionsConfig{IdleTimeout: 30 * time.Second})
+	require.NotNil(t, srv.IdleTimeout)
+	assert.Equal(t, 30*time.Second, srv.IdleTimeout())
+	assert.Equal(t, -1, srv.MaxTCPQueries)
+
+	configureTCPServer(srv, &config.ConnectionsConfig{MaxQueriesPerConnection: 10})
+	assert.Equal(t, 10, srv.MaxTCPQueries)
+}
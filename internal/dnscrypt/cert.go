@@ -0,0 +1,256 @@
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ProviderPrefix is the label prefix of DNSCrypt v2 provider names.
+const ProviderPrefix = "2.dnscrypt-cert."
+
+const (
+	certMagic = "DNSC"
+	// esVersion is the only encryption system supported:
+	// X25519-XSalsa20Poly1305.
+	esVersion = 0x0001
+	certSize  = 124
+)
+
+// resolverCert is a short-term resolver key pair and the certificate, signed
+// by the provider key, that publishes it.
+type resolverCert struct {
+	magic     [8]byte
+	publicKey [32]byte
+	secretKey [32]byte
+	serial    uint32
+	notBefore time.Time
+	notAfter  time.Time
+	signed    []byte
+}
+
+// CertificateInfo describes a published resolver certificate.
+type CertificateInfo struct {
+	Serial     uint32    `json:"serial"`
+	ValidFrom  time.Time `json:"valid_from"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// Provider holds the long-term provider signing key and the short-term
+// resolver certificates it has issued. The current and previous certificates
+// are published and accepted, so clients have a full rotation period to
+// refetch.
+type Provider struct {
+	name       string
+	signingKey ed25519.PrivateKey
+	rotation   time.Duration
+
+	mu    sync.RWMutex
+	certs []*resolverCert // newest first
+}
+
+// NewProvider returns a provider using the Ed25519 key in keyFile, which is
+// generated on first use, and issues its first resolver certificate. Each
+// certificate is valid for two rotation periods.
+func NewProvider(name string, keyFile string, rotation time.Duration) (*Provider, error) {
+	if rotation <= 0 {
+		return nil, errors.New("DNSCrypt certificate rotation must be positive")
+	}
+	signingKey, err := loadOrCreateSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		name:       dns.Fqdn(strings.ToLower(name)),
+		signingKey: signingKey,
+		rotation:   rotation,
+	}
+	if err := p.Rotate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ProviderName returns the provider name, without the trailing dot, e.g.
+// 2.dnscrypt-cert.example.com.
+func ProviderName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if !strings.HasPrefix(name, ProviderPrefix) {
+		name = ProviderPrefix + name
+	}
+	return name
+}
+
+func loadOrCreateSigningKey(keyFile string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.Newf("failed to decode DNSCrypt provider key %s", keyFile)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse DNSCrypt provider key %s", keyFile)
+		}
+		signingKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.Newf("DNSCrypt provider key %s is not an Ed25519 key", keyFile)
+		}
+		return signingKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read DNSCrypt provider key %s", keyFile)
+	}
+
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate DNSCrypt provider key")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signingKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode DNSCrypt provider key")
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create DNSCrypt key directory")
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, errors.Wrapf(err, "failed to write DNSCrypt provider key %s", keyFile)
+	}
+	return signingKey, nil
+}
+
+// Rotate issues a new resolver certificate with a fresh key pair, keeping
+// the previous one for clients that have not refetched yet.
+func (p *Provider) Rotate() error {
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate DNSCrypt resolver key")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	// Serials must increase, also across restarts, so they follow the clock
+	serial := uint32(now.Unix())
+	if len(p.certs) > 0 && serial <= p.certs[0].serial {
+		serial = p.certs[0].serial + 1
+	}
+
+	cert := &resolverCert{
+		publicKey: *publicKey,
+		secretKey: *secretKey,
+		serial:    serial,
+		notBefore: now.Add(-time.Minute), // allow for client clock skew
+		notAfter:  now.Add(2 * p.rotation),
+	}
+	copy(cert.magic[:], cert.publicKey[:8])
+	cert.signed = cert.marshal(p.signingKey)
+
+	p.certs = append([]*resolverCert{cert}, p.certs...)
+	if len(p.certs) > 2 {
+		p.certs = p.certs[:2]
+	}
+	return nil
+}
+
+// marshal encodes and signs the certificate (DNSCrypt v2 protocol, section
+// "Certificates").
+func (c *resolverCert) marshal(signingKey ed25519.PrivateKey) []byte {
+	signed := make([]byte, 0, 52)
+	signed = append(signed, c.publicKey[:]...)
+	signed = append(signed, c.magic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, c.serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(c.notBefore.Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(c.notAfter.Unix()))
+
+	buf := make([]byte, 0, certSize)
+	buf = append(buf, certMagic...)
+	buf = binary.BigEndian.AppendUint16(buf, esVersion)
+	buf = binary.BigEndian.AppendUint16(buf, 0) // protocol minor version
+	buf = append(buf, ed25519.Sign(signingKey, signed)...)
+	return append(buf, signed...)
+}
+
+// lookup returns the certificate whose client magic prefixes a query.
+func (p *Provider) lookup(magic []byte) *resolverCert {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, cert := range p.certs {
+		if string(cert.magic[:]) == string(magic) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// Name returns the fully qualified provider name, at which the certificates
+// are served as TXT records.
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// PublicKey returns the provider's Ed25519 public key, which clients use to
+// verify the certificates.
+func (p *Provider) PublicKey() ed25519.PublicKey {
+	return p.signingKey.Public().(ed25519.PublicKey)
+}
+
+// Certificates describes the currently published certificates, newest first.
+func (p *Provider) Certificates() []CertificateInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	infos := make([]CertificateInfo, 0, len(p.certs))
+	for _, cert := range p.certs {
+		infos = append(infos, CertificateInfo{
+			Serial:     cert.serial,
+			ValidFrom:  cert.notBefore,
+			ValidUntil: cert.notAfter,
+		})
+	}
+	return infos
+}
+
+// certificateRecords returns the TXT records answering a certificate query.
+func (p *Provider) certificateRecords(ttl uint32) []dns.RR {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	records := make([]dns.RR, 0, len(p.certs))
+	for _, cert := range p.certs {
+		records = append(records, &dns.TXT{
+			Hdr: dns.RR_Header{Name: p.name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: []string{escapeTXT(cert.signed)},
+		})
+	}
+	return records
+}
+
+// escapeTXT escapes binary data for a miekg/dns TXT string, which is
+// interpreted in presentation format when packed.
+func escapeTXT(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c < ' ' || c > '~' || c == '\\' || c == '"' {
+			fmt.Fprintf(&sb, "\\%03d", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
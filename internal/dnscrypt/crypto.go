@@ -0,0 +1,101 @@
+package dnscrypt
+
+import (
+	"crypto/rand"
+
+	"github.com/cockroachdb/errors"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	clientMagicSize = 8
+	publicKeySize   = 32
+	halfNonceSize   = 12
+	queryHeaderSize = clientMagicSize + publicKeySize + halfNonceSize
+
+	// resolverMagic prefixes every encrypted response
+	resolverMagic = "r6fnvWj8"
+
+	// Padded plaintexts are a multiple of this size
+	paddingBlock = 64
+
+	// responseOverhead is the most that encryption adds to a response: the
+	// magic, nonce, authenticator and padding.
+	responseOverhead = len(resolverMagic) + 2*halfNonceSize + box.Overhead + paddingBlock
+)
+
+// query is a decrypted client query, along with what is needed to encrypt
+// the response to it.
+type query struct {
+	msg         []byte
+	sharedKey   [32]byte
+	clientNonce [halfNonceSize]byte
+}
+
+// decryptQuery decrypts a query encrypted to the certificate's resolver key:
+// <client-magic> <client-pk> <client-nonce> <encrypted-query>.
+func decryptQuery(cert *resolverCert, packet []byte) (*query, error) {
+	if len(packet) < queryHeaderSize+box.Overhead {
+		return nil, errors.New("DNSCrypt query too short")
+	}
+
+	var clientPublicKey [publicKeySize]byte
+	copy(clientPublicKey[:], packet[clientMagicSize:])
+
+	q := &query{}
+	copy(q.clientNonce[:], packet[clientMagicSize+publicKeySize:])
+	box.Precompute(&q.sharedKey, &clientPublicKey, &cert.secretKey)
+
+	// The client nonce is completed with zeros
+	var nonce [24]byte
+	copy(nonce[:], q.clientNonce[:])
+
+	padded, ok := box.OpenAfterPrecomputation(nil, packet[queryHeaderSize:], &nonce, &q.sharedKey)
+	if !ok {
+		return nil, errors.New("failed to decrypt DNSCrypt query")
+	}
+	msg, err := unpad(padded)
+	if err != nil {
+		return nil, err
+	}
+	q.msg = msg
+	return q, nil
+}
+
+// encryptResponse encrypts a packed response to the client:
+// <resolver-magic> <client-nonce> <resolver-nonce> <encrypted-response>.
+func (q *query) encryptResponse(msg []byte) ([]byte, error) {
+	var nonce [24]byte
+	copy(nonce[:], q.clientNonce[:])
+	if _, err := rand.Read(nonce[halfNonceSize:]); err != nil {
+		return nil, errors.Wrap(err, "failed to generate resolver nonce")
+	}
+
+	buf := make([]byte, 0, len(msg)+responseOverhead)
+	buf = append(buf, resolverMagic...)
+	buf = append(buf, nonce[:]...)
+	return box.SealAfterPrecomputation(buf, pad(msg), &nonce, &q.sharedKey), nil
+}
+
+// pad appends the ISO/IEC 7816-4 padding used by DNSCrypt: a 0x80 byte,
+// then zeros up to a multiple of the block size.
+func pad(msg []byte) []byte {
+	padded := make([]byte, len(msg), (len(msg)/paddingBlock+1)*paddingBlock)
+	copy(padded, msg)
+	padded = append(padded, 0x80)
+	return padded[:cap(padded)]
+}
+
+func unpad(padded []byte) ([]byte, error) {
+	for i := len(padded) - 1; i >= 0; i-- {
+		switch padded[i] {
+		case 0x00:
+			continue
+		case 0x80:
+			return padded[:i], nil
+		default:
+			return nil, errors.New("invalid DNSCrypt padding")
+		}
+	}
+	return nil, errors.New("missing DNSCrypt padding")
+}
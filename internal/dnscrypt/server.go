@@ -0,0 +1,306 @@
+// Package dnscrypt implements a DNSCrypt v2 server
+// (https://dnscrypt.info/protocol) that hands each decrypted query to a
+// regular miekg/dns handler, so it can share the dispatcher used by the other
+// listeners. Only the X25519-XSalsa20Poly1305 construction is supported, as
+// it is understood by every DNSCrypt client.
+package dnscrypt
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxQuerySize bounds UDP queries; anything larger cannot be a DNS
+	// message plus DNSCrypt overhead.
+	maxQuerySize = dns.MaxMsgSize
+	tcpTimeout   = 10 * time.Second
+	certTTL      = 600
+)
+
+type Server struct {
+	// Addr is the address to listen on, e.g. ":5443".
+	Addr string
+	// Net is "udp" or "tcp", optionally restricted to IPv4 or IPv6 with a
+	// "4" or "6" suffix.
+	Net      string
+	Provider *Provider
+	// Handler is invoked for every decrypted query.
+	Handler dns.Handler
+	// Allow, if set, is asked whether to answer an unencrypted certificate
+	// query from the client IP. Encrypted queries are left to the Handler.
+	Allow  func(ip string) bool
+	Logger *slog.Logger
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	listener net.Listener
+	closed   bool
+}
+
+// ListenAndServe listens on the configured address and serves DNSCrypt
+// queries until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	switch s.Net {
+	case "udp", "udp4", "udp6":
+		conn, err := net.ListenPacket(s.Net, s.Addr)
+		if err != nil {
+			return errors.Wrap(err, "failed to create DNSCrypt UDP listener")
+		}
+		return s.ServeUDP(conn)
+	case "tcp", "tcp4", "tcp6":
+		listener, err := net.Listen(s.Net, s.Addr)
+		if err != nil {
+			return errors.Wrap(err, "failed to create DNSCrypt TCP listener")
+		}
+		return s.ServeTCP(listener)
+	default:
+		return errors.Newf("unsupported DNSCrypt network %q", s.Net)
+	}
+}
+
+// ServeUDP answers queries received on the packet connection until Shutdown
+// is called.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, maxQuerySize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return errors.Wrap(err, "failed to read DNSCrypt UDP packet")
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		go s.handlePacket(packet, &responseWriter{
+			local:  conn.LocalAddr(),
+			remote: addr,
+			// Responses (including unencrypted certificate responses) must
+			// not be larger than the query, so that the server cannot be
+			// used for amplification.
+			maxSize: n,
+			send: func(b []byte) error {
+				_, err := conn.WriteTo(b, addr)
+				return err
+			},
+		})
+	}
+}
+
+// ServeTCP answers queries received on connections accepted by the listener
+// until Shutdown is called. Messages are framed with a 2-byte length prefix,
+// as for regular DNS over TCP.
+func (s *Server) ServeTCP(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return errors.Wrap(err, "failed to accept DNSCrypt TCP connection")
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	var mu sync.Mutex
+	for {
+		_ = conn.SetDeadline(time.Now().Add(tcpTimeout))
+
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+
+		s.handlePacket(packet, &responseWriter{
+			local:  conn.LocalAddr(),
+			remote: conn.RemoteAddr(),
+			send: func(b []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+				return err
+			},
+		})
+	}
+}
+
+// Shutdown stops the listener. Queries in flight are dropped.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	switch {
+	case s.conn != nil:
+		return s.conn.Close()
+	case s.listener != nil:
+		return s.listener.Close()
+	default:
+		return errors.New("DNSCrypt server is not running")
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) handlePacket(packet []byte, w *responseWriter) {
+	if len(packet) >= clientMagicSize {
+		if cert := s.Provider.lookup(packet[:clientMagicSize]); cert != nil {
+			q, err := decryptQuery(cert, packet)
+			if err != nil {
+				s.logger().Debug("failed to decrypt DNSCrypt query", "remote_addr", w.remote, "error", err)
+				return
+			}
+
+			req := new(dns.Msg)
+			if err := req.Unpack(q.msg); err != nil {
+				s.logger().Debug("failed to parse DNSCrypt query", "remote_addr", w.remote, "error", err)
+				return
+			}
+			w.query = q
+			s.Handler.ServeDNS(w, req)
+			return
+		}
+	}
+
+	// Anything else must be an unencrypted certificate query
+	req := new(dns.Msg)
+	if err := req.Unpack(packet); err != nil || len(req.Question) != 1 {
+		return
+	}
+	q := req.Question[0]
+	if q.Qtype != dns.TypeTXT || !strings.EqualFold(q.Name, s.Provider.Name()) {
+		return
+	}
+	if s.Allow != nil {
+		ip := w.remote.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if !s.Allow(ip) {
+			s.logger().Debug("DNSCrypt certificate query rate limited", "remote_addr", w.remote)
+			return
+		}
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.Answer = s.Provider.certificateRecords(certTTL)
+	if err := w.WriteMsg(resp); err != nil {
+		s.logger().Debug("failed to send DNSCrypt certificates", "remote_addr", w.remote, "error", err)
+	}
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// responseWriter adapts a DNSCrypt exchange to the miekg/dns ResponseWriter,
+// encrypting responses to queries (and sending certificate responses in the
+// clear).
+type responseWriter struct {
+	local   net.Addr
+	remote  net.Addr
+	maxSize int // UDP only
+	send    func([]byte) error
+	query   *query
+}
+
+func (w *responseWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *responseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return errors.Wrap(err, "failed to pack DNSCrypt response")
+	}
+
+	overhead := responseOverhead
+	if w.query == nil {
+		overhead = 0
+	}
+	if w.maxSize > 0 && len(packed)+overhead > w.maxSize {
+		// Too large for UDP: send an empty truncated response so that the
+		// client retries over TCP
+		truncated := m.Copy()
+		truncated.Truncated = true
+		truncated.Answer, truncated.Ns, truncated.Extra = nil, nil, nil
+		if packed, err = truncated.Pack(); err != nil {
+			return errors.Wrap(err, "failed to pack DNSCrypt response")
+		}
+	}
+	if w.query == nil {
+		return w.send(packed)
+	}
+	return w.writeEncrypted(packed)
+}
+
+// Write sends a raw DNS message, encrypted if it is a response to a query.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.query == nil {
+		return len(b), w.send(b)
+	}
+	return len(b), w.writeEncrypted(b)
+}
+
+func (w *responseWriter) writeEncrypted(b []byte) error {
+	encrypted, err := w.query.encryptResponse(b)
+	if err != nil {
+		return err
+	}
+	return w.send(encrypted)
+}
+
+func (w *responseWriter) Close() error {
+	return nil
+}
+
+func (w *responseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *responseWriter) TsigTimersOnly(bool) {
+
+}
+
+func (w *responseWriter) Hijack() {
+
+}
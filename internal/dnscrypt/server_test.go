@@ -0,0 +1,363 @@
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const testProvider = "2.dnscrypt-cert.dot-block.test"
+
+func newTestProvider(t *testing.T) *Provider {
+	t.Helper()
+	provider, err := NewProvider(testProvider, filepath.Join(t.TempDir(), "provider.key"), time.Hour)
+	require.NoError(t, err)
+	return provider
+}
+
+func startServer(t *testing.T, network string, provider *Provider, handler dns.HandlerFunc) string {
+	t.Helper()
+	return startTestServer(t, &Server{Net: network, Provider: provider, Handler: handler})
+}
+
+func startTestServer(t *testing.T, server *Server) string {
+	t.Helper()
+	network := server.Net
+	done := make(chan error, 1)
+
+	var addr string
+	switch network {
+	case "udp":
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr = conn.LocalAddr().String()
+		go func() { done <- server.ServeUDP(conn) }()
+	case "tcp":
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr = listener.Addr().String()
+		go func() { done <- server.ServeTCP(listener) }()
+	}
+
+	t.Cleanup(func() {
+		assert.NoError(t, server.Shutdown())
+		assert.NoError(t, <-done)
+	})
+	return addr
+}
+
+// testClient speaks just enough DNSCrypt to exercise the server.
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	network string
+}
+
+func dial(t *testing.T, network, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, network: network}
+}
+
+func (c *testClient) send(b []byte) {
+	if c.network == "tcp" {
+		b = append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+	}
+	_, err := c.conn.Write(b)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) receive() []byte {
+	if c.network == "tcp" {
+		var length uint16
+		require.NoError(c.t, binary.Read(c.conn, binary.BigEndian, &length))
+		buf := make([]byte, length)
+		_, err := io.ReadFull(c.conn, buf)
+		require.NoError(c.t, err)
+		return buf
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := c.conn.Read(buf)
+	require.NoError(c.t, err)
+	return buf[:n]
+}
+
+type parsedCert struct {
+	publicKey [32]byte
+	magic     [8]byte
+	serial    uint32
+}
+
+// certQuery builds the unencrypted certificate query. Over UDP, clients pad
+// it (as dnscrypt-proxy does) so that the response fits.
+func certQuery(t *testing.T, padding int) []byte {
+	req := new(dns.Msg)
+	req.SetQuestion(testProvider+".", dns.TypeTXT)
+	if padding > 0 {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+	}
+	packed, err := req.Pack()
+	require.NoError(t, err)
+	return packed
+}
+
+// fetchCerts queries the provider name in the clear and verifies the
+// returned certificates against the provider public key.
+func (c *testClient) fetchCerts(providerKey ed25519.PublicKey) []parsedCert {
+	c.send(certQuery(c.t, 480))
+
+	resp := new(dns.Msg)
+	require.NoError(c.t, resp.Unpack(c.receive()))
+	require.False(c.t, resp.Truncated)
+
+	var certs []parsedCert
+	for _, rr := range resp.Answer {
+		raw := unescapeTXT(c.t, strings.Join(rr.(*dns.TXT).Txt, ""))
+		require.Len(c.t, raw, certSize)
+		require.Equal(c.t, certMagic, string(raw[:4]))
+		require.Equal(c.t, uint16(esVersion), binary.BigEndian.Uint16(raw[4:]))
+		require.True(c.t, ed25519.Verify(providerKey, raw[72:], raw[8:72]), "certificate signature should verify")
+
+		var cert parsedCert
+		copy(cert.publicKey[:], raw[72:104])
+		copy(cert.magic[:], raw[104:112])
+		cert.serial = binary.BigEndian.Uint32(raw[112:])
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+// exchange sends an encrypted query, padded to minSize, and decrypts the
+// response.
+func (c *testClient) exchange(cert parsedCert, req *dns.Msg, minSize int) *dns.Msg {
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	require.NoError(c.t, err)
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, &cert.publicKey, secretKey)
+
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:halfNonceSize])
+	require.NoError(c.t, err)
+
+	packed, err := req.Pack()
+	require.NoError(c.t, err)
+	padded := pad(packed)
+	for len(padded) < minSize {
+		padded = append(padded, make([]byte, paddingBlock)...)
+	}
+
+	packet := append(cert.magic[:], publicKey[:]...)
+	packet = append(packet, nonce[:halfNonceSize]...)
+	packet = box.SealAfterPrecomputation(packet, padded, &nonce, &sharedKey)
+	c.send(packet)
+
+	response := c.receive()
+	require.Equal(c.t, resolverMagic, string(response[:8]))
+	require.Equal(c.t, nonce[:halfNonceSize], response[8:8+halfNonceSize], "response should echo the client nonce")
+
+	copy(nonce[:], response[8:32])
+	decrypted, ok := box.OpenAfterPrecomputation(nil, response[32:], &nonce, &sharedKey)
+	require.True(c.t, ok, "response should decrypt")
+	msg, err := unpad(decrypted)
+	require.NoError(c.t, err)
+
+	resp := new(dns.Msg)
+	require.NoError(c.t, resp.Unpack(msg))
+	return resp
+}
+
+func unescapeTXT(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			buf = append(buf, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			n, err := strconv.Atoi(s[i+1 : i+4])
+			require.NoError(t, err)
+			buf = append(buf, byte(n))
+			i += 3
+		} else {
+			buf = append(buf, s[i+1])
+			i++
+		}
+	}
+	return buf
+}
+
+func isDigits(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
+}
+
+func answerHandler(answers int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		for range answers {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{host},
+			})
+		}
+		_ = w.WriteMsg(m)
+	}
+}
+
+func TestServer_Exchange(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			provider := newTestProvider(t)
+			addr := startServer(t, network, provider, answerHandler(1))
+			client := dial(t, network, addr)
+
+			certs := client.fetchCerts(provider.PublicKey())
+			require.Len(t, certs, 1)
+
+			for _, name := range []string{"example.com.", "example.org."} {
+				req := new(dns.Msg)
+				req.SetQuestion(name, dns.TypeTXT)
+
+				resp := client.exchange(certs[0], req, 256)
+				assert.Equal(t, req.Id, resp.Id)
+				require.Len(t, resp.Answer, 1)
+				assert.Equal(t, name, resp.Answer[0].Header().Name)
+				assert.Equal(t, []string{"127.0.0.1"}, resp.Answer[0].(*dns.TXT).Txt, "handler should see the client address")
+			}
+		})
+	}
+}
+
+func TestServer_UDPResponseNotLargerThanQuery(t *testing.T) {
+	provider := newTestProvider(t)
+	addr := startServer(t, "udp", provider, answerHandler(20))
+	client := dial(t, "udp", addr)
+	cert := client.fetchCerts(provider.PublicKey())[0]
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+
+	resp := client.exchange(cert, req, 256)
+	assert.True(t, resp.Truncated, "oversized response should be truncated")
+	assert.Empty(t, resp.Answer)
+
+	// A larger query makes room for the full response
+	resp = client.exchange(cert, req, 1024)
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 20)
+}
+
+func TestServer_UDPCertificatesNotLargerThanQuery(t *testing.T) {
+	provider := newTestProvider(t)
+	addr := startServer(t, "udp", provider, answerHandler(1))
+	client := dial(t, "udp", addr)
+
+	query := certQuery(t, 0)
+	client.send(query)
+	raw := client.receive()
+	assert.LessOrEqual(t, len(raw), len(query))
+
+	resp := new(dns.Msg)
+	require.NoError(t, resp.Unpack(raw))
+	assert.True(t, resp.Truncated, "unpadded certificate query should get a truncated response")
+	assert.Empty(t, resp.Answer)
+}
+
+func TestServer_CertificateQueriesRateLimited(t *testing.T) {
+	provider := newTestProvider(t)
+	asked := make(chan string, 1)
+	addr := startTestServer(t, &Server{
+		Net:      "udp",
+		Provider: provider,
+		Handler:  answerHandler(1),
+		Allow: func(ip string) bool {
+			asked <- ip
+			return false
+		},
+	})
+	client := dial(t, "udp", addr)
+
+	client.send(certQuery(t, 480))
+	_ = client.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := client.conn.Read(make([]byte, 512))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout(), "rate limited certificate query should not be answered")
+	assert.Equal(t, "127.0.0.1", <-asked)
+}
+
+func TestServer_IgnoresOtherQueries(t *testing.T) {
+	provider := newTestProvider(t)
+	addr := startServer(t, "udp", provider, answerHandler(1))
+	client := dial(t, "udp", addr)
+
+	// Plain DNS queries for anything but the certificates are not answered
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	packed, err := req.Pack()
+	require.NoError(t, err)
+	client.send(packed)
+
+	_ = client.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = client.conn.Read(make([]byte, 512))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestProvider_Rotate(t *testing.T) {
+	provider := newTestProvider(t)
+	addr := startServer(t, "tcp", provider, answerHandler(1))
+	client := dial(t, "tcp", addr)
+	old := client.fetchCerts(provider.PublicKey())[0]
+
+	require.NoError(t, provider.Rotate())
+	certs := client.fetchCerts(provider.PublicKey())
+	require.Len(t, certs, 2)
+	assert.Greater(t, certs[0].serial, old.serial)
+	assert.Equal(t, old.magic, certs[1].magic)
+
+	// Clients holding the previous certificate are still answered
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	assert.Len(t, client.exchange(old, req, 0).Answer, 1)
+
+	require.NoError(t, provider.Rotate())
+	assert.Nil(t, provider.lookup(old.magic[:]), "certificates older than the previous one should be dropped")
+	assert.Len(t, provider.Certificates(), 2)
+}
+
+func TestNewProvider_PersistsKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "dnscrypt", "provider.key")
+
+	first, err := NewProvider(testProvider, keyFile, time.Hour)
+	require.NoError(t, err)
+	second, err := NewProvider(testProvider, keyFile, time.Hour)
+	require.NoError(t, err)
+
+	assert.Equal(t, first.PublicKey(), second.PublicKey())
+	assert.Equal(t, testProvider+".", second.Name())
+}
+
+func TestProviderName(t *testing.T) {
+	assert.Equal(t, "2.dnscrypt-cert.example.com", ProviderName("example.com"))
+	assert.Equal(t, "2.dnscrypt-cert.example.com", ProviderName("2.dnscrypt-cert.Example.com."))
+}
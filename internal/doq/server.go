@@ -0,0 +1,284 @@
+// Package doq implements a DNS-over-QUIC (RFC 9250) server that hands each
+// query to a regular miekg/dns handler, so it can share the dispatcher used by
+// the UDP, TCP and DoT listeners.
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the TLS application protocol negotiated by DoQ clients.
+const ALPN = "doq"
+
+// Error codes from RFC 9250 section 4.3.
+const (
+	ErrorNoError          = 0x0
+	ErrorInternal         = 0x1
+	ErrorProtocol         = 0x2
+	ErrorRequestCancelled = 0x3
+)
+
+const (
+	defaultIdleTimeout = 30 * time.Second
+	streamTimeout      = 10 * time.Second
+)
+
+type Server struct {
+	// Addr is the UDP address to listen on, e.g. ":853".
+	Addr string
+	// Net is "udp" (the default), "udp4" or "udp6".
+	Net string
+	// TLSConfig provides the certificate; its NextProtos are replaced with
+	// the DoQ ALPN.
+	TLSConfig *tls.Config
+	// Handler is invoked for every query received on a stream.
+	Handler dns.Handler
+	// IdleTimeout closes connections without activity. Defaults to 30s.
+	IdleTimeout time.Duration
+	Logger      *slog.Logger
+
+	mu        sync.Mutex
+	transport *quic.Transport
+	listener  *quic.Listener
+	conns     map[*quic.Conn]struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// ListenAndServe listens on the configured UDP address and serves DoQ
+// connections until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	if s.TLSConfig == nil {
+		return errors.New("DoQ server requires a TLS configuration")
+	}
+
+	tlsConfig := s.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{ALPN}
+
+	idleTimeout := s.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	network := s.Net
+	if network == "" {
+		network = "udp"
+	}
+	conn, err := net.ListenPacket(network, s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to create DoQ listener")
+	}
+	transport := &quic.Transport{Conn: conn}
+	listener, err := transport.Listen(tlsConfig, &quic.Config{
+		MaxIdleTimeout: idleTimeout,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return errors.Wrap(err, "failed to create DoQ listener")
+	}
+
+	s.mu.Lock()
+	s.transport = transport
+	s.mu.Unlock()
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener until Shutdown is called.
+func (s *Server) Serve(listener *quic.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.conns = make(map[*quic.Conn]struct{})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return errors.Wrap(err, "failed to accept DoQ connection")
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// Shutdown stops accepting connections and closes the open ones.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return errors.New("DoQ server is not running")
+	}
+
+	s.cancel()
+	for conn := range s.conns {
+		_ = conn.CloseWithError(ErrorNoError, "")
+	}
+	if err := s.listener.Close(); err != nil {
+		return err
+	}
+	if s.transport == nil {
+		return nil
+	}
+	// The transport does not own the UDP socket created by ListenAndServe
+	_ = s.transport.Close()
+	return s.transport.Conn.Close()
+}
+
+func (s *Server) serveConn(ctx context.Context, conn *quic.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			// Idle timeouts and client-initiated closes end up here
+			return
+		}
+		go s.serveStream(conn, stream)
+	}
+}
+
+func (s *Server) serveStream(conn *quic.Conn, stream *quic.Stream) {
+	_ = stream.SetDeadline(time.Now().Add(streamTimeout))
+
+	req, err := readMsg(stream)
+	if err != nil {
+		s.logger().Debug("failed to read DoQ query", "remote_addr", conn.RemoteAddr(), "error", err)
+		stream.CancelRead(ErrorProtocol)
+		stream.CancelWrite(ErrorProtocol)
+		return
+	}
+
+	// RFC 9250 4.2.1: the message ID must be zero, anything else is a
+	// protocol error that closes the connection.
+	if req.Id != 0 {
+		_ = conn.CloseWithError(ErrorProtocol, "non-zero message ID")
+		return
+	}
+
+	writer := &responseWriter{conn: conn, stream: stream}
+	s.Handler.ServeDNS(writer, req)
+
+	if !writer.written {
+		// The handler chose not to answer
+		stream.CancelWrite(ErrorRequestCancelled)
+	}
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// readMsg reads a single length-prefixed DNS message from the stream.
+func readMsg(r io.Reader) (*dns.Msg, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, errors.Wrap(err, "failed to read message length")
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Wrap(err, "failed to read message")
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, errors.Wrap(err, "failed to parse message")
+	}
+	return msg, nil
+}
+
+// responseWriter adapts a QUIC stream to the miekg/dns ResponseWriter, so
+// that the DoQ listener can share the handler of the other listeners.
+type responseWriter struct {
+	conn    *quic.Conn
+	stream  *quic.Stream
+	written bool
+}
+
+func (w *responseWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+func (w *responseWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+// ConnectionState implements dns.ConnectionStater, exposing the TLS state
+// (e.g. the server name) of the QUIC connection.
+func (w *responseWriter) ConnectionState() *tls.ConnectionState {
+	state := w.conn.ConnectionState().TLS
+	return &state
+}
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	// Responses must echo the zero message ID of the query
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		w.stream.CancelWrite(ErrorInternal)
+		return errors.Wrap(err, "failed to pack DoQ response")
+	}
+	_, err = w.Write(packed)
+	return err
+}
+
+// Write sends a raw DNS message with its length prefix, and closes the
+// stream as only one response is allowed per query.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.written {
+		return 0, errors.New("DoQ response already written")
+	}
+	w.written = true
+
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	if _, err := w.stream.Write(buf); err != nil {
+		return 0, errors.Wrap(err, "failed to write DoQ response")
+	}
+	return len(b), w.stream.Close()
+}
+
+func (w *responseWriter) Close() error {
+	return w.conn.CloseWithError(ErrorNoError, "")
+}
+
+func (w *responseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *responseWriter) TsigTimersOnly(bool) {
+
+}
+
+func (w *responseWriter) Hijack() {
+
+}
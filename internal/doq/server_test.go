@@ -0,0 +1,164 @@
+package doq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func startServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	tlsConfig := selfSignedTLSConfig(t)
+	tlsConfig.NextProtos = []string{ALPN}
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	require.NoError(t, err)
+
+	server := &Server{TLSConfig: tlsConfig, Handler: handler}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+
+	t.Cleanup(func() {
+		require.Eventually(t, func() bool { return server.Shutdown() == nil }, time.Second, 10*time.Millisecond)
+		assert.NoError(t, <-done)
+	})
+
+	return listener.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *quic.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPN}}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.CloseWithError(ErrorNoError, "") })
+	return conn
+}
+
+func exchange(t *testing.T, conn *quic.Conn, req *dns.Msg) (*dns.Msg, error) {
+	t.Helper()
+	stream, err := conn.OpenStreamSync(t.Context())
+	require.NoError(t, err)
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	packed, err := req.Pack()
+	require.NoError(t, err)
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	_, err = stream.Write(append(buf, packed...))
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+
+	resp, err := readMsg(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server must close its side of the stream after the response
+	_, err = stream.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	return resp, nil
+}
+
+func answerHandler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{host},
+	})
+	_ = w.WriteMsg(m)
+}
+
+func TestServer_Exchange(t *testing.T) {
+	addr := startServer(t, answerHandler)
+	conn := dial(t, addr)
+
+	// Several queries share one connection, one stream each
+	for _, name := range []string{"example.com.", "example.org."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeTXT)
+		req.Id = 0
+
+		resp, err := exchange(t, conn, req)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(0), resp.Id)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, name, resp.Answer[0].Header().Name)
+		assert.Equal(t, []string{"127.0.0.1"}, resp.Answer[0].(*dns.TXT).Txt, "handler should see the client address")
+	}
+}
+
+func TestServer_NonZeroMessageID(t *testing.T) {
+	addr := startServer(t, answerHandler)
+	conn := dial(t, addr)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	req.Id = 1234
+
+	_, err := exchange(t, conn, req)
+	require.Error(t, err)
+
+	var appErr *quic.ApplicationError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, quic.ApplicationErrorCode(ErrorProtocol), appErr.ErrorCode)
+}
+
+func TestServer_HandlerWithoutResponse(t *testing.T) {
+	addr := startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	conn := dial(t, addr)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	req.Id = 0
+
+	_, err := exchange(t, conn, req)
+	require.Error(t, err)
+
+	var streamErr *quic.StreamError
+	require.ErrorAs(t, err, &streamErr)
+	assert.Equal(t, quic.StreamErrorCode(ErrorRequestCancelled), streamErr.ErrorCode)
+}
+
+func TestServer_ListenAndServeRequiresTLS(t *testing.T) {
+	server := &Server{Addr: "127.0.0.1:0", Handler: dns.HandlerFunc(answerHandler)}
+	assert.ErrorContains(t, server.ListenAndServe(), "requires a TLS configuration")
+}
@@ -0,0 +1,90 @@
+package forwarder
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rm-hull/dot-block/internal/config"
+)
+
+// listenerACL restricts the clients that may query each listener, so that
+// e.g. the plain DNS port can be enabled for the LAN without becoming an open
+// resolver.
+type listenerACL struct {
+	networks map[DNSSource][]netip.Prefix
+}
+
+func newListenerACL(cfg *config.ListenersConfig) (*listenerACL, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	acl := &listenerACL{networks: make(map[DNSSource][]netip.Prefix)}
+	for _, listener := range []struct {
+		cfg     *config.ListenerConfig
+		sources []DNSSource
+	}{
+		{cfg.DNS, []DNSSource{SourceUDP, SourceTCP}},
+		{cfg.DoT, []DNSSource{SourceDoT}},
+		{cfg.DoQ, []DNSSource{SourceDoQ}},
+		{cfg.DNSCrypt, []DNSSource{SourceDNSCrypt}},
+		{cfg.HTTP, []DNSSource{SourceDoH}},
+	} {
+		if listener.cfg == nil || len(listener.cfg.AllowedNetworks) == 0 {
+			continue
+		}
+		prefixes, err := parseNetworks(listener.cfg.AllowedNetworks)
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range listener.sources {
+			acl.networks[source] = prefixes
+		}
+	}
+
+	if len(acl.networks) == 0 {
+		return nil, nil
+	}
+	return acl, nil
+}
+
+// parseNetworks parses a list of CIDR ranges and single IP addresses.
+func parseNetworks(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		if prefix, err := netip.ParsePrefix(network); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(network)
+		if err != nil {
+			return nil, errors.Newf("invalid allowed network %q (expected an IP address or CIDR range)", network)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// allows returns whether the client may query the listener. Listeners without
+// allowed networks accept any client, while clients whose address is not
+// known are refused by those that have them.
+func (a *listenerACL) allows(source DNSSource, ipAddr string) bool {
+	if a == nil {
+		return true
+	}
+	prefixes, ok := a.networks[source]
+	if !ok {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ipAddr)
+	if err != nil {
+		return false
+	}
+	addr = addr.WithZone("").Unmap()
+	return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
@@ -0,0 +1,55 @@
+package forwarder
+
+import (
+	"testing"
+
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerACL_Allows(t *testing.T) {
+	acl, err := newListenerACL(&config.ListenersConfig{
+		DNS:  &config.ListenerConfig{AllowedNetworks: []string{"192.168.0.0/16", "fd00::/8", "203.0.113.7"}},
+		DoT:  &config.ListenerConfig{AllowedNetworks: []string{}},
+		HTTP: &config.ListenerConfig{AllowedNetworks: []string{"10.0.0.0/8"}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		source  DNSSource
+		ipAddr  string
+		allowed bool
+	}{
+		{SourceUDP, "192.168.1.20", true},
+		{SourceTCP, "192.168.1.20", true},
+		{SourceUDP, "::ffff:192.168.1.20", true},
+		{SourceUDP, "fd12:3456::1", true},
+		{SourceUDP, "203.0.113.7", true},
+		{SourceUDP, "203.0.113.8", false},
+		{SourceTCP, "8.8.8.8", false},
+		{SourceUDP, "2001:db8::1", false},
+		{SourceUDP, "unknown", false},
+		{SourceDoT, "8.8.8.8", true},
+		{SourceDoQ, "8.8.8.8", true},
+		{SourceDoH, "10.1.2.3", true},
+		{SourceDoH, "8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, acl.allows(tt.source, tt.ipAddr), "%s %s", tt.source, tt.ipAddr)
+	}
+}
+
+func TestListenerACL_NoneConfigured(t *testing.T) {
+	acl, err := newListenerACL(config.DefaultConfig().Server.Listeners)
+	require.NoError(t, err)
+	assert.Nil(t, acl)
+	assert.True(t, acl.allows(SourceUDP, "8.8.8.8"))
+}
+
+func TestListenerACL_InvalidNetwork(t *testing.T) {
+	_, err := newListenerACL(&config.ListenersConfig{
+		DNS: &config.ListenerConfig{AllowedNetworks: []string{"192.168.0.0/33"}},
+	})
+	assert.ErrorContains(t, err, "192.168.0.0/33")
+}
@@ -76,7 +76,7 @@ func setupDispatcherBench(b *testing.B, upstream string, enableECS bool) *DNSDis
 		NXDOMAINThreshold:  0.8,
 		ReapInterval:       time.Minute,
 		IdleTTL:            10 * time.Minute,
-	}, dnsMetrics)
+	}, dnsMetrics, nil, nil, nil)
 	require.NoError(b, err)
 
 	dispatcher, err := NewDNSDispatcher(
@@ -84,7 +84,7 @@ func setupDispatcherBench(b *testing.B, upstream string, enableECS bool) *DNSDis
 		[]*blocklist.BlockList{blockList},
 		noisefilter.NewNoiseFilter(),
 		sse.NewBroadcaster(logger, dnsMetrics.DroppedSSEEvents),
-		1*time.Minute, logger, enableECS, rateLimiter,
+		newTestDNSConfig(1*time.Minute, enableECS), nil, logger, rateLimiter, nil,
 	)
 	require.NoError(b, err)
 	b.Cleanup(dispatcher.Close)
@@ -188,6 +188,8 @@ func BenchmarkDNSDispatcher(b *testing.B) {
 	b.Run("ReservedTLD", benchmarkReservedTLD)
 	b.Run("MultipleQuestions", benchmarkMultipleQuestions)
 	b.Run("ECS", benchmarkECS)
+	b.Run("CacheHitECS", benchmarkCacheHitECS)
+	b.Run("CacheHitECSIPv6", benchmarkCacheHitECSIPv6)
 }
 
 func benchmarkCacheHit(b *testing.B) {
@@ -350,6 +352,32 @@ func benchmarkECS(b *testing.B) {
 	}
 }
 
+// benchmarkCacheHitECSFrom measures cache hits on an answer that upstream did
+// not scope to the client subnet, as most are.
+func benchmarkCacheHitECSFrom(b *testing.B, ip string) {
+	server, upstream := startLocalDNSBench(b, anyRecordHandler())
+	defer func() { _ = server.Shutdown() }()
+
+	dispatcher := setupDispatcherBench(b, upstream, true)
+	prePopulateCache(b, dispatcher, "example.com.", []byte{93, 184, 216, 34})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	for b.Loop() {
+		writer := &benchResponseWriter{ip: ip, port: 12345}
+		dispatcher.HandleDNSRequest("test")(writer, req)
+	}
+}
+
+func benchmarkCacheHitECS(b *testing.B) {
+	benchmarkCacheHitECSFrom(b, "1.2.3.4")
+}
+
+func benchmarkCacheHitECSIPv6(b *testing.B) {
+	benchmarkCacheHitECSFrom(b, "2001:db8::1")
+}
+
 func BenchmarkDNSDispatcherConcurrent(b *testing.B) {
 	server, upstream := startLocalDNSBench(b, anyRecordHandler())
 	defer func() { _ = server.Shutdown() }()
@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/miekg/dns"
 	"github.com/rm-hull/dot-block/internal/blocklist"
+	"github.com/rm-hull/dot-block/internal/clients"
+	"github.com/rm-hull/dot-block/internal/config"
 	"github.com/rm-hull/dot-block/internal/http/sse"
 	"github.com/rm-hull/dot-block/internal/limiter"
 	"github.com/rm-hull/dot-block/internal/metrics"
@@ -29,10 +33,18 @@ const (
 type DNSSource string
 
 const (
-	SourceUDP DNSSource = "UDP"
-	SourceTCP DNSSource = "TCP"
-	SourceDoT DNSSource = "DoT"
-	SourceDoH DNSSource = "DoH"
+	SourceUDP      DNSSource = "UDP"
+	SourceTCP      DNSSource = "TCP"
+	SourceDoT      DNSSource = "DoT"
+	SourceDoH      DNSSource = "DoH"
+	SourceDoQ      DNSSource = "DoQ"
+	SourceDNSCrypt DNSSource = "DNSCrypt"
+	// SourceODoH queries arrive via an Oblivious DoH relay, so by design
+	// the client's IP address is not known.
+	SourceODoH DNSSource = "ODoH"
+	// SourceInternal queries are made by dot-block itself, e.g. to look up
+	// its own addresses.
+	SourceInternal DNSSource = "Internal"
 )
 
 var (
@@ -46,25 +58,47 @@ type RequestContext struct {
 	snapshot *metrics.RequestSnapshot
 	logger   *slog.Logger
 	ipAddr   string
-	subnet   string
+	clientID string
+	source   DNSSource
+	ecs      netip.Prefix
+	ecsScope int
+	secure   bool
+	// localNXDOMAIN is set when water torture mitigation answered NXDOMAIN
+	// locally, which does not count towards NXDOMAIN-flood detection.
+	localNXDOMAIN bool
+}
+
+// nxdomainExempter is implemented by response writers whose results are
+// recorded for NXDOMAIN-flood detection elsewhere (i.e. DoH), to be told when
+// an NXDOMAIN must not count.
+type nxdomainExempter interface {
+	ExemptNXDOMAIN()
 }
 
 type DispatcherFunc func(writer dns.ResponseWriter, req *dns.Msg)
 
 type DNSDispatcher struct {
-	dnsClient   *RoundRobinClient
-	defaultTTL  float64
-	ttlFloor    time.Duration
-	cache       *DNSCache
-	blockLists  []*blocklist.BlockList
-	metrics     *metrics.DnsMetrics
-	logger      *slog.Logger
-	noiseFilter *noisefilter.NoiseFilter
-	broadcaster *sse.Broadcaster
-	enableECS   bool
-	limiter     *limiter.Limiter
-	snapshotCh  chan *metrics.RequestSnapshot
-	done        chan struct{}
+	dnsClient    *RoundRobinClient
+	defaultTTL   float64
+	ttlFloor     time.Duration
+	cache        *DNSCache
+	blockLists   []*blocklist.BlockList
+	metrics      *metrics.DnsMetrics
+	logger       *slog.Logger
+	noiseFilter  *noisefilter.NoiseFilter
+	broadcaster  *sse.Broadcaster
+	ecs          *ecsPolicy
+	blockAnswer  bool
+	rebinding    *rebindingGuard
+	validator    *dnssecValidator
+	qtypes       *queryTypePolicy
+	acl          *listenerACL
+	waterTorture *waterTortureGuard
+	shedder      *loadShedder
+	limiter      *limiter.Limiter
+	clients      *clients.Registry
+	snapshotCh   chan *metrics.RequestSnapshot
+	done         chan struct{}
 }
 
 func NewDNSDispatcher(
@@ -74,37 +108,89 @@ func NewDNSDispatcher(
 	blockLists []*blocklist.BlockList,
 	noiseFilter *noisefilter.NoiseFilter,
 	broadcaster *sse.Broadcaster,
-	ttlFloor time.Duration,
+	cfg *config.DNSConfig,
+	listeners *config.ListenersConfig,
 	logger *slog.Logger,
-	enableECS bool,
 	rateLimiter *limiter.Limiter,
+	clientRegistry *clients.Registry,
 ) (*DNSDispatcher, error) {
 
+	var ttlFloor time.Duration
+	if cfg.Cache != nil {
+		ttlFloor = cfg.Cache.TtlFloor
+	}
 	if ttlFloor < 0 {
 		return nil, errors.New("TTL floor cannot be negative")
 	}
 
+	ecs, err := newECSPolicy(cfg.ECS)
+	if err != nil {
+		return nil, err
+	}
+
+	blockAnswer := cfg.ResponseBlocking != nil && cfg.ResponseBlocking.Enabled
+
+	rebinding, err := newRebindingGuard(cfg.Rebinding)
+	if err != nil {
+		return nil, err
+	}
+
+	shedder, err := newLoadShedder(cfg.LoadShedding, dnsMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validation fetches are upstream queries too. They never nest within the
+	// slot of the query being validated, which is released beforehand.
+	validator, err := newDNSSECValidator(cfg.DNSSEC, cache, shedder.limit(dnsClient.Exchange), logger)
+	if err != nil {
+		return nil, err
+	}
+
+	qtypes, err := newQueryTypePolicy(cfg.QueryTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := newListenerACL(listeners)
+	if err != nil {
+		return nil, err
+	}
+
+	waterTorture, err := newWaterTortureGuard(cfg.WaterTorture)
+	if err != nil {
+		return nil, err
+	}
+
 	d := &DNSDispatcher{
-		dnsClient:   dnsClient,
-		defaultTTL:  300, // TODO: pass in
-		ttlFloor:    ttlFloor,
-		cache:       cache,
-		blockLists:  blockLists,
-		metrics:     dnsMetrics,
-		logger:      logger,
-		noiseFilter: noiseFilter,
-		broadcaster: broadcaster,
-		enableECS:   enableECS,
-		limiter:     rateLimiter,
-		snapshotCh:  make(chan *metrics.RequestSnapshot, SNAPSHOT_BUFFER_SIZE),
-		done:        make(chan struct{}),
+		dnsClient:    dnsClient,
+		defaultTTL:   300, // TODO: pass in
+		ttlFloor:     ttlFloor,
+		cache:        cache,
+		blockLists:   blockLists,
+		metrics:      dnsMetrics,
+		logger:       logger,
+		noiseFilter:  noiseFilter,
+		broadcaster:  broadcaster,
+		ecs:          ecs,
+		blockAnswer:  blockAnswer,
+		rebinding:    rebinding,
+		validator:    validator,
+		qtypes:       qtypes,
+		acl:          acl,
+		waterTorture: waterTorture,
+		shedder:      shedder,
+		limiter:      rateLimiter,
+		clients:      clientRegistry,
+		snapshotCh:   make(chan *metrics.RequestSnapshot, SNAPSHOT_BUFFER_SIZE),
+		done:         make(chan struct{}),
 	}
 
 	for range NUM_WORKERS {
 		go d.snapshotWorker()
 	}
 
-	logger.Info("DNS dispatcher initialized", "num_snapshot_workers", NUM_WORKERS, "enable_ecs", enableECS)
+	logger.Info("DNS dispatcher initialized", "num_snapshot_workers", NUM_WORKERS, "enable_ecs", ecs != nil, "response_blocking", blockAnswer, "rebinding_protection", rebinding != nil, "dnssec_validation", validator != nil, "listener_acl", acl != nil, "water_torture_detection", waterTorture != nil, "load_shedding", shedder != nil)
 	return d, nil
 }
 
@@ -128,58 +214,75 @@ func (d *DNSDispatcher) HandleDNSRequest(source DNSSource) DispatcherFunc {
 			return
 		}
 
-		remoteAddr := writer.RemoteAddr().String()
-		ipAddr, _, err := net.SplitHostPort(remoteAddr)
-		if err != nil {
-			d.logger.Warn("failed to parse client IP from remote address",
-				"remote_addr", remoteAddr,
-				"source", source,
-				"error", err)
+		ipAddr := "unknown"
+		if source != SourceODoH && source != SourceInternal {
+			remoteAddr := writer.RemoteAddr().String()
+			host, _, err := net.SplitHostPort(remoteAddr)
+			if err != nil {
+				d.logger.Warn("failed to parse client IP from remote address",
+					"remote_addr", remoteAddr,
+					"source", source,
+					"error", err)
+			} else {
+				ipAddr = host
+			}
+		}
 
-			ipAddr = "unknown" // Fallback to "unknown" if IP parsing fails
+		// Listener ACL and rate limit checks — do these as early as possible
+		// (before any tracing or setup work) so rejected traffic costs as
+		// little as possible.
+		if source != SourceODoH && source != SourceInternal && !d.acl.allows(source, ipAddr) {
+			d.logger.Debug("client not in listener's allowed networks", "ip", ipAddr, "source", source)
+			d.metrics.ACLRefused.WithLabelValues(string(source)).Inc()
+			d.reject(writer, req, source)
+			return
 		}
 
-		// Rate limit check — do this as early as possible (before any tracing
-		// or setup work) so rejected traffic costs as little as possible.
-		// DoH queries are handled by the Gin middleware instead.
+		// DoH queries are rate limited by the Gin middleware instead.
 		shouldRateLimit := ipAddr != "unknown" && source != SourceDoH
 		if shouldRateLimit {
 			if ok, reason := d.limiter.Allow(ipAddr); !ok {
 				d.logger.Debug("client rate limited", "ip", ipAddr, "source", source, "reason", reason)
-				if source != SourceUDP {
-					// TCP/DoT: send REFUSED so the client knows to back off.
-					// (A banned source address is provably reachable for TCP.)
-					refused := d.newReply(req)
-					refused.Rcode = dns.RcodeRefused
-					_ = writer.WriteMsg(refused)
-				}
-				// UDP: silent drop to avoid amplification via spoofed-source replies.
+				d.reject(writer, req, source)
 				return
 			}
 		}
 
+		// Named clients are identified by the DoH path or the TLS server name,
+		// but rate limiting stays keyed on the IP address, as client IDs are
+		// chosen by the clients themselves.
+		clientID := d.clients.Track(writer, ipAddr)
+
 		// Start root span for the request
 		tracer := telemetry.GetTracer("dns-dispatcher")
 		ctx, span := tracer.Start(context.Background(), "HandleDNSRequest",
 			trace.WithAttributes(
 				attribute.String("client_ip", ipAddr),
+				attribute.String("client", clientID),
 				attribute.String("source", string(source)),
 				attribute.Int("request_id", int(req.Id)),
 			),
 		)
 		defer span.End()
 
+		logger := d.logger.With("client_ip", ipAddr, "request_id", req.Id, "source", source)
+		if clientID != "" {
+			logger = logger.With("client", clientID)
+		}
 		requestCtx := &RequestContext{
 			ctx:      ctx,
 			req:      req,
-			logger:   d.logger.With("client_ip", ipAddr, "request_id", req.Id, "source", source),
+			logger:   logger,
 			snapshot: metrics.NewRequestSnapshot(time.Now(), string(source), ipAddr),
 			ipAddr:   ipAddr,
-			subnet:   d.computeSubnet(ipAddr),
+			clientID: clientID,
+			source:   source,
 		}
+		requestCtx.snapshot.SetClient(clientID)
 		if len(req.Question) > 0 {
 			requestCtx.snapshot.SetPrimaryDomain(req.Question[0].Name)
 			requestCtx.snapshot.SetQueryType(getQueryType(&req.Question[0]))
+			requestCtx.ecs = d.ecs.subnet(ipAddr, req, req.Question[0].Name)
 		}
 
 		defer func() {
@@ -192,71 +295,150 @@ func (d *DNSDispatcher) HandleDNSRequest(source DNSSource) DispatcherFunc {
 
 		resp := d.newReply(req)
 
+		// RFC 9619: a query carries exactly one question. Most resolvers answer
+		// anything else with FORMERR, and so do we.
+		if len(req.Question) != 1 {
+			requestCtx.logger.DebugContext(ctx, "Rejecting query without exactly one question", "count", len(req.Question))
+			resp.Rcode = dns.RcodeFormatError
+			d.sendResponse(requestCtx, writer, resp)
+			return
+		}
+
 		// Record the rate-limiting result (for NXDOMAIN-flood detection)
 		// after the response has been constructed. Skipped for DoH — the
-		// Gin middleware handles RecordResult for HTTP clients.
-		if shouldRateLimit {
-			defer func() {
-				d.limiter.RecordResult(ipAddr, resp.Rcode == dns.RcodeNameError)
-			}()
+		// Gin middleware handles RecordResult for HTTP clients. NXDOMAINs
+		// answered locally by water torture mitigation are not counted: the
+		// clients sending those queries are mostly resolvers relaying the
+		// attack, not its source.
+		defer func() {
+			if shouldRateLimit {
+				d.limiter.RecordResult(ipAddr, resp.Rcode == dns.RcodeNameError && !requestCtx.localNXDOMAIN)
+			} else if exempter, ok := writer.(nxdomainExempter); ok && requestCtx.localNXDOMAIN {
+				exempter.ExemptNXDOMAIN()
+			}
+		}()
+
+		q := req.Question[0]
+		res, err := d.processQuestion(requestCtx, &q)
+		if err != nil {
+			resp.Rcode = dns.RcodeServerFailure
+			d.sendResponse(requestCtx, writer, resp)
+			return
 		}
 
-		unansweredQuestions := make([]dns.Question, 0, len(req.Question))
+		// Add authority and extra records before checking rcode,
+		// so cached NXDOMAIN responses can include the SOA in authority
+		mergeAuthorityAndExtra(resp, res)
 
-		for _, q := range req.Question {
-			res, err := d.processQuestion(requestCtx, &q)
-			if err != nil {
-				resp.Rcode = dns.RcodeServerFailure
-				d.sendResponse(requestCtx, writer, resp)
-				return
-			}
+		if res.rcode != dns.RcodeSuccess {
+			resp.Rcode = res.rcode
+			d.sendResponse(requestCtx, writer, resp)
+			return
+		}
 
-			// Add authority and extra records before checking rcode,
-			// so cached NXDOMAIN responses can include the SOA in authority
-			if len(res.authority) > 0 {
-				resp.Ns = append(resp.Ns, res.authority...)
-			}
+		resp.Answer = append(resp.Answer, res.answer...)
+		if len(res.answer) > 0 || res.fromCache || len(res.authority) > 0 || len(res.extra) > 0 || isDNSSDQuery(q.Name) {
+			d.sendResponse(requestCtx, writer, resp)
+			return
+		}
 
-			if len(res.extra) > 0 {
-				for _, rr := range res.extra {
-					if opt, ok := rr.(*dns.OPT); ok {
-						if existingOpt := resp.IsEdns0(); existingOpt != nil {
-							existingOpt.Option = append(existingOpt.Option, opt.Option...)
-						} else {
-							resp.Extra = append(resp.Extra, opt)
-						}
-					} else {
-						resp.Extra = append(resp.Extra, rr)
-					}
-				}
+		rcode, answers, err := d.resolveUpstream(requestCtx, q, req)
+		if err == nil || rcode == dns.RcodeNameError {
+			d.recordWaterTorture(requestCtx, &q, rcode)
+		}
+		if errors.Is(err, ErrOverloaded) {
+			requestCtx.logger.DebugContext(requestCtx.ctx, "Shedding query, upstream overloaded", "name", q.Name)
+			requestCtx.snapshot.SetErrorCategory("overloaded")
+			resp.Rcode = rcode
+			mergeAuthorityAndExtra(resp, QuestionResolution{extra: d.edeExtra(requestCtx, &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeOther,
+				ExtraText: "Server overloaded: answering from cache only",
+			})})
+			d.sendResponse(requestCtx, writer, resp)
+			return
+		}
+		if err != nil {
+			resp.Rcode = rcode
+			errorCategory := "upstream"
+			var dnssecErr *DNSSECError
+			if errors.As(err, &dnssecErr) {
+				errorCategory = "dnssec"
+				mergeAuthorityAndExtra(resp, QuestionResolution{extra: d.edeExtra(requestCtx, &dns.EDNS0_EDE{
+					InfoCode:  dns.ExtendedErrorCodeDNSBogus,
+					ExtraText: dnssecErr.Err.Error(),
+				})})
 			}
+			d.reportError(requestCtx, errorCategory, err, q.Name, "qtype", getQueryType(&q))
+			d.sendResponse(requestCtx, writer, resp)
+			return
+		}
 
+		// Inspect the upstream answer chain, so that CNAME-cloaked trackers
+		// are blocked even though the question name itself is not on any
+		// blocklist.
+		qAnswers := extractAnswersForQuestion(q, answers)
+		res, blocked, err := d.inspectAnswers(requestCtx, &q, qAnswers)
+		if err != nil {
+			resp.Rcode = dns.RcodeServerFailure
+			d.sendResponse(requestCtx, writer, resp)
+			return
+		}
+		if blocked {
+			resp.Answer = nil
+			mergeAuthorityAndExtra(resp, res)
+			d.sendResponse(requestCtx, writer, resp)
+			return
+		}
+
+		if res, removed := d.applyRebindingGuard(requestCtx, &q, qAnswers); len(removed) > 0 {
+			mergeAuthorityAndExtra(resp, res)
 			if res.rcode != dns.RcodeSuccess {
 				resp.Rcode = res.rcode
+				resp.Answer = nil
 				d.sendResponse(requestCtx, writer, resp)
 				return
 			}
-
-			if len(res.answer) > 0 {
-				resp.Answer = append(resp.Answer, res.answer...)
-			} else if !res.fromCache && len(res.authority) == 0 && len(res.extra) == 0 && !isDNSSDQuery(q.Name) {
-				unansweredQuestions = append(unansweredQuestions, q)
-			}
+			answers = slices.DeleteFunc(answers, func(rr dns.RR) bool {
+				return slices.Contains(removed, rr)
+			})
 		}
 
-		if len(unansweredQuestions) > 0 {
-			rcode, answers, err := d.resolveUpstream(requestCtx, unansweredQuestions, req)
-			if err != nil {
-				resp.Rcode = rcode
-				d.reportError(requestCtx, "upstream", err, unansweredQuestions[0].Name, "qtype", getQueryType(&unansweredQuestions[0]))
-				d.sendResponse(requestCtx, writer, resp)
-				return
-			}
+		resp.Answer = append(resp.Answer, answers...)
+		d.sendResponse(requestCtx, writer, resp)
+	}
+}
 
-			resp.Answer = append(resp.Answer, answers...)
-		}
+// reject answers a query refused before processing with REFUSED, so that the
+// client knows to back off (a source address is provably reachable for TCP).
+// UDP queries are silently dropped instead, to avoid amplification via
+// spoofed-source replies.
+func (d *DNSDispatcher) reject(writer dns.ResponseWriter, req *dns.Msg, source DNSSource) {
+	if source == SourceUDP {
+		return
+	}
+	refused := d.newReply(req)
+	refused.Rcode = dns.RcodeRefused
+	_ = writer.WriteMsg(refused)
+}
 
-		d.sendResponse(requestCtx, writer, resp)
+// mergeAuthorityAndExtra copies the authority and extra sections of a question
+// resolution into the response, folding any EDNS0 options into a single OPT
+// record.
+func mergeAuthorityAndExtra(resp *dns.Msg, res QuestionResolution) {
+	if len(res.authority) > 0 {
+		resp.Ns = append(resp.Ns, res.authority...)
+	}
+
+	for _, rr := range res.extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			if existingOpt := resp.IsEdns0(); existingOpt != nil {
+				existingOpt.Option = append(existingOpt.Option, opt.Option...)
+			} else {
+				resp.Extra = append(resp.Extra, opt)
+			}
+		} else {
+			resp.Extra = append(resp.Extra, rr)
+		}
 	}
 }
 
@@ -283,10 +465,13 @@ func (d *DNSDispatcher) snapshotWorker() {
 					Domain:    snapshot.PrimaryDomain(),
 					Result:    snapshot.Rcode(),
 					ClientIP:  snapshot.IPAddr(),
+					Client:    snapshot.Client(),
 					Source:    snapshot.Source(),
 					Blocked:   snapshot.IsBlocked(),
 					Cached:    snapshot.FromCache(),
 					Cause:     snapshot.BlockCause(),
+					Hop:       snapshot.BlockHop(),
+					Rebinding: snapshot.IsRebinding(),
 					Answers:   snapshot.AnswerCount(),
 					Timestamp: time.Now(),
 				}
@@ -323,6 +508,28 @@ func (d *DNSDispatcher) processQuestion(requestCtx *RequestContext, q *dns.Quest
 		"name", q.Name,
 		"type", queryType)
 
+	if d.qtypes.isZoneTransfer(q) {
+		requestCtx.logger.DebugContext(requestCtx.ctx, "Refusing zone transfer", "name", q.Name, "type", queryType)
+		requestCtx.snapshot.AddQueryCount(queryType, false)
+		return QuestionResolution{rcode: dns.RcodeRefused}, nil
+	}
+
+	if d.qtypes.isMinimalANY(q) {
+		requestCtx.logger.DebugContext(requestCtx.ctx, "Answering ANY with minimal response", "name", q.Name)
+		requestCtx.snapshot.AddQueryCount(queryType, false)
+		return QuestionResolution{answer: []dns.RR{minimalANYResponse(q, uint32(d.defaultTTL))}, rcode: dns.RcodeSuccess}, nil
+	}
+
+	if d.qtypes.isBlocked(q) {
+		requestCtx.logger.DebugContext(requestCtx.ctx, "Query type blocked by policy", "name", q.Name, "type", queryType)
+		requestCtx.snapshot.AddQueryCount(queryType, true)
+		ede := &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeFiltered,
+			ExtraText: fmt.Sprintf("Query type %s is blocked by policy", queryType),
+		}
+		return QuestionResolution{authority: []dns.RR{d.syntheticSOA(q.Name)}, extra: d.edeExtra(requestCtx, ede), rcode: dns.RcodeSuccess}, nil
+	}
+
 	isBlocked, cause, err := d.isBlocked(q.Name)
 	if err != nil {
 		span.RecordError(err)
@@ -332,7 +539,8 @@ func (d *DNSDispatcher) processQuestion(requestCtx *RequestContext, q *dns.Quest
 	}
 
 	if isBlocked {
-		return d.constructBlockedResponse(requestCtx, q, queryType, cause), nil
+		requestCtx.snapshot.AddQueryCount(queryType, true)
+		return d.constructBlockedResponse(requestCtx, q, q.Name, cause), nil
 	}
 
 	if isReservedLocalhost(q.Name) {
@@ -362,32 +570,120 @@ func (d *DNSDispatcher) processQuestion(requestCtx *RequestContext, q *dns.Quest
 
 	requestCtx.snapshot.AddDomain(q.Name)
 	requestCtx.snapshot.AddQueryCount(queryType, false)
-	if cachedRRs, ok := d.cache.Get(getCacheKey(q, requestCtx.subnet)); ok {
+	if cachedRRs, ok := d.cachedAnswer(requestCtx, q); ok {
 		span.SetAttributes(attribute.Bool("dns.cache_hit", true))
 		requestCtx.snapshot.SetFromCache(true)
 
+		// With DNSSEC validation enabled, only secure answers are cached with
+		// their signatures, so their presence marks the answer as validated.
+		requestCtx.secure = d.validator != nil && hasDNSSECRecords(cachedRRs)
+
 		// Check if this is a cached NXDOMAIN response
 		// (SOA record stored as a marker for NXDOMAIN)
 		for _, rr := range cachedRRs {
-			if soa, isSOA := rr.(*dns.SOA); isSOA {
-				return QuestionResolution{authority: []dns.RR{soa}, rcode: dns.RcodeNameError, fromCache: true}, nil
+			if _, isSOA := rr.(*dns.SOA); isSOA {
+				return QuestionResolution{authority: cachedRRs, rcode: dns.RcodeNameError, fromCache: true}, nil
 			}
 		}
 
+		// Answers are cached unfiltered, so the chain is re-inspected on every
+		// hit: a blocklist reload may have added one of the hops since.
+		res, blocked, err := d.inspectAnswers(requestCtx, q, cachedRRs)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return res, err
+		}
+		if blocked {
+			res.fromCache = true
+			return res, nil
+		}
+
+		if res, removed := d.applyRebindingGuard(requestCtx, q, cachedRRs); len(removed) > 0 {
+			res.fromCache = true
+			return res, nil
+		}
+
 		return QuestionResolution{answer: cachedRRs, rcode: dns.RcodeSuccess, fromCache: true}, nil
 	}
 
+	if res, mitigated := d.applyWaterTortureMitigation(requestCtx, q); mitigated {
+		return res, nil
+	}
+
 	return QuestionResolution{rcode: dns.RcodeSuccess}, nil
 }
 
-func (d *DNSDispatcher) constructBlockedResponse(requestCtx *RequestContext, q *dns.Question, queryType string, cause *blocklist.BlockList) QuestionResolution {
-	requestCtx.logger.DebugContext(requestCtx.ctx, "Domain blocked", "name", q.Name, "cause", cause.Name())
-	requestCtx.snapshot.AddBlockedDomain(q.Name, cause.Name())
-	requestCtx.snapshot.AddQueryCount(queryType, true)
+// inspectAnswers checks every CNAME target and A/AAAA address in the answer
+// chain for a question against the blocklists. If any hop is blocked, a
+// blocked resolution is returned that replaces the whole answer.
+func (d *DNSDispatcher) inspectAnswers(requestCtx *RequestContext, q *dns.Question, answers []dns.RR) (QuestionResolution, bool, error) {
+	if !d.blockAnswer {
+		return QuestionResolution{}, false, nil
+	}
+
+	for _, rr := range answers {
+		var hop string
+		var isBlocked bool
+		var cause *blocklist.BlockList
+		var err error
+
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			hop = v.Target
+			isBlocked, cause, err = d.isBlocked(v.Target)
+		case *dns.A:
+			hop = v.A.String()
+			isBlocked, cause, err = d.isBlockedIP(v.A)
+		case *dns.AAAA:
+			hop = v.AAAA.String()
+			isBlocked, cause, err = d.isBlockedIP(v.AAAA)
+		default:
+			continue
+		}
+
+		if err != nil {
+			d.reportError(requestCtx, "blocklist", err, q.Name, "qtype", getQueryType(q), "hop", hop)
+			return QuestionResolution{rcode: dns.RcodeServerFailure}, false, err
+		}
+
+		if isBlocked {
+			return d.constructBlockedResponse(requestCtx, q, hop, cause), true, nil
+		}
+	}
+
+	return QuestionResolution{}, false, nil
+}
+
+// constructBlockedResponse builds the SOA + EDE response for a blocked
+// question. The hop is the name or address that matched the blocklist, which
+// is the question name itself unless the block came from the answer chain.
+func (d *DNSDispatcher) constructBlockedResponse(requestCtx *RequestContext, q *dns.Question, hop string, cause *blocklist.BlockList) QuestionResolution {
+	requestCtx.logger.DebugContext(requestCtx.ctx, "Domain blocked", "name", q.Name, "hop", hop, "cause", cause.Name())
+	requestCtx.snapshot.AddBlockedDomain(hop, cause.Name())
+	requestCtx.secure = false
+
+	extraText := fmt.Sprintf("Blocked by: %s", cause.Name())
+	if hop != q.Name {
+		requestCtx.snapshot.SetBlockHop(hop)
+		extraText = fmt.Sprintf("Blocked by: %s (via %s)", cause.Name(), hop)
+	}
+
+	// Inject EDE for blocked domain
+	ede := &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeBlocked,
+		ExtraText: extraText,
+	}
+
+	return QuestionResolution{authority: []dns.RR{d.syntheticSOA(q.Name)}, extra: d.edeExtra(requestCtx, ede), rcode: dns.RcodeSuccess}
+}
 
-	soa := &dns.SOA{
+// syntheticSOA builds the SOA record placed in the authority section of
+// locally generated negative answers, so clients can cache them.
+func (d *DNSDispatcher) syntheticSOA(name string) *dns.SOA {
+	return &dns.SOA{
 		Hdr: dns.RR_Header{
-			Name:   q.Name,
+			Name:   name,
 			Rrtype: dns.TypeSOA,
 			Class:  dns.ClassINET,
 			Ttl:    uint32(d.defaultTTL),
@@ -400,41 +696,87 @@ func (d *DNSDispatcher) constructBlockedResponse(requestCtx *RequestContext, q *
 		Expire:  604800,
 		Minttl:  uint32(d.defaultTTL),
 	}
+}
+
+// applyRebindingGuard filters the answers for a question through the DNS
+// rebinding guard. If any records were removed, the returned resolution
+// carries either the remaining answers (strip mode) or a REFUSED rcode
+// (refuse mode), along with a Filtered EDE naming the offending address.
+func (d *DNSDispatcher) applyRebindingGuard(requestCtx *RequestContext, q *dns.Question, answers []dns.RR) (QuestionResolution, []dns.RR) {
+	if d.rebinding == nil {
+		return QuestionResolution{}, nil
+	}
+
+	kept, removed := d.rebinding.filter(q, answers)
+	if len(removed) == 0 {
+		return QuestionResolution{}, nil
+	}
+
+	offending := answerIP(removed[0]).String()
+	requestCtx.logger.InfoContext(requestCtx.ctx, "Possible DNS rebinding attack",
+		"name", q.Name,
+		"address", offending,
+		"mode", d.rebinding.mode)
+	requestCtx.snapshot.SetRebinding(d.rebinding.mode)
+	requestCtx.secure = false
 
-	// Inject EDE for blocked domain
 	ede := &dns.EDNS0_EDE{
-		InfoCode:  dns.ExtendedErrorCodeBlocked,
-		ExtraText: fmt.Sprintf("Blocked by: %s", cause.Name()),
+		InfoCode:  dns.ExtendedErrorCodeFiltered,
+		ExtraText: fmt.Sprintf("DNS rebinding protection: %s", offending),
+	}
+
+	if d.rebinding.mode == RebindingModeRefuse {
+		return QuestionResolution{extra: d.edeExtra(requestCtx, ede), rcode: dns.RcodeRefused}, removed
 	}
+	return QuestionResolution{answer: kept, extra: d.edeExtra(requestCtx, ede), rcode: dns.RcodeSuccess}, removed
+}
+
+// echoECS returns a client's subnet option in the response, as required of
+// resolvers that support ECS (RFC 7871 7.2.1).
+func (d *DNSDispatcher) echoECS(ctx *RequestContext, msg *dns.Msg) {
+	if d.ecs == nil {
+		return
+	}
+	clientECS := findECS(ctx.req)
+	if clientECS == nil {
+		return
+	}
+	mergeAuthorityAndExtra(msg, QuestionResolution{extra: d.optExtra(ctx, echoedECS(clientECS, ctx.ecs, ctx.ecsScope))})
+}
+
+// edeExtra wraps an extended DNS error in an OPT record mirroring the client's
+// EDNS0 parameters. Clients that did not send an OPT record get nothing, as
+// they would not understand the option anyway.
+func (d *DNSDispatcher) edeExtra(requestCtx *RequestContext, ede *dns.EDNS0_EDE) []dns.RR {
+	return d.optExtra(requestCtx, ede)
+}
 
-	var extra []dns.RR
-	if optIn := requestCtx.req.IsEdns0(); optIn != nil {
-		o := new(dns.OPT)
-		o.Hdr.Name = "."
-		o.Hdr.Rrtype = dns.TypeOPT
-		o.SetUDPSize(optIn.UDPSize())
-		o.SetVersion(optIn.Version())
-		o.SetDo(optIn.Do())
-		o.Option = append(o.Option, ede)
-		extra = []dns.RR{o}
+// optExtra wraps an EDNS0 option in an OPT record, as for edeExtra.
+func (d *DNSDispatcher) optExtra(requestCtx *RequestContext, option dns.EDNS0) []dns.RR {
+	optIn := requestCtx.req.IsEdns0()
+	if optIn == nil {
+		return nil
 	}
 
-	return QuestionResolution{authority: []dns.RR{soa}, extra: extra, rcode: dns.RcodeSuccess}
+	o := new(dns.OPT)
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	o.SetUDPSize(optIn.UDPSize())
+	o.SetVersion(optIn.Version())
+	o.SetDo(optIn.Do())
+	o.Option = append(o.Option, option)
+	return []dns.RR{o}
 }
 
-func (d *DNSDispatcher) resolveUpstream(requestCtx *RequestContext, unansweredQuestions []dns.Question, req *dns.Msg) (int, []dns.RR, error) {
+func (d *DNSDispatcher) resolveUpstream(requestCtx *RequestContext, q dns.Question, req *dns.Msg) (int, []dns.RR, error) {
 	tracer := telemetry.GetTracer("dns-dispatcher")
-	_, span := tracer.Start(requestCtx.ctx, "resolveUpstream",
-		trace.WithAttributes(
-			attribute.Int("dns.unanswered_count", len(unansweredQuestions)),
-		),
-	)
+	_, span := tracer.Start(requestCtx.ctx, "resolveUpstream")
 	defer span.End()
 
 	upstreamReq := new(dns.Msg)
 	upstreamReq.Id = dns.Id()
 	upstreamReq.RecursionDesired = req.RecursionDesired
-	upstreamReq.Question = unansweredQuestions
+	upstreamReq.Question = []dns.Question{q}
 
 	for _, rr := range req.Extra {
 		if opt, ok := rr.(*dns.OPT); ok {
@@ -444,180 +786,235 @@ func (d *DNSDispatcher) resolveUpstream(requestCtx *RequestContext, unansweredQu
 	}
 
 	d.applyECS(requestCtx, upstreamReq)
+	if d.validator != nil {
+		prepareQuery(upstreamReq)
+	}
 
 	upstreamResp, upstream, err := d.forwardQuery(requestCtx, upstreamReq)
+	if errors.Is(err, ErrOverloaded) {
+		span.SetAttributes(attribute.Bool("dns.shed", true))
+		return d.shedder.rcode, nil, err
+	}
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		return dns.RcodeServerFailure, nil, err
 	}
+	scoped := scopedSubnet(requestCtx.ecs, upstreamResp)
+	requestCtx.ecsScope = scoped.Bits()
+	subnet := cacheSubnet(scoped)
+
+	cacheable := true
+	if d.validator != nil {
+		cacheable, err = d.validateDNSSEC(requestCtx, q, upstreamResp)
+		if errors.Is(err, ErrOverloaded) {
+			span.SetAttributes(attribute.Bool("dns.shed", true))
+			return d.shedder.rcode, nil, err
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return dns.RcodeServerFailure, nil, err
+		}
+	}
+	if scoped.IsValid() && cacheable {
+		d.ecs.addScope(getCacheKey(&q, ""), scoped.Bits())
+	}
 
 	if upstreamResp.Rcode != dns.RcodeSuccess {
 		// Cache negative responses (NXDOMAIN) before returning early
-		if upstreamResp.Rcode == dns.RcodeNameError {
-			for _, q := range unansweredQuestions {
-				cacheKey := getCacheKey(&q, requestCtx.subnet)
-				// Use SOA from authority section for negative TTL, or default TTL
-				negativeTTL := d.defaultTTL
-				var soaRecord *dns.SOA
-				for _, rr := range upstreamResp.Ns {
-					if soa, ok := rr.(*dns.SOA); ok {
-						soaRecord = soa
-						negativeTTL = float64(soa.Hdr.Ttl)
-						break
-					}
-				}
-				effectiveTTL := time.Duration(negativeTTL) * time.Second
-				if !d.isFreshnessSensitive(&q) && effectiveTTL < d.ttlFloor {
-					effectiveTTL = d.ttlFloor
-				}
-				// Cache the SOA record as a marker for NXDOMAIN
-				// An empty slice signals NXDOMAIN when read from cache
-				if soaRecord != nil {
-					d.cache.Set(cacheKey, []dns.RR{soaRecord}, effectiveTTL)
-				} else {
-					d.cache.Set(cacheKey, []dns.RR{}, effectiveTTL)
+		if upstreamResp.Rcode == dns.RcodeNameError && cacheable {
+			cacheKey := getCacheKey(&q, subnet)
+			// Use SOA from authority section for negative TTL, or default TTL
+			negativeTTL := d.defaultTTL
+			var soaRecord *dns.SOA
+			for _, rr := range upstreamResp.Ns {
+				if soa, ok := rr.(*dns.SOA); ok {
+					soaRecord = soa
+					negativeTTL = float64(soa.Hdr.Ttl)
+					break
 				}
-				requestCtx.snapshot.AddUpstreamTTL(getQueryType(&q), negativeTTL)
 			}
+			effectiveTTL := time.Duration(negativeTTL) * time.Second
+			if !d.isFreshnessSensitive(&q) && effectiveTTL < d.ttlFloor {
+				effectiveTTL = d.ttlFloor
+			}
+			// Cache the SOA record as a marker for NXDOMAIN
+			// An empty slice signals NXDOMAIN when read from cache
+			if soaRecord != nil {
+				d.cache.Set(cacheKey, append([]dns.RR{soaRecord}, soaSignatures(requestCtx, upstreamResp.Ns)...), effectiveTTL)
+			} else {
+				d.cache.Set(cacheKey, []dns.RR{}, effectiveTTL)
+			}
+			requestCtx.snapshot.AddUpstreamTTL(getQueryType(&q), negativeTTL)
 		}
 
 		// Propagate the upstream response Rcode if not successful
 		err := errors.NewWithDepthf(0,
 			"upstream resolver (%s) returned Rcode: %s for query: %s",
-			upstream, dns.RcodeToString[upstreamResp.Rcode], unansweredQuestions[0].Name,
+			upstream, dns.RcodeToString[upstreamResp.Rcode], q.Name,
 		)
 		span.SetAttributes(attribute.Int("dns.upstream_rcode", upstreamResp.Rcode))
 		return upstreamResp.Rcode, nil, &RcodeError{Rcode: upstreamResp.Rcode, Err: err}
 	}
 
-	// Process unanswered questions and cache the results
-	for _, q := range unansweredQuestions {
-		cacheKey := getCacheKey(&q, requestCtx.subnet)
-		qAnswers := extractAnswersForQuestion(q, upstreamResp.Answer)
+	if !cacheable {
+		return dns.RcodeSuccess, upstreamResp.Answer, nil
+	}
 
-		// Cache both positive and negative responses
-		// For NODATA (NOERROR with 0 answers): Cache an empty slice
-		if len(qAnswers) == 0 {
-			// Negative caching: NODATA (NOERROR, no answers)
-			// Use SOA from authority section for TTL, or default TTL
-			negativeTTL := d.defaultTTL
-			for _, rr := range upstreamResp.Ns {
-				if soa, ok := rr.(*dns.SOA); ok {
-					negativeTTL = float64(soa.Hdr.Ttl)
-					break
-				}
+	// Cache the results
+	cacheKey := getCacheKey(&q, subnet)
+	qAnswers := extractAnswersForQuestion(q, upstreamResp.Answer)
+
+	// Cache both positive and negative responses
+	// For NODATA (NOERROR with 0 answers): Cache an empty slice
+	if len(qAnswers) == 0 {
+		// Negative caching: NODATA (NOERROR, no answers)
+		// Use SOA from authority section for TTL, or default TTL
+		negativeTTL := d.defaultTTL
+		for _, rr := range upstreamResp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				negativeTTL = float64(soa.Hdr.Ttl)
+				break
 			}
-			effectiveTTL := time.Duration(negativeTTL) * time.Second
-			if !d.isFreshnessSensitive(&q) && effectiveTTL < d.ttlFloor {
-				effectiveTTL = d.ttlFloor
-			}
-			d.cache.Set(cacheKey, qAnswers, effectiveTTL)
-			requestCtx.snapshot.AddUpstreamTTL(getQueryType(&q), negativeTTL)
-		} else {
-			// Positive caching: Cache the extracted answers
-			upstreamTTL := qAnswers[0].Header().Ttl
-			for _, ans := range qAnswers {
-				if ans.Header().Ttl < upstreamTTL {
-					upstreamTTL = ans.Header().Ttl
-				}
+		}
+		effectiveTTL := time.Duration(negativeTTL) * time.Second
+		if !d.isFreshnessSensitive(&q) && effectiveTTL < d.ttlFloor {
+			effectiveTTL = d.ttlFloor
+		}
+		d.cache.Set(cacheKey, qAnswers, effectiveTTL)
+		requestCtx.snapshot.AddUpstreamTTL(getQueryType(&q), negativeTTL)
+	} else {
+		// Positive caching: Cache the extracted answers
+		upstreamTTL := qAnswers[0].Header().Ttl
+		for _, ans := range qAnswers {
+			if ans.Header().Ttl < upstreamTTL {
+				upstreamTTL = ans.Header().Ttl
 			}
+		}
 
-			effectiveTTL := time.Duration(upstreamTTL) * time.Second
-
-			if !d.isFreshnessSensitive(&q) && effectiveTTL < d.ttlFloor {
-				effectiveTTL = d.ttlFloor
-			}
+		effectiveTTL := time.Duration(upstreamTTL) * time.Second
 
-			d.cache.Set(cacheKey, qAnswers, effectiveTTL)
-			requestCtx.snapshot.AddUpstreamTTL(getQueryType(&q), float64(upstreamTTL))
+		if !d.isFreshnessSensitive(&q) && effectiveTTL < d.ttlFloor {
+			effectiveTTL = d.ttlFloor
 		}
+
+		d.cache.Set(cacheKey, qAnswers, effectiveTTL)
+		requestCtx.snapshot.AddUpstreamTTL(getQueryType(&q), float64(upstreamTTL))
 	}
 
 	return dns.RcodeSuccess, upstreamResp.Answer, nil
 }
 
-func (d *DNSDispatcher) computeSubnet(ipAddr string) string {
-	if !d.enableECS || ipAddr == "unknown" {
-		return ""
-	}
+// validateDNSSEC validates the upstream response, returning whether it may be
+// cached. Bogus responses fail with a DNSSECError, unless the client set the
+// CD bit, in which case they are passed on (but never cached). It fails with
+// ErrOverloaded if the keys needed to validate could not be fetched for load
+// shedding.
+func (d *DNSDispatcher) validateDNSSEC(requestCtx *RequestContext, q dns.Question, resp *dns.Msg) (bool, error) {
+	tracer := telemetry.GetTracer("dns-dispatcher")
+	ctx, span := tracer.Start(requestCtx.ctx, "validateDNSSEC")
+	defer span.End()
 
-	ip := net.ParseIP(ipAddr)
-	if ip == nil {
-		return ""
+	status, err := d.validator.validate(ctx, q, resp)
+	if errors.Is(err, ErrOverloaded) {
+		// Validation could not complete, which says nothing about the answer
+		return false, err
 	}
-
-	if ip4 := ip.To4(); ip4 != nil {
-		mask := net.CIDRMask(24, 32)
-		return ip4.Mask(mask).String()
+	span.SetAttributes(attribute.String("dns.dnssec", status.String()))
+	requestCtx.snapshot.SetDNSSECStatus(status.String())
+
+	switch status {
+	case dnssecSecure:
+		requestCtx.secure = true
+		return true, nil
+
+	case dnssecInsecure:
+		// Signatures on insecure answers are meaningless to us, and leaving
+		// them out of the cache keeps "has RRSIGs" equivalent to "secure".
+		resp.Answer = slices.DeleteFunc(resp.Answer, isDNSSECRecord)
+		resp.Ns = slices.DeleteFunc(resp.Ns, isDNSSECRecord)
+		return true, nil
+
+	default:
+		if requestCtx.req.CheckingDisabled {
+			requestCtx.logger.DebugContext(requestCtx.ctx, "Passing bogus answer to client with checking disabled",
+				"name", q.Name,
+				"reason", err)
+			return false, nil
+		}
+		return false, &DNSSECError{Err: err}
 	}
-
-	mask := net.CIDRMask(48, 128)
-	return ip.Mask(mask).String()
 }
 
-func (d *DNSDispatcher) applyECS(requestCtx *RequestContext, upstreamReq *dns.Msg) {
-	if !d.enableECS || requestCtx.ipAddr == "unknown" {
-		return
+// soaSignatures returns the signatures over the SOA record in the authority
+// section of a secure negative response, so they can be cached alongside it.
+func soaSignatures(requestCtx *RequestContext, authority []dns.RR) []dns.RR {
+	if !requestCtx.secure {
+		return nil
 	}
-
-	ip := net.ParseIP(requestCtx.ipAddr)
-	if ip == nil {
-		return
+	var sigs []dns.RR
+	for _, rr := range authority {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeSOA {
+			sigs = append(sigs, sig)
+		}
 	}
+	return sigs
+}
 
-	var family uint16
-	var prefixLen uint8
-	if ip4 := ip.To4(); ip4 != nil {
-		family = 1
-		prefixLen = 24
-		ip = ip4.Mask(net.CIDRMask(24, 32))
-	} else {
-		family = 2
-		prefixLen = 48
-		ip = ip.Mask(net.CIDRMask(48, 128))
+// cachedAnswer looks up the question in the cache. Answers are cached under
+// the scope upstream returned them for, so clients with a subnet try the most
+// specific scope first, then those that upstream scoped to everyone. Only the
+// scopes that answers to the question have been cached for are tried, as most
+// answers are not scoped at all.
+func (d *DNSDispatcher) cachedAnswer(requestCtx *RequestContext, q *dns.Question) ([]dns.RR, bool) {
+	key := getCacheKey(q, "")
+	if requestCtx.ecs.IsValid() {
+		scopes := d.ecs.cachedScopes(key)
+		for bits := requestCtx.ecs.Bits(); bits > 0; bits-- {
+			if !scopes.has(bits) {
+				continue
+			}
+			scoped, err := requestCtx.ecs.Addr().Prefix(bits)
+			if err != nil {
+				break
+			}
+			if rrs, ok := d.cache.Get(getCacheKey(q, scoped.String())); ok {
+				requestCtx.ecsScope = bits
+				return rrs, true
+			}
+		}
 	}
+	requestCtx.ecsScope = 0
+	return d.cache.Get(key)
+}
 
-	ecs := &dns.EDNS0_SUBNET{
-		Code:          dns.EDNS0SUBNET,
-		Family:        family,
-		SourceNetmask: prefixLen,
-		SourceScope:   0,
-		Address:       ip,
+// applyECS replaces any client subnet option copied from the client's request
+// with the one chosen by the ECS policy, if any.
+func (d *DNSDispatcher) applyECS(requestCtx *RequestContext, upstreamReq *dns.Msg) {
+	opt := upstreamReq.IsEdns0()
+	if opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+			return o.Option() == dns.EDNS0SUBNET
+		})
 	}
 
-	found := false
-	for _, rr := range upstreamReq.Extra {
-		if opt, ok := rr.(*dns.OPT); ok {
-			found = true
-			ecsIndex := -1
-			for i, o := range opt.Option {
-				if o.Option() == dns.EDNS0SUBNET {
-					ecsIndex = i
-					break
-				}
-			}
-
-			if ecsIndex != -1 {
-				opt.Option[ecsIndex] = ecs
-			} else {
-				opt.Option = append(opt.Option, ecs)
-			}
-			break
-		}
+	if !requestCtx.ecs.IsValid() {
+		return
 	}
-	if !found {
-		opt := &dns.OPT{
+
+	if opt == nil {
+		opt = &dns.OPT{
 			Hdr: dns.RR_Header{
 				Name:   ".",
 				Rrtype: dns.TypeOPT,
 				Class:  dns.ClassINET,
 				Ttl:    4096,
 			},
-			Option: []dns.EDNS0{ecs},
 		}
 		upstreamReq.Extra = append(upstreamReq.Extra, opt)
 	}
+	opt.Option = append(opt.Option, newECSOption(requestCtx.ecs))
 }
 
 func (d *DNSDispatcher) isFreshnessSensitive(q *dns.Question) bool {
@@ -641,14 +1038,14 @@ func (d *DNSDispatcher) isFreshnessSensitive(q *dns.Question) bool {
 // relevant to a specific question, following CNAME chains so that alias
 // responses are cached atomically.
 //
-// For each question, the following records are included:
+// The following records are included:
 //   - Exact matches (same name and type as the question)
 //   - CNAME records whose owner name matches the question name or any CNAME
 //     target in the chain
 //   - A/AAAA records whose owner name matches a CNAME target in the chain
 //
-// This preserves multi-question isolation (issue #225) while ensuring CNAME
-// chains are cached correctly (issue #250).
+// This keeps unrelated records out of the question's cache entry (issue #225)
+// while ensuring CNAME chains are cached correctly (issue #250).
 func extractAnswersForQuestion(q dns.Question, answers []dns.RR) []dns.RR {
 	// Build a map of CNAME owner -> target to follow chains
 	cnameMap := make(map[string]string)
@@ -682,11 +1079,16 @@ func extractAnswersForQuestion(q dns.Question, answers []dns.RR) []dns.RR {
 		}
 
 		// Include CNAME records, exact type matches, and A/AAAA records
-		// for CNAME targets (i.e., names other than the original question name)
-		if ans.Header().Rrtype == dns.TypeCNAME ||
-			ans.Header().Rrtype == q.Qtype ||
+		// for CNAME targets (i.e., names other than the original question name),
+		// along with any RRSIGs covering them
+		rrtype := ans.Header().Rrtype
+		if sig, ok := ans.(*dns.RRSIG); ok {
+			rrtype = sig.TypeCovered
+		}
+		if rrtype == dns.TypeCNAME ||
+			rrtype == q.Qtype ||
 			(ansName != dns.Fqdn(q.Name) &&
-				(ans.Header().Rrtype == dns.TypeA || ans.Header().Rrtype == dns.TypeAAAA)) {
+				(rrtype == dns.TypeA || rrtype == dns.TypeAAAA)) {
 			qAnswers = append(qAnswers, ans)
 		}
 	}
@@ -730,6 +1132,14 @@ func (d *DNSDispatcher) forwardQuery(requestCtx *RequestContext, req *dns.Msg) (
 	_, span := tracer.Start(requestCtx.ctx, "forwardQuery")
 	defer span.End()
 
+	if d.shedder != nil {
+		release, err := d.shedder.acquire()
+		if err != nil {
+			return nil, "", err
+		}
+		defer release()
+	}
+
 	requestCtx.snapshot.Forwarded()
 	in, upstream, err := d.dnsClient.Exchange(req)
 
@@ -744,14 +1154,83 @@ func (d *DNSDispatcher) forwardQuery(requestCtx *RequestContext, req *dns.Msg) (
 }
 
 func (d *DNSDispatcher) sendResponse(ctx *RequestContext, writer dns.ResponseWriter, msg *dns.Msg) {
+	finalizeDNSSEC(ctx, msg)
+	d.echoECS(ctx, msg)
 	ctx.snapshot.SetRcode(dns.RcodeToString[msg.Rcode])
 	ctx.snapshot.SetAnswerCount(len(msg.Answer))
+	if msg = d.limitResponse(ctx, msg); msg == nil {
+		return
+	}
 	if err := writer.WriteMsg(msg); err != nil {
 		d.reportError(ctx, "response", err, "")
 		return
 	}
 }
 
+// limitResponse applies Response Rate Limiting to UDP responses, whose
+// client address may be spoofed to reflect them at a victim. It returns nil
+// if the response is to be dropped, or an empty truncated response if the
+// client should retry over TCP.
+func (d *DNSDispatcher) limitResponse(ctx *RequestContext, msg *dns.Msg) *dns.Msg {
+	if ctx.source != SourceUDP {
+		return msg
+	}
+
+	name, qtype := rrlKey(msg)
+	switch action := d.limiter.AllowResponse(ctx.ipAddr, name, qtype, msg.Rcode); action {
+	case limiter.ResponseDrop:
+		ctx.logger.DebugContext(ctx.ctx, "Response rate limited", "action", action)
+		return nil
+	case limiter.ResponseSlip:
+		ctx.logger.DebugContext(ctx.ctx, "Response rate limited", "action", action)
+		tc := new(dns.Msg)
+		tc.SetReply(ctx.req)
+		tc.Truncated = true
+		return tc
+	}
+	return msg
+}
+
+// rrlKey returns the name and type that identical responses are grouped by
+// for Response Rate Limiting: answers by their question, NXDOMAIN and NODATA
+// responses by their zone (so that random subdomains share a budget), and
+// errors by their rcode alone.
+func rrlKey(msg *dns.Msg) (string, uint16) {
+	if len(msg.Question) == 0 || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return "", 0
+	}
+
+	q := msg.Question[0]
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		return q.Name, q.Qtype
+	}
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, 0
+		}
+	}
+	return q.Name, 0
+}
+
+// finalizeDNSSEC sets the AD bit on validated responses for clients that
+// signalled they understand it (RFC 6840 5.8), and withholds DNSSEC records
+// from clients that did not set the DO bit (RFC 4035 3.2.1).
+func finalizeDNSSEC(ctx *RequestContext, msg *dns.Msg) {
+	do := false
+	if opt := ctx.req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	msg.AuthenticatedData = ctx.secure &&
+		(do || ctx.req.AuthenticatedData) &&
+		(msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError)
+
+	if !do {
+		msg.Answer = slices.DeleteFunc(msg.Answer, isDNSSECRecord)
+		msg.Ns = slices.DeleteFunc(msg.Ns, isDNSSECRecord)
+	}
+}
+
 func getCacheKey(q *dns.Question, subnet string) string {
 	key := dns.Fqdn(q.Name) + ":" + getQueryType(q)
 	if subnet != "" {
@@ -798,3 +1277,16 @@ func (d *DNSDispatcher) isBlocked(fqdn string) (bool, *blocklist.BlockList, erro
 	}
 	return false, nil, nil
 }
+
+func (d *DNSDispatcher) isBlockedIP(ip net.IP) (bool, *blocklist.BlockList, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false, nil, nil
+	}
+	for _, blockList := range d.blockLists {
+		if isBlocked, err := blockList.IsBlockedIP(addr); isBlocked || err != nil {
+			return isBlocked, blockList, err
+		}
+	}
+	return false, nil, nil
+}
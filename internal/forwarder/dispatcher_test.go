@@ -6,6 +6,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"path/filepath"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/miekg/dns"
 	"github.com/rm-hull/dot-block/internal/blocklist"
+	"github.com/rm-hull/dot-block/internal/clients"
 	"github.com/rm-hull/dot-block/internal/config"
 	"github.com/rm-hull/dot-block/internal/geoblock"
 	"github.com/rm-hull/dot-block/internal/http/sse"
@@ -102,11 +104,18 @@ func newTestLimiter(t *testing.T, metrics *metrics.DnsMetrics) *limiter.Limiter
 		NXDOMAINThreshold:  0.8,
 		ReapInterval:       time.Minute,
 		IdleTTL:            10 * time.Minute,
-	}, metrics)
+	}, metrics, nil, nil, nil)
 	require.NoError(t, err)
 	return l
 }
 
+func newTestDNSConfig(ttlFloor time.Duration, enableECS bool) *config.DNSConfig {
+	cfg := config.DefaultConfig().DNS
+	cfg.Cache.TtlFloor = ttlFloor
+	cfg.ECS.Enabled = enableECS
+	return cfg
+}
+
 func setupDispatcherTest(t *testing.T, upstream string, logger *slog.Logger, enableECS bool) (*DNSDispatcher, *MockGeoIpLookup, *blocklist.BlockList, *slog.Logger) {
 	t.Helper()
 	if logger == nil {
@@ -126,79 +135,13 @@ func setupDispatcherTest(t *testing.T, upstream string, logger *slog.Logger, ena
 	dnsClient, err := NewRoundRobinClient(metrics, 2*time.Second, 2*time.Second, 2*time.Second, logger, upstream)
 	require.NoError(t, err)
 
-	dispatcher, err := NewDNSDispatcher(cache, metrics, dnsClient, []*blocklist.BlockList{blockList}, noisefilter.NewNoiseFilter(), sse.NewBroadcaster(logger, metrics.DroppedSSEEvents), 1*time.Minute, logger, enableECS, newTestLimiter(t, metrics))
+	dispatcher, err := NewDNSDispatcher(cache, metrics, dnsClient, []*blocklist.BlockList{blockList}, noisefilter.NewNoiseFilter(), sse.NewBroadcaster(logger, metrics.DroppedSSEEvents), newTestDNSConfig(1*time.Minute, enableECS), nil, logger, newTestLimiter(t, metrics), nil)
 	require.NoError(t, err)
 	t.Cleanup(dispatcher.Close)
 
 	return dispatcher, mockGeo, blockList, logger
 }
 
-func TestDNSDispatcher_HandleDNSRequest_MixedBlockedAndUpstream(t *testing.T) {
-	// A server that answers for google.com and fails or times out for others?
-	// Or just a standard server. Let's make it a standard one.
-	server, upstream := startLocalDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.SetRcode(r, dns.RcodeSuccess)
-
-		if r.Question[0].Name == "google.com." {
-			aRecord := &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   dns.Fqdn("google.com."),
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    3600,
-				},
-				A: []byte{142, 251, 29, 101},
-			}
-			m.Answer = append(m.Answer, aRecord)
-		}
-
-		_ = w.WriteMsg(m)
-	})
-
-	defer func() {
-		err := server.Shutdown()
-		assert.NoError(t, err)
-	}()
-
-	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, false)
-
-	req := new(dns.Msg)
-	req.Question = []dns.Question{
-		{Name: "google.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-		{Name: "ads.0xbt.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, // Blocked
-	}
-
-	writer := new(MockResponseWriter)
-	writer.On("WriteMsg", mock.Anything).Return(nil)
-
-	// Call the method under test
-	dispatcher.HandleDNSRequest("test")(writer, req)
-
-	assert.NotNil(t, writer.WrittenMsg)
-	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
-
-	// The upstream answer should stay in the answer section, and the blocked domain should be returned as authority data.
-	assert.Len(t, writer.WrittenMsg.Answer, 1, "should have one upstream answer")
-	assert.Len(t, writer.WrittenMsg.Ns, 1, "should have one blocked authority record")
-
-	foundA := false
-	foundSOA := false
-	for _, rr := range writer.WrittenMsg.Answer {
-		if _, ok := rr.(*dns.A); ok {
-			foundA = true
-		}
-	}
-	for _, rr := range writer.WrittenMsg.Ns {
-		if _, ok := rr.(*dns.SOA); ok {
-			foundSOA = true
-		}
-	}
-	assert.True(t, foundA, "A record for google.com. not found")
-	assert.True(t, foundSOA, "SOA record for ads.0xbt.net. not found")
-}
-
 func TestDNSDispatcher_HandleDNSRequest_Allowed(t *testing.T) {
 	server, upstream := startLocalDNS(t, dnsRecord("google.com.", dns.TypeA, []byte{142, 251, 29, 101}))
 	defer func() {
@@ -315,7 +258,11 @@ func TestDNSDispatcher_HandleDNSRequest_BlockedIncludesEDE(t *testing.T) {
 }
 
 func TestDNSDispatcher_HandleDNSRequest_MultipleQuestions(t *testing.T) {
-	server, upstream := startLocalDNS(t, dnsRecord("google.com.", dns.TypeA, []byte{142, 251, 29, 101}))
+	var upstreamQueries atomic.Int32
+	server, upstream := startLocalDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		upstreamQueries.Add(1)
+		dnsRecord("google.com.", dns.TypeA, []byte{142, 251, 29, 101})(w, r)
+	})
 
 	defer func() {
 		err := server.Shutdown()
@@ -324,37 +271,41 @@ func TestDNSDispatcher_HandleDNSRequest_MultipleQuestions(t *testing.T) {
 
 	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, false)
 
-	req := new(dns.Msg)
-	req.Question = []dns.Question{
-		{Name: "google.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-		{Name: "ads.0xbt.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	tests := []struct {
+		name      string
+		questions []dns.Question
+	}{
+		{
+			name: "two questions",
+			questions: []dns.Question{
+				{Name: "google.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				{Name: "ads.0xbt.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+		},
+		{
+			name:      "no questions",
+			questions: []dns.Question{},
+		},
 	}
 
-	writer := new(MockResponseWriter)
-	writer.On("WriteMsg", mock.Anything).Return(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.Question = tt.questions
 
-	// Call the method under test
-	dispatcher.HandleDNSRequest("test")(writer, req)
+			writer := new(MockResponseWriter)
+			writer.On("WriteMsg", mock.Anything).Return(nil)
 
-	// Assert that the response writer was called with a non-nil message
-	assert.NotNil(t, writer.WrittenMsg)
-	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
-	assert.Len(t, writer.WrittenMsg.Answer, 1)
-	assert.Len(t, writer.WrittenMsg.Ns, 1)
-	assert.Len(t, writer.WrittenMsg.Question, 2)
-
-	// Verify that the blocked domain has a SOA record in the authority section
-	foundSOA := false
-	for _, rr := range writer.WrittenMsg.Ns {
-		if soa, ok := rr.(*dns.SOA); ok {
-			if soa.Hdr.Name == "ads.0xbt.net." {
-				assert.Equal(t, "ns.blocked.local.", soa.Ns, "unexpected Ns name for blocked domain")
-				foundSOA = true
-				break
-			}
-		}
+			dispatcher.HandleDNSRequest("test")(writer, req)
+
+			require.NotNil(t, writer.WrittenMsg)
+			assert.Equal(t, dns.RcodeFormatError, writer.WrittenMsg.Rcode)
+			assert.Empty(t, writer.WrittenMsg.Answer)
+			assert.Empty(t, writer.WrittenMsg.Ns)
+		})
 	}
-	assert.True(t, foundSOA, "SOA record for ads.0xbt.net. not found in authority section")
+
+	assert.Zero(t, upstreamQueries.Load(), "malformed queries must not be forwarded upstream")
 }
 
 func TestDNSDispatcher_HandleDNSRequest_CacheHit(t *testing.T) {
@@ -396,7 +347,7 @@ func TestDNSDispatcher_HandleDNSRequest_CacheHit(t *testing.T) {
 }
 
 func TestDNSDispatcher_HandleDNSRequest_CacheHit_ECS(t *testing.T) {
-	server, upstream := startLocalDNS(t, dnsRecord("example.com.", dns.TypeA, []byte{93, 184, 216, 34}))
+	server, upstream := startLocalDNS(t, ecsScopeHandler(dnsRecord("example.com.", dns.TypeA, []byte{93, 184, 216, 34}), 24, nil))
 
 	defer func() {
 		err := server.Shutdown()
@@ -421,7 +372,7 @@ func TestDNSDispatcher_HandleDNSRequest_CacheHit_ECS(t *testing.T) {
 	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
 
 	// Ensure the cache item is actually retrievable
-	cacheKey := getCacheKey(&req.Question[0], "1.2.3.0")
+	cacheKey := getCacheKey(&req.Question[0], "1.2.3.0/24")
 	assert.Eventually(t, func() bool {
 		_, ok := dispatcher.cache.Get(cacheKey)
 		return ok // Wait until Get actually finds the item
@@ -484,7 +435,7 @@ func TestDNSDispatcher_NegativeCacheTtlFloor(t *testing.T) {
 	dnsClient, err := NewRoundRobinClient(metrics, 2*time.Second, 2*time.Second, 2*time.Second, logger, "8.8.8.8:53")
 	assert.NoError(t, err)
 
-	dispatcher, err := NewDNSDispatcher(cache, metrics, dnsClient, []*blocklist.BlockList{blockList}, noisefilter.NewNoiseFilter(), sse.NewBroadcaster(logger, metrics.DroppedSSEEvents), -1*time.Second, logger, false, newTestLimiter(t, metrics))
+	dispatcher, err := NewDNSDispatcher(cache, metrics, dnsClient, []*blocklist.BlockList{blockList}, noisefilter.NewNoiseFilter(), sse.NewBroadcaster(logger, metrics.DroppedSSEEvents), newTestDNSConfig(-1*time.Second, false), nil, logger, newTestLimiter(t, metrics), nil)
 	assert.Error(t, err)
 	assert.Nil(t, dispatcher)
 	assert.Contains(t, err.Error(), "TTL floor cannot be negative")
@@ -813,7 +764,7 @@ func TestDNSDispatcher_ECS_Injection(t *testing.T) {
 			metrics, _ := metrics.NewDNSMetrics(cache, mockGeo, metrics.DefaultTopKConfig())
 			dnsClient, _ := NewRoundRobinClient(metrics, 2*time.Second, 2*time.Second, 2*time.Second, logger, upstream)
 
-			dispatcher, _ := NewDNSDispatcher(cache, metrics, dnsClient, []*blocklist.BlockList{blockList}, noisefilter.NewNoiseFilter(), sse.NewBroadcaster(logger, metrics.DroppedSSEEvents), 1*time.Minute, logger, tt.enableECS, newTestLimiter(t, metrics))
+			dispatcher, _ := NewDNSDispatcher(cache, metrics, dnsClient, []*blocklist.BlockList{blockList}, noisefilter.NewNoiseFilter(), sse.NewBroadcaster(logger, metrics.DroppedSSEEvents), newTestDNSConfig(1*time.Minute, tt.enableECS), nil, logger, newTestLimiter(t, metrics), nil)
 			defer dispatcher.Close()
 
 			// Mock ResponseWriter with the specific client IP
@@ -1066,10 +1017,10 @@ func (m *mockIPResponseWriter) Hijack() {
 
 }
 
-func TestResolveUpstreamCacheKeyCollision(t *testing.T) {
+func TestResolveUpstreamCachesOnlyQuestionAnswers(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 
-	// Create a simple UDP server that handles multi-question requests
+	// Create a simple UDP server that answers with an unrelated record too
 	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
 	require.NoError(t, err)
 	addr := pc.LocalAddr().String()
@@ -1089,9 +1040,9 @@ func TestResolveUpstreamCacheKeyCollision(t *testing.T) {
 			m.SetReply(&req)
 			m.SetRcode(&req, dns.RcodeSuccess)
 			m.Authoritative = true
-			for _, q := range req.Question {
+			for _, name := range []string{req.Question[0].Name, "domainB.com."} {
 				m.Answer = append(m.Answer, &dns.A{
-					Hdr: dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 3600},
+					Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
 					A:   net.ParseIP("1.2.3.4"),
 				})
 			}
@@ -1115,17 +1066,13 @@ func TestResolveUpstreamCacheKeyCollision(t *testing.T) {
 		ipAddr:   "127.0.0.1",
 	}
 
-	// Simulate a multi-question request with two different domains
-	questions := []dns.Question{
-		{Name: "domainA.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-		{Name: "domainB.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-	}
-	multiReq := new(dns.Msg)
-	multiReq.Id = dns.Id()
-	multiReq.RecursionDesired = true
-	multiReq.Question = questions
+	q := dns.Question{Name: "domainA.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	req := new(dns.Msg)
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{q}
 
-	rcode, answers, err := dispatcher.resolveUpstream(reqCtx, questions, multiReq)
+	rcode, answers, err := dispatcher.resolveUpstream(reqCtx, q, req)
 	assert.NoError(t, err)
 	assert.Equal(t, dns.RcodeSuccess, rcode)
 	assert.Len(t, answers, 2)
@@ -1133,9 +1080,8 @@ func TestResolveUpstreamCacheKeyCollision(t *testing.T) {
 	// Give the cache update worker time to process the updates
 	time.Sleep(100 * time.Millisecond)
 
-	// Verify domainA.com cache entry only contains the answer for domainA.com
-	keyA := getCacheKey(&questions[0], "")
-	cachedA, okA := dispatcher.cache.Get(keyA)
+	// Verify the domainA.com cache entry only contains the answer for domainA.com
+	cachedA, okA := dispatcher.cache.Get(getCacheKey(&q, ""))
 	assert.True(t, okA, "domainA.com should be in cache")
 	assert.Len(t, cachedA, 1, "domainA.com cache should only have 1 answer")
 	if len(cachedA) > 0 {
@@ -1143,15 +1089,9 @@ func TestResolveUpstreamCacheKeyCollision(t *testing.T) {
 			"domainA.com cache should only contain domainA.com answer, not domainB.com")
 	}
 
-	// Verify domainB.com cache entry only contains the answer for domainB.com
-	keyB := getCacheKey(&questions[1], "")
-	cachedB, okB := dispatcher.cache.Get(keyB)
-	assert.True(t, okB, "domainB.com should be in cache")
-	assert.Len(t, cachedB, 1, "domainB.com cache should only have 1 answer")
-	if len(cachedB) > 0 {
-		assert.Equal(t, "domainB.com.", cachedB[0].Header().Name,
-			"domainB.com cache should only contain domainB.com answer, not domainA.com")
-	}
+	// The unrelated record is not cached for a question it was not asked for
+	_, okB := dispatcher.cache.Get(getCacheKey(&dns.Question{Name: "domainB.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, ""))
+	assert.False(t, okB, "domainB.com should not be in cache")
 }
 
 func TestDNSDispatcher_reportError_OddAdditionalFields(t *testing.T) {
@@ -1309,3 +1249,292 @@ func TestDNSDispatcher_HandleDNSRequest_CacheHit_NXDOMAIN(t *testing.T) {
 	assert.Equal(t, firstCallCount, secondCallCount,
 		"NXDOMAIN response should have been cached - upstream should not be called again")
 }
+
+func cnameRecord(name string, target string, ip []byte) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetRcode(r, dns.RcodeSuccess)
+
+		m.Answer = append(m.Answer,
+			&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 3600},
+				Target: target,
+			},
+			&dns.A{
+				Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+				A:   ip,
+			},
+		)
+
+		_ = w.WriteMsg(m)
+	}
+}
+
+func blockedEDE(t *testing.T, msg *dns.Msg) *dns.EDNS0_EDE {
+	t.Helper()
+	opt := msg.IsEdns0()
+	require.NotNil(t, opt, "expected OPT record in response")
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	require.Fail(t, "expected EDE option in response")
+	return nil
+}
+
+func TestDNSDispatcher_HandleDNSRequest_BlockedCNAMETarget(t *testing.T) {
+	server, upstream := startLocalDNS(t, cnameRecord("metrics.example.org.", "tracker.ads.0xbt.net.", []byte{192, 0, 2, 1}))
+	defer func() {
+		err := server.Shutdown()
+		assert.NoError(t, err)
+	}()
+
+	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, false)
+
+	req := new(dns.Msg)
+	req.SetQuestion("metrics.example.org.", dns.TypeA)
+	req.SetEdns0(1232, false)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
+	assert.Empty(t, writer.WrittenMsg.Answer, "cloaked answer should be discarded")
+	require.Len(t, writer.WrittenMsg.Ns, 1)
+	assert.IsType(t, &dns.SOA{}, writer.WrittenMsg.Ns[0])
+
+	ede := blockedEDE(t, writer.WrittenMsg)
+	assert.Equal(t, dns.ExtendedErrorCodeBlocked, ede.InfoCode)
+	assert.Equal(t, "Blocked by: dispatcher_test (via tracker.ads.0xbt.net.)", ede.ExtraText)
+}
+
+func TestDNSDispatcher_HandleDNSRequest_BlockedAnswerIP(t *testing.T) {
+	server, upstream := startLocalDNS(t, dnsRecord("example.com.", dns.TypeA, []byte{203, 0, 113, 5}))
+	defer func() {
+		err := server.Shutdown()
+		assert.NoError(t, err)
+	}()
+
+	dispatcher, _, blockList, _ := setupDispatcherTest(t, upstream, nil, false)
+	blockList.Load([]string{"ads.0xbt.net", "203.0.113.0/24"})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Empty(t, writer.WrittenMsg.Answer)
+	assert.Equal(t, "Blocked by: dispatcher_test (via 203.0.113.5)", blockedEDE(t, writer.WrittenMsg).ExtraText)
+}
+
+func TestDNSDispatcher_HandleDNSRequest_BlockedAnswerOnCacheHit(t *testing.T) {
+	server, upstream := startLocalDNS(t, dnsRecord("example.com.", dns.TypeA, []byte{203, 0, 113, 5}))
+	defer func() {
+		err := server.Shutdown()
+		assert.NoError(t, err)
+	}()
+
+	dispatcher, _, blockList, _ := setupDispatcherTest(t, upstream, nil, false)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+
+	// First request is allowed, and populates the cache
+	dispatcher.HandleDNSRequest("test")(writer, req)
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Len(t, writer.WrittenMsg.Answer, 1)
+
+	assert.Eventually(t, func() bool {
+		_, ok := dispatcher.cache.Get(getCacheKey(&req.Question[0], ""))
+		return ok
+	}, 5*time.Second, 50*time.Millisecond, "Cache item not found after first request")
+
+	// After a blocklist reload, the cached answer should now be blocked
+	blockList.Load([]string{"ads.0xbt.net", "203.0.113.5"})
+
+	writer = new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+
+	dispatcher.HandleDNSRequest("test")(writer, req)
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Empty(t, writer.WrittenMsg.Answer)
+	require.Len(t, writer.WrittenMsg.Ns, 1)
+	assert.IsType(t, &dns.SOA{}, writer.WrittenMsg.Ns[0])
+}
+
+func TestDNSDispatcher_HandleDNSRequest_ResponseBlockingDisabled(t *testing.T) {
+	server, upstream := startLocalDNS(t, cnameRecord("metrics.example.org.", "tracker.ads.0xbt.net.", []byte{192, 0, 2, 1}))
+	defer func() {
+		err := server.Shutdown()
+		assert.NoError(t, err)
+	}()
+
+	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, false)
+	dispatcher.blockAnswer = false
+
+	req := new(dns.Msg)
+	req.SetQuestion("metrics.example.org.", dns.TypeA)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Len(t, writer.WrittenMsg.Answer, 2)
+	assert.Empty(t, writer.WrittenMsg.Ns)
+}
+
+// identifiedResponseWriter is a response writer for a query from a named
+// client, as made through /dns-query/{client-id}.
+type identifiedResponseWriter struct {
+	MockResponseWriter
+	clientID string
+}
+
+func (w *identifiedResponseWriter) ClientID() string {
+	return w.clientID
+}
+
+func TestDNSDispatcher_HandleDNSRequest_NamedClient(t *testing.T) {
+	dispatcher, _, _, _ := setupDispatcherTest(t, "127.0.0.1:0", nil, false)
+	registry, err := clients.NewRegistry(filepath.Join(t.TempDir(), "clients.json"), 10, nil)
+	require.NoError(t, err)
+	dispatcher.clients = registry
+
+	events := dispatcher.GetBroadcaster().Subscribe()
+	defer dispatcher.GetBroadcaster().Unsubscribe(events)
+
+	req := new(dns.Msg)
+	req.SetQuestion("ads.0xbt.net.", dns.TypeA)
+
+	writer := &identifiedResponseWriter{clientID: "phone"}
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest(SourceDoH)(writer, req)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, "phone", event.Client)
+		assert.Equal(t, "192.0.2.10", event.ClientIP)
+	case <-time.After(time.Second):
+		t.Fatal("no event broadcast")
+	}
+
+	list := registry.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, "phone", list[0].ID)
+	assert.Equal(t, "192.0.2.10", list[0].LastIP)
+	assert.Equal(t, uint64(1), list[0].Queries)
+}
+
+func TestDNSDispatcher_HandleDNSRequest_ListenerACL(t *testing.T) {
+	dispatcher, _, _, _ := setupDispatcherTest(t, "127.0.0.1:0", nil, false)
+	acl, err := newListenerACL(&config.ListenersConfig{
+		DNS: &config.ListenerConfig{AllowedNetworks: []string{"10.0.0.0/8"}},
+	})
+	require.NoError(t, err)
+	dispatcher.acl = acl
+
+	req := new(dns.Msg)
+	req.SetQuestion("ads.0xbt.net.", dns.TypeA)
+
+	// The mock writer's client (192.0.2.10) is outside the allowed networks
+	writer := new(MockResponseWriter)
+	dispatcher.HandleDNSRequest(SourceUDP)(writer, req)
+	assert.Nil(t, writer.WrittenMsg, "UDP queries should be dropped")
+
+	writer = new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest(SourceTCP)(writer, req)
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeRefused, writer.WrittenMsg.Rcode)
+
+	writer = new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest(SourceDoT)(writer, req)
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode, "other listeners are unrestricted")
+}
+
+func TestDNSDispatcher_HandleDNSRequest_ResponseRateLimiting(t *testing.T) {
+	dispatcher, _, _, _ := setupDispatcherTest(t, "127.0.0.1:0", nil, false)
+	rateLimiter, err := limiter.New(&config.RateLimitConfig{
+		RRL: &config.RRLConfig{
+			Enabled:            true,
+			ResponsesPerSecond: 1,
+			Window:             time.Minute,
+			Slip:               2,
+			IPv4Prefix:         24,
+			IPv6Prefix:         56,
+		},
+	}, dispatcher.metrics, nil, nil, nil)
+	require.NoError(t, err)
+	dispatcher.limiter = rateLimiter
+
+	req := new(dns.Msg)
+	req.SetQuestion("ads.0xbt.net.", dns.TypeA)
+
+	query := func(source DNSSource) *dns.Msg {
+		writer := new(MockResponseWriter)
+		writer.On("WriteMsg", mock.Anything).Return(nil)
+		dispatcher.HandleDNSRequest(source)(writer, req)
+		return writer.WrittenMsg
+	}
+
+	resp := query(SourceUDP)
+	require.NotNil(t, resp)
+	assert.False(t, resp.Truncated)
+
+	assert.Nil(t, query(SourceUDP), "over the limit, responses are dropped")
+
+	resp = query(SourceUDP)
+	require.NotNil(t, resp, "every second limited response slips")
+	assert.True(t, resp.Truncated)
+	assert.Empty(t, resp.Answer)
+
+	resp = query(SourceTCP)
+	require.NotNil(t, resp, "only UDP responses are limited")
+	assert.False(t, resp.Truncated)
+}
+
+func TestRRLKey(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeAAAA)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	aaaa, err := dns.NewRR("www.example.com. 300 IN AAAA 2001:db8::1")
+	require.NoError(t, err)
+	resp.Answer = []dns.RR{aaaa}
+	name, qtype := rrlKey(resp)
+	assert.Equal(t, "www.example.com.", name)
+	assert.Equal(t, dns.TypeAAAA, qtype)
+
+	resp = new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	soa, err := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")
+	require.NoError(t, err)
+	resp.Ns = []dns.RR{soa}
+	name, qtype = rrlKey(resp)
+	assert.Equal(t, "example.com.", name)
+	assert.Zero(t, qtype)
+
+	resp = new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	name, qtype = rrlKey(resp)
+	assert.Empty(t, name)
+	assert.Zero(t, qtype)
+}
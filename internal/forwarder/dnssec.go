@@ -0,0 +1,984 @@
+package forwarder
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+)
+
+type dnssecStatus int
+
+const (
+	// dnssecInsecure means the answer is provably not covered by the chain of
+	// trust (e.g. an unsigned delegation), so it is served without the AD bit.
+	dnssecInsecure dnssecStatus = iota
+	// dnssecSecure means every RRset in the answer validated up to a trust anchor.
+	dnssecSecure
+	// dnssecBogus means the answer should have validated but did not.
+	dnssecBogus
+)
+
+func (s dnssecStatus) String() string {
+	switch s {
+	case dnssecSecure:
+		return "secure"
+	case dnssecBogus:
+		return "bogus"
+	default:
+		return "insecure"
+	}
+}
+
+// maxNSEC3Iterations is the most NSEC3 hash iterations that will be computed
+// for a proof. Zones using more are treated as insecure (RFC 9276 3.2), as
+// otherwise any signed zone could make every proof cost thousands of hashes.
+const maxNSEC3Iterations = 150
+
+// errNotZoneCut is returned when looking up the keys for a name that turns out
+// not to be a delegation point, so the keys of its parent zone apply instead.
+var errNotZoneCut = errors.New("not a zone cut")
+
+// exchangeFunc sends a query upstream; it matches RoundRobinClient.Exchange.
+type exchangeFunc func(msg *dns.Msg) (*dns.Msg, string, error)
+
+// dnssecValidator performs local DNSSEC validation of upstream responses,
+// building the chain of trust from the configured root trust anchors by
+// fetching DS and DNSKEY records through the upstream resolvers. Validated
+// DNSKEY sets (and insecure delegation markers) are kept in the DNS cache, so
+// the chain is only rebuilt as the keys expire.
+type dnssecValidator struct {
+	anchors  []*dns.DS
+	cache    *DNSCache
+	exchange exchangeFunc
+	logger   *slog.Logger
+	now      func() time.Time
+}
+
+func newDNSSECValidator(cfg *config.DNSSECConfig, cache *DNSCache, exchange exchangeFunc, logger *slog.Logger) (*dnssecValidator, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	if len(cfg.TrustAnchors) == 0 {
+		return nil, errors.New("DNSSEC validation requires at least one trust anchor")
+	}
+
+	anchors := make([]*dns.DS, 0, len(cfg.TrustAnchors))
+	for _, anchor := range cfg.TrustAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse trust anchor %q", anchor)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok || ds.Hdr.Name != "." {
+			return nil, errors.Newf("trust anchor %q is not a root DS record", anchor)
+		}
+		anchors = append(anchors, ds)
+	}
+
+	return &dnssecValidator{
+		anchors:  anchors,
+		cache:    cache,
+		exchange: exchange,
+		logger:   logger,
+		now:      time.Now,
+	}, nil
+}
+
+// prepareQuery sets the DO bit (so the upstream returns signatures) and the CD
+// bit (so the upstream returns bogus data for us to judge, rather than an
+// opaque SERVFAIL) on an outgoing query.
+func prepareQuery(msg *dns.Msg) {
+	msg.CheckingDisabled = true
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.SetDo()
+		return
+	}
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+}
+
+// validate classifies an upstream response to the question. A bogus status is
+// always accompanied by an error describing the failure.
+func (v *dnssecValidator) validate(ctx context.Context, q dns.Question, resp *dns.Msg) (dnssecStatus, error) {
+	answerSets := groupRRsets(resp.Answer)
+	status := dnssecSecure
+
+	var expanded []wildcardExpansion
+	for _, set := range answerSets {
+		setStatus, sig, err := v.validateRRset(ctx, set)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		status = min(status, setStatus)
+		if setStatus == dnssecSecure && isWildcardExpansion(set.name, sig) {
+			expanded = append(expanded, wildcardExpansion{name: set.name, labels: sig.Labels})
+		}
+	}
+
+	if len(expanded) > 0 {
+		proofStatus, err := v.validateWildcardProof(ctx, expanded, resp)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		status = min(status, proofStatus)
+	}
+
+	// Positive answers are complete once the RRsets validate, but a CNAME
+	// chain that dead-ends (NXDOMAIN/NODATA for the final target) also needs
+	// a denial of existence for that target.
+	target := chainTarget(q, resp.Answer)
+	if resp.Rcode == dns.RcodeSuccess && hasAnswerForType(resp.Answer, target, q.Qtype) {
+		return status, nil
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return dnssecInsecure, nil
+	}
+
+	denialStatus, err := v.validateDenial(ctx, target, q.Qtype, resp)
+	if err != nil {
+		return dnssecBogus, err
+	}
+	return min(status, denialStatus), nil
+}
+
+// validateRRset checks the signatures over a single RRset, returning insecure
+// if the RRset is unsigned and provably outside the chain of trust. A secure
+// RRset is returned with the signature that validated it.
+func (v *dnssecValidator) validateRRset(ctx context.Context, set rrset) (dnssecStatus, *dns.RRSIG, error) {
+	if len(set.sigs) == 0 {
+		insecure, err := v.provablyInsecure(ctx, set.name)
+		if err != nil {
+			return dnssecBogus, nil, err
+		}
+		if !insecure {
+			return dnssecBogus, nil, errors.Newf("missing signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+		}
+		return dnssecInsecure, nil, nil
+	}
+
+	return v.validateSigned(ctx, set)
+}
+
+// validateSigned checks the signatures over an RRset using the keys of the
+// signing zones, which must enclose the RRset. The RRset may carry signatures
+// from several zones, e.g. while it moves between them, and is secure if any
+// of them validates.
+func (v *dnssecValidator) validateSigned(ctx context.Context, set rrset) (dnssecStatus, *dns.RRSIG, error) {
+	status := dnssecBogus
+	var lastErr error
+	for _, signed := range set.bySigner() {
+		signer := dns.CanonicalName(signed.sigs[0].SignerName)
+		if !dns.IsSubDomain(signer, dns.CanonicalName(set.name)) {
+			lastErr = errors.Newf("signer %s is not authoritative for %s", signer, set.name)
+			continue
+		}
+
+		keys, err := v.zoneKeys(ctx, signer)
+		if errors.Is(err, ErrOverloaded) {
+			return dnssecBogus, nil, err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if keys == nil {
+			status = dnssecInsecure
+			continue
+		}
+
+		sig, err := v.verify(signed, keys)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return dnssecSecure, sig, nil
+	}
+
+	if status == dnssecInsecure {
+		return dnssecInsecure, nil, nil
+	}
+	return dnssecBogus, nil, lastErr
+}
+
+// wildcardExpansion is an answer RRset synthesized from a wildcard with the
+// given number of labels (e.g. 2 for *.example.com).
+type wildcardExpansion struct {
+	name   string
+	labels uint8
+}
+
+// isWildcardExpansion reports whether the signature shows that the RRset was
+// synthesized from a wildcard, as it covers fewer labels than the owner name
+// (RFC 4035 5.3.4).
+func isWildcardExpansion(name string, sig *dns.RRSIG) bool {
+	labels := dns.SplitDomainName(name)
+	if len(labels) > 0 && labels[0] == "*" {
+		labels = labels[1:]
+	}
+	return int(sig.Labels) < len(labels)
+}
+
+// validateWildcardProof checks that the authority section proves that no
+// name closer to each wildcard-expanded answer than the wildcard exists, as
+// the answer could otherwise stand in for a name that does (RFC 4035 5.3.4,
+// RFC 5155 8.8).
+func (v *dnssecValidator) validateWildcardProof(ctx context.Context, expanded []wildcardExpansion, resp *dns.Msg) (dnssecStatus, error) {
+	status := dnssecSecure
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range groupRRsets(resp.Ns) {
+		if set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		setStatus, _, err := v.validateRRset(ctx, set)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		status = min(status, setStatus)
+		nsecs, nsec3s = appendDenialRecords(nsecs, nsec3s, set)
+	}
+	if status == dnssecInsecure || exceedsNSEC3Iterations(nsec3s) {
+		return dnssecInsecure, nil
+	}
+
+	for _, answer := range expanded {
+		proven, optOut := proveWildcardExpansion(answer.name, answer.labels, nsecs, nsec3s)
+		if !proven {
+			return dnssecBogus, errors.Newf("missing proof that %s does not exist for its wildcard answer", answer.name)
+		}
+		if optOut {
+			status = dnssecInsecure
+		}
+	}
+	return status, nil
+}
+
+// validateDenial validates the authority section of a negative response and
+// checks that it proves the non-existence of the name (or type).
+func (v *dnssecValidator) validateDenial(ctx context.Context, qname string, qtype uint16, resp *dns.Msg) (dnssecStatus, error) {
+	// Only the SOA and NSEC/NSEC3 records take part in the proof; any other
+	// authority records (e.g. NS) are unsigned at the parent anyway.
+	var authoritySets []rrset
+	for _, set := range groupRRsets(resp.Ns) {
+		switch set.rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			authoritySets = append(authoritySets, set)
+		}
+	}
+
+	signed := false
+	for _, set := range authoritySets {
+		if len(set.sigs) > 0 {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		insecure, err := v.provablyInsecure(ctx, qname)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if !insecure {
+			return dnssecBogus, errors.Newf("missing denial of existence for %s %s", qname, dns.TypeToString[qtype])
+		}
+		return dnssecInsecure, nil
+	}
+
+	status := dnssecSecure
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range authoritySets {
+		setStatus, _, err := v.validateRRset(ctx, set)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		status = min(status, setStatus)
+		nsecs, nsec3s = appendDenialRecords(nsecs, nsec3s, set)
+	}
+
+	if status == dnssecInsecure || exceedsNSEC3Iterations(nsec3s) {
+		return dnssecInsecure, nil
+	}
+
+	proof := proveDenial(qname, qtype, nsecs, nsec3s)
+	switch {
+	case proof.optOut:
+		// An opt-out span only proves that any delegation here is unsigned
+		return dnssecInsecure, nil
+	case resp.Rcode == dns.RcodeNameError && proof.kind == denialNXDomain:
+		return dnssecSecure, nil
+	case resp.Rcode == dns.RcodeSuccess && proof.kind == denialNoData:
+		return dnssecSecure, nil
+	default:
+		return dnssecBogus, errors.Newf("no valid denial of existence for %s %s", qname, dns.TypeToString[qtype])
+	}
+}
+
+// zoneKeys returns the validated DNSKEY set for the zone. A nil result with a
+// nil error means the zone is provably insecure (an unsigned delegation, or
+// signed with unsupported algorithms only). errNotZoneCut is returned if the
+// name is not a delegation point at all.
+func (v *dnssecValidator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	cacheKey := zone + ":DNSKEY:dnssec"
+	if cached, ok := v.cache.Get(cacheKey); ok {
+		return toDNSKEYs(cached), nil
+	}
+
+	var dsSet []*dns.DS
+	var dsTTL uint32
+	if zone == "." {
+		dsSet = v.anchors
+		dsTTL = uint32((24 * time.Hour).Seconds())
+	} else {
+		var err error
+		dsSet, dsTTL, err = v.delegationSigner(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dsSet = supportedDS(dsSet)
+	if len(dsSet) == 0 {
+		// Unsigned delegation, or no algorithms we can validate (RFC 4035 5.2)
+		v.cache.Set(cacheKey, []dns.RR{}, time.Duration(dsTTL)*time.Second)
+		return nil, nil
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	var keySet rrset
+	for _, set := range groupRRsets(resp.Answer) {
+		if set.rrtype == dns.TypeDNSKEY && dns.CanonicalName(set.name) == zone {
+			keySet = set
+			break
+		}
+	}
+	if len(keySet.rrs) == 0 {
+		return nil, errors.Newf("no DNSKEY records found for %s", zone)
+	}
+
+	// The DNSKEY RRset must be self-signed by one of the keys matching a DS
+	var anchoredKeys []*dns.DNSKEY
+	for _, key := range toDNSKEYs(keySet.rrs) {
+		if matchesDS(key, dsSet) {
+			anchoredKeys = append(anchoredKeys, key)
+		}
+	}
+	if len(anchoredKeys) == 0 {
+		return nil, errors.Newf("no DNSKEY for %s matches its DS records", zone)
+	}
+	if _, err := v.verify(keySet, anchoredKeys); err != nil {
+		return nil, errors.Wrapf(err, "DNSKEY RRset for %s", zone)
+	}
+
+	ttl := min(keySet.ttl(), dsTTL)
+	v.cache.Set(cacheKey, keySet.rrs, time.Duration(ttl)*time.Second)
+	v.logger.DebugContext(ctx, "Validated DNSKEY set", "zone", zone, "keys", len(keySet.rrs), "ttl", ttl)
+
+	return toDNSKEYs(keySet.rrs), nil
+}
+
+// delegationSigner fetches and validates the DS RRset for a zone from its
+// parent. An empty result means the delegation is provably unsigned.
+func (v *dnssecValidator) delegationSigner(ctx context.Context, zone string) ([]*dns.DS, uint32, error) {
+	resp, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, set := range groupRRsets(resp.Answer) {
+		if set.rrtype != dns.TypeDS || dns.CanonicalName(set.name) != zone {
+			continue
+		}
+		if len(set.sigs) == 0 {
+			return nil, 0, errors.Newf("missing signature for %s DS", zone)
+		}
+
+		// Signatures made by the zone itself would recurse back into it
+		parentSigned := set.withoutSigner(zone)
+		if len(parentSigned.sigs) == 0 {
+			return nil, 0, errors.Newf("DS for %s is not signed by its parent", zone)
+		}
+		status, _, err := v.validateSigned(ctx, parentSigned)
+		if err != nil {
+			return nil, 0, err
+		}
+		if status == dnssecInsecure {
+			return nil, set.ttl(), nil
+		}
+
+		dsSet := make([]*dns.DS, 0, len(set.rrs))
+		for _, rr := range set.rrs {
+			dsSet = append(dsSet, rr.(*dns.DS))
+		}
+		return dsSet, set.ttl(), nil
+	}
+
+	// No DS records: the parent must prove that this is either an unsigned
+	// delegation, or not a delegation at all.
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	var ttl uint32
+	for _, set := range groupRRsets(resp.Ns) {
+		if set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		// The proof must come from a parent zone: accepting unsigned or
+		// self-signed records here would recurse back into this zone.
+		if len(set.sigs) == 0 {
+			return nil, 0, errors.Newf("missing signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+		}
+		parentSigned := set.withoutSigner(zone)
+		if len(parentSigned.sigs) == 0 {
+			return nil, 0, errors.Newf("proof of missing DS for %s is not signed by its parent", zone)
+		}
+		status, _, err := v.validateSigned(ctx, parentSigned)
+		if err != nil {
+			return nil, 0, err
+		}
+		if status == dnssecInsecure {
+			return nil, set.ttl(), nil
+		}
+		ttl = set.ttl()
+		nsecs, nsec3s = appendDenialRecords(nsecs, nsec3s, set)
+	}
+
+	if exceedsNSEC3Iterations(nsec3s) {
+		return nil, ttl, nil
+	}
+
+	proof := proveDenial(zone, dns.TypeDS, nsecs, nsec3s)
+	switch {
+	case proof.kind == denialNoData && proof.delegation:
+		return nil, ttl, nil
+	case proof.optOut:
+		return nil, ttl, nil
+	case proof.kind != denialNone:
+		return nil, 0, errNotZoneCut
+	default:
+		return nil, 0, errors.Newf("no valid proof of missing DS for %s", zone)
+	}
+}
+
+// provablyInsecure walks down from the root towards the name, looking for an
+// unsigned delegation along the way. It returns false if the name sits inside
+// a signed zone, in which case unsigned data for it is bogus.
+func (v *dnssecValidator) provablyInsecure(ctx context.Context, name string) (bool, error) {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+
+	for i := len(labels); i >= 0; i-- {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		keys, err := v.zoneKeys(ctx, candidate)
+		switch {
+		case errors.Is(err, errNotZoneCut):
+			continue
+		case err != nil:
+			return false, err
+		case keys == nil:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verify checks that at least one of the RRSIGs over the RRset is currently
+// valid and was made by one of the keys, returning that RRSIG.
+func (v *dnssecValidator) verify(set rrset, keys []*dns.DNSKEY) (*dns.RRSIG, error) {
+	now := v.now()
+	var lastErr error = errors.New("no matching key")
+	for _, sig := range set.sigs {
+		if !sig.ValidityPeriod(now) {
+			lastErr = errors.New("signature expired or not yet valid")
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, set.rrs); err != nil {
+				lastErr = err
+				continue
+			}
+			return sig, nil
+		}
+	}
+	return nil, errors.Wrapf(lastErr, "invalid signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+}
+
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	prepareQuery(msg)
+
+	resp, upstream, err := v.exchange(msg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s %s", name, dns.TypeToString[qtype])
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, errors.Newf("upstream resolver (%s) returned Rcode: %s for %s %s",
+			upstream, dns.RcodeToString[resp.Rcode], name, dns.TypeToString[qtype])
+	}
+	return resp, nil
+}
+
+// rrset groups records sharing an owner name and type with their signatures.
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+func (s rrset) ttl() uint32 {
+	ttl := s.rrs[0].Header().Ttl
+	for _, rr := range s.rrs {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return ttl
+}
+
+// bySigner splits the RRset by the zones that signed it, in the order of
+// their first signature.
+func (s rrset) bySigner() []rrset {
+	var sets []rrset
+	for _, sig := range s.sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		i := slices.IndexFunc(sets, func(set rrset) bool {
+			return dns.CanonicalName(set.sigs[0].SignerName) == signer
+		})
+		if i < 0 {
+			sets = append(sets, rrset{name: s.name, rrtype: s.rrtype, rrs: s.rrs})
+			i = len(sets) - 1
+		}
+		sets[i].sigs = append(sets[i].sigs, sig)
+	}
+	return sets
+}
+
+// withoutSigner returns the RRset without the signatures made by the zone.
+func (s rrset) withoutSigner(zone string) rrset {
+	s.sigs = slices.DeleteFunc(slices.Clone(s.sigs), func(sig *dns.RRSIG) bool {
+		return dns.CanonicalName(sig.SignerName) == zone
+	})
+	return s
+}
+
+// appendDenialRecords appends the NSEC and NSEC3 records of the RRset.
+func appendDenialRecords(nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, set rrset) ([]*dns.NSEC, []*dns.NSEC3) {
+	for _, rr := range set.rrs {
+		switch x := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, x)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, x)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+func groupRRsets(rrs []dns.RR) []rrset {
+	type key struct {
+		name   string
+		rrtype uint16
+	}
+	index := make(map[key]int)
+	var sets []rrset
+
+	for _, rr := range rrs {
+		if _, isSig := rr.(*dns.RRSIG); isSig {
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := key{dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype}
+		i, ok := index[k]
+		if !ok {
+			i = len(sets)
+			index[k] = i
+			sets = append(sets, rrset{name: rr.Header().Name, rrtype: k.rrtype})
+		}
+		sets[i].rrs = append(sets[i].rrs, rr)
+	}
+
+	for _, rr := range rrs {
+		sig, isSig := rr.(*dns.RRSIG)
+		if !isSig {
+			continue
+		}
+		if i, ok := index[key{dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered}]; ok {
+			sets[i].sigs = append(sets[i].sigs, sig)
+		}
+	}
+
+	return sets
+}
+
+// chainTarget follows any CNAME chain in the answer from the question name.
+func chainTarget(q dns.Question, answers []dns.RR) string {
+	current := dns.CanonicalName(q.Name)
+	for range 8 {
+		next := ""
+		for _, rr := range answers {
+			if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == current {
+				next = dns.CanonicalName(cname.Target)
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		current = next
+	}
+	return current
+}
+
+func hasAnswerForType(answers []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range answers {
+		if rr.Header().Rrtype == qtype && dns.CanonicalName(rr.Header().Name) == name {
+			return true
+		}
+	}
+	return qtype == dns.TypeCNAME && len(answers) > 0
+}
+
+func toDNSKEYs(rrs []dns.RR) []*dns.DNSKEY {
+	if len(rrs) == 0 {
+		return nil
+	}
+	keys := make([]*dns.DNSKEY, 0, len(rrs))
+	for _, rr := range rrs {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func supportedDS(dsSet []*dns.DS) []*dns.DS {
+	supported := make([]*dns.DS, 0, len(dsSet))
+	for _, ds := range dsSet {
+		switch ds.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+			dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		default:
+			continue
+		}
+		switch ds.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			supported = append(supported, ds)
+		}
+	}
+	return supported
+}
+
+func matchesDS(key *dns.DNSKEY, dsSet []*dns.DS) bool {
+	for _, ds := range dsSet {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		if computed := key.ToDS(ds.DigestType); computed != nil && strings.EqualFold(computed.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDNSSECRecords reports whether the records include any signatures, which
+// (with validation enabled) is only ever the case for secure cached answers.
+func hasDNSSECRecords(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isDNSSECRecord reports whether the record should be withheld from clients
+// that did not set the DO bit (RFC 4035 3.2.1).
+func isDNSSECRecord(rr dns.RR) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+type denialKind int
+
+const (
+	denialNone denialKind = iota
+	denialNXDomain
+	denialNoData
+)
+
+type denialProof struct {
+	kind denialKind
+	// delegation is set when a NODATA proof shows an NS record (but no SOA)
+	// at the name, i.e. the name is a delegation point.
+	delegation bool
+	// optOut is set when the proof relies on an NSEC3 opt-out span.
+	optOut bool
+}
+
+// proveDenial checks whether the NSEC/NSEC3 records prove that the name does
+// not exist, or that it exists without the requested type. A name that does
+// not exist also needs proof that no wildcard at its closest encloser could
+// have answered for it instead (RFC 4035 5.4, RFC 5155 8.4).
+func proveDenial(qname string, qtype uint16, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) denialProof {
+	qname = dns.CanonicalName(qname)
+
+	for _, nsec := range nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == qname {
+			return noDataProof(nsec.TypeBitMap, qtype)
+		}
+	}
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, qname) || isAncestorDelegation(nsec.Hdr.Name, nsec.TypeBitMap, qname) {
+			continue
+		}
+		// An empty non-terminal is covered, but has descendants
+		if next := dns.CanonicalName(nsec.NextDomain); next != qname && dns.IsSubDomain(qname, next) {
+			return denialProof{kind: denialNoData}
+		}
+		return proveNoWildcardNSEC(closestEncloserNSEC(nsec, qname), qtype, nsecs)
+	}
+
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(qname) {
+			return noDataProof(nsec3.TypeBitMap, qtype)
+		}
+	}
+
+	// Closest encloser proof (RFC 5155 8.3): find the closest ancestor with a
+	// matching NSEC3, then the "next closer" name must be covered.
+	labels := dns.SplitDomainName(qname)
+	for i := 1; i <= len(labels); i++ {
+		closestEncloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+
+		var encloser *dns.NSEC3
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(closestEncloser) {
+				encloser = nsec3
+				break
+			}
+		}
+		if encloser == nil {
+			continue
+		}
+		if isAncestorDelegation(closestEncloser, encloser.TypeBitMap, qname) {
+			return denialProof{kind: denialNone}
+		}
+
+		for _, nsec3 := range nsec3s {
+			if !nsec3.Cover(nextCloser) {
+				continue
+			}
+			if nsec3.Flags&1 == 1 {
+				return denialProof{kind: denialNXDomain, optOut: true}
+			}
+			return proveNoWildcardNSEC3(closestEncloser, qtype, nsec3s)
+		}
+		break
+	}
+
+	return denialProof{kind: denialNone}
+}
+
+// closestEncloserNSEC returns the closest encloser of a name covered by the
+// NSEC: the longer of the names it shares with the owner and with the next
+// domain name.
+func closestEncloserNSEC(nsec *dns.NSEC, name string) string {
+	owner := commonAncestor(dns.CanonicalName(nsec.Hdr.Name), name)
+	next := commonAncestor(dns.CanonicalName(nsec.NextDomain), name)
+	if dns.CountLabel(next) > dns.CountLabel(owner) {
+		return next
+	}
+	return owner
+}
+
+// commonAncestor returns the longest name that both names are equal to, or a
+// subdomain of.
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	labels := dns.SplitDomainName(a)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// proveNoWildcardNSEC completes an NXDOMAIN proof by checking the wildcard at
+// the closest encloser. A matching NSEC means the wildcard exists, which only
+// proves NODATA if it lacks the type (RFC 4035 3.1.3.4).
+func proveNoWildcardNSEC(closestEncloser string, qtype uint16, nsecs []*dns.NSEC) denialProof {
+	wildcard := "*." + closestEncloser
+	if closestEncloser == "." {
+		wildcard = "*."
+	}
+	for _, nsec := range nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == wildcard {
+			return noDataProof(nsec.TypeBitMap, qtype)
+		}
+	}
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, wildcard) {
+			return denialProof{kind: denialNXDomain}
+		}
+	}
+	return denialProof{kind: denialNone}
+}
+
+// proveNoWildcardNSEC3 is proveNoWildcardNSEC for NSEC3 (RFC 5155 8.4, 8.7).
+func proveNoWildcardNSEC3(closestEncloser string, qtype uint16, nsec3s []*dns.NSEC3) denialProof {
+	wildcard := "*." + closestEncloser
+	if closestEncloser == "." {
+		wildcard = "*."
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(wildcard) {
+			return noDataProof(nsec3.TypeBitMap, qtype)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(wildcard) {
+			return denialProof{kind: denialNXDomain}
+		}
+	}
+	return denialProof{kind: denialNone}
+}
+
+// isAncestorDelegation reports whether an NSEC/NSEC3 record at owner is from
+// the parent side of a delegation (NS without SOA) above the name. The parent
+// is not authoritative below the cut, so such a record cannot prove anything
+// about names there (RFC 6840 4.1).
+func isAncestorDelegation(owner string, bitmap []uint16, name string) bool {
+	owner = dns.CanonicalName(owner)
+	return owner != name && dns.IsSubDomain(owner, name) &&
+		slices.Contains(bitmap, dns.TypeNS) && !slices.Contains(bitmap, dns.TypeSOA)
+}
+
+// exceedsNSEC3Iterations reports whether any of the NSEC3 records uses more
+// than maxNSEC3Iterations hash iterations.
+func exceedsNSEC3Iterations(nsec3s []*dns.NSEC3) bool {
+	return slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool {
+		return nsec3.Iterations > maxNSEC3Iterations
+	})
+}
+
+// proveWildcardExpansion checks whether the NSEC/NSEC3 records prove that the
+// "next closer" name — the name one label below the wildcard's parent, on
+// the way to the expanded name — does not exist, so that neither the name nor
+// a closer wildcard exist to answer for it instead. optOut is set if the
+// proof relies on an NSEC3 opt-out span.
+func proveWildcardExpansion(name string, labels uint8, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (proven, optOut bool) {
+	nameLabels := dns.SplitDomainName(dns.CanonicalName(name))
+	if int(labels) >= len(nameLabels) {
+		return false, false
+	}
+	nextCloser := dns.Fqdn(strings.Join(nameLabels[len(nameLabels)-int(labels)-1:], "."))
+
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, nextCloser) {
+			continue
+		}
+		// An empty non-terminal is covered, but exists
+		if next := dns.CanonicalName(nsec.NextDomain); next != nextCloser && dns.IsSubDomain(nextCloser, next) {
+			continue
+		}
+		return true, false
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(nextCloser) {
+			return true, nsec3.Flags&1 == 1
+		}
+	}
+	return false, false
+}
+
+// noDataProof checks the type bitmap of the NSEC/NSEC3 record matching the
+// name. A record from the parent side of a delegation (NS without SOA) only
+// proves the absence of DS, as the child zone holds the other types
+// (RFC 6840 4.1).
+func noDataProof(bitmap []uint16, qtype uint16) denialProof {
+	var hasNS, hasSOA bool
+	for _, t := range bitmap {
+		switch t {
+		case qtype, dns.TypeCNAME:
+			return denialProof{kind: denialNone}
+		case dns.TypeNS:
+			hasNS = true
+		case dns.TypeSOA:
+			hasSOA = true
+		}
+	}
+	delegation := hasNS && !hasSOA
+	if delegation && qtype != dns.TypeDS {
+		return denialProof{kind: denialNone}
+	}
+	return denialProof{kind: denialNoData, delegation: delegation}
+}
+
+// nsecCovers reports whether the name falls strictly between the NSEC owner
+// and its next domain name in canonical order, allowing for the wrap-around at
+// the end of the zone.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := dns.CanonicalName(nsec.Hdr.Name)
+	next := dns.CanonicalName(nsec.NextDomain)
+
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// Last NSEC in the zone: next is the apex
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// canonicalCompare orders domain names as per RFC 4034 6.1: label by label
+// from the right, comparing lowercased labels as octet strings.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(unescapeLabel(la[i]), unescapeLabel(lb[j])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// unescapeLabel converts a label from presentation format (with \DDD and \X
+// escapes) to its wire octets so that it can be compared byte-wise.
+func unescapeLabel(label string) string {
+	if !strings.Contains(label, "\\") {
+		return label
+	}
+	var sb strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			sb.WriteByte(label[i])
+			continue
+		}
+		if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+			sb.WriteByte((label[i+1]-'0')*100 + (label[i+2]-'0')*10 + (label[i+3] - '0'))
+			i += 3
+			continue
+		}
+		sb.WriteByte(label[i+1])
+		i++
+	}
+	return sb.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,587 @@
+package forwarder
+
+import (
+	"crypto"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is a tiny authoritative zone used to stand in for the DNS
+// hierarchy. Signed zones (with a key) generate RRSIGs and NSEC records on
+// the fly; unsigned zones serve their records as-is.
+type testZone struct {
+	origin  string
+	key     *dns.DNSKEY
+	signer  crypto.Signer
+	records []dns.RR
+}
+
+func newSignedZone(t *testing.T, origin string, records ...string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	zone := newUnsignedZone(t, origin, records...)
+	zone.key = key
+	zone.signer = priv.(crypto.Signer)
+	zone.records = append(zone.records, key)
+	return zone
+}
+
+func newUnsignedZone(t *testing.T, origin string, records ...string) *testZone {
+	t.Helper()
+	zone := &testZone{origin: origin}
+	records = append(records,
+		origin+" 3600 IN SOA ns."+strings.TrimPrefix(origin, ".")+" hostmaster."+strings.TrimPrefix(origin, ".")+" 1 3600 900 604800 300",
+		origin+" 3600 IN NS ns."+strings.TrimPrefix(origin, "."),
+	)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		require.NoError(t, err)
+		zone.records = append(zone.records, rr)
+	}
+	return zone
+}
+
+func (z *testZone) delegate(t *testing.T, child *testZone) {
+	t.Helper()
+	ns, err := dns.NewRR(child.origin + " 3600 IN NS ns." + child.origin)
+	require.NoError(t, err)
+	z.records = append(z.records, ns)
+	if child.key != nil {
+		z.records = append(z.records, child.key.ToDS(dns.SHA256))
+	}
+}
+
+func (z *testZone) sign(t *testing.T, rrs []dns.RR) *dns.RRSIG {
+	t.Helper()
+	hdr := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		TypeCovered: hdr.Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(hdr.Name)),
+		OrigTtl:     hdr.Ttl,
+		Expiration:  uint32(time.Now().Add(24 * time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.origin,
+	}
+	require.NoError(t, sig.Sign(z.signer, rrs))
+	return sig
+}
+
+func (z *testZone) lookup(name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.records {
+		if strings.EqualFold(rr.Header().Name, name) && rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// nsecChain builds the NSEC chain over all owner names in the zone.
+func (z *testZone) nsecChain() []*dns.NSEC {
+	types := make(map[string][]uint16)
+	for _, rr := range z.records {
+		name := dns.CanonicalName(rr.Header().Name)
+		types[name] = append(types[name], rr.Header().Rrtype)
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, canonicalCompare)
+
+	chain := make([]*dns.NSEC, 0, len(names))
+	for i, name := range names {
+		next := names[(i+1)%len(names)]
+		bitmap := append(types[name], dns.TypeNSEC, dns.TypeRRSIG)
+		slices.Sort(bitmap)
+		chain = append(chain, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: next,
+			TypeBitMap: slices.Compact(bitmap),
+		})
+	}
+	return chain
+}
+
+type testHierarchy struct {
+	zones []*testZone
+	// tamper lists names whose answers are modified after signing
+	tamper map[string]bool
+	// strip lists names whose answers are served without signatures
+	strip map[string]bool
+	// cosign lists names whose answers also carry an invalid signature from
+	// the root zone, ahead of their own
+	cosign map[string]bool
+	// unproven lists names whose wildcard answers are served without proof
+	// that the name does not exist
+	unproven map[string]bool
+	// nowildcard lists names whose NXDOMAIN answers are served without proof
+	// that no wildcard exists at the closest encloser
+	nowildcard map[string]bool
+}
+
+func (h *testHierarchy) zoneFor(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, zone := range h.zones {
+		if !dns.IsSubDomain(zone.origin, name) {
+			continue
+		}
+		// DS records live in the parent zone
+		if qtype == dns.TypeDS && strings.EqualFold(zone.origin, name) && name != "." {
+			continue
+		}
+		if best == nil || dns.CountLabel(zone.origin) > dns.CountLabel(best.origin) {
+			best = zone
+		}
+	}
+	return best
+}
+
+func (h *testHierarchy) handler(t *testing.T) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		zone := h.zoneFor(q.Name, q.Qtype)
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetEdns0(dns.DefaultMsgSize, true)
+
+		withSig := func(rrs []dns.RR) []dns.RR {
+			if zone.key == nil || h.strip[q.Name] {
+				return rrs
+			}
+			sig := zone.sign(t, rrs)
+			if h.cosign[q.Name] {
+				expired := h.zones[0].sign(t, rrs)
+				expired.Expiration = expired.Inception
+				rrs = append(rrs, expired)
+			}
+			return append(rrs, sig)
+		}
+
+		if rrs := zone.lookup(q.Name, q.Qtype); len(rrs) > 0 {
+			m.Answer = withSig(rrs)
+			if h.tamper[q.Name] {
+				tampered := dns.Copy(m.Answer[0]).(*dns.A)
+				tampered.A = net.ParseIP("198.51.100.66")
+				m.Answer[0] = tampered
+			}
+		} else if rrs := zone.lookup(q.Name, dns.TypeCNAME); len(rrs) > 0 {
+			// Chase in-zone targets as a recursive upstream would
+			m.Answer = withSig(rrs)
+			m.Answer = append(m.Answer, withSig(zone.lookup(rrs[0].(*dns.CNAME).Target, q.Qtype))...)
+		} else if rrs := zone.lookup(wildcardName(q.Name), q.Qtype); len(rrs) > 0 {
+			// Expand the wildcard, proving that the name itself does not exist
+			for _, rr := range withSig(rrs) {
+				rr = dns.Copy(rr)
+				rr.Header().Name = q.Name
+				m.Answer = append(m.Answer, rr)
+			}
+			if !h.unproven[q.Name] {
+				for _, nsec := range zone.nsecChain() {
+					if nsecCovers(nsec, q.Name) {
+						m.Ns = append(m.Ns, withSig([]dns.RR{nsec})...)
+					}
+				}
+			}
+		} else {
+			m.Ns = withSig(zone.lookup(zone.origin, dns.TypeSOA))
+			if zone.key != nil {
+				exists := false
+				for _, rr := range zone.records {
+					if strings.EqualFold(rr.Header().Name, q.Name) {
+						exists = true
+					}
+				}
+				if !exists {
+					m.Rcode = dns.RcodeNameError
+				}
+				chain := zone.nsecChain()
+				var proof []*dns.NSEC
+				for _, nsec := range chain {
+					if strings.EqualFold(nsec.Hdr.Name, q.Name) || (!exists && nsecCovers(nsec, q.Name)) {
+						proof = append(proof, nsec)
+					}
+				}
+				if !exists && len(proof) > 0 && !h.nowildcard[q.Name] {
+					wildcard := "*." + closestEncloserNSEC(proof[0], dns.CanonicalName(q.Name))
+					for _, nsec := range chain {
+						if nsecCovers(nsec, wildcard) && !slices.Contains(proof, nsec) {
+							proof = append(proof, nsec)
+						}
+					}
+				}
+				for _, nsec := range proof {
+					m.Ns = append(m.Ns, withSig([]dns.RR{nsec})...)
+				}
+			}
+		}
+
+		_ = w.WriteMsg(m)
+	}
+}
+
+// wildcardName returns the wildcard that would answer for the name.
+func wildcardName(name string) string {
+	labels := dns.Split(name)
+	if len(labels) < 2 {
+		return "*."
+	}
+	return "*." + name[labels[1]:]
+}
+
+func setupDNSSECTest(t *testing.T) *DNSDispatcher {
+	t.Helper()
+
+	root := newSignedZone(t, ".")
+	signed := newSignedZone(t, "signed.",
+		"www.signed. 3600 IN A 192.0.2.1",
+		"alias.signed. 3600 IN CNAME www.signed.",
+		"bad.signed. 3600 IN A 192.0.2.66",
+		"unsigned.signed. 3600 IN A 192.0.2.2",
+		"cosigned.signed. 3600 IN A 192.0.2.4",
+	)
+	wild := newSignedZone(t, "wild.",
+		"*.wild. 3600 IN A 192.0.2.9",
+	)
+	insecure := newUnsignedZone(t, "insecure.",
+		"host.insecure. 3600 IN A 192.0.2.3",
+	)
+	root.delegate(t, signed)
+	root.delegate(t, insecure)
+	root.delegate(t, wild)
+
+	hierarchy := &testHierarchy{
+		zones:      []*testZone{root, signed, insecure, wild},
+		tamper:     map[string]bool{"bad.signed.": true},
+		strip:      map[string]bool{"unsigned.signed.": true},
+		cosign:     map[string]bool{"cosigned.signed.": true},
+		unproven:   map[string]bool{"unproven.wild.": true},
+		nowildcard: map[string]bool{"nowildcard.signed.": true},
+	}
+
+	server, upstream := startLocalDNS(t, hierarchy.handler(t))
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, false)
+	validator, err := newDNSSECValidator(&config.DNSSECConfig{
+		Enabled:      true,
+		TrustAnchors: []string{root.key.ToDS(dns.SHA256).String()},
+	}, dispatcher.cache, dispatcher.dnsClient.Exchange, dispatcher.logger)
+	require.NoError(t, err)
+	dispatcher.validator = validator
+
+	return dispatcher
+}
+
+func dnssecQuery(t *testing.T, dispatcher *DNSDispatcher, name string, do bool, cd bool) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.CheckingDisabled = cd
+	if do {
+		req.SetEdns0(1232, true)
+	}
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	return writer.WrittenMsg
+}
+
+func countRRSIGs(rrs []dns.RR) int {
+	count := 0
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDNSSEC_Secure(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "www.signed.", true, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.AuthenticatedData, "secure answer should have AD set")
+	assert.Equal(t, 1, countRRSIGs(resp.Answer), "DO client should receive signatures")
+
+	// Served from cache: still authenticated, signatures withheld without DO
+	assert.Eventually(t, func() bool {
+		_, ok := dispatcher.cache.Get("www.signed.:A")
+		return ok
+	}, 5*time.Second, 50*time.Millisecond)
+
+	resp = dnssecQuery(t, dispatcher, "www.signed.", false, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.False(t, resp.AuthenticatedData, "AD is only set for clients that set DO or AD")
+	assert.Len(t, resp.Answer, 1)
+	assert.Zero(t, countRRSIGs(resp.Answer))
+
+	resp = dnssecQuery(t, dispatcher, "www.signed.", true, false)
+	assert.True(t, resp.AuthenticatedData, "cached secure answer should have AD set")
+}
+
+func TestDNSSEC_ShedsValidationFetches(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+	shedder, err := newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 1, Rcode: "refused"}, dispatcher.metrics)
+	require.NoError(t, err)
+	dispatcher.shedder = shedder
+
+	// The forwarded query gets through, but there is no room for the fetches
+	// of its validation
+	busy, err := newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 1}, dispatcher.metrics)
+	require.NoError(t, err)
+	release, err := busy.acquire()
+	require.NoError(t, err)
+	defer release()
+	dispatcher.validator.exchange = busy.limit(dispatcher.dnsClient.Exchange)
+
+	resp := dnssecQuery(t, dispatcher, "www.signed.", true, false)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	ede := blockedEDE(t, resp)
+	assert.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode, "shed rather than bogus")
+}
+
+func TestDNSSEC_SecureCNAME(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "alias.signed.", true, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.AuthenticatedData)
+}
+
+func TestDNSSEC_SecureNXDOMAIN(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "nope.signed.", true, false)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.True(t, resp.AuthenticatedData, "proven NXDOMAIN should have AD set")
+}
+
+func TestDNSSEC_NXDOMAINWithoutWildcardProof(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "nowildcard.signed.", true, false)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.False(t, resp.AuthenticatedData, "NXDOMAIN without a wildcard proof must not have AD set")
+}
+
+func TestDNSSEC_Insecure(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "host.insecure.", true, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.False(t, resp.AuthenticatedData, "insecure answer must not have AD set")
+	assert.Len(t, resp.Answer, 1)
+}
+
+func TestDNSSEC_Bogus(t *testing.T) {
+	for _, name := range []string{"bad.signed.", "unsigned.signed."} {
+		t.Run(name, func(t *testing.T) {
+			dispatcher := setupDNSSECTest(t)
+
+			resp := dnssecQuery(t, dispatcher, name, true, false)
+			assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+			assert.Empty(t, resp.Answer)
+
+			ede := blockedEDE(t, resp)
+			assert.Equal(t, dns.ExtendedErrorCodeDNSBogus, ede.InfoCode)
+
+			// Bogus answers are never cached
+			time.Sleep(50 * time.Millisecond)
+			_, ok := dispatcher.cache.Get(name + ":A")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestDNSSEC_SecureWildcard(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "host.wild.", true, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.AuthenticatedData)
+	require.NotEmpty(t, resp.Answer)
+	assert.Equal(t, "192.0.2.9", resp.Answer[0].(*dns.A).A.String())
+}
+
+func TestDNSSEC_WildcardWithoutProof(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "unproven.wild.", true, false)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.False(t, resp.AuthenticatedData)
+}
+
+func TestDNSSEC_SecureWithSeveralSigners(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "cosigned.signed.", true, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.AuthenticatedData)
+}
+
+func TestIsWildcardExpansion(t *testing.T) {
+	assert.False(t, isWildcardExpansion("www.example.", &dns.RRSIG{Labels: 2}))
+	assert.True(t, isWildcardExpansion("www.example.", &dns.RRSIG{Labels: 1}))
+	assert.False(t, isWildcardExpansion("*.example.", &dns.RRSIG{Labels: 1}), "wildcard queried directly")
+}
+
+func TestProveWildcardExpansion_NSEC(t *testing.T) {
+	nsecs := []*dns.NSEC{
+		{Hdr: dns.RR_Header{Name: "*.example."}, NextDomain: "a.example.", TypeBitMap: []uint16{dns.TypeA}},
+		{Hdr: dns.RR_Header{Name: "a.example."}, NextDomain: "x.y.example.", TypeBitMap: []uint16{dns.TypeA}},
+	}
+
+	proven, optOut := proveWildcardExpansion("b.example.", 1, nsecs, nil)
+	assert.True(t, proven)
+	assert.False(t, optOut)
+
+	proven, _ = proveWildcardExpansion("a.example.", 1, nsecs, nil)
+	assert.False(t, proven, "name exists")
+
+	proven, _ = proveWildcardExpansion("b.y.example.", 1, nsecs, nil)
+	assert.False(t, proven, "y.example. is an empty non-terminal")
+
+	proven, _ = proveWildcardExpansion("b.example.", 2, nsecs, nil)
+	assert.False(t, proven, "not an expansion")
+}
+
+func TestDNSSEC_CheckingDisabled(t *testing.T) {
+	dispatcher := setupDNSSECTest(t)
+
+	resp := dnssecQuery(t, dispatcher, "bad.signed.", true, true)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode, "CD clients get the bogus answer to judge for themselves")
+	assert.False(t, resp.AuthenticatedData)
+	assert.NotEmpty(t, resp.Answer)
+}
+
+func TestNewDNSSECValidator_InvalidAnchor(t *testing.T) {
+	_, err := newDNSSECValidator(&config.DNSSECConfig{Enabled: true, TrustAnchors: []string{"example. IN A 192.0.2.1"}}, nil, nil, nil)
+	assert.ErrorContains(t, err, "is not a root DS record")
+
+	_, err = newDNSSECValidator(&config.DNSSECConfig{Enabled: true}, nil, nil, nil)
+	assert.ErrorContains(t, err, "at least one trust anchor")
+
+	validator, err := newDNSSECValidator(&config.DNSSECConfig{Enabled: false}, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, validator)
+
+	defaults := config.DefaultConfig().DNS.DNSSEC
+	defaults.Enabled = true
+	_, err = newDNSSECValidator(defaults, nil, nil, nil)
+	assert.NoError(t, err, "default root trust anchors should parse")
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// Canonical ordering example from RFC 4034 6.1
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"\\001.z.example.",
+		"*.z.example.",
+		"\\200.z.example.",
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		assert.Negative(t, canonicalCompare(ordered[i], ordered[i+1]), "%s < %s", ordered[i], ordered[i+1])
+	}
+}
+
+func TestProveDenial_NSEC(t *testing.T) {
+	nsecs := []*dns.NSEC{
+		{Hdr: dns.RR_Header{Name: "example."}, NextDomain: "a.example.", TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA}},
+		{Hdr: dns.RR_Header{Name: "a.example."}, NextDomain: "x.y.example.", TypeBitMap: []uint16{dns.TypeA}},
+		{Hdr: dns.RR_Header{Name: "x.y.example."}, NextDomain: "z.example.", TypeBitMap: []uint16{dns.TypeA}},
+		{Hdr: dns.RR_Header{Name: "z.example."}, NextDomain: "example.", TypeBitMap: []uint16{dns.TypeNS}},
+	}
+
+	assert.Equal(t, denialNXDomain, proveDenial("b.example.", dns.TypeA, nsecs, nil).kind)
+	assert.Equal(t, denialNXDomain, proveDenial("zz.example.", dns.TypeA, nsecs, nil).kind, "wraps around to apex")
+	assert.Equal(t, denialNoData, proveDenial("a.example.", dns.TypeAAAA, nsecs, nil).kind)
+	assert.Equal(t, denialNone, proveDenial("a.example.", dns.TypeA, nsecs, nil).kind)
+	assert.Equal(t, denialNoData, proveDenial("y.example.", dns.TypeA, nsecs, nil).kind, "empty non-terminal")
+
+	proof := proveDenial("z.example.", dns.TypeDS, nsecs, nil)
+	assert.Equal(t, denialNoData, proof.kind)
+	assert.True(t, proof.delegation, "NS without SOA is an unsigned delegation")
+
+	assert.Equal(t, denialNone, proveDenial("z.example.", dns.TypeAAAA, nsecs, nil).kind, "parent side of a delegation only proves no DS")
+	assert.Equal(t, denialNone, proveDenial("a.z.example.", dns.TypeA, nsecs, nil).kind, "parent is not authoritative below a delegation")
+	assert.Equal(t, denialNone, proveDenial("b.example.", dns.TypeA, nsecs[1:], nil).kind, "missing proof that *.example. does not exist")
+
+	withWildcard := append([]*dns.NSEC{
+		{Hdr: dns.RR_Header{Name: "example."}, NextDomain: "*.example.", TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA}},
+		{Hdr: dns.RR_Header{Name: "*.example."}, NextDomain: "a.example.", TypeBitMap: []uint16{dns.TypeTXT}},
+	}, nsecs[1:]...)
+	assert.Equal(t, denialNone, proveDenial("b.example.", dns.TypeTXT, withWildcard, nil).kind, "wildcard answers for the name")
+	assert.Equal(t, denialNoData, proveDenial("b.example.", dns.TypeA, withWildcard, nil).kind, "wildcard exists without the type")
+}
+
+func TestProveDenial_NSEC3(t *testing.T) {
+	// nsec3 returns an NSEC3 matching the name, whose span covers no others
+	nsec3 := func(name string, flags uint8, types ...uint16) *dns.NSEC3 {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		return &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: hash + ".example."},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			NextDomain: hash + "0",
+			TypeBitMap: types,
+		}
+	}
+	// cover returns an NSEC3 whose span just covers the hash of the name
+	cover := func(name string, flags uint8) *dns.NSEC3 {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		rr := nsec3(name, flags)
+		rr.Hdr.Name = hash[:len(hash)-1] + ".example."
+		return rr
+	}
+
+	apex := nsec3("example.", 0, dns.TypeNS, dns.TypeSOA)
+	proof := []*dns.NSEC3{apex, cover("b.example.", 0), cover("*.example.", 0)}
+	assert.Equal(t, denialNXDomain, proveDenial("b.example.", dns.TypeA, nil, proof).kind)
+	assert.Equal(t, denialNone, proveDenial("b.example.", dns.TypeA, nil, proof[:2]).kind, "missing proof that *.example. does not exist")
+
+	optOut := proveDenial("b.example.", dns.TypeA, nil, []*dns.NSEC3{apex, cover("b.example.", 1)})
+	assert.True(t, optOut.optOut)
+
+	delegation := nsec3("z.example.", 0, dns.TypeNS)
+	assert.Equal(t, denialNoData, proveDenial("z.example.", dns.TypeDS, nil, []*dns.NSEC3{delegation}).kind)
+	assert.Equal(t, denialNone, proveDenial("z.example.", dns.TypeA, nil, []*dns.NSEC3{delegation}).kind, "parent side of a delegation only proves no DS")
+	assert.Equal(t, denialNone, proveDenial("a.z.example.", dns.TypeA, nil, []*dns.NSEC3{delegation, cover("a.z.example.", 0), cover("*.z.example.", 0)}).kind, "parent is not authoritative below a delegation")
+}
+
+func TestExceedsNSEC3Iterations(t *testing.T) {
+	assert.False(t, exceedsNSEC3Iterations([]*dns.NSEC3{{Iterations: 0}, {Iterations: maxNSEC3Iterations}}))
+	assert.True(t, exceedsNSEC3Iterations([]*dns.NSEC3{{Iterations: 0}, {Iterations: 2500}}))
+}
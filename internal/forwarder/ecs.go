@@ -0,0 +1,239 @@
+package forwarder
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+)
+
+// scopedQuestions bounds the questions whose scoped answer prefix lengths are
+// remembered. Forgetting one only means its scoped answers miss the cache.
+const scopedQuestions = 10_000
+
+const (
+	ClientECSOverride = "override"
+	ClientECSHonour   = "honour"
+	ClientECSStrip    = "strip"
+)
+
+// ecsPolicy decides which EDNS0 Client Subnet (RFC 7871), if any, is sent
+// upstream on behalf of a client.
+type ecsPolicy struct {
+	ipv4Prefix int
+	ipv6Prefix int
+	clientECS  string
+	domains    []string
+
+	// scopes holds the prefix lengths that answers to each question have
+	// been cached under, so that lookups only try those.
+	scopesMu sync.Mutex
+	scopes   *simplelru.LRU[string, scopeSet]
+}
+
+// scopeSet is a set of prefix lengths from 1 to 128.
+type scopeSet [2]uint64
+
+func (s *scopeSet) add(bits int) {
+	s[(bits-1)/64] |= 1 << ((bits - 1) % 64)
+}
+
+func (s scopeSet) has(bits int) bool {
+	return s[(bits-1)/64]&(1<<((bits-1)%64)) != 0
+}
+
+func newECSPolicy(cfg *config.ECSConfig) (*ecsPolicy, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	// A prefix length of 0 is deliberate: the defaults are set by the config
+	// loader, and a /0 subnet tells upstreams not to use our address either.
+	scopes, err := simplelru.NewLRU[string, scopeSet](scopedQuestions, nil)
+	if err != nil {
+		return nil, err
+	}
+	p := &ecsPolicy{
+		ipv4Prefix: cfg.IPv4Prefix,
+		ipv6Prefix: cfg.IPv6Prefix,
+		clientECS:  cfg.ClientECS,
+		scopes:     scopes,
+	}
+	if p.clientECS == "" {
+		p.clientECS = ClientECSOverride
+	}
+
+	if p.ipv4Prefix < 0 || p.ipv4Prefix > 32 {
+		return nil, errors.Newf("invalid ECS IPv4 prefix length: %d", p.ipv4Prefix)
+	}
+	if p.ipv6Prefix < 0 || p.ipv6Prefix > 128 {
+		return nil, errors.Newf("invalid ECS IPv6 prefix length: %d", p.ipv6Prefix)
+	}
+	switch p.clientECS {
+	case ClientECSOverride, ClientECSHonour, ClientECSStrip:
+	default:
+		return nil, errors.Newf("invalid client ECS policy: %q (expected %q, %q or %q)", p.clientECS, ClientECSOverride, ClientECSHonour, ClientECSStrip)
+	}
+
+	for _, domain := range cfg.Domains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		if domain != "" {
+			p.domains = append(p.domains, dns.Fqdn(domain))
+		}
+	}
+
+	return p, nil
+}
+
+// addScope records that an answer to the question with the cache key has been
+// cached for a subnet with the prefix length.
+func (p *ecsPolicy) addScope(key string, bits int) {
+	p.scopesMu.Lock()
+	defer p.scopesMu.Unlock()
+	scopes, _ := p.scopes.Get(key)
+	scopes.add(bits)
+	p.scopes.Add(key, scopes)
+}
+
+// cachedScopes returns the prefix lengths that answers to the question with
+// the cache key may have been cached for.
+func (p *ecsPolicy) cachedScopes(key string) scopeSet {
+	p.scopesMu.Lock()
+	defer p.scopesMu.Unlock()
+	scopes, _ := p.scopes.Get(key)
+	return scopes
+}
+
+// appliesTo returns whether ECS may be sent for the name at all.
+func (p *ecsPolicy) appliesTo(name string) bool {
+	if len(p.domains) == 0 {
+		return true
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	for _, domain := range p.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// subnet returns the client subnet to send upstream for a query about name,
+// or an invalid prefix if none should be sent. Client-supplied options are
+// subject to the client ECS policy; a client sending a /0 source prefix has
+// opted out of ECS (RFC 7871 7.1.2), which is always respected.
+func (p *ecsPolicy) subnet(ipAddr string, req *dns.Msg, name string) netip.Prefix {
+	if p == nil || !p.appliesTo(name) {
+		return netip.Prefix{}
+	}
+
+	if clientECS := findECS(req); clientECS != nil {
+		if clientECS.SourceNetmask == 0 {
+			return netip.Prefix{}
+		}
+		switch p.clientECS {
+		case ClientECSStrip:
+			return netip.Prefix{}
+		case ClientECSHonour:
+			if addr, ok := netip.AddrFromSlice(clientECS.Address); ok {
+				return p.truncate(addr.Unmap(), int(clientECS.SourceNetmask))
+			}
+		}
+	}
+
+	addr, err := netip.ParseAddr(ipAddr)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	return p.truncate(addr.Unmap(), 128)
+}
+
+// truncate masks the address to the shorter of the requested and configured
+// prefix lengths, so that clients cannot leak more of their address than the
+// operator allows.
+func (p *ecsPolicy) truncate(addr netip.Addr, bits int) netip.Prefix {
+	limit := p.ipv6Prefix
+	if addr.Is4() {
+		limit = p.ipv4Prefix
+	}
+	prefix, err := addr.Prefix(min(bits, limit))
+	if err != nil {
+		return netip.Prefix{}
+	}
+	return prefix
+}
+
+// findECS returns the client subnet option of the message, if any.
+func findECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// newECSOption builds the client subnet option for the prefix.
+func newECSOption(prefix netip.Prefix) *dns.EDNS0_SUBNET {
+	family := uint16(2)
+	if prefix.Addr().Is4() {
+		family = 1
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(prefix.Bits()),
+		SourceScope:   0,
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	}
+}
+
+// scopedSubnet returns the subnet an upstream response to a query sent with
+// the given client subnet is valid for, as given by its SCOPE PREFIX-LENGTH
+// (RFC 7871 7.3.1). A scope longer than the subnet sent is capped to it.
+// Responses with a scope of zero (or without an ECS option at all) are valid
+// for every client, for which an invalid prefix is returned.
+func scopedSubnet(sent netip.Prefix, resp *dns.Msg) netip.Prefix {
+	if !sent.IsValid() {
+		return netip.Prefix{}
+	}
+	ecs := findECS(resp)
+	if ecs == nil || ecs.SourceScope == 0 || sent.Bits() == 0 {
+		return netip.Prefix{}
+	}
+	scoped, err := sent.Addr().Prefix(min(int(ecs.SourceScope), sent.Bits()))
+	if err != nil {
+		return netip.Prefix{}
+	}
+	return scoped
+}
+
+// cacheSubnet returns the cache key suffix for answers scoped to the subnet.
+func cacheSubnet(scoped netip.Prefix) string {
+	if !scoped.IsValid() {
+		return ""
+	}
+	return scoped.String()
+}
+
+// echoedECS returns the client subnet option to echo back to a client that
+// sent one, with the scope of the answer (RFC 7871 7.2.1). The scope is 0 if
+// the answer was not tailored to the client's subnet, e.g. because it was
+// overridden by the client's own address.
+func echoedECS(clientECS *dns.EDNS0_SUBNET, used netip.Prefix, scope int) *dns.EDNS0_SUBNET {
+	echo := *clientECS
+	echo.SourceScope = 0
+	if addr, ok := netip.AddrFromSlice(clientECS.Address); ok && used.IsValid() && used.Contains(addr.Unmap()) {
+		echo.SourceScope = uint8(min(scope, int(clientECS.SourceNetmask)))
+	}
+	return &echo
+}
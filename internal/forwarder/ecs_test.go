@@ -0,0 +1,331 @@
+package forwarder
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// ecsScopeWriter echoes the query's client subnet option back in the
+// response with the given scope, as an ECS-aware authoritative server would.
+type ecsScopeWriter struct {
+	dns.ResponseWriter
+	ecs   *dns.EDNS0_SUBNET
+	scope uint8
+}
+
+func (w *ecsScopeWriter) WriteMsg(m *dns.Msg) error {
+	if w.ecs != nil {
+		echo := *w.ecs
+		echo.SourceScope = w.scope
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &echo)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// ecsScopeHandler wraps an upstream handler so that responses carry the given
+// ECS scope, reporting the client subnet option of each query to seen.
+func ecsScopeHandler(next dns.HandlerFunc, scope uint8, seen func(*dns.EDNS0_SUBNET)) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		ecs := findECS(r)
+		if seen != nil {
+			seen(ecs)
+		}
+		next(&ecsScopeWriter{ResponseWriter: w, ecs: ecs, scope: scope}, r)
+	}
+}
+
+func newTestECSConfig(clientECS string, domains ...string) *config.ECSConfig {
+	return &config.ECSConfig{Enabled: true, IPv4Prefix: 24, IPv6Prefix: 56, ClientECS: clientECS, Domains: domains}
+}
+
+func ecsRequest(name string, clientSubnet string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	if clientSubnet != "" {
+		prefix := netip.MustParsePrefix(clientSubnet)
+		req.SetEdns0(1232, false)
+		req.IsEdns0().Option = append(req.IsEdns0().Option, newECSOption(prefix))
+	}
+	return req
+}
+
+func TestNewECSPolicy(t *testing.T) {
+	policy, err := newECSPolicy(&config.ECSConfig{Enabled: false})
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+
+	policy, err = newECSPolicy(config.DefaultConfig().DNS.ECS)
+	assert.NoError(t, err)
+	assert.Nil(t, policy, "disabled by default")
+
+	policy, err = newECSPolicy(&config.ECSConfig{Enabled: true, IPv4Prefix: 24, IPv6Prefix: 48})
+	require.NoError(t, err)
+	assert.Equal(t, 24, policy.ipv4Prefix)
+	assert.Equal(t, 48, policy.ipv6Prefix)
+	assert.Equal(t, ClientECSOverride, policy.clientECS)
+
+	policy, err = newECSPolicy(&config.ECSConfig{Enabled: true})
+	require.NoError(t, err)
+	assert.Equal(t, 0, policy.ipv4Prefix, "0 is not replaced by a default")
+	assert.Equal(t, 0, policy.ipv6Prefix, "0 is not replaced by a default")
+
+	_, err = newECSPolicy(&config.ECSConfig{Enabled: true, IPv4Prefix: 33})
+	assert.ErrorContains(t, err, "invalid ECS IPv4 prefix length")
+
+	_, err = newECSPolicy(&config.ECSConfig{Enabled: true, IPv6Prefix: 129})
+	assert.ErrorContains(t, err, "invalid ECS IPv6 prefix length")
+
+	_, err = newECSPolicy(&config.ECSConfig{Enabled: true, ClientECS: "ignore"})
+	assert.ErrorContains(t, err, "invalid client ECS policy")
+}
+
+func TestECSPolicy_Subnet(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          *config.ECSConfig
+		clientIP     string
+		qname        string
+		clientSubnet string
+		expected     string
+	}{
+		{name: "IPv4 configured prefix", cfg: newTestECSConfig(ClientECSOverride), clientIP: "1.2.3.4", qname: "example.com.", expected: "1.2.3.0/24"},
+		{name: "IPv6 configured prefix", cfg: newTestECSConfig(ClientECSOverride), clientIP: "2001:db8:1:2ff::1", qname: "example.com.", expected: "2001:db8:1:200::/56"},
+		{name: "IPv4-mapped IPv6", cfg: newTestECSConfig(ClientECSOverride), clientIP: "::ffff:1.2.3.4", qname: "example.com.", expected: "1.2.3.0/24"},
+		{name: "Unknown IP", cfg: newTestECSConfig(ClientECSOverride), clientIP: "unknown", qname: "example.com.", expected: ""},
+		{name: "Override client ECS", cfg: newTestECSConfig(ClientECSOverride), clientIP: "1.2.3.4", qname: "example.com.", clientSubnet: "9.9.9.0/24", expected: "1.2.3.0/24"},
+		{name: "Honour client ECS", cfg: newTestECSConfig(ClientECSHonour), clientIP: "1.2.3.4", qname: "example.com.", clientSubnet: "9.9.9.0/24", expected: "9.9.9.0/24"},
+		{name: "Honour truncates client ECS", cfg: newTestECSConfig(ClientECSHonour), clientIP: "1.2.3.4", qname: "example.com.", clientSubnet: "9.9.9.9/32", expected: "9.9.9.0/24"},
+		{name: "Honour keeps shorter client ECS", cfg: newTestECSConfig(ClientECSHonour), clientIP: "1.2.3.4", qname: "example.com.", clientSubnet: "9.9.0.0/16", expected: "9.9.0.0/16"},
+		{name: "Strip client ECS", cfg: newTestECSConfig(ClientECSStrip), clientIP: "1.2.3.4", qname: "example.com.", clientSubnet: "9.9.9.0/24", expected: ""},
+		{name: "Strip without client ECS", cfg: newTestECSConfig(ClientECSStrip), clientIP: "1.2.3.4", qname: "example.com.", expected: "1.2.3.0/24"},
+		{name: "Client opt-out", cfg: newTestECSConfig(ClientECSOverride), clientIP: "1.2.3.4", qname: "example.com.", clientSubnet: "0.0.0.0/0", expected: ""},
+		{name: "Listed domain", cfg: newTestECSConfig(ClientECSOverride, "cdn.example"), clientIP: "1.2.3.4", qname: "img.CDN.example.", expected: "1.2.3.0/24"},
+		{name: "Unlisted domain", cfg: newTestECSConfig(ClientECSOverride, "cdn.example"), clientIP: "1.2.3.4", qname: "example.com.", expected: ""},
+		{name: "Disabled", cfg: &config.ECSConfig{Enabled: false}, clientIP: "1.2.3.4", qname: "example.com.", expected: ""},
+		{name: "Zero prefix", cfg: &config.ECSConfig{Enabled: true}, clientIP: "1.2.3.4", qname: "example.com.", expected: "0.0.0.0/0"},
+		{name: "Zero prefix IPv6", cfg: &config.ECSConfig{Enabled: true}, clientIP: "2001:db8::1", qname: "example.com.", expected: "::/0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newECSPolicy(tt.cfg)
+			require.NoError(t, err)
+
+			subnet := policy.subnet(tt.clientIP, ecsRequest(tt.qname, tt.clientSubnet), tt.qname)
+			if tt.expected == "" {
+				assert.False(t, subnet.IsValid(), "expected no subnet, got %s", subnet)
+			} else {
+				assert.Equal(t, tt.expected, subnet.String())
+			}
+		})
+	}
+}
+
+func TestScopedSubnet(t *testing.T) {
+	sent := netip.MustParsePrefix("1.2.3.0/24")
+
+	resp := new(dns.Msg)
+	assert.False(t, scopedSubnet(sent, resp).IsValid(), "no ECS in response means scope 0")
+
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+	ecs := newECSOption(sent)
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, ecs)
+	assert.False(t, scopedSubnet(sent, resp).IsValid())
+
+	ecs.SourceScope = 24
+	assert.Equal(t, "1.2.3.0/24", scopedSubnet(sent, resp).String())
+	ecs.SourceScope = 16
+	assert.Equal(t, "1.2.0.0/16", scopedSubnet(sent, resp).String(), "cached under the scope returned")
+	ecs.SourceScope = 32
+	assert.Equal(t, "1.2.3.0/24", scopedSubnet(sent, resp).String(), "capped to the subnet sent")
+	assert.False(t, scopedSubnet(netip.Prefix{}, resp).IsValid(), "no subnet sent")
+	assert.False(t, scopedSubnet(netip.MustParsePrefix("0.0.0.0/0"), resp).IsValid(), "empty subnet sent")
+}
+
+func TestECSPolicy_CachedScopes(t *testing.T) {
+	policy, err := newECSPolicy(&config.ECSConfig{Enabled: true, IPv4Prefix: 24, IPv6Prefix: 56})
+	require.NoError(t, err)
+
+	policy.addScope("example.com.:A", 16)
+	policy.addScope("example.com.:A", 24)
+	policy.addScope("example.com.:AAAA", 128)
+
+	scopes := policy.cachedScopes("example.com.:A")
+	for bits := 1; bits <= 128; bits++ {
+		assert.Equal(t, bits == 16 || bits == 24, scopes.has(bits), bits)
+	}
+	assert.True(t, policy.cachedScopes("example.com.:AAAA").has(128))
+	assert.Equal(t, scopeSet{}, policy.cachedScopes("example.org.:A"), "nothing cached")
+}
+
+func TestEchoedECS(t *testing.T) {
+	clientECS := newECSOption(netip.MustParsePrefix("9.9.9.0/24"))
+
+	echo := echoedECS(clientECS, netip.MustParsePrefix("9.9.9.0/24"), 16)
+	assert.Equal(t, uint8(24), echo.SourceNetmask)
+	assert.Equal(t, uint8(16), echo.SourceScope)
+	assert.Equal(t, uint8(0), clientECS.SourceScope, "client option is not modified")
+
+	echo = echoedECS(clientECS, netip.MustParsePrefix("9.9.9.0/24"), 32)
+	assert.Equal(t, uint8(24), echo.SourceScope, "capped to the source prefix")
+
+	echo = echoedECS(clientECS, netip.MustParsePrefix("1.2.3.0/24"), 24)
+	assert.Equal(t, uint8(0), echo.SourceScope, "client subnet was overridden")
+
+	echo = echoedECS(clientECS, netip.Prefix{}, 0)
+	assert.Equal(t, uint8(0), echo.SourceScope, "client subnet was stripped")
+}
+
+func setupECSDispatcherTest(t *testing.T, scope uint8, cfg *config.ECSConfig) (*DNSDispatcher, *atomic.Int32, *atomic.Pointer[dns.EDNS0_SUBNET]) {
+	t.Helper()
+	var queries atomic.Int32
+	var lastECS atomic.Pointer[dns.EDNS0_SUBNET]
+	server, upstream := startLocalDNS(t, ecsScopeHandler(dnsRecord("example.com.", dns.TypeA, []byte{93, 184, 216, 34}), scope, func(ecs *dns.EDNS0_SUBNET) {
+		queries.Add(1)
+		lastECS.Store(ecs)
+	}))
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, true)
+	if cfg != nil {
+		policy, err := newECSPolicy(cfg)
+		require.NoError(t, err)
+		dispatcher.ecs = policy
+	}
+	return dispatcher, &queries, &lastECS
+}
+
+func ecsResolve(t *testing.T, dispatcher *DNSDispatcher, clientIP string, req *dns.Msg) {
+	t.Helper()
+	writer := &mockIPResponseWriter{ip: clientIP, port: 12345}
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, req)
+	require.NotNil(t, writer.WrittenMsg)
+	require.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
+	require.Len(t, writer.WrittenMsg.Answer, 1)
+}
+
+func TestDNSDispatcher_ECS_ScopeZeroSharedAcrossSubnets(t *testing.T) {
+	dispatcher, queries, _ := setupECSDispatcherTest(t, 0, nil)
+
+	ecsResolve(t, dispatcher, "1.2.3.4", ecsRequest("example.com.", ""))
+	assert.Eventually(t, func() bool {
+		_, ok := dispatcher.cache.Get("example.com.:A")
+		return ok
+	}, 5*time.Second, 50*time.Millisecond, "scope 0 answer should be cached under the shared key")
+
+	ecsResolve(t, dispatcher, "5.6.7.8", ecsRequest("example.com.", ""))
+	assert.Equal(t, int32(1), queries.Load(), "second subnet should be served from the shared cache entry")
+}
+
+func TestDNSDispatcher_ECS_ScopedAnswersCachedPerSubnet(t *testing.T) {
+	dispatcher, queries, _ := setupECSDispatcherTest(t, 24, nil)
+
+	ecsResolve(t, dispatcher, "1.2.3.4", ecsRequest("example.com.", ""))
+	assert.Eventually(t, func() bool {
+		_, ok := dispatcher.cache.Get("example.com.:A:1.2.3.0/24")
+		return ok
+	}, 5*time.Second, 50*time.Millisecond)
+
+	ecsResolve(t, dispatcher, "1.2.3.99", ecsRequest("example.com.", ""))
+	assert.Equal(t, int32(1), queries.Load(), "same subnet should be served from cache")
+
+	ecsResolve(t, dispatcher, "5.6.7.8", ecsRequest("example.com.", ""))
+	assert.Equal(t, int32(2), queries.Load(), "other subnets must not receive a tailored answer")
+}
+
+func TestDNSDispatcher_ECS_CachedByReturnedScope(t *testing.T) {
+	dispatcher, queries, _ := setupECSDispatcherTest(t, 16, nil)
+
+	ecsResolve(t, dispatcher, "1.2.3.4", ecsRequest("example.com.", ""))
+	assert.Eventually(t, func() bool {
+		_, ok := dispatcher.cache.Get("example.com.:A:1.2.0.0/16")
+		return ok
+	}, 5*time.Second, 50*time.Millisecond)
+
+	ecsResolve(t, dispatcher, "1.2.99.1", ecsRequest("example.com.", ""))
+	assert.Equal(t, int32(1), queries.Load(), "subnets within the returned scope should be served from cache")
+
+	ecsResolve(t, dispatcher, "1.3.3.4", ecsRequest("example.com.", ""))
+	assert.Equal(t, int32(2), queries.Load(), "subnets outside the returned scope must not receive the answer")
+}
+
+func TestDNSDispatcher_ECS_EchoesClientECS(t *testing.T) {
+	dispatcher, _, _ := setupECSDispatcherTest(t, 16, newTestECSConfig(ClientECSHonour))
+
+	writer := &mockIPResponseWriter{ip: "1.2.3.4", port: 12345}
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, ecsRequest("example.com.", "9.9.9.0/24"))
+
+	require.NotNil(t, writer.WrittenMsg)
+	echo := findECS(writer.WrittenMsg)
+	require.NotNil(t, echo, "client ECS must be echoed in the response")
+	assert.Equal(t, "9.9.9.0", net.IP(echo.Address).String())
+	assert.Equal(t, uint8(24), echo.SourceNetmask)
+	assert.Equal(t, uint8(16), echo.SourceScope)
+
+	// Without a client ECS option, none is added
+	writer = &mockIPResponseWriter{ip: "1.2.3.4", port: 12345}
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, ecsRequest("example.com.", ""))
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Nil(t, findECS(writer.WrittenMsg))
+}
+
+func TestDNSDispatcher_ECS_ClientPolicy(t *testing.T) {
+	tests := []struct {
+		clientECS string
+		expected  string
+	}{
+		{clientECS: ClientECSOverride, expected: "1.2.3.0/24"},
+		{clientECS: ClientECSHonour, expected: "9.9.9.0/24"},
+		{clientECS: ClientECSStrip, expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clientECS, func(t *testing.T) {
+			dispatcher, _, lastECS := setupECSDispatcherTest(t, 24, newTestECSConfig(tt.clientECS))
+
+			ecsResolve(t, dispatcher, "1.2.3.4", ecsRequest("example.com.", "9.9.9.9/32"))
+
+			ecs := lastECS.Load()
+			if tt.expected == "" {
+				assert.Nil(t, ecs, "client ECS should not be forwarded")
+				return
+			}
+			require.NotNil(t, ecs)
+			prefix := netip.PrefixFrom(netip.MustParseAddr(net.IP(ecs.Address).String()).Unmap(), int(ecs.SourceNetmask))
+			assert.Equal(t, tt.expected, prefix.String())
+		})
+	}
+}
+
+func TestDNSDispatcher_ECS_DisabledStripsClientECS(t *testing.T) {
+	dispatcher, _, lastECS := setupECSDispatcherTest(t, 0, &config.ECSConfig{Enabled: false})
+
+	ecsResolve(t, dispatcher, "1.2.3.4", ecsRequest("example.com.", "9.9.9.0/24"))
+	assert.Nil(t, lastECS.Load(), "client ECS must not leak upstream when ECS is disabled")
+}
+
+func TestDNSDispatcher_ECS_NotDerivedForODoH(t *testing.T) {
+	dispatcher, _, lastECS := setupECSDispatcherTest(t, 0, newTestECSConfig(ClientECSOverride))
+
+	// The remote address of an ODoH query is the relay's, never the client's
+	writer := &mockIPResponseWriter{ip: "1.2.3.4", port: 12345}
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest(SourceODoH)(writer, ecsRequest("example.com.", ""))
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
+	assert.Nil(t, lastECS.Load(), "relay address must not be sent upstream as ECS")
+}
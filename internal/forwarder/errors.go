@@ -26,6 +26,19 @@ func (e *RcodeError) ShouldLog() bool {
 	return e.Rcode != dns.RcodeNameError && e.Rcode != dns.RcodeNotImplemented
 }
 
+// DNSSECError is returned when an upstream response fails DNSSEC validation.
+type DNSSECError struct {
+	Err error
+}
+
+func (e *DNSSECError) Error() string {
+	return "DNSSEC validation failed: " + e.Err.Error()
+}
+
+func (e *DNSSECError) Unwrap() error {
+	return e.Err
+}
+
 func ShouldLog(err error) bool {
 	if err == nil {
 		return false
@@ -0,0 +1,102 @@
+package forwarder
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/metrics"
+)
+
+// ErrOverloaded is returned for queries shed because no upstream slot became
+// free within the queue timeout.
+var ErrOverloaded = errors.New("too many outstanding upstream queries")
+
+var loadSheddingRcodes = map[string]int{
+	"servfail": dns.RcodeServerFailure,
+	"refused":  dns.RcodeRefused,
+}
+
+// loadShedder bounds the number of outstanding upstream queries. Without it,
+// a latency spike upstream piles up goroutines (and client connections)
+// without limit; with it, queries only wait for a slot as long as the queue
+// timeout, after which they are shed and only answered from the cache.
+type loadShedder struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	rcode        int
+	metrics      *metrics.DnsMetrics
+}
+
+func newLoadShedder(cfg *config.LoadSheddingConfig, dnsMetrics *metrics.DnsMetrics) (*loadShedder, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.MaxInFlight <= 0 {
+		return nil, errors.Newf("invalid load shedding max_in_flight %d (must be positive)", cfg.MaxInFlight)
+	}
+	if cfg.QueueTimeout < 0 {
+		return nil, errors.New("load shedding queue_timeout cannot be negative")
+	}
+
+	name := cfg.Rcode
+	if name == "" {
+		name = "servfail"
+	}
+	rcode, ok := loadSheddingRcodes[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.Newf("invalid load shedding rcode: %q (expected \"servfail\" or \"refused\")", cfg.Rcode)
+	}
+
+	return &loadShedder{
+		slots:        make(chan struct{}, cfg.MaxInFlight),
+		queueTimeout: cfg.QueueTimeout,
+		rcode:        rcode,
+		metrics:      dnsMetrics,
+	}, nil
+}
+
+// acquire waits up to the queue timeout for an upstream slot, returning the
+// function that releases it, or ErrOverloaded if the query is to be shed.
+func (s *loadShedder) acquire() (func(), error) {
+	start := time.Now()
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(s.queueTimeout)
+		defer timer.Stop()
+		select {
+		case s.slots <- struct{}{}:
+		case <-timer.C:
+			s.metrics.UpstreamQueueTime.Observe(time.Since(start).Seconds())
+			s.metrics.LoadShed.Inc()
+			return nil, ErrOverloaded
+		}
+	}
+	s.metrics.UpstreamQueueTime.Observe(time.Since(start).Seconds())
+	s.metrics.UpstreamInFlight.Set(float64(len(s.slots)))
+
+	return func() {
+		<-s.slots
+		s.metrics.UpstreamInFlight.Set(float64(len(s.slots)))
+	}, nil
+}
+
+// limit wraps the exchange function to take an upstream slot for every
+// query, so that queries made on behalf of a forwarded one, such as the
+// DNSKEY and DS fetches of DNSSEC validation, are bounded too.
+func (s *loadShedder) limit(exchange exchangeFunc) exchangeFunc {
+	if s == nil {
+		return exchange
+	}
+	return func(msg *dns.Msg) (*dns.Msg, string, error) {
+		release, err := s.acquire()
+		if err != nil {
+			return nil, "", err
+		}
+		defer release()
+		return exchange(msg)
+	}
+}
@@ -0,0 +1,113 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLoadShedder(t *testing.T) {
+	shedder, err := newLoadShedder(nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, shedder)
+
+	shedder, err = newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 10}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, shedder.rcode, "defaults to SERVFAIL")
+
+	shedder, err = newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 10, Rcode: "REFUSED"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, shedder.rcode)
+
+	_, err = newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 0}, nil)
+	assert.Error(t, err)
+	_, err = newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 10, QueueTimeout: -time.Second}, nil)
+	assert.Error(t, err)
+	_, err = newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 10, Rcode: "nxdomain"}, nil)
+	assert.Error(t, err)
+}
+
+func TestLoadShedder_Acquire(t *testing.T) {
+	dispatcher, _, _, _ := setupDispatcherTest(t, "127.0.0.1:0", nil, false)
+	shedder, err := newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 2, QueueTimeout: 10 * time.Millisecond}, dispatcher.metrics)
+	require.NoError(t, err)
+
+	release1, err := shedder.acquire()
+	require.NoError(t, err)
+	release2, err := shedder.acquire()
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = shedder.acquire()
+	assert.ErrorIs(t, err, ErrOverloaded)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond, "waits for the queue timeout")
+
+	// A slot freed while waiting is taken up
+	go func() {
+		time.Sleep(time.Millisecond)
+		release1()
+	}()
+	shedder.queueTimeout = time.Second
+	release3, err := shedder.acquire()
+	require.NoError(t, err)
+
+	release2()
+	release3()
+	assert.Empty(t, shedder.slots)
+}
+
+func TestLoadShedder_Limit(t *testing.T) {
+	exchange := func(*dns.Msg) (*dns.Msg, string, error) { return new(dns.Msg), "upstream", nil }
+	var shedder *loadShedder
+	_, _, err := shedder.limit(exchange)(new(dns.Msg))
+	require.NoError(t, err, "unlimited without load shedding")
+
+	dispatcher, _, _, _ := setupDispatcherTest(t, "127.0.0.1:0", nil, false)
+	shedder, err = newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 1}, dispatcher.metrics)
+	require.NoError(t, err)
+
+	inFlight := 0
+	_, _, err = shedder.limit(func(*dns.Msg) (*dns.Msg, string, error) {
+		inFlight = len(shedder.slots)
+		return new(dns.Msg), "upstream", nil
+	})(new(dns.Msg))
+	require.NoError(t, err)
+	assert.Equal(t, 1, inFlight, "holds a slot during the exchange")
+	assert.Empty(t, shedder.slots)
+
+	release, err := shedder.acquire()
+	require.NoError(t, err)
+	defer release()
+	_, _, err = shedder.limit(exchange)(new(dns.Msg))
+	assert.ErrorIs(t, err, ErrOverloaded)
+}
+
+func TestDNSDispatcher_HandleDNSRequest_LoadShedding(t *testing.T) {
+	dispatcher, _, _, _ := setupDispatcherTest(t, "127.0.0.1:0", nil, false)
+	shedder, err := newLoadShedder(&config.LoadSheddingConfig{Enabled: true, MaxInFlight: 1, Rcode: "refused"}, dispatcher.metrics)
+	require.NoError(t, err)
+	dispatcher.shedder = shedder
+
+	release, err := shedder.acquire()
+	require.NoError(t, err)
+	defer release()
+
+	req := new(dns.Msg)
+	req.SetQuestion("uncached.example.com.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest(SourceTCP)(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeRefused, writer.WrittenMsg.Rcode)
+	ede := blockedEDE(t, writer.WrittenMsg)
+	assert.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+	assert.Contains(t, ede.ExtraText, "overloaded")
+}
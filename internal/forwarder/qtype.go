@@ -0,0 +1,65 @@
+package forwarder
+
+import (
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+)
+
+// queryTypePolicy decides how questions are handled based on their type,
+// before any blocklist or upstream work is done.
+type queryTypePolicy struct {
+	minimalANY        bool
+	allowZoneTransfer bool
+	blocked           map[uint16]struct{}
+}
+
+func newQueryTypePolicy(cfg *config.QueryTypesConfig) (*queryTypePolicy, error) {
+	p := &queryTypePolicy{blocked: make(map[uint16]struct{})}
+	if cfg == nil {
+		return p, nil
+	}
+
+	p.minimalANY = cfg.MinimalANY
+	p.allowZoneTransfer = cfg.AllowZoneTransfer
+
+	for _, name := range cfg.Blocked {
+		qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, errors.Newf("unknown query type in blocked list: %q", name)
+		}
+		p.blocked[qtype] = struct{}{}
+	}
+
+	return p, nil
+}
+
+func (p *queryTypePolicy) isZoneTransfer(q *dns.Question) bool {
+	return !p.allowZoneTransfer && (q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR)
+}
+
+func (p *queryTypePolicy) isMinimalANY(q *dns.Question) bool {
+	return p.minimalANY && q.Qtype == dns.TypeANY
+}
+
+func (p *queryTypePolicy) isBlocked(q *dns.Question) bool {
+	_, ok := p.blocked[q.Qtype]
+	return ok
+}
+
+// minimalANYResponse synthesises the RFC 8482 answer to an ANY query: a single
+// HINFO record, which is cheap to produce and useless for amplification.
+func minimalANYResponse(q *dns.Question, ttl uint32) *dns.HINFO {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Cpu: "RFC8482",
+		Os:  "",
+	}
+}
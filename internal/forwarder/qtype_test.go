@@ -0,0 +1,118 @@
+package forwarder
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupQueryTypeTest(t *testing.T, cfg *config.QueryTypesConfig) (*DNSDispatcher, *atomic.Int32) {
+	t.Helper()
+	var upstreamQueries atomic.Int32
+	server, upstream := startLocalDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		upstreamQueries.Add(1)
+		dnsRecord(r.Question[0].Name, dns.TypeA, []byte{93, 184, 216, 34})(w, r)
+	})
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, false)
+	if cfg != nil {
+		policy, err := newQueryTypePolicy(cfg)
+		require.NoError(t, err)
+		dispatcher.qtypes = policy
+	}
+	return dispatcher, &upstreamQueries
+}
+
+func queryType(t *testing.T, dispatcher *DNSDispatcher, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(1232, false)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	return writer.WrittenMsg
+}
+
+func TestNewQueryTypePolicy(t *testing.T) {
+	policy, err := newQueryTypePolicy(&config.QueryTypesConfig{Blocked: []string{"aaaa", " HTTPS "}})
+	require.NoError(t, err)
+	assert.True(t, policy.isBlocked(&dns.Question{Qtype: dns.TypeAAAA}))
+	assert.True(t, policy.isBlocked(&dns.Question{Qtype: dns.TypeHTTPS}))
+	assert.False(t, policy.isBlocked(&dns.Question{Qtype: dns.TypeA}))
+
+	_, err = newQueryTypePolicy(&config.QueryTypesConfig{Blocked: []string{"BOGUS"}})
+	assert.ErrorContains(t, err, "unknown query type")
+}
+
+func TestDNSDispatcher_QueryType_MinimalANY(t *testing.T) {
+	dispatcher, upstreamQueries := setupQueryTypeTest(t, nil)
+
+	resp := queryType(t, dispatcher, "example.com.", dns.TypeANY)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+
+	hinfo, ok := resp.Answer[0].(*dns.HINFO)
+	require.True(t, ok, "expected HINFO answer, got %T", resp.Answer[0])
+	assert.Equal(t, "RFC8482", hinfo.Cpu)
+	assert.Equal(t, "example.com.", hinfo.Hdr.Name)
+	assert.Zero(t, upstreamQueries.Load(), "ANY should not be forwarded upstream")
+}
+
+func TestDNSDispatcher_QueryType_ANYForwardedWhenDisabled(t *testing.T) {
+	dispatcher, upstreamQueries := setupQueryTypeTest(t, &config.QueryTypesConfig{MinimalANY: false})
+
+	resp := queryType(t, dispatcher, "example.com.", dns.TypeANY)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, int32(1), upstreamQueries.Load())
+}
+
+func TestDNSDispatcher_QueryType_ZoneTransfer(t *testing.T) {
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		t.Run(dns.TypeToString[qtype], func(t *testing.T) {
+			dispatcher, upstreamQueries := setupQueryTypeTest(t, nil)
+
+			resp := queryType(t, dispatcher, "example.com.", qtype)
+			assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+			assert.Empty(t, resp.Answer)
+			assert.Zero(t, upstreamQueries.Load(), "zone transfers should not be forwarded upstream")
+		})
+	}
+}
+
+func TestDNSDispatcher_QueryType_ZoneTransferAllowed(t *testing.T) {
+	dispatcher, upstreamQueries := setupQueryTypeTest(t, &config.QueryTypesConfig{AllowZoneTransfer: true})
+
+	resp := queryType(t, dispatcher, "example.com.", dns.TypeAXFR)
+	assert.NotEqual(t, dns.RcodeRefused, resp.Rcode)
+	assert.Equal(t, int32(1), upstreamQueries.Load())
+}
+
+func TestDNSDispatcher_QueryType_Blocked(t *testing.T) {
+	dispatcher, upstreamQueries := setupQueryTypeTest(t, &config.QueryTypesConfig{Blocked: []string{"AAAA"}})
+
+	resp := queryType(t, dispatcher, "example.com.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	require.Len(t, resp.Ns, 1)
+	assert.IsType(t, &dns.SOA{}, resp.Ns[0])
+
+	ede := blockedEDE(t, resp)
+	assert.Equal(t, dns.ExtendedErrorCodeFiltered, ede.InfoCode)
+	assert.Contains(t, ede.ExtraText, "AAAA")
+	assert.Zero(t, upstreamQueries.Load(), "blocked query types should not be forwarded upstream")
+
+	// Other types are unaffected
+	resp = queryType(t, dispatcher, "example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+}
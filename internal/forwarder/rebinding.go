@@ -0,0 +1,110 @@
+package forwarder
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+)
+
+const (
+	RebindingModeStrip  = "strip"
+	RebindingModeRefuse = "refuse"
+)
+
+// cgnatPrefix is the RFC 6598 shared address space, which netip does not
+// classify as private.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// rebindingGuard protects clients against DNS rebinding attacks, where a public
+// name resolves to an address on the client's own network so that a browser
+// can be used to attack LAN devices under the guise of a same-origin request.
+type rebindingGuard struct {
+	mode            string
+	allowedSuffixes []string
+}
+
+func newRebindingGuard(cfg *config.RebindingConfig) (*rebindingGuard, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	mode := cfg.Mode
+	if mode == "" {
+		mode = RebindingModeStrip
+	}
+	if mode != RebindingModeStrip && mode != RebindingModeRefuse {
+		return nil, errors.Newf("invalid rebinding protection mode: %q (expected %q or %q)", mode, RebindingModeStrip, RebindingModeRefuse)
+	}
+
+	allowedSuffixes := make([]string, 0, len(cfg.AllowedSuffixes))
+	for _, suffix := range cfg.AllowedSuffixes {
+		suffix = strings.Trim(strings.ToLower(suffix), ".")
+		if suffix != "" {
+			allowedSuffixes = append(allowedSuffixes, dns.Fqdn(suffix))
+		}
+	}
+
+	return &rebindingGuard{mode: mode, allowedSuffixes: allowedSuffixes}, nil
+}
+
+// isAllowed returns whether the name may resolve to private addresses, i.e.
+// it is equal to, or a subdomain of, one of the allowed suffixes.
+func (g *rebindingGuard) isAllowed(name string) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	for _, suffix := range g.allowedSuffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter splits the answers to the question into those that are kept and the
+// A/AAAA records that were removed for pointing at non-public addresses.
+func (g *rebindingGuard) filter(q *dns.Question, answers []dns.RR) ([]dns.RR, []dns.RR) {
+	if g.isAllowed(q.Name) {
+		return answers, nil
+	}
+
+	var kept, removed []dns.RR
+	for _, rr := range answers {
+		if ip := answerIP(rr); ip != nil && isNonPublicAddr(ip) {
+			removed = append(removed, rr)
+			continue
+		}
+		kept = append(kept, rr)
+	}
+
+	return kept, removed
+}
+
+// answerIP returns the address of an A/AAAA record, or nil for other types.
+func answerIP(rr dns.RR) net.IP {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A
+	case *dns.AAAA:
+		return v.AAAA
+	}
+	return nil
+}
+
+// isNonPublicAddr returns true for private (RFC 1918 / ULA), loopback,
+// link-local, CGNAT and unspecified addresses.
+func isNonPublicAddr(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	return addr.IsPrivate() ||
+		addr.IsLoopback() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsUnspecified() ||
+		cgnatPrefix.Contains(addr)
+}
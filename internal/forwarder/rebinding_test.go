@@ -0,0 +1,166 @@
+package forwarder
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsNonPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:192.168.1.1", true},
+		{"8.8.8.8", false},
+		{"100.128.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			assert.Equal(t, tt.want, isNonPublicAddr(net.ParseIP(tt.addr)))
+		})
+	}
+}
+
+func TestRebindingGuard_IsAllowed(t *testing.T) {
+	guard, err := newRebindingGuard(&config.RebindingConfig{
+		Enabled:         true,
+		AllowedSuffixes: []string{"lan", ".corp.example.com."},
+	})
+	require.NoError(t, err)
+
+	assert.True(t, guard.isAllowed("router.lan."))
+	assert.True(t, guard.isAllowed("lan."))
+	assert.True(t, guard.isAllowed("Intranet.Corp.Example.com."))
+	assert.False(t, guard.isAllowed("notlan."))
+	assert.False(t, guard.isAllowed("corp.example.com.evil.net."))
+}
+
+func TestRebindingGuard_Config(t *testing.T) {
+	guard, err := newRebindingGuard(&config.RebindingConfig{Enabled: false})
+	assert.NoError(t, err)
+	assert.Nil(t, guard)
+
+	guard, err = newRebindingGuard(&config.RebindingConfig{Enabled: true})
+	assert.NoError(t, err)
+	assert.Equal(t, RebindingModeStrip, guard.mode)
+
+	_, err = newRebindingGuard(&config.RebindingConfig{Enabled: true, Mode: "drop"})
+	assert.ErrorContains(t, err, "invalid rebinding protection mode")
+}
+
+func setupRebindingTest(t *testing.T, mode string, handler dns.HandlerFunc) *DNSDispatcher {
+	t.Helper()
+	server, upstream := startLocalDNS(t, handler)
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, false)
+	guard, err := newRebindingGuard(&config.RebindingConfig{Enabled: true, Mode: mode, AllowedSuffixes: []string{"lan"}})
+	require.NoError(t, err)
+	dispatcher.rebinding = guard
+
+	return dispatcher
+}
+
+func rebindingUpstream(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	name := r.Question[0].Name
+	m.Answer = append(m.Answer,
+		&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP("93.184.216.34")},
+		&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP("192.168.1.1")},
+	)
+	_ = w.WriteMsg(m)
+}
+
+func TestDNSDispatcher_Rebinding_Strip(t *testing.T) {
+	dispatcher := setupRebindingTest(t, RebindingModeStrip, rebindingUpstream)
+
+	req := new(dns.Msg)
+	req.SetQuestion("rebind.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
+	require.Len(t, writer.WrittenMsg.Answer, 1)
+	assert.Equal(t, "93.184.216.34", writer.WrittenMsg.Answer[0].(*dns.A).A.String())
+
+	ede := blockedEDE(t, writer.WrittenMsg)
+	assert.Equal(t, dns.ExtendedErrorCodeFiltered, ede.InfoCode)
+	assert.Equal(t, "DNS rebinding protection: 192.168.1.1", ede.ExtraText)
+
+	// The unfiltered answer is cached, so a cache hit must be filtered too
+	assert.Eventually(t, func() bool {
+		_, ok := dispatcher.cache.Get(getCacheKey(&req.Question[0], ""))
+		return ok
+	}, 5*time.Second, 50*time.Millisecond, "Cache item not found after first request")
+
+	writer = new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	require.Len(t, writer.WrittenMsg.Answer, 1)
+	assert.Equal(t, "93.184.216.34", writer.WrittenMsg.Answer[0].(*dns.A).A.String())
+
+	ede = blockedEDE(t, writer.WrittenMsg)
+	assert.Equal(t, dns.ExtendedErrorCodeFiltered, ede.InfoCode)
+	assert.Equal(t, "DNS rebinding protection: 192.168.1.1", ede.ExtraText)
+}
+
+func TestDNSDispatcher_Rebinding_Refuse(t *testing.T) {
+	dispatcher := setupRebindingTest(t, RebindingModeRefuse, rebindingUpstream)
+
+	req := new(dns.Msg)
+	req.SetQuestion("rebind.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeRefused, writer.WrittenMsg.Rcode)
+	assert.Empty(t, writer.WrittenMsg.Answer)
+
+	ede := blockedEDE(t, writer.WrittenMsg)
+	assert.Equal(t, dns.ExtendedErrorCodeFiltered, ede.InfoCode)
+	assert.Equal(t, "DNS rebinding protection: 192.168.1.1", ede.ExtraText)
+}
+
+func TestDNSDispatcher_Rebinding_AllowedSuffix(t *testing.T) {
+	dispatcher := setupRebindingTest(t, RebindingModeRefuse, rebindingUpstream)
+
+	req := new(dns.Msg)
+	req.SetQuestion("nas.lan.", dns.TypeA)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest("test")(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
+	assert.Len(t, writer.WrittenMsg.Answer, 2)
+}
@@ -0,0 +1,330 @@
+package forwarder
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axiomhq/hyperloglog"
+	"github.com/cockroachdb/errors"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/config"
+	"golang.org/x/net/publicsuffix"
+)
+
+// sketchPrecision keeps the unique name sketch of an attacked domain to 1KiB,
+// with a standard error of about 3%: plenty to tell a random-subdomain
+// attack from regular traffic.
+const sketchPrecision = 10
+
+// knownLabelsPerDomain bounds the subdomains remembered as resolving for each
+// registrable domain, which keep being forwarded while it is under attack.
+const knownLabelsPerDomain = 256
+
+// WaterTortureMitigation is a registrable domain whose uncached subdomains
+// are answered locally, as it is the target of a random-subdomain attack.
+type WaterTortureMitigation struct {
+	Domain      string    `json:"domain"`
+	Since       time.Time `json:"since"`
+	Until       time.Time `json:"until"`
+	UniqueNames uint64    `json:"unique_names"`
+	NXDOMAIN    float64   `json:"nxdomain_ratio"`
+	Answered    int       `json:"answered"`
+}
+
+// domainStats tracks the queries forwarded for one registrable domain. As
+// with the per-client NXDOMAIN flood detection in the limiter, the counts are
+// reset every window rather than sliding.
+type domainStats struct {
+	windowStart time.Time
+	total       int
+	nxdomain    int
+	names       *hyperloglog.Sketch
+}
+
+// waterTortureGuard detects random-subdomain ("water torture") attacks, where
+// many clients — often open resolvers or a botnet — query random labels under
+// a victim domain to overwhelm its authoritative servers. Per-client
+// detection cannot see these, so the queries are tracked per registrable
+// domain instead, and while an attack lasts the domain's subdomains are
+// answered locally, unless they are cached or have resolved before.
+type waterTortureGuard struct {
+	cfg      *config.WaterTortureConfig
+	excluded []string
+
+	mu          sync.Mutex
+	stats       *lru.Cache[string, *domainStats]
+	known       *lru.Cache[string, *lru.Cache[string, struct{}]]
+	mitigations map[string]*WaterTortureMitigation
+}
+
+func newWaterTortureGuard(cfg *config.WaterTortureConfig) (*waterTortureGuard, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Window <= 0 || cfg.MitigationDuration <= 0 {
+		return nil, errors.New("water torture window and mitigation_duration must be positive")
+	}
+	if cfg.NXDOMAINThreshold < 0 || cfg.NXDOMAINThreshold > 1 {
+		return nil, errors.Newf("invalid water torture nxdomain_threshold %v (expected 0-1)", cfg.NXDOMAINThreshold)
+	}
+
+	maxDomains := cfg.MaxDomains
+	if maxDomains <= 0 {
+		maxDomains = 10_000
+	}
+	stats, err := lru.New[string, *domainStats](maxDomains)
+	if err != nil {
+		return nil, err
+	}
+	known, err := lru.New[string, *lru.Cache[string, struct{}]](maxDomains)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make([]string, 0, len(cfg.ExcludedDomains))
+	for _, domain := range cfg.ExcludedDomains {
+		if domain = strings.Trim(strings.ToLower(domain), "."); domain != "" {
+			excluded = append(excluded, domain)
+		}
+	}
+
+	return &waterTortureGuard{
+		cfg:         cfg,
+		excluded:    excluded,
+		stats:       stats,
+		known:       known,
+		mitigations: make(map[string]*WaterTortureMitigation),
+	}, nil
+}
+
+// registrableDomain returns the registrable domain (eTLD+1) the name belongs
+// to, or an empty string if it has none or is within an excluded domain.
+func (g *waterTortureGuard) registrableDomain(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, excluded := range g.excluded {
+		if name == excluded || strings.HasSuffix(name, "."+excluded) {
+			return ""
+		}
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// subdomainLabels returns the labels of the name below the registrable
+// domain, e.g. "mail" for mail.example.com.
+func subdomainLabels(name, domain string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(name), "."), "."+domain)
+}
+
+// record tracks an upstream response to a query for the name, starting the
+// mitigation of its registrable domain if the thresholds are exceeded. It
+// returns the domain if mitigation was started.
+func (g *waterTortureGuard) record(name string, rcode int, now time.Time) string {
+	domain := g.registrableDomain(name)
+	if domain == "" {
+		return ""
+	}
+	isNXDOMAIN := rcode == dns.RcodeNameError
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if rcode == dns.RcodeSuccess {
+		g.addKnown(domain, subdomainLabels(name, domain))
+	}
+
+	stats, ok := g.stats.Get(domain)
+	if !ok || now.Sub(stats.windowStart) > g.cfg.Window {
+		names, err := hyperloglog.NewSketch(sketchPrecision, true)
+		if err != nil {
+			return ""
+		}
+		stats = &domainStats{windowStart: now, names: names}
+		g.stats.Add(domain, stats)
+	}
+	stats.total++
+	if isNXDOMAIN {
+		stats.nxdomain++
+	}
+	stats.names.Insert([]byte(strings.ToLower(name)))
+
+	if stats.total < g.cfg.MinQueries {
+		return ""
+	}
+	ratio := float64(stats.nxdomain) / float64(stats.total)
+	uniqueNames := stats.names.Estimate()
+	if ratio < g.cfg.NXDOMAINThreshold || uniqueNames < uint64(g.cfg.UniqueNames) {
+		return ""
+	}
+
+	g.stats.Remove(domain)
+	if m, ok := g.mitigations[domain]; ok && now.Before(m.Until) {
+		return ""
+	}
+	g.mitigations[domain] = &WaterTortureMitigation{
+		Domain:      domain,
+		Since:       now,
+		Until:       now.Add(g.cfg.MitigationDuration),
+		UniqueNames: uniqueNames,
+		NXDOMAIN:    ratio,
+	}
+	return domain
+}
+
+// addKnown remembers the subdomain labels as resolving, evicting the least
+// recently resolved ones of the domain beyond knownLabelsPerDomain. The
+// caller must hold the lock.
+func (g *waterTortureGuard) addKnown(domain, labels string) {
+	if labels == "" || labels == domain {
+		return
+	}
+	known, ok := g.known.Get(domain)
+	if !ok {
+		var err error
+		if known, err = lru.New[string, struct{}](knownLabelsPerDomain); err != nil {
+			return
+		}
+		g.known.Add(domain, known)
+	}
+	known.Add(labels, struct{}{})
+}
+
+// mitigated returns the registrable domain of the name if it is under
+// mitigation, counting the query as answered locally. The registrable domain
+// itself, and subdomains that have resolved before, are always resolved.
+func (g *waterTortureGuard) mitigated(name string, now time.Time) (string, bool) {
+	domain := g.registrableDomain(name)
+	if domain == "" || domain == strings.TrimSuffix(strings.ToLower(name), ".") {
+		return "", false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	m, ok := g.mitigations[domain]
+	if !ok {
+		return "", false
+	}
+	if now.After(m.Until) {
+		delete(g.mitigations, domain)
+		return "", false
+	}
+	if known, ok := g.known.Peek(domain); ok && known.Contains(subdomainLabels(name, domain)) {
+		return "", false
+	}
+	m.Answered++
+	return domain, true
+}
+
+// active returns the current mitigations, sorted by domain.
+func (g *waterTortureGuard) active(now time.Time) []WaterTortureMitigation {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	mitigations := make([]WaterTortureMitigation, 0, len(g.mitigations))
+	for domain, m := range g.mitigations {
+		if now.After(m.Until) {
+			delete(g.mitigations, domain)
+			continue
+		}
+		mitigations = append(mitigations, *m)
+	}
+	slices.SortFunc(mitigations, func(a, b WaterTortureMitigation) int {
+		return cmp.Compare(a.Domain, b.Domain)
+	})
+	return mitigations
+}
+
+// lift ends the mitigation of a domain early, reporting whether there was
+// one.
+func (g *waterTortureGuard) lift(domain string) bool {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.mitigations[domain]; !ok {
+		return false
+	}
+	delete(g.mitigations, domain)
+	return true
+}
+
+// WaterTortureMitigations returns the domains currently treated as the
+// target of a random-subdomain attack.
+func (d *DNSDispatcher) WaterTortureMitigations() []WaterTortureMitigation {
+	if d.waterTorture == nil {
+		return []WaterTortureMitigation{}
+	}
+	mitigations := d.waterTorture.active(time.Now())
+	d.metrics.WaterTortureActive.Set(float64(len(mitigations)))
+	return mitigations
+}
+
+// updateWaterTortureActive sets the active mitigations gauge, dropping those
+// that have expired.
+func (d *DNSDispatcher) updateWaterTortureActive() {
+	d.metrics.WaterTortureActive.Set(float64(len(d.waterTorture.active(time.Now()))))
+}
+
+// LiftWaterTortureMitigation ends the mitigation of a domain early, e.g. after
+// a false positive, reporting whether there was one.
+func (d *DNSDispatcher) LiftWaterTortureMitigation(domain string) bool {
+	if d.waterTorture == nil || !d.waterTorture.lift(domain) {
+		return false
+	}
+	d.updateWaterTortureActive()
+	return true
+}
+
+// recordWaterTorture tracks the upstream response to the question for
+// random-subdomain attack detection.
+func (d *DNSDispatcher) recordWaterTorture(requestCtx *RequestContext, q *dns.Question, rcode int) {
+	if d.waterTorture == nil {
+		return
+	}
+	now := time.Now()
+	if domain := d.waterTorture.record(q.Name, rcode, now); domain != "" {
+		requestCtx.logger.WarnContext(requestCtx.ctx, "Random-subdomain attack detected, answering uncached subdomains locally",
+			"domain", domain,
+			"duration", d.waterTorture.cfg.MitigationDuration)
+		d.metrics.WaterTortureMitigations.Inc()
+		d.updateWaterTortureActive()
+		// Mitigations otherwise only expire when next looked up, which would
+		// leave the gauge stale once the attack stops
+		time.AfterFunc(d.waterTorture.cfg.MitigationDuration, d.updateWaterTortureActive)
+	}
+}
+
+// applyWaterTortureMitigation answers an uncached subdomain of a domain under
+// attack with NXDOMAIN, rather than forwarding it upstream, unless it has
+// resolved before. The SOA is owned by the registrable domain, so that clients
+// cache the negative answer for all its names.
+func (d *DNSDispatcher) applyWaterTortureMitigation(requestCtx *RequestContext, q *dns.Question) (QuestionResolution, bool) {
+	if d.waterTorture == nil {
+		return QuestionResolution{}, false
+	}
+	domain, ok := d.waterTorture.mitigated(q.Name, time.Now())
+	if !ok {
+		return QuestionResolution{}, false
+	}
+
+	requestCtx.logger.DebugContext(requestCtx.ctx, "Answering subdomain of attacked domain locally", "name", q.Name, "domain", domain)
+	d.metrics.WaterTortureAnswered.Inc()
+	requestCtx.secure = false
+	requestCtx.localNXDOMAIN = true
+
+	ede := &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeFiltered,
+		ExtraText: fmt.Sprintf("Random subdomain attack mitigation: %s", domain),
+	}
+	return QuestionResolution{authority: []dns.RR{d.syntheticSOA(dns.Fqdn(domain))}, extra: d.edeExtra(requestCtx, ede), rcode: dns.RcodeNameError}, true
+}
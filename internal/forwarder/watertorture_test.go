@@ -0,0 +1,262 @@
+package forwarder
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/limiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWaterTortureGuard(t *testing.T) *waterTortureGuard {
+	guard, err := newWaterTortureGuard(&config.WaterTortureConfig{
+		Enabled:            true,
+		Window:             time.Minute,
+		MinQueries:         20,
+		UniqueNames:        10,
+		NXDOMAINThreshold:  0.8,
+		MitigationDuration: 10 * time.Minute,
+		MaxDomains:         100,
+		ExcludedDomains:    []string{"in-addr.arpa", "Example.ORG."},
+	})
+	require.NoError(t, err)
+	return guard
+}
+
+func TestNewWaterTortureGuard(t *testing.T) {
+	guard, err := newWaterTortureGuard(nil)
+	require.NoError(t, err)
+	assert.Nil(t, guard)
+
+	guard, err = newWaterTortureGuard(&config.WaterTortureConfig{Enabled: false})
+	require.NoError(t, err)
+	assert.Nil(t, guard)
+
+	_, err = newWaterTortureGuard(&config.WaterTortureConfig{Enabled: true, MitigationDuration: time.Minute})
+	assert.Error(t, err)
+
+	_, err = newWaterTortureGuard(&config.WaterTortureConfig{Enabled: true, Window: time.Minute, MitigationDuration: time.Minute, NXDOMAINThreshold: 1.5})
+	assert.Error(t, err)
+}
+
+func TestWaterTortureGuard_RegistrableDomain(t *testing.T) {
+	guard := newTestWaterTortureGuard(t)
+
+	assert.Equal(t, "example.com", guard.registrableDomain("x7f3k.WWW.Example.com."))
+	assert.Equal(t, "example.co.uk", guard.registrableDomain("abc.example.co.uk."))
+	assert.Equal(t, "", guard.registrableDomain("com."), "public suffixes have no registrable domain")
+	assert.Equal(t, "", guard.registrableDomain("random.example.org."), "excluded domain")
+	assert.Equal(t, "", guard.registrableDomain("4.3.2.1.in-addr.arpa."), "excluded domain")
+}
+
+func TestWaterTortureGuard_DetectsRandomSubdomains(t *testing.T) {
+	guard := newTestWaterTortureGuard(t)
+	now := time.Now()
+
+	var detected string
+	for i := range 20 {
+		detected = guard.record(fmt.Sprintf("r%d.victim.com.", i), dns.RcodeNameError, now)
+	}
+	assert.Equal(t, "victim.com", detected)
+
+	mitigations := guard.active(now)
+	require.Len(t, mitigations, 1)
+	assert.Equal(t, "victim.com", mitigations[0].Domain)
+	assert.Equal(t, now.Add(10*time.Minute), mitigations[0].Until)
+	assert.InDelta(t, 1.0, mitigations[0].NXDOMAIN, 0.001)
+
+	domain, ok := guard.mitigated("another-random.victim.com.", now)
+	assert.True(t, ok)
+	assert.Equal(t, "victim.com", domain)
+	_, ok = guard.mitigated("victim.com.", now)
+	assert.False(t, ok, "the registrable domain itself is always resolved")
+	_, ok = guard.mitigated("random.bystander.com.", now)
+	assert.False(t, ok)
+	assert.Equal(t, 1, guard.active(now)[0].Answered)
+
+	_, ok = guard.mitigated("late.victim.com.", now.Add(11*time.Minute))
+	assert.False(t, ok, "mitigation expires")
+	assert.Empty(t, guard.active(now))
+}
+
+func TestWaterTortureGuard_IgnoresRegularTraffic(t *testing.T) {
+	guard := newTestWaterTortureGuard(t)
+	now := time.Now()
+
+	// Many queries for a few names, e.g. a busy site
+	for i := range 100 {
+		assert.Empty(t, guard.record(fmt.Sprintf("host%d.busy.com.", i%5), dns.RcodeNameError, now))
+	}
+	// Many unique names that mostly resolve, e.g. a CDN
+	for i := range 100 {
+		rcode := dns.RcodeSuccess
+		if i%2 == 0 {
+			rcode = dns.RcodeNameError
+		}
+		assert.Empty(t, guard.record(fmt.Sprintf("edge%d.cdn.com.", i), rcode, now))
+	}
+	// Unique NXDOMAINs, but spread over several windows
+	for i := range 30 {
+		assert.Empty(t, guard.record(fmt.Sprintf("r%d.slow.com.", i), dns.RcodeNameError, now.Add(time.Duration(i)*10*time.Second)))
+	}
+	assert.Empty(t, guard.active(now))
+}
+
+func TestWaterTortureGuard_KnownSubdomainsStillResolve(t *testing.T) {
+	guard := newTestWaterTortureGuard(t)
+	now := time.Now()
+
+	assert.Empty(t, guard.record("mail.victim.com.", dns.RcodeSuccess, now))
+	assert.Empty(t, guard.record("a.b.victim.com.", dns.RcodeSuccess, now))
+	for i := range 20 {
+		guard.record(fmt.Sprintf("r%d.victim.com.", i), dns.RcodeNameError, now)
+	}
+	require.Len(t, guard.active(now), 1)
+
+	_, ok := guard.mitigated("MAIL.victim.com.", now)
+	assert.False(t, ok, "subdomains that resolved before are still forwarded")
+	_, ok = guard.mitigated("a.b.victim.com.", now)
+	assert.False(t, ok)
+	_, ok = guard.mitigated("qz81x.victim.com.", now)
+	assert.True(t, ok)
+	_, ok = guard.mitigated("b.victim.com.", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2, guard.active(now)[0].Answered)
+}
+
+func TestWaterTortureGuard_KnownSubdomainsAreBounded(t *testing.T) {
+	guard := newTestWaterTortureGuard(t)
+	now := time.Now()
+
+	for i := range knownLabelsPerDomain + 1 {
+		guard.record(fmt.Sprintf("host%d.victim.com.", i), dns.RcodeSuccess, now)
+	}
+	known, ok := guard.known.Peek("victim.com")
+	require.True(t, ok)
+	assert.Equal(t, knownLabelsPerDomain, known.Len())
+	assert.False(t, known.Contains("host0"), "the least recently resolved subdomain is forgotten")
+}
+
+func TestWaterTortureGuard_Lift(t *testing.T) {
+	guard := newTestWaterTortureGuard(t)
+	now := time.Now()
+	for i := range 20 {
+		guard.record(fmt.Sprintf("r%d.victim.com.", i), dns.RcodeNameError, now)
+	}
+
+	assert.False(t, guard.lift("bystander.com"))
+	assert.True(t, guard.lift("Victim.com."))
+	assert.Empty(t, guard.active(now))
+	_, ok := guard.mitigated("random.victim.com.", now)
+	assert.False(t, ok)
+}
+
+func TestDNSDispatcher_HandleDNSRequest_WaterTortureMitigation(t *testing.T) {
+	server, upstream := startLocalDNS(t, dnsRecord("mail.victim.com.", dns.TypeA, []byte{192, 0, 2, 25}))
+	defer func() { _ = server.Shutdown() }()
+	dispatcher, _, _, _ := setupDispatcherTest(t, upstream, nil, false)
+	assert.Empty(t, dispatcher.WaterTortureMitigations())
+	assert.False(t, dispatcher.LiftWaterTortureMitigation("victim.com"), "detection disabled")
+
+	dispatcher.waterTorture = newTestWaterTortureGuard(t)
+	dispatcher.waterTorture.record("mail.victim.com.", dns.RcodeSuccess, time.Now())
+	for i := range 20 {
+		dispatcher.waterTorture.record(fmt.Sprintf("r%d.victim.com.", i), dns.RcodeNameError, time.Now())
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("qz81x.victim.com.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	writer := new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest(SourceTCP)(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeNameError, writer.WrittenMsg.Rcode)
+	require.Len(t, writer.WrittenMsg.Ns, 1)
+	soa, ok := writer.WrittenMsg.Ns[0].(*dns.SOA)
+	require.True(t, ok)
+	assert.Equal(t, "victim.com.", soa.Hdr.Name)
+	ede := blockedEDE(t, writer.WrittenMsg)
+	assert.Equal(t, dns.ExtendedErrorCodeFiltered, ede.InfoCode)
+
+	// A sibling that resolved before the attack is still forwarded
+	req = new(dns.Msg)
+	req.SetQuestion("mail.victim.com.", dns.TypeA)
+	writer = new(MockResponseWriter)
+	writer.On("WriteMsg", mock.Anything).Return(nil)
+	dispatcher.HandleDNSRequest(SourceTCP)(writer, req)
+
+	require.NotNil(t, writer.WrittenMsg)
+	assert.Equal(t, dns.RcodeSuccess, writer.WrittenMsg.Rcode)
+	require.Len(t, writer.WrittenMsg.Answer, 1)
+	assert.Equal(t, "192.0.2.25", writer.WrittenMsg.Answer[0].(*dns.A).A.String())
+
+	mitigations := dispatcher.WaterTortureMitigations()
+	require.Len(t, mitigations, 1)
+	assert.Equal(t, 1, mitigations[0].Answered)
+
+	assert.True(t, dispatcher.LiftWaterTortureMitigation("victim.com"))
+	assert.Empty(t, dispatcher.WaterTortureMitigations())
+}
+
+func TestDNSDispatcher_WaterTortureActiveExpires(t *testing.T) {
+	dispatcher, _, _, _ := setupDispatcherTest(t, "127.0.0.1:0", nil, false)
+	dispatcher.waterTorture = newTestWaterTortureGuard(t)
+	dispatcher.waterTorture.cfg.MitigationDuration = 50 * time.Millisecond
+
+	for i := range 20 {
+		req := new(dns.Msg)
+		req.SetQuestion(fmt.Sprintf("r%d.victim.com.", i), dns.TypeA)
+		dispatcher.recordWaterTorture(&RequestContext{ctx: t.Context(), logger: dispatcher.logger}, &req.Question[0], dns.RcodeNameError)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(dispatcher.metrics.WaterTortureActive))
+
+	// The gauge drops once the mitigation expires, without any further queries
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(dispatcher.metrics.WaterTortureActive) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDNSDispatcher_HandleDNSRequest_WaterTortureNotCountedAsNXDOMAINFlood(t *testing.T) {
+	dispatcher, _, _, _ := setupDispatcherTest(t, "127.0.0.1:0", nil, false)
+	rateLimiter, err := limiter.New(&config.RateLimitConfig{
+		Enabled:            true,
+		RequestsPerSecond:  100000,
+		Burst:              100000,
+		MaxTrackedIPs:      100,
+		BanDuration:        time.Hour,
+		NXDOMAINWindow:     time.Minute,
+		NXDOMAINMinQueries: 5,
+		NXDOMAINThreshold:  0.8,
+	}, dispatcher.metrics, nil, nil, nil)
+	require.NoError(t, err)
+	defer rateLimiter.Close()
+	dispatcher.limiter = rateLimiter
+
+	dispatcher.waterTorture = newTestWaterTortureGuard(t)
+	for i := range 20 {
+		dispatcher.waterTorture.record(fmt.Sprintf("r%d.victim.com.", i), dns.RcodeNameError, time.Now())
+	}
+
+	for i := range 10 {
+		req := new(dns.Msg)
+		req.SetQuestion(fmt.Sprintf("q%d.victim.com.", i), dns.TypeA)
+		writer := new(MockResponseWriter)
+		writer.On("WriteMsg", mock.Anything).Return(nil)
+		dispatcher.HandleDNSRequest(SourceTCP)(writer, req)
+
+		require.NotNil(t, writer.WrittenMsg)
+		assert.Equal(t, dns.RcodeNameError, writer.WrittenMsg.Rcode)
+	}
+	rateLimiter.Flush()
+
+	assert.Empty(t, rateLimiter.BannedIPs(), "clients relaying the attack are not banned")
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/limiter"
+)
+
+// MaxReasonLength bounds the reason recorded with a ban or exemption.
+const MaxReasonLength = 256
+
+// BansHandler manages the manual bans and the exempt networks through the
+// admin API.
+type BansHandler struct {
+	limiter *limiter.Limiter
+}
+
+func NewBansHandler(rateLimiter *limiter.Limiter) *BansHandler {
+	return &BansHandler{limiter: rateLimiter}
+}
+
+type accessListPayload struct {
+	Network  string `json:"network" binding:"required"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// bindAccessListPayload parses the payload, writing a 400 response if it is
+// invalid.
+func bindAccessListPayload(c *gin.Context) (accessListPayload, bool) {
+	var payload accessListPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return payload, false
+	}
+	if len(payload.Reason) > MaxReasonLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Reason must be at most %d characters", MaxReasonLength)})
+		return payload, false
+	}
+	return payload, true
+}
+
+// networkParam returns the network from the wildcard path parameter, which
+// includes the leading slash.
+func networkParam(c *gin.Context) (string, bool) {
+	network := strings.TrimPrefix(c.Param("network"), "/")
+	if network == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing network"})
+		return "", false
+	}
+	return network, true
+}
+
+// createdBy names the admin making a change, as authenticated by the API
+// key or proxy auth middleware.
+func createdBy(c *gin.Context) string {
+	if email := c.GetString("email"); email != "" {
+		return email
+	}
+	return c.GetString("user")
+}
+
+// List returns the current bans, both manual and from flood detection.
+func (h *BansHandler) List(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"bans": h.limiter.Bans()})
+}
+
+// Ban bans an IP address or CIDR range for a duration, or permanently if
+// none is given.
+func (h *BansHandler) Ban(c *gin.Context) {
+	payload, ok := bindAccessListPayload(c)
+	if !ok {
+		return
+	}
+	prefix, err := limiter.ParseNetwork(payload.Network)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var duration time.Duration
+	if payload.Duration != "" {
+		if duration, err = time.ParseDuration(payload.Duration); err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration: must be a positive Go duration (e.g. 1h30m), or empty for a permanent ban"})
+			return
+		}
+	}
+
+	ban, err := h.limiter.Ban(prefix, duration, payload.Reason, createdBy(c))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, ban)
+}
+
+// Unban lifts the ban of a network, along with any flood detection bans
+// within it.
+func (h *BansHandler) Unban(c *gin.Context) {
+	h.remove(c, h.limiter.Unban, "Ban not found")
+}
+
+// Exemptions returns the networks exempt from rate limiting and bans.
+func (h *BansHandler) Exemptions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"exemptions": h.limiter.Exemptions()})
+}
+
+// Exempt exempts an IP address or CIDR range, e.g. an office NAT, from rate
+// limiting and bans.
+func (h *BansHandler) Exempt(c *gin.Context) {
+	payload, ok := bindAccessListPayload(c)
+	if !ok {
+		return
+	}
+	prefix, err := limiter.ParseNetwork(payload.Network)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	exemption, err := h.limiter.Exempt(prefix, payload.Reason, createdBy(c))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, exemption)
+}
+
+// Unexempt removes the exemption of a network.
+func (h *BansHandler) Unexempt(c *gin.Context) {
+	h.remove(c, h.limiter.Unexempt, "Exemption not found")
+}
+
+func (h *BansHandler) remove(c *gin.Context, remove func(network netip.Prefix) error, notFound string) {
+	network, ok := networkParam(c)
+	if !ok {
+		return
+	}
+	prefix, err := limiter.ParseNetwork(network)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = remove(prefix)
+	if errors.Is(err, limiter.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return
+	}
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
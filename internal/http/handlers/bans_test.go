@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/limiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopLimiterMetrics struct{}
+
+func (nopLimiterMetrics) IncRateLimited(limiter.Reason)             {}
+func (nopLimiterMetrics) SetTrackedIPs(int)                         {}
+func (nopLimiterMetrics) IncResponseLimited(limiter.ResponseAction) {}
+func (nopLimiterMetrics) SetTrackedResponses(int)                   {}
+
+func bansTestRouter(t *testing.T) (*gin.Engine, *limiter.Limiter) {
+	t.Helper()
+	rateLimiter, err := limiter.New(&config.RateLimitConfig{}, nopLimiterMetrics{}, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(rateLimiter.Close)
+	handler := NewBansHandler(rateLimiter)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user", "Ops team") })
+	r.GET("/api/bans", handler.List)
+	r.POST("/api/bans", handler.Ban)
+	r.DELETE("/api/bans/*network", handler.Unban)
+	r.GET("/api/exemptions", handler.Exemptions)
+	r.POST("/api/exemptions", handler.Exempt)
+	r.DELETE("/api/exemptions/*network", handler.Unexempt)
+	return r, rateLimiter
+}
+
+func TestBansHandler(t *testing.T) {
+	r, rateLimiter := bansTestRouter(t)
+
+	w := serve(r, http.MethodGet, "/api/bans", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"bans": []}`, w.Body.String())
+
+	w = serve(r, http.MethodPost, "/api/bans", `{"network": "192.0.2.7/24", "duration": "2h", "reason": "scraping"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"network":"192.0.2.0/24"`)
+	assert.Contains(t, w.Body.String(), `"created_by":"Ops team"`)
+	assert.Contains(t, w.Body.String(), `"until"`)
+
+	w = serve(r, http.MethodPost, "/api/bans", `{"network": "2001:db8::/32"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.NotContains(t, w.Body.String(), `"until"`, "permanent ban")
+
+	ok, _ := rateLimiter.Allow("192.0.2.1")
+	assert.False(t, ok)
+
+	w = serve(r, http.MethodGet, "/api/bans", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"reason":"scraping"`)
+	assert.Contains(t, w.Body.String(), `"network":"2001:db8::/32"`)
+
+	assert.Equal(t, http.StatusBadRequest, serve(r, http.MethodPost, "/api/bans", `{"network": "example.com"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(r, http.MethodPost, "/api/bans", `{"network": "192.0.2.1", "duration": "-1h"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(r, http.MethodPost, "/api/bans", `{"duration": "1h"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(r, http.MethodPost, "/api/bans", `not json`).Code)
+
+	assert.Equal(t, http.StatusNoContent, serve(r, http.MethodDelete, "/api/bans/192.0.2.0/24", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(r, http.MethodDelete, "/api/bans/192.0.2.0/24", "").Code)
+	assert.Equal(t, http.StatusNoContent, serve(r, http.MethodDelete, "/api/bans/2001:db8::/32", "").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(r, http.MethodDelete, "/api/bans/", "").Code)
+}
+
+func TestBansHandler_Exemptions(t *testing.T) {
+	r, _ := bansTestRouter(t)
+
+	w := serve(r, http.MethodPost, "/api/exemptions", `{"network": "203.0.113.1", "reason": "office NAT"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"network":"203.0.113.1/32"`)
+
+	w = serve(r, http.MethodGet, "/api/exemptions", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"reason":"office NAT"`)
+
+	assert.Equal(t, http.StatusNoContent, serve(r, http.MethodDelete, "/api/exemptions/203.0.113.1", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(r, http.MethodDelete, "/api/exemptions/203.0.113.1", "").Code)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/clients"
+)
+
+// ClientsHandler manages the named clients through the admin API.
+type ClientsHandler struct {
+	registry *clients.Registry
+}
+
+func NewClientsHandler(registry *clients.Registry) *ClientsHandler {
+	return &ClientsHandler{registry: registry}
+}
+
+func (h *ClientsHandler) available(c *gin.Context) bool {
+	if h.registry == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "client identification is disabled"})
+		return false
+	}
+	return true
+}
+
+// List returns the known clients, along with their query counts since
+// startup.
+func (h *ClientsHandler) List(c *gin.Context) {
+	if !h.available(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"clients": h.registry.List()})
+}
+
+// Rename sets the display name of a client, which need not have queried
+// yet. An empty name clears it.
+func (h *ClientsHandler) Rename(c *gin.Context) {
+	if !h.available(c) {
+		return
+	}
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return
+	}
+	id := c.Param("id")
+	if !clients.IsValidID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid client ID: must be a lower-case DNS label"})
+		return
+	}
+	if len(payload.Name) > clients.MaxNameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Name must be at most %d characters", clients.MaxNameLength)})
+		return
+	}
+
+	client, err := h.registry.Rename(id, payload.Name)
+	if errors.Is(err, clients.ErrFull) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Client registry is full"})
+		return
+	}
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, client)
+}
+
+// Delete forgets a client and its name.
+func (h *ClientsHandler) Delete(c *gin.Context) {
+	if !h.available(c) {
+		return
+	}
+	err := h.registry.Delete(c.Param("id"))
+	if errors.Is(err, clients.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
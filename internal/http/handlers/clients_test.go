@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/clients"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func clientsTestRouter(registry *clients.Registry) *gin.Engine {
+	handler := NewClientsHandler(registry)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/clients", handler.List)
+	r.PUT("/api/clients/:id", handler.Rename)
+	r.DELETE("/api/clients/:id", handler.Delete)
+	return r
+}
+
+func serve(r *gin.Engine, method, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestClientsHandler(t *testing.T) {
+	registry, err := clients.NewRegistry(filepath.Join(t.TempDir(), "clients.json"), 10, nil)
+	require.NoError(t, err)
+	r := clientsTestRouter(registry)
+
+	w := serve(r, http.MethodGet, "/api/clients", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"clients": []}`, w.Body.String())
+
+	w = serve(r, http.MethodPut, "/api/clients/phone", `{"name": "Alex's phone"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id": "phone", "name": "Alex's phone", "queries": 0}`, w.Body.String())
+
+	w = serve(r, http.MethodGet, "/api/clients", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"clients": [{"id": "phone", "name": "Alex's phone", "queries": 0}]}`, w.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, serve(r, http.MethodPut, "/api/clients/Not_Valid", `{"name": "x"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(r, http.MethodPut, "/api/clients/phone", `{"name": "`+strings.Repeat("x", 65)+`"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(r, http.MethodPut, "/api/clients/phone", `not json`).Code)
+
+	assert.Equal(t, http.StatusNoContent, serve(r, http.MethodDelete, "/api/clients/phone", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(r, http.MethodDelete, "/api/clients/phone", "").Code)
+}
+
+func TestClientsHandler_Full(t *testing.T) {
+	registry, err := clients.NewRegistry(filepath.Join(t.TempDir(), "clients.json"), 1, nil)
+	require.NoError(t, err)
+	r := clientsTestRouter(registry)
+
+	assert.Equal(t, http.StatusOK, serve(r, http.MethodPut, "/api/clients/phone", `{"name": "Phone"}`).Code)
+	assert.Equal(t, http.StatusConflict, serve(r, http.MethodPut, "/api/clients/laptop", `{"name": "Laptop"}`).Code)
+}
+
+func TestClientsHandler_Disabled(t *testing.T) {
+	r := clientsTestRouter(nil)
+
+	w := serve(r, http.MethodGet, "/api/clients", "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"error": "client identification is disabled"}`, w.Body.String())
+	assert.Equal(t, http.StatusServiceUnavailable, serve(r, http.MethodDelete, "/api/clients/phone", "").Code)
+}
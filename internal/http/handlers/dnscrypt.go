@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/dnscrypt"
+)
+
+// NewDNSCryptInfoHandler describes the DNSCrypt provider, so that clients can
+// be configured from the admin UI. provider is nil if DNSCrypt is disabled.
+func NewDNSCryptInfoHandler(provider *dnscrypt.Provider, stamp string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if provider == nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "DNSCrypt is disabled"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"provider_name": provider.Name(),
+			"public_key":    hex.EncodeToString(provider.PublicKey()),
+			"stamp":         stamp,
+			"certificates":  provider.Certificates(),
+		})
+	}
+}
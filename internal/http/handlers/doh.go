@@ -8,13 +8,24 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/gin-gonic/gin"
 	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/clients"
 )
 
+// NewDoHHandler serves DoH queries. Clients may identify themselves with a
+// client ID in the path, i.e. /dns-query/{client-id}.
 func NewDoHHandler(handler dns.Handler) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var raw []byte
 		var err error
 
+		clientID := c.Param("client")
+		if clientID != "" && !clients.IsValidID(clientID) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid client ID: must be a lower-case DNS label",
+			})
+			return
+		}
+
 		if c.Request.Method == http.MethodPost {
 			if raw, err = c.GetRawData(); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{
@@ -47,12 +58,14 @@ func NewDoHHandler(handler dns.Handler) gin.HandlerFunc {
 			})
 			return
 		}
+		responseWriter.clientID = clientID
 		handler.ServeDNS(responseWriter, msg)
 
 		// Stash the parsed DNS response on the context so the rate-limit
 		// middleware (which wraps this handler) can record NXDOMAIN results
 		// for flood detection.
 		c.Set("dns_response", responseWriter.msg)
+		c.Set("dns_nxdomain_exempt", responseWriter.nxdomainExempt)
 
 		packed, err := responseWriter.msg.Pack()
 		if err != nil {
@@ -67,8 +80,10 @@ func NewDoHHandler(handler dns.Handler) gin.HandlerFunc {
 }
 
 type doHResponseWriter struct {
-	msg        *dns.Msg
-	remoteAddr net.Addr
+	msg            *dns.Msg
+	remoteAddr     net.Addr
+	clientID       string
+	nxdomainExempt bool
 }
 
 func NewDoHResponseWriter(clientIP string) (*doHResponseWriter, error) {
@@ -100,6 +115,17 @@ func (w *doHResponseWriter) RemoteAddr() net.Addr {
 	return w.remoteAddr
 }
 
+// ExemptNXDOMAIN marks an NXDOMAIN response as not counting towards
+// NXDOMAIN-flood detection, as it was answered locally.
+func (w *doHResponseWriter) ExemptNXDOMAIN() {
+	w.nxdomainExempt = true
+}
+
+// ClientID implements clients.Identifier.
+func (w *doHResponseWriter) ClientID() string {
+	return w.clientID
+}
+
 func (w *doHResponseWriter) WriteMsg(m *dns.Msg) error {
 	w.msg = m
 	return nil
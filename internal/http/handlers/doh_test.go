@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/clients"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoHHandler_ClientID(t *testing.T) {
+	var clientID string
+	handler := NewDoHHandler(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		clientID = w.(clients.Identifier).ClientID()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	}))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/dns-query", handler)
+	r.GET("/dns-query/:client", handler)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	packed, err := req.Pack()
+	require.NoError(t, err)
+	query := "?dns=" + base64.RawURLEncoding.EncodeToString(packed)
+
+	status := func(url string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, status("/dns-query/phone"+query))
+	assert.Equal(t, "phone", clientID)
+
+	require.Equal(t, http.StatusOK, status("/dns-query"+query))
+	assert.Empty(t, clientID)
+
+	assert.Equal(t, http.StatusBadRequest, status("/dns-query/Not_Valid"+query))
+}
@@ -2,32 +2,91 @@ package handlers
 
 import (
 	"bytes"
-	"net"
+	"context"
+	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/cockroachdb/errors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/miekg/dns"
 	"github.com/rm-hull/dot-block/internal/mobileconfig"
+	"github.com/rm-hull/dot-block/internal/setup"
 	"howett.net/plist"
 )
 
-func NewMobileconfigHandler(serverName string) gin.HandlerFunc {
+// MobileconfigOptions configures the profiles served by the mobileconfig
+// handler.
+type MobileconfigOptions struct {
+	// DoHBaseURL is the scheme, host and port of the DoH endpoint, used for
+	// ?protocol=https profiles.
+	DoHBaseURL string
+	// DisconnectSSIDs and ExcludedDomains are included in the on-demand rules
+	// of every profile, in addition to any given as query parameters.
+	DisconnectSSIDs []string
+	ExcludedDomains []string
+	// Signer signs the profiles; they are unsigned if nil.
+	Signer *mobileconfig.Signer
+	// Addresses determines the ServerAddresses of the profiles. If nil, the
+	// server name is looked up with the system resolver.
+	Addresses *setup.AddressResolver
+}
+
+// NewMobileconfigHandler serves an Apple configuration profile for the
+// encrypted DNS settings. The query parameters select the variant:
+//
+//   - protocol: tls (the default) or https
+//   - path: the DoH path for https profiles, defaulting to /dns-query
+//   - ssid: a Wi-Fi network on which the settings are not used (repeatable)
+//   - exclude_domain: a domain not resolved through the settings (repeatable)
+func NewMobileconfigHandler(serverName string, opts MobileconfigOptions) gin.HandlerFunc {
 	rootPayloadIdentifier := invertServerName(serverName) + ".profile"
 	dnsPayloadIdentifier := rootPayloadIdentifier + ".dnsSettings.managed"
 	rootUUID := uuid.NewSHA1(uuid.NameSpaceDNS, []byte(rootPayloadIdentifier))
 	dnsUUID := uuid.NewSHA1(uuid.NameSpaceDNS, []byte(dnsPayloadIdentifier))
 
+	addresses := opts.Addresses
+	if addresses == nil {
+		// Without static addresses this cannot fail
+		addresses, _ = setup.NewAddressResolver(serverName, nil, nil)
+	}
+
 	return func(c *gin.Context) {
-		ips, err := net.LookupHost(serverName)
-		if err != nil {
-			_ = c.AbortWithError(
-				http.StatusInternalServerError,
-				errors.Wrapf(err, "failed to lookup IP addr for %s", serverName))
+		var dnsSettings mobileconfig.DNSBlock
+		description := "Configures system-wide DNS over TLS with ad and malware blocking."
+		switch protocol := c.DefaultQuery("protocol", "tls"); protocol {
+		case "tls":
+			dnsSettings.DNSProtocol = "TLS"
+			dnsSettings.ServerName = serverName
+		case "https":
+			serverURL, ok := dohURL(c, opts.DoHBaseURL)
+			if !ok {
+				return
+			}
+			dnsSettings.DNSProtocol = "HTTPS"
+			dnsSettings.ServerURL = serverURL
+			description = "Configures system-wide DNS over HTTPS with ad and malware blocking."
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported protocol %q (expected tls or https)", protocol)})
+			return
+		}
 
+		excluded, ok := excludedDomains(c, opts.ExcludedDomains)
+		if !ok {
 			return
 		}
+		onDemandRules := mobileconfig.NewOnDemandRules(
+			append(slices.Clone(opts.DisconnectSSIDs), c.QueryArray("ssid")...),
+			excluded)
+
+		// The addresses only save clients a bootstrap lookup of the server
+		// name, so the profile is still usable without them
+		ctx, cancel := context.WithTimeout(c.Request.Context(), addressLookupTimeout)
+		dnsSettings.ServerAddresses = addresses.Lookup(ctx)
+		cancel()
 
 		profile := mobileconfig.Profile{
 			PayloadType:         "Configuration",
@@ -36,7 +95,7 @@ func NewMobileconfigHandler(serverName string) gin.HandlerFunc {
 			PayloadUUID:         rootUUID,
 			PayloadDisplayName:  "dot-block DNS",
 			PayloadScope:        "System",
-			PayloadDescription:  "Configures system-wide DNS over TLS with ad and malware blocking.",
+			PayloadDescription:  description,
 			PayloadOrganization: "Destructuring Bind Ltd",
 
 			PayloadContent: []mobileconfig.DNSSpec{
@@ -47,11 +106,8 @@ func NewMobileconfigHandler(serverName string) gin.HandlerFunc {
 					PayloadUUID:         dnsUUID,
 					PayloadDisplayName:  "Encrypted DNS",
 					PayloadOrganization: "Destructuring Bind Ltd",
-					DNSSettings: mobileconfig.DNSBlock{
-						DNSProtocol:     "TLS",
-						ServerName:      serverName,
-						ServerAddresses: ips,
-					},
+					DNSSettings:         dnsSettings,
+					OnDemandRules:       onDemandRules,
 				},
 			},
 		}
@@ -60,7 +116,7 @@ func NewMobileconfigHandler(serverName string) gin.HandlerFunc {
 		enc := plist.NewEncoder(buf)
 		enc.Indent("  ")
 
-		err = enc.Encode(profile)
+		err := enc.Encode(profile)
 		if err != nil {
 			_ = c.AbortWithError(
 				http.StatusInternalServerError,
@@ -69,9 +125,51 @@ func NewMobileconfigHandler(serverName string) gin.HandlerFunc {
 			return
 		}
 
+		data := buf.Bytes()
+		if opts.Signer != nil {
+			if data, err = opts.Signer.Sign(data); err != nil {
+				_ = c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+
 		c.Header("Content-Disposition", "attachment; filename=\"dot-block.mobileconfig\"")
-		c.Data(http.StatusOK, "application/x-apple-aspen-config", buf.Bytes())
+		c.Data(http.StatusOK, "application/x-apple-aspen-config", data)
+	}
+}
+
+// dohURL returns the DoH URL for the path query parameter (defaulting to
+// /dns-query). If the path is invalid, it aborts the request and returns
+// false.
+func dohURL(c *gin.Context, baseURL string) (string, bool) {
+	path := c.DefaultQuery("path", "/dns-query")
+	if !isValidDoHPath(path) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid path"})
+		return "", false
+	}
+	return baseURL + path, true
+}
+
+// excludedDomains returns the configured domains plus any given as
+// exclude_domain query parameters. If any is invalid, it aborts the request
+// and returns false.
+func excludedDomains(c *gin.Context, configured []string) ([]string, bool) {
+	domains := append(slices.Clone(configured), c.QueryArray("exclude_domain")...)
+	for _, domain := range domains {
+		if _, ok := dns.IsDomainName(domain); !ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid domain %q", domain)})
+			return nil, false
+		}
 	}
+	return domains, true
+}
+
+// isValidDoHPath reports whether path is an absolute URL path without a query
+// or fragment, so that it can be appended to the DoH base URL.
+func isValidDoHPath(path string) bool {
+	u, err := url.Parse(path)
+	return err == nil && strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") &&
+		u.Path == path && u.RawQuery == "" && u.Fragment == ""
 }
 
 func invertServerName(fqdn string) string {
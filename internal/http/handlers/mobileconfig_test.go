@@ -1,21 +1,52 @@
 package handlers
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
 	"github.com/rm-hull/dot-block/internal/mobileconfig"
+	"github.com/rm-hull/dot-block/internal/setup"
+	"github.com/smallstep/pkcs7"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"howett.net/plist"
 )
 
-func TestHandler(t *testing.T) {
+func mobileconfigTestRouter(opts MobileconfigOptions) *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
-	r.GET("/.mobileconfig", NewMobileconfigHandler("localhost"))
+	r.GET("/.mobileconfig", NewMobileconfigHandler("localhost", opts))
+	return r
+}
+
+func getProfile(t *testing.T, r *gin.Engine, url string) mobileconfig.Profile {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", url, nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var profile mobileconfig.Profile
+	require.NoError(t, plist.NewDecoder(strings.NewReader(w.Body.String())).Decode(&profile))
+	return profile
+}
+
+func TestHandler(t *testing.T) {
+	r := mobileconfigTestRouter(MobileconfigOptions{})
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/.mobileconfig", nil)
@@ -31,4 +62,117 @@ func TestHandler(t *testing.T) {
 
 	assert.Equal(t, "localhost", profile.PayloadContent[0].DNSSettings.ServerName)
 	assert.NotEmpty(t, profile.PayloadContent[0].DNSSettings.ServerAddresses, "ServerAddresses should not be empty")
+	assert.Empty(t, profile.PayloadContent[0].OnDemandRules)
+}
+
+// failingDNSHandler answers every query with SERVFAIL.
+var failingDNSHandler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	_ = w.WriteMsg(m)
+})
+
+func TestHandler_AddressLookupFailure(t *testing.T) {
+	addresses, err := setup.NewAddressResolver("localhost", nil, failingDNSHandler)
+	require.NoError(t, err)
+	r := mobileconfigTestRouter(MobileconfigOptions{Addresses: addresses})
+
+	settings := getProfile(t, r, "/.mobileconfig").PayloadContent[0].DNSSettings
+	assert.Equal(t, "localhost", settings.ServerName)
+	assert.Empty(t, settings.ServerAddresses, "profile should omit addresses it cannot determine")
+}
+
+func TestHandler_StaticAddresses(t *testing.T) {
+	addresses, err := setup.NewAddressResolver("localhost", []string{"192.0.2.1", "2001:db8::1"}, nil)
+	require.NoError(t, err)
+	r := mobileconfigTestRouter(MobileconfigOptions{Addresses: addresses})
+
+	settings := getProfile(t, r, "/.mobileconfig").PayloadContent[0].DNSSettings
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1"}, settings.ServerAddresses)
+}
+
+func TestHandler_HTTPS(t *testing.T) {
+	r := mobileconfigTestRouter(MobileconfigOptions{DoHBaseURL: "https://localhost:8443"})
+
+	settings := getProfile(t, r, "/.mobileconfig?protocol=https").PayloadContent[0].DNSSettings
+	assert.Equal(t, "HTTPS", settings.DNSProtocol)
+	assert.Equal(t, "https://localhost:8443/dns-query", settings.ServerURL)
+
+	settings = getProfile(t, r, "/.mobileconfig?protocol=https&path=/dns-query/family").PayloadContent[0].DNSSettings
+	assert.Equal(t, "https://localhost:8443/dns-query/family", settings.ServerURL)
+}
+
+func TestHandler_OnDemandRules(t *testing.T) {
+	r := mobileconfigTestRouter(MobileconfigOptions{
+		DisconnectSSIDs: []string{"Home"},
+		ExcludedDomains: []string{"captive.apple.com"},
+	})
+
+	rules := getProfile(t, r, "/.mobileconfig?ssid=Office&exclude_domain=portal.example.com").PayloadContent[0].OnDemandRules
+	assert.Equal(t, []mobileconfig.OnDemandRule{
+		{Action: "Disconnect", InterfaceTypeMatch: "WiFi", SSIDMatch: []string{"Home", "Office"}},
+		{Action: "EvaluateConnection", ActionParameters: []mobileconfig.ActionParameter{
+			{DomainAction: "NeverConnect", Domains: []string{"captive.apple.com", "portal.example.com"}},
+		}},
+		{Action: "Connect"},
+	}, rules)
+}
+
+func TestHandler_BadRequest(t *testing.T) {
+	r := mobileconfigTestRouter(MobileconfigOptions{DoHBaseURL: "https://localhost"})
+
+	for _, url := range []string{
+		"/.mobileconfig?protocol=quic",
+		"/.mobileconfig?protocol=https&path=dns-query",
+		"/.mobileconfig?protocol=https&path=//evil.example.com/dns-query",
+		"/.mobileconfig?protocol=https&path=/dns-query%3Fx=1",
+		"/.mobileconfig?exclude_domain=not..a..domain",
+	} {
+		t.Run(url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", url, nil)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestHandler_Signed(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dot-block profile signing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	signer, err := mobileconfig.NewSigner(certFile, keyFile)
+	require.NoError(t, err)
+	r := mobileconfigTestRouter(MobileconfigOptions{Signer: signer})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.mobileconfig", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-apple-aspen-config", w.Header().Get("Content-Type"))
+
+	p7, err := pkcs7.Parse(w.Body.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, p7.Verify())
+	assert.Equal(t, der, p7.GetOnlySigner().Raw)
+
+	var profile mobileconfig.Profile
+	require.NoError(t, plist.NewDecoder(strings.NewReader(string(p7.Content))).Decode(&profile))
+	assert.Equal(t, "localhost", profile.PayloadContent[0].DNSSettings.ServerName)
 }
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/odoh"
+)
+
+// maxODoHMessageSize bounds request and response bodies: a message type and
+// two 16-bit length-prefixed vectors.
+const maxODoHMessageSize = 1 + 2*(2+0xffff)
+
+// ODoHHandler serves Oblivious DoH (RFC 9230) requests. As a target it
+// decrypts queries, resolves them with the DNS handler and encrypts the
+// responses; as a relay it forwards queries to another target.
+type ODoHHandler struct {
+	handler       dns.Handler
+	keys          *odoh.KeyRing
+	configsMaxAge time.Duration
+	relay         *ODoHRelay
+	logger        *slog.Logger
+}
+
+// NewODoHHandler returns an ODoH handler. keys is nil if this server is not
+// a target, and relay is nil if it is not a relay.
+func NewODoHHandler(handler dns.Handler, keys *odoh.KeyRing, keyRotation time.Duration, relay *ODoHRelay, logger *slog.Logger) *ODoHHandler {
+	return &ODoHHandler{
+		handler:       handler,
+		keys:          keys,
+		configsMaxAge: keyRotation,
+		relay:         relay,
+		logger:        logger,
+	}
+}
+
+// Configs publishes the target's ObliviousDoHConfigs. They may be cached
+// for one rotation period, as the previous key is accepted for as long.
+func (h *ODoHHandler) Configs(c *gin.Context) {
+	if h.keys == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.configsMaxAge.Seconds())))
+	c.Data(http.StatusOK, "application/octet-stream", h.keys.Configs())
+}
+
+// Query handles POST requests to /dns-query carrying an ODoH message. Other
+// content types are passed on to the next handler (the regular DoH handler).
+func (h *ODoHHandler) Query(c *gin.Context) {
+	if c.ContentType() != odoh.ContentType {
+		return
+	}
+	defer c.Abort()
+
+	if c.Query("targethost") != "" {
+		if h.relay == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ODoH relaying is not enabled"})
+			return
+		}
+		h.relay.forward(c, h.logger)
+		return
+	}
+
+	if h.keys == nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "ODoH target is not enabled"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxODoHMessageSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	raw, responseCtx, err := h.keys.DecryptQuery(body)
+	if errors.Is(err, odoh.ErrUnknownKey) {
+		// RFC 9230 4.3: tells the client to refetch the target's configs
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to decrypt ODoH query: " + err.Error()})
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse DNS message: " + err.Error()})
+		return
+	}
+
+	// The remote address is that of the relay, not the client, so it is not
+	// passed on; the dispatcher treats ODoH queries as having no client IP.
+	// For the same reason the DNS response is not stashed for the rate-limit
+	// middleware, as an NXDOMAIN flood would otherwise ban the whole relay.
+	responseWriter := &doHResponseWriter{msg: &dns.Msg{}, remoteAddr: &net.TCPAddr{IP: net.IPv4zero}}
+	h.handler.ServeDNS(responseWriter, msg)
+
+	packed, err := responseWriter.msg.Pack()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pack DNS response: " + err.Error()})
+		return
+	}
+
+	encrypted, err := responseCtx.EncryptResponse(packed)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt ODoH response: " + err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, odoh.ContentType, encrypted)
+}
+
+// ODoHRelay forwards encrypted queries to an allow-listed set of targets,
+// without passing on anything that could identify the client.
+type ODoHRelay struct {
+	allowedTargets map[string]struct{}
+	client         *http.Client
+}
+
+func NewODoHRelay(allowedTargets []string, timeout time.Duration) *ODoHRelay {
+	relay := &ODoHRelay{
+		allowedTargets: make(map[string]struct{}, len(allowedTargets)),
+		client:         &http.Client{Timeout: timeout},
+	}
+	for _, target := range allowedTargets {
+		relay.allowedTargets[strings.ToLower(strings.TrimSpace(target))] = struct{}{}
+	}
+	return relay
+}
+
+func (r *ODoHRelay) forward(c *gin.Context, logger *slog.Logger) {
+	targetHost := strings.ToLower(c.Query("targethost"))
+	if _, ok := r.allowedTargets[targetHost]; !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "ODoH target is not allowed: " + targetHost})
+		return
+	}
+
+	targetPath := c.DefaultQuery("targetpath", "/dns-query")
+	if !strings.HasPrefix(targetPath, "/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ODoH target path"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxODoHMessageSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	target := url.URL{Scheme: "https", Host: targetHost, Path: targetPath}
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ODoH target: " + err.Error()})
+		return
+	}
+	req.Header.Set("Content-Type", odoh.ContentType)
+	req.Header.Set("Accept", odoh.ContentType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		logger.Warn("failed to forward ODoH query", "target", targetHost, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach ODoH target"})
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxODoHMessageSize))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read ODoH target response"})
+		return
+	}
+
+	// Target errors (e.g. 401 on a key mismatch) are passed through so the
+	// client can act on them.
+	c.Header("Cache-Control", "no-store")
+	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), respBody)
+}
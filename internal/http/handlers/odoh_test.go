@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/rm-hull/dot-block/internal/odoh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func odohTestRouter(handler *ODoHHandler) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET(odoh.ConfigsPath, handler.Configs)
+	r.POST("/dns-query", handler.Query, func(c *gin.Context) {
+		c.String(http.StatusTeapot, "DoH")
+	})
+	return r
+}
+
+func newODoHTarget(t *testing.T) (*ODoHHandler, *odoh.KeyRing, *net.Addr) {
+	t.Helper()
+	keys, err := odoh.NewKeyRing()
+	require.NoError(t, err)
+
+	var remoteAddr net.Addr
+	dnsHandler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		remoteAddr = w.RemoteAddr()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(93, 184, 216, 34),
+		})
+		_ = w.WriteMsg(m)
+	})
+	return NewODoHHandler(dnsHandler, keys, time.Hour, nil, nil), keys, &remoteAddr
+}
+
+func encryptedQuery(t *testing.T, configs []byte, name string) ([]byte, *odoh.QueryContext) {
+	t.Helper()
+	config, err := odoh.ParseConfigs(configs)
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	packed, err := req.Pack()
+	require.NoError(t, err)
+
+	encrypted, queryCtx, err := config.EncryptQuery(packed)
+	require.NoError(t, err)
+	return encrypted, queryCtx
+}
+
+func postODoH(r http.Handler, target string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", odoh.ContentType)
+	req.RemoteAddr = "1.2.3.4:5678"
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestODoHHandler_Configs(t *testing.T) {
+	handler, keys, _ := newODoHTarget(t)
+	r := odohTestRouter(handler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, odoh.ConfigsPath, nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, keys.Configs(), w.Body.Bytes())
+	assert.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+}
+
+func TestODoHHandler_Query(t *testing.T) {
+	handler, keys, remoteAddr := newODoHTarget(t)
+	r := odohTestRouter(handler)
+
+	encrypted, queryCtx := encryptedQuery(t, keys.Configs(), "example.com.")
+	w := postODoH(r, "/dns-query", encrypted)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, odoh.ContentType, w.Header().Get("Content-Type"))
+
+	packed, err := queryCtx.DecryptResponse(w.Body.Bytes())
+	require.NoError(t, err)
+	resp := new(dns.Msg)
+	require.NoError(t, resp.Unpack(packed))
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "example.com.", resp.Answer[0].Header().Name)
+
+	assert.NotContains(t, (*remoteAddr).String(), "1.2.3.4", "relay address should not reach the DNS handler")
+}
+
+func TestODoHHandler_UnknownKey(t *testing.T) {
+	handler, _, _ := newODoHTarget(t)
+	r := odohTestRouter(handler)
+
+	otherKeys, err := odoh.NewKeyRing()
+	require.NoError(t, err)
+	encrypted, _ := encryptedQuery(t, otherKeys.Configs(), "example.com.")
+
+	w := postODoH(r, "/dns-query", encrypted)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postODoH(r, "/dns-query", []byte{1, 2, 3})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestODoHHandler_FallsThroughToDoH(t *testing.T) {
+	handler, _, _ := newODoHTarget(t)
+	r := odohTestRouter(handler)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader([]byte{0}))
+	req.Header.Set("Content-Type", "application/dns-message")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTeapot, w.Code)
+}
+
+func TestODoHHandler_Relay(t *testing.T) {
+	targetHandler, keys, _ := newODoHTarget(t)
+
+	var forwardedFor string
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwardedFor = req.Header.Get("X-Forwarded-For")
+		odohTestRouter(targetHandler).ServeHTTP(w, req)
+	}))
+	t.Cleanup(target.Close)
+	targetHost := target.Listener.Addr().String()
+
+	relay := NewODoHRelay([]string{targetHost}, time.Second)
+	relay.client = target.Client()
+	r := odohTestRouter(NewODoHHandler(nil, nil, 0, relay, nil))
+
+	encrypted, queryCtx := encryptedQuery(t, keys.Configs(), "example.com.")
+	query := url.Values{"targethost": {targetHost}, "targetpath": {"/dns-query"}}
+	w := postODoH(r, "/dns-query?"+query.Encode(), encrypted)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, odoh.ContentType, w.Header().Get("Content-Type"))
+	_, err := queryCtx.DecryptResponse(w.Body.Bytes())
+	require.NoError(t, err)
+	assert.Empty(t, forwardedFor, "relay must not identify the client to the target")
+
+	// Only allow-listed targets are relayed to
+	query.Set("targethost", "elsewhere.test")
+	w = postODoH(r, "/dns-query?"+query.Encode(), encrypted)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestODoHHandler_RelayDisabled(t *testing.T) {
+	handler, _, _ := newODoHTarget(t)
+	r := odohTestRouter(handler)
+
+	w := postODoH(r, "/dns-query?targethost=odoh.test", []byte{1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
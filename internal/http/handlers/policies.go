@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/setup"
+)
+
+// PolicyOptions configures the managed-policy generators.
+type PolicyOptions struct {
+	// DoHBaseURL is the scheme, host and port of the DoH endpoint.
+	DoHBaseURL string
+	// ExcludedDomains are excluded in the Firefox policy, in addition to any
+	// given as query parameters.
+	ExcludedDomains []string
+	// Addresses determines the servers registered by the Windows policy.
+	Addresses *setup.AddressResolver
+}
+
+// PolicyHandler generates browser and OS policies that point clients at the
+// DoH endpoint, for deployment by IT teams alongside the mobileconfig
+// profiles. Like the profiles, each policy can be given a DoH path with the
+// path query parameter.
+type PolicyHandler struct {
+	opts PolicyOptions
+}
+
+func NewPolicyHandler(opts PolicyOptions) *PolicyHandler {
+	return &PolicyHandler{opts: opts}
+}
+
+// Chrome returns a Chrome/Chromium managed policy, e.g. for
+// /etc/opt/chrome/policies/managed or an Android EMM. The mode query
+// parameter sets DnsOverHttpsMode: secure (the default) or automatic, which
+// falls back to the system resolver.
+func (h *PolicyHandler) Chrome(c *gin.Context) {
+	template, ok := dohURL(c, h.opts.DoHBaseURL)
+	if !ok {
+		return
+	}
+	mode := c.DefaultQuery("mode", "secure")
+	if mode != "secure" && mode != "automatic" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported mode %q (expected secure or automatic)", mode)})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\"dot-block.json\"")
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"DnsOverHttpsMode":      mode,
+		"DnsOverHttpsTemplates": template,
+	})
+}
+
+type firefoxDNSOverHTTPS struct {
+	Enabled         bool     `json:"Enabled"`
+	ProviderURL     string   `json:"ProviderURL"`
+	Locked          bool     `json:"Locked"`
+	ExcludedDomains []string `json:"ExcludedDomains,omitempty"`
+}
+
+// Firefox returns a Firefox enterprise policies.json. The locked query
+// parameter stops users changing the setting, and exclude_domain
+// (repeatable) adds domains resolved by the system resolver instead.
+func (h *PolicyHandler) Firefox(c *gin.Context) {
+	providerURL, ok := dohURL(c, h.opts.DoHBaseURL)
+	if !ok {
+		return
+	}
+	excluded, ok := excludedDomains(c, h.opts.ExcludedDomains)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\"policies.json\"")
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"policies": gin.H{
+			"DNSOverHTTPS": firefoxDNSOverHTTPS{
+				Enabled:         true,
+				ProviderURL:     providerURL,
+				Locked:          c.Query("locked") == "true",
+				ExcludedDomains: excluded,
+			},
+		},
+	})
+}
+
+// Windows returns a .reg file registering the DoH template for each of the
+// server's addresses (as `netsh dns add encryption` does) and setting the
+// DoH policy. The mode query parameter selects allow (the default), which
+// upgrades to DoH where a template is known, or require, which refuses
+// unencrypted DNS.
+func (h *PolicyHandler) Windows(c *gin.Context) {
+	template, ok := dohURL(c, h.opts.DoHBaseURL)
+	if !ok {
+		return
+	}
+	var dohPolicy int
+	switch mode := c.DefaultQuery("mode", "allow"); mode {
+	case "allow":
+		dohPolicy = 2
+	case "require":
+		dohPolicy = 3
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported mode %q (expected allow or require)", mode)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), addressLookupTimeout)
+	defer cancel()
+	addresses := h.opts.Addresses.Lookup(ctx)
+	if len(addresses) == 0 {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server addresses are unknown, configure server.public_addresses"})
+		return
+	}
+
+	var reg strings.Builder
+	reg.WriteString("Windows Registry Editor Version 5.00\r\n")
+	reg.WriteString("\r\n; Set the network adapter's DNS servers to: " + strings.Join(addresses, ", ") + "\r\n")
+	for _, addr := range addresses {
+		fmt.Fprintf(&reg, "\r\n[HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Services\\Dnscache\\Parameters\\DohWellKnownServers\\%s]\r\n", addr)
+		fmt.Fprintf(&reg, "\"Template\"=\"%s\"\r\n", escapeRegString(template))
+	}
+	reg.WriteString("\r\n[HKEY_LOCAL_MACHINE\\SOFTWARE\\Policies\\Microsoft\\Windows NT\\DNSClient]\r\n")
+	fmt.Fprintf(&reg, "\"DoHPolicy\"=dword:%08x\r\n", dohPolicy)
+
+	c.Header("Content-Disposition", "attachment; filename=\"dot-block-doh.reg\"")
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(reg.String()))
+}
+
+// escapeRegString escapes a value for a quoted .reg file string.
+func escapeRegString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
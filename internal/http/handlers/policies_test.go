@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/setup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func policyTestRouter(t *testing.T, static ...string) *gin.Engine {
+	t.Helper()
+	addresses, err := setup.NewAddressResolver("dns.example.com", static, failingDNSHandler)
+	require.NoError(t, err)
+	handler := NewPolicyHandler(PolicyOptions{
+		DoHBaseURL:      "https://dns.example.com",
+		ExcludedDomains: []string{"captive.apple.com"},
+		Addresses:       addresses,
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/policies/chrome.json", handler.Chrome)
+	r.GET("/policies/firefox.json", handler.Firefox)
+	r.GET("/policies/windows-doh.reg", handler.Windows)
+	return r
+}
+
+func get(r *gin.Engine, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", url, nil)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPolicyHandler_Chrome(t *testing.T) {
+	r := policyTestRouter(t)
+
+	w := get(r, "/policies/chrome.json")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"DnsOverHttpsMode": "secure", "DnsOverHttpsTemplates": "https://dns.example.com/dns-query"}`, w.Body.String())
+
+	w = get(r, "/policies/chrome.json?mode=automatic&path=/dns-query/kids")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"DnsOverHttpsMode": "automatic", "DnsOverHttpsTemplates": "https://dns.example.com/dns-query/kids"}`, w.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, get(r, "/policies/chrome.json?mode=off").Code)
+	assert.Equal(t, http.StatusBadRequest, get(r, "/policies/chrome.json?path=//evil.example.com").Code)
+}
+
+func TestPolicyHandler_Firefox(t *testing.T) {
+	r := policyTestRouter(t)
+
+	w := get(r, "/policies/firefox.json?locked=true&exclude_domain=intranet.example.com")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "policies.json")
+
+	var policies struct {
+		Policies struct {
+			DNSOverHTTPS firefoxDNSOverHTTPS
+		}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &policies))
+	assert.Equal(t, firefoxDNSOverHTTPS{
+		Enabled:         true,
+		ProviderURL:     "https://dns.example.com/dns-query",
+		Locked:          true,
+		ExcludedDomains: []string{"captive.apple.com", "intranet.example.com"},
+	}, policies.Policies.DNSOverHTTPS)
+
+	assert.Equal(t, http.StatusBadRequest, get(r, "/policies/firefox.json?exclude_domain=bad..domain").Code)
+}
+
+func TestPolicyHandler_Windows(t *testing.T) {
+	r := policyTestRouter(t, "192.0.2.1", "2001:db8::1")
+
+	w := get(r, "/policies/windows-doh.reg?mode=require")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Windows Registry Editor Version 5.00\r\n"+
+		"\r\n; Set the network adapter's DNS servers to: 192.0.2.1, 2001:db8::1\r\n"+
+		"\r\n[HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Services\\Dnscache\\Parameters\\DohWellKnownServers\\192.0.2.1]\r\n"+
+		"\"Template\"=\"https://dns.example.com/dns-query\"\r\n"+
+		"\r\n[HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Services\\Dnscache\\Parameters\\DohWellKnownServers\\2001:db8::1]\r\n"+
+		"\"Template\"=\"https://dns.example.com/dns-query\"\r\n"+
+		"\r\n[HKEY_LOCAL_MACHINE\\SOFTWARE\\Policies\\Microsoft\\Windows NT\\DNSClient]\r\n"+
+		"\"DoHPolicy\"=dword:00000003\r\n", w.Body.String())
+
+	assert.Contains(t, get(r, "/policies/windows-doh.reg").Body.String(), "\"DoHPolicy\"=dword:00000002\r\n")
+	assert.Equal(t, http.StatusBadRequest, get(r, "/policies/windows-doh.reg?mode=off").Code)
+}
+
+func TestPolicyHandler_WindowsUnknownAddresses(t *testing.T) {
+	r := policyTestRouter(t)
+	assert.Equal(t, http.StatusServiceUnavailable, get(r, "/policies/windows-doh.reg").Code)
+}
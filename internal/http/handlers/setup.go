@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/setup"
+)
+
+// addressLookupTimeout bounds lookups of the server's own addresses.
+const addressLookupTimeout = 2 * time.Second
+
+// SetupHandler serves client setup instructions derived from the server
+// configuration.
+type SetupHandler struct {
+	generator *setup.Generator
+	addresses *setup.AddressResolver
+}
+
+func NewSetupHandler(generator *setup.Generator, addresses *setup.AddressResolver) *SetupHandler {
+	return &SetupHandler{generator: generator, addresses: addresses}
+}
+
+func (h *SetupHandler) guide(c *gin.Context) *setup.Guide {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), addressLookupTimeout)
+	defer cancel()
+	return h.generator.Guide(h.addresses.Lookup(ctx))
+}
+
+// Guide returns the setup instructions as JSON or, for browsers, as an HTML
+// page.
+func (h *SetupHandler) Guide(c *gin.Context) {
+	guide := h.guide(c)
+
+	switch c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) {
+	case gin.MIMEHTML:
+		buf := new(bytes.Buffer)
+		if err := guide.WriteHTML(buf); err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+	default:
+		c.JSON(http.StatusOK, guide)
+	}
+}
+
+// QRCode returns a PNG QR code of the DoH URL, for scanning into mobile
+// clients.
+func (h *SetupHandler) QRCode(c *gin.Context) {
+	png, err := h.generator.QRCode()
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Data(http.StatusOK, "image/png", png)
+}
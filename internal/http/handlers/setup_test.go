@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/setup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Server.LetsEncrypt.AllowedHosts = []string{"dns.example.com"}
+	generator, err := setup.New(cfg, nil)
+	require.NoError(t, err)
+
+	addresses, err := setup.NewAddressResolver("dns.example.com", []string{"192.0.2.1"}, nil)
+	require.NoError(t, err)
+	handler := NewSetupHandler(generator, addresses)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/setup", handler.Guide)
+	r.GET("/setup/qr.png", handler.QRCode)
+	return r
+}
+
+func TestSetupHandler_Guide(t *testing.T) {
+	r := setupTestRouter(t)
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+	}{
+		{name: "JSON by default", accept: "", contentType: "application/json; charset=utf-8"},
+		{name: "JSON", accept: "application/json", contentType: "application/json; charset=utf-8"},
+		{name: "HTML for browsers", accept: "text/html,application/xhtml+xml,*/*;q=0.8", contentType: "text/html; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/setup", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+			assert.Contains(t, w.Body.String(), "192.0.2.1#dns.example.com")
+		})
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/setup", nil)
+	r.ServeHTTP(w, req)
+
+	var guide setup.Guide
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &guide))
+	assert.Equal(t, "https://dns.example.com/dns-query", guide.DoHURL)
+	assert.Equal(t, []string{"192.0.2.1"}, guide.Addresses)
+}
+
+func TestSetupHandler_QRCode(t *testing.T) {
+	r := setupTestRouter(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/setup/qr.png", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.NotEmpty(t, w.Body.Bytes())
+}
@@ -14,6 +14,7 @@ type SSEQueryParams struct {
 	Blocked  *bool    `form:"blocked"`
 	Domain   []string `form:"domain"`
 	ClientIP []string `form:"client_ip"`
+	Client   []string `form:"client"`
 }
 
 func (q *SSEQueryParams) Matches(event sse.Event) bool {
@@ -47,6 +48,10 @@ func (q *SSEQueryParams) Matches(event sse.Event) bool {
 		}
 	}
 
+	if len(q.Client) > 0 && !slices.Contains(q.Client, event.Client) {
+		return false
+	}
+
 	return true
 }
 
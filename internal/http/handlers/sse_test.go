@@ -153,3 +153,11 @@ func TestSSEHandler_DomainFiltersMatchMultiple(t *testing.T) {
 	assert.Contains(t, body, "x.other.com")
 	assert.NotContains(t, body, "nope.notmatched")
 }
+
+func TestSSEQueryParams_ClientFilter(t *testing.T) {
+	q := SSEQueryParams{Client: []string{"phone", "laptop"}}
+
+	assert.True(t, q.Matches(sse.Event{Domain: "example.com", Client: "phone"}))
+	assert.False(t, q.Matches(sse.Event{Domain: "example.com", Client: "tablet"}))
+	assert.False(t, q.Matches(sse.Event{Domain: "example.com"}), "events from unnamed clients are filtered out")
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/forwarder"
+)
+
+// WaterTortureMitigator is implemented by the DNS dispatcher when
+// random-subdomain attack detection is enabled.
+type WaterTortureMitigator interface {
+	WaterTortureMitigations() []forwarder.WaterTortureMitigation
+	LiftWaterTortureMitigation(domain string) bool
+}
+
+// WaterTortureHandler surfaces the domains under random-subdomain attack
+// mitigation through the admin API.
+type WaterTortureHandler struct {
+	mitigator WaterTortureMitigator
+}
+
+// NewWaterTortureHandler creates the handler; a nil mitigator means detection
+// is disabled.
+func NewWaterTortureHandler(mitigator WaterTortureMitigator) *WaterTortureHandler {
+	return &WaterTortureHandler{mitigator: mitigator}
+}
+
+func (h *WaterTortureHandler) available(c *gin.Context) bool {
+	if h.mitigator == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "random-subdomain attack detection is disabled"})
+		return false
+	}
+	return true
+}
+
+// List returns the domains currently under mitigation.
+func (h *WaterTortureHandler) List(c *gin.Context) {
+	if !h.available(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mitigations": h.mitigator.WaterTortureMitigations()})
+}
+
+// Lift ends the mitigation of a domain early, e.g. after a false positive.
+func (h *WaterTortureHandler) Lift(c *gin.Context) {
+	if !h.available(c) {
+		return
+	}
+	if !h.mitigator.LiftWaterTortureMitigation(c.Param("domain")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mitigation not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rm-hull/dot-block/internal/forwarder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMitigator map[string]forwarder.WaterTortureMitigation
+
+func (f fakeMitigator) WaterTortureMitigations() []forwarder.WaterTortureMitigation {
+	mitigations := []forwarder.WaterTortureMitigation{}
+	for _, m := range f {
+		mitigations = append(mitigations, m)
+	}
+	return mitigations
+}
+
+func (f fakeMitigator) LiftWaterTortureMitigation(domain string) bool {
+	_, ok := f[domain]
+	delete(f, domain)
+	return ok
+}
+
+func waterTortureTestRouter(mitigator WaterTortureMitigator) *gin.Engine {
+	handler := NewWaterTortureHandler(mitigator)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/water-torture", handler.List)
+	r.DELETE("/api/water-torture/:domain", handler.Lift)
+	return r
+}
+
+func TestWaterTortureHandler(t *testing.T) {
+	since := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := waterTortureTestRouter(fakeMitigator{
+		"victim.com": {Domain: "victim.com", Since: since, Until: since.Add(10 * time.Minute), UniqueNames: 500, NXDOMAIN: 0.95, Answered: 42},
+	})
+
+	w := serve(r, http.MethodGet, "/api/water-torture", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"mitigations": [{
+		"domain": "victim.com",
+		"since": "2026-01-02T03:04:05Z",
+		"until": "2026-01-02T03:14:05Z",
+		"unique_names": 500,
+		"nxdomain_ratio": 0.95,
+		"answered": 42
+	}]}`, w.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, serve(r, http.MethodDelete, "/api/water-torture/victim.com", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(r, http.MethodDelete, "/api/water-torture/victim.com", "").Code)
+
+	w = serve(r, http.MethodGet, "/api/water-torture", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"mitigations": []}`, w.Body.String())
+}
+
+func TestWaterTortureHandler_Disabled(t *testing.T) {
+	r := waterTortureTestRouter(nil)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(r, http.MethodGet, "/api/water-torture", "").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(r, http.MethodDelete, "/api/water-torture/victim.com", "").Code)
+}
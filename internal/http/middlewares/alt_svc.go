@@ -0,0 +1,21 @@
+package middlewares
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdvertiseHTTP3 adds an Alt-Svc header to responses served over TLS, telling
+// clients that the same origin is also reachable over HTTP/3 on the given UDP
+// port. Plain HTTP responses are left alone, as browsers ignore Alt-Svc on
+// insecure origins, as are requests that already arrived over HTTP/3.
+func AdvertiseHTTP3(port int) gin.HandlerFunc {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, port)
+	return func(c *gin.Context) {
+		if c.Request.TLS != nil && c.Request.ProtoMajor < 3 {
+			c.Header("Alt-Svc", altSvc)
+		}
+		c.Next()
+	}
+}
@@ -16,10 +16,9 @@ import (
 
 // RateLimit returns Gin middleware for the DoH (/dns-query) endpoint.
 //
-// If dot-block sits behind a reverse proxy / load balancer, make sure
-// Gin's TrustedProxies is configured correctly first — c.ClientIP()
-// otherwise trusts X-Forwarded-For blindly, which would let an attacker
-// spoof their way past the per-IP limiter entirely.
+// c.ClientIP() only honours X-Forwarded-For from the reverse proxies in
+// server.http_trusted_proxies; trusting it from anyone would let an
+// attacker spoof their way past the per-IP limiter entirely.
 func RateLimit(l *limiter.Limiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ip := c.ClientIP()
@@ -44,7 +43,7 @@ func RateLimit(l *limiter.Limiter) gin.HandlerFunc {
 		// the parsed dns.Msg / rcode today).
 		if msg, ok := c.Get("dns_response"); ok {
 			if m, ok := msg.(*dns.Msg); ok {
-				l.RecordResult(ip, m.Rcode == dns.RcodeNameError)
+				l.RecordResult(ip, m.Rcode == dns.RcodeNameError && !c.GetBool("dns_nxdomain_exempt"))
 			}
 		}
 	}
@@ -15,20 +15,38 @@ import (
 	"github.com/rm-hull/dot-block/internal/http/sse"
 	"github.com/rm-hull/dot-block/internal/http/web"
 	"github.com/rm-hull/dot-block/internal/limiter"
+	"github.com/rm-hull/dot-block/internal/odoh"
 	cachecontrol "go.eigsys.de/gin-cachecontrol/v2"
 )
 
-func NewPublicGroup(r *gin.Engine, publicHost string, rateLimiter *limiter.Limiter, mobileConfigHandler gin.HandlerFunc, dohHandler gin.HandlerFunc) *gin.RouterGroup {
+func NewPublicGroup(r *gin.Engine, publicHost string, rateLimiter *limiter.Limiter, mobileConfigHandler gin.HandlerFunc, dohHandler gin.HandlerFunc, odohHandler *handlers.ODoHHandler, setupHandler *handlers.SetupHandler, policyHandler *handlers.PolicyHandler) *gin.RouterGroup {
 	public := r.Group("/")
 	public.Use(middlewares.RequireHost(publicHost))
 	{
 		public.GET("/.mobileconfig", mobileConfigHandler)
 		public.GET("/robots.txt", handlers.RobotsTxtHandler)
+		public.GET("/setup", setupHandler.Guide)
+		public.GET("/setup/qr.png", setupHandler.QRCode)
+		public.GET("/policies/chrome.json", policyHandler.Chrome)
+		public.GET("/policies/firefox.json", policyHandler.Firefox)
+		public.GET("/policies/windows-doh.reg", policyHandler.Windows)
 		doh := public.Group("/dns-query")
 		doh.Use(middlewares.RateLimit(rateLimiter))
 		{
 			doh.GET("", dohHandler)
-			doh.POST("", dohHandler)
+			if odohHandler != nil {
+				// ODoH messages are picked off by content type, anything
+				// else falls through to the regular DoH handler
+				doh.POST("", odohHandler.Query, dohHandler)
+			} else {
+				doh.POST("", dohHandler)
+			}
+			// Named clients identify themselves with a path token
+			doh.GET("/:client", dohHandler)
+			doh.POST("/:client", dohHandler)
+		}
+		if odohHandler != nil {
+			public.GET(odoh.ConfigsPath, odohHandler.Configs)
 		}
 	}
 	return public
@@ -44,6 +62,10 @@ func NewAdminGroup(
 	geoIp geoblock.GeoIpLookup,
 	versionInfoHandler *handlers.VersionInfoHandler,
 	rateLimiter *limiter.Limiter,
+	dnscryptInfoHandler gin.HandlerFunc,
+	clientsHandler *handlers.ClientsHandler,
+	bansHandler *handlers.BansHandler,
+	waterTortureHandler *handlers.WaterTortureHandler,
 ) *gin.RouterGroup {
 
 	// --- Admin: SPA + API, pinned to the admin host, auth on top ---
@@ -53,7 +75,7 @@ func NewAdminGroup(
 		api := admin.Group("/api")
 		api.Use(cors.New(cors.Config{
 			AllowOrigins:     []string{"*"},
-			AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodOptions},
+			AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions},
 			AllowHeaders:     []string{"Authorization", "Content-Type", "X-API-Key"},
 			ExposeHeaders:    []string{"Content-Length"},
 			AllowCredentials: true,
@@ -72,6 +94,18 @@ func NewAdminGroup(
 			api.GET("/whoami", whoAmIHandler)
 			api.GET("/version-info", versionInfoHandler.Info)
 			api.GET("/banned-ips", bannedIPsHandler(rateLimiter))
+			api.GET("/bans", bansHandler.List)
+			api.POST("/bans", bansHandler.Ban)
+			api.DELETE("/bans/*network", bansHandler.Unban)
+			api.GET("/exemptions", bansHandler.Exemptions)
+			api.POST("/exemptions", bansHandler.Exempt)
+			api.DELETE("/exemptions/*network", bansHandler.Unexempt)
+			api.GET("/water-torture", waterTortureHandler.List)
+			api.DELETE("/water-torture/:domain", waterTortureHandler.Lift)
+			api.GET("/dnscrypt", dnscryptInfoHandler)
+			api.GET("/clients", clientsHandler.List)
+			api.PUT("/clients/:id", clientsHandler.Rename)
+			api.DELETE("/clients/:id", clientsHandler.Delete)
 			api.GET("/metrics", handlers.MetricsJSON(prometheus.DefaultGatherer.(*prometheus.Registry)))
 		}
 
@@ -16,10 +16,13 @@ type Event struct {
 	Domain    string    `json:"domain"`
 	Result    string    `json:"result"`
 	ClientIP  string    `json:"ip"`
+	Client    string    `json:"client,omitempty"`
 	Source    string    `json:"src"`
 	Blocked   bool      `json:"blocked"`
 	Cached    bool      `json:"cached"`
 	Cause     string    `json:"cause,omitempty"`
+	Hop       string    `json:"hop,omitempty"`
+	Rebinding bool      `json:"rebinding,omitempty"`
 	Answers   int       `json:"answers"`
 }
 
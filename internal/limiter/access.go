@@ -0,0 +1,363 @@
+package limiter
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ErrNotFound is returned when removing a network that is not banned or
+// exempt.
+var ErrNotFound = errors.New("network not found")
+
+// Ban bans a client IP or network. Bans with a zero Until are permanent.
+type Ban struct {
+	Network   netip.Prefix `json:"network"`
+	Reason    string       `json:"reason,omitempty"`
+	CreatedBy string       `json:"created_by,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	Until     time.Time    `json:"until,omitzero"`
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Until.IsZero() && now.After(b.Until)
+}
+
+// Exemption exempts a client IP or network, e.g. an office NAT, from rate
+// limiting and bans.
+type Exemption struct {
+	Network   netip.Prefix `json:"network"`
+	Reason    string       `json:"reason,omitempty"`
+	CreatedBy string       `json:"created_by,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type persistedAccessList struct {
+	Bans       []Ban       `json:"bans"`
+	Exemptions []Exemption `json:"exemptions"`
+}
+
+// accessListBackend persists the access list as a JSON document.
+type accessListBackend interface {
+	// load returns the document, or nil if there is none yet.
+	load() ([]byte, error)
+	save(data []byte) error
+	// shared reports whether other replicas may change the document, in
+	// which case it is reloaded before every change and periodically.
+	shared() bool
+}
+
+type fileAccessListBackend struct {
+	file string
+}
+
+func (b fileAccessListBackend) load() ([]byte, error) {
+	data, err := os.ReadFile(b.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, errors.Wrap(err, "failed to read access list file")
+}
+
+func (b fileAccessListBackend) save(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(b.file), 0700); err != nil {
+		return errors.Wrap(err, "failed to create access list directory")
+	}
+	// Write to a temporary file first so a crash cannot truncate the list
+	tmp := b.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write access list file")
+	}
+	return errors.Wrap(os.Rename(tmp, b.file), "failed to write access list file")
+}
+
+func (b fileAccessListBackend) shared() bool {
+	return false
+}
+
+// AccessList holds the bans and exemptions made through the admin API, as
+// opposed to the bans from flood detection. They are kept in a JSON file, or
+// in Redis when shared by several replicas, so that they survive restarts.
+type AccessList struct {
+	backend accessListBackend // nil keeps the list in memory only
+
+	mu         sync.RWMutex
+	bans       []Ban
+	exemptions []Exemption
+}
+
+// NewAccessList loads the access list from file if it exists. An empty file
+// name keeps the list in memory only.
+func NewAccessList(file string) (*AccessList, error) {
+	a := &AccessList{}
+	if file == "" {
+		return a, nil
+	}
+	a.backend = fileAccessListBackend{file: file}
+	if err := a.load(); err != nil {
+		return nil, errors.Wrapf(err, "failed to load access list file %s", file)
+	}
+	return a, nil
+}
+
+// NewRedisAccessList loads the access list from Redis, where it is shared
+// with the other replicas using the store. If Redis is unreachable, the list
+// starts empty and is loaded once it recovers.
+func NewRedisAccessList(store *RedisStore) *AccessList {
+	a := &AccessList{backend: redisAccessListBackend{store: store}}
+	if err := a.load(); err != nil {
+		store.warn("load access list", err)
+	}
+	return a
+}
+
+// load replaces the list with the persisted one. It must be called with the
+// lock held, or before the list is shared.
+func (a *AccessList) load() error {
+	data, err := a.backend.load()
+	if err != nil || data == nil {
+		return err
+	}
+	var persisted persistedAccessList
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return errors.Wrap(err, "failed to parse access list")
+	}
+	now := time.Now()
+	a.bans = slices.DeleteFunc(persisted.Bans, func(b Ban) bool { return b.expired(now) })
+	a.exemptions = persisted.Exemptions
+	return nil
+}
+
+// refresh reloads a shared list before it is changed, so that changes made
+// by other replicas are not overwritten. It must be called with the lock
+// held.
+func (a *AccessList) refresh() error {
+	if a.backend == nil || !a.backend.shared() {
+		return nil
+	}
+	return a.load()
+}
+
+// ParseNetwork parses a CIDR range or a single IP address.
+func ParseNetwork(network string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(network); err == nil {
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0))
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(network)
+	if err != nil {
+		return netip.Prefix{}, errors.Newf("invalid network %q (expected an IP address or CIDR range)", network)
+	}
+	addr = addr.WithZone("").Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (a *AccessList) banned(addr netip.Addr, now time.Time) (Ban, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, ban := range a.bans {
+		if ban.Network.Contains(addr) && !ban.expired(now) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+func (a *AccessList) exempt(addr netip.Addr) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.ContainsFunc(a.exemptions, func(e Exemption) bool {
+		return e.Network.Contains(addr)
+	})
+}
+
+// addBan adds the ban, replacing any existing ban of the same network.
+func (a *AccessList) addBan(ban Ban) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(); err != nil {
+		return err
+	}
+	bans := slices.DeleteFunc(slices.Clone(a.bans), func(b Ban) bool { return b.Network == ban.Network })
+	return a.update(append(bans, ban), a.exemptions)
+}
+
+// removeBan removes the ban of exactly the network, reporting whether there
+// was one.
+func (a *AccessList) removeBan(network netip.Prefix) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(); err != nil {
+		return false, err
+	}
+	bans := slices.DeleteFunc(slices.Clone(a.bans), func(b Ban) bool { return b.Network == network })
+	if len(bans) == len(a.bans) {
+		return false, nil
+	}
+	return true, a.update(bans, a.exemptions)
+}
+
+// addExemption adds the exemption, replacing any existing exemption of the
+// same network.
+func (a *AccessList) addExemption(exemption Exemption) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(); err != nil {
+		return err
+	}
+	exemptions := slices.DeleteFunc(slices.Clone(a.exemptions), func(e Exemption) bool { return e.Network == exemption.Network })
+	return a.update(a.bans, append(exemptions, exemption))
+}
+
+func (a *AccessList) removeExemption(network netip.Prefix) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(); err != nil {
+		return err
+	}
+	exemptions := slices.DeleteFunc(slices.Clone(a.exemptions), func(e Exemption) bool { return e.Network == network })
+	if len(exemptions) == len(a.exemptions) {
+		return ErrNotFound
+	}
+	return a.update(a.bans, exemptions)
+}
+
+// update saves the new list and only then replaces the current one with it,
+// so that a change that could not be saved does not apply either. It must be
+// called with the lock held.
+func (a *AccessList) update(bans []Ban, exemptions []Exemption) error {
+	if err := a.save(bans, exemptions); err != nil {
+		return err
+	}
+	a.bans, a.exemptions = bans, exemptions
+	return nil
+}
+
+func (a *AccessList) list(now time.Time) ([]Ban, []Exemption) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	// Never nil, so that empty lists are encoded as such
+	bans := slices.DeleteFunc(append([]Ban{}, a.bans...), func(b Ban) bool { return b.expired(now) })
+	return bans, append([]Exemption{}, a.exemptions...)
+}
+
+// reap drops expired bans from memory, and picks up the changes of other
+// replicas to a shared list. The persisted list is left alone until the next
+// change, as expired bans are dropped when loading it too.
+func (a *AccessList) reap(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_ = a.refresh() // Keep the current list if it is unavailable
+	a.bans = slices.DeleteFunc(a.bans, func(b Ban) bool { return b.expired(now) })
+}
+
+func (a *AccessList) save(bans []Ban, exemptions []Exemption) error {
+	if a.backend == nil {
+		return nil
+	}
+
+	now := time.Now()
+	persisted := persistedAccessList{
+		Bans:       slices.DeleteFunc(append([]Ban{}, bans...), func(b Ban) bool { return b.expired(now) }),
+		Exemptions: append([]Exemption{}, exemptions...),
+	}
+	sortByNetwork(persisted.Bans, func(b Ban) netip.Prefix { return b.Network })
+	sortByNetwork(persisted.Exemptions, func(e Exemption) netip.Prefix { return e.Network })
+
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode access list")
+	}
+	return a.backend.save(data)
+}
+
+func sortByNetwork[T any](items []T, network func(T) netip.Prefix) {
+	slices.SortFunc(items, func(a, b T) int {
+		pa, pb := network(a), network(b)
+		return cmp.Or(pa.Addr().Compare(pb.Addr()), cmp.Compare(pa.Bits(), pb.Bits()))
+	})
+}
+
+// Ban bans the network for the given duration, or permanently if it is zero.
+// Exempt networks are never banned, whatever their bans.
+func (l *Limiter) Ban(network netip.Prefix, duration time.Duration, reason, createdBy string) (Ban, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	ban := Ban{Network: network, Reason: reason, CreatedBy: createdBy, CreatedAt: now}
+	if duration > 0 {
+		ban.Until = now.Add(duration)
+	}
+	return ban, l.access.addBan(ban)
+}
+
+// Unban lifts the ban of exactly the network, along with any flood detection
+// bans of addresses within it. It returns ErrNotFound if nothing was banned.
+func (l *Limiter) Unban(network netip.Prefix) error {
+	found, err := l.access.removeBan(network)
+	if err != nil {
+		return err
+	}
+
+	if l.store.Unban(network) {
+		found = true
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Exempt exempts the network from rate limiting and bans.
+func (l *Limiter) Exempt(network netip.Prefix, reason, createdBy string) (Exemption, error) {
+	exemption := Exemption{
+		Network:   network,
+		Reason:    reason,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	return exemption, l.access.addExemption(exemption)
+}
+
+// Unexempt removes the exemption of exactly the network. It returns
+// ErrNotFound if it was not exempt.
+func (l *Limiter) Unexempt(network netip.Prefix) error {
+	return l.access.removeExemption(network)
+}
+
+// Bans returns the current bans, both those made through the admin API and
+// those from flood detection, sorted by network.
+func (l *Limiter) Bans() []Ban {
+	now := time.Now()
+	bans, _ := l.access.list(now)
+	for ip, until := range l.BannedIPs() {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || now.After(until) {
+			continue
+		}
+		addr = addr.WithZone("").Unmap()
+		bans = append(bans, Ban{
+			Network:   netip.PrefixFrom(addr, addr.BitLen()),
+			Reason:    string(ReasonNXDOMAIFlood),
+			CreatedBy: "dot-block",
+			CreatedAt: until.Add(-l.cfg.BanDuration),
+			Until:     until,
+		})
+	}
+	sortByNetwork(bans, func(b Ban) netip.Prefix { return b.Network })
+	return bans
+}
+
+// Exemptions returns the exempt networks, sorted by network.
+func (l *Limiter) Exemptions() []Exemption {
+	_, exemptions := l.access.list(time.Now())
+	sortByNetwork(exemptions, func(e Exemption) netip.Prefix { return e.Network })
+	return exemptions
+}
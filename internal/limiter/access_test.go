@@ -0,0 +1,173 @@
+package limiter
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":            "192.0.2.1/32",
+		"192.0.2.77/24":        "192.0.2.0/24",
+		"::ffff:192.0.2.1":     "192.0.2.1/32",
+		"::ffff:192.0.2.1/120": "192.0.2.0/24",
+		"2001:db8::1":          "2001:db8::1/128",
+		"2001:db8:1:2::/48":    "2001:db8:1::/48",
+	}
+	for network, expected := range tests {
+		prefix, err := ParseNetwork(network)
+		require.NoError(t, err, network)
+		assert.Equal(t, expected, prefix.String(), network)
+	}
+
+	_, err := ParseNetwork("example.com")
+	assert.Error(t, err)
+}
+
+func TestLimiter_ManualBans(t *testing.T) {
+	metrics := newMockMetrics()
+	// Rate limiting is disabled, but manual bans still apply
+	l, err := New(&config.RateLimitConfig{Enabled: false}, metrics, nil, nil, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = l.Ban(netip.MustParsePrefix("192.0.2.0/24"), time.Hour, "abuse", "admin")
+	require.NoError(t, err)
+	_, err = l.Ban(netip.MustParsePrefix("2001:db8::/32"), 0, "", "admin")
+	require.NoError(t, err)
+
+	ok, reason := l.Allow("192.0.2.55")
+	assert.False(t, ok)
+	assert.Equal(t, ReasonManualBan, reason)
+	assert.Greater(t, l.RetryAfter("192.0.2.55"), 59*time.Minute)
+
+	ok, _ = l.Allow("2001:db8::1")
+	assert.False(t, ok)
+	assert.Equal(t, 24*time.Hour, l.RetryAfter("2001:db8::1"), "permanent bans")
+
+	ok, _ = l.Allow("198.51.100.1")
+	assert.True(t, ok)
+	assert.Equal(t, 2, metrics.rateLimitedCalled[ReasonManualBan])
+
+	bans := l.Bans()
+	require.Len(t, bans, 2)
+	assert.Equal(t, "192.0.2.0/24", bans[0].Network.String())
+	assert.Equal(t, "abuse", bans[0].Reason)
+	assert.Equal(t, "admin", bans[0].CreatedBy)
+	assert.False(t, bans[0].Until.IsZero())
+	assert.True(t, bans[1].Until.IsZero())
+
+	require.NoError(t, l.Unban(netip.MustParsePrefix("192.0.2.0/24")))
+	ok, _ = l.Allow("192.0.2.55")
+	assert.True(t, ok)
+	assert.ErrorIs(t, l.Unban(netip.MustParsePrefix("192.0.2.0/24")), ErrNotFound)
+}
+
+func TestLimiter_Exemptions(t *testing.T) {
+	metrics := newMockMetrics()
+	l, err := New(&config.RateLimitConfig{
+		Enabled:           true,
+		RequestsPerSecond: 1,
+		Burst:             1,
+		BanDuration:       time.Hour,
+		MaxTrackedIPs:     100,
+	}, metrics, nil, nil, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = l.Exempt(netip.MustParsePrefix("203.0.113.0/24"), "office NAT", "admin")
+	require.NoError(t, err)
+	_, err = l.Ban(netip.MustParsePrefix("203.0.113.0/24"), time.Hour, "", "admin")
+	require.NoError(t, err)
+
+	// Exempt networks bypass both the rate limits and bans
+	for range 10 {
+		ok, _ := l.Allow("203.0.113.9")
+		assert.True(t, ok)
+	}
+
+	require.NoError(t, l.Unexempt(netip.MustParsePrefix("203.0.113.0/24")))
+	ok, reason := l.Allow("203.0.113.9")
+	assert.False(t, ok)
+	assert.Equal(t, ReasonManualBan, reason)
+	assert.ErrorIs(t, l.Unexempt(netip.MustParsePrefix("203.0.113.0/24")), ErrNotFound)
+}
+
+func TestLimiter_UnbanFloodDetection(t *testing.T) {
+	l, err := New(&config.RateLimitConfig{Enabled: true, BanDuration: time.Hour}, newMockMetrics(), nil, nil, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	l.ban("10.0.0.5", time.Now())
+	bans := l.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, "10.0.0.5/32", bans[0].Network.String())
+	assert.Equal(t, string(ReasonNXDOMAIFlood), bans[0].Reason)
+
+	require.NoError(t, l.Unban(netip.MustParsePrefix("10.0.0.0/8")))
+	assert.Empty(t, l.BannedIPs())
+}
+
+func TestAccessList_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data", "access-list.json")
+	accessList, err := NewAccessList(file)
+	require.NoError(t, err)
+	l, err := New(&config.RateLimitConfig{}, newMockMetrics(), nil, accessList, nil)
+	require.NoError(t, err)
+
+	_, err = l.Ban(netip.MustParsePrefix("192.0.2.0/24"), 0, "abuse", "admin")
+	require.NoError(t, err)
+	_, err = l.Ban(netip.MustParsePrefix("198.51.100.0/24"), time.Hour, "", "admin")
+	require.NoError(t, err)
+	_, err = l.Exempt(netip.MustParsePrefix("203.0.113.1/32"), "office NAT", "admin")
+	require.NoError(t, err)
+	l.Close()
+
+	accessList, err = NewAccessList(file)
+	require.NoError(t, err)
+	l, err = New(&config.RateLimitConfig{}, newMockMetrics(), nil, accessList, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	bans := l.Bans()
+	require.Len(t, bans, 2)
+	assert.Equal(t, "192.0.2.0/24", bans[0].Network.String())
+	assert.Equal(t, "abuse", bans[0].Reason)
+	exemptions := l.Exemptions()
+	require.Len(t, exemptions, 1)
+	assert.Equal(t, "office NAT", exemptions[0].Reason)
+
+	ok, _ := l.Allow("192.0.2.1")
+	assert.False(t, ok)
+}
+
+// failingBackend accepts no changes to the access list.
+type failingBackend struct{}
+
+func (failingBackend) load() ([]byte, error) { return nil, nil }
+func (failingBackend) save([]byte) error     { return errors.New("disk full") }
+func (failingBackend) shared() bool          { return false }
+
+func TestAccessList_FailedSaveDoesNotApply(t *testing.T) {
+	accessList := &AccessList{backend: failingBackend{}}
+	l, err := New(&config.RateLimitConfig{}, newMockMetrics(), nil, accessList, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = l.Ban(netip.MustParsePrefix("192.0.2.0/24"), 0, "abuse", "admin")
+	require.ErrorContains(t, err, "disk full")
+	_, err = l.Exempt(netip.MustParsePrefix("203.0.113.1/32"), "office NAT", "admin")
+	require.ErrorContains(t, err, "disk full")
+
+	assert.Empty(t, l.Bans())
+	assert.Empty(t, l.Exemptions())
+	ok, _ := l.Allow("192.0.2.1")
+	assert.True(t, ok, "the ban was not saved, so does not apply")
+}
@@ -1,12 +1,19 @@
 // Package limiter provides per-client-IP rate limiting and abuse detection
 // (NXDOMAIN/random-subdomain flood mitigation) shared across the UDP, TCP,
-// DoT and DoH listeners.
+// DoT and DoH listeners, as well as Response Rate Limiting for UDP.
 //
 // Design notes:
 //   - Per-IP token buckets are stored in a bounded LRU so a distributed
 //     "low and slow" flood from many source IPs can't grow memory without
 //     limit (that would just be a different flavour of the same DoS the
 //     feature is meant to prevent).
+//   - The token buckets and bans are kept in a Store: in memory by default,
+//     or in Redis so that replicas behind a load balancer share them (a
+//     client's budget would otherwise be multiplied by the replica count).
+//   - Limits are hierarchical: per client IP, then per subnet and
+//     (optionally) per ASN, each with its own token buckets. Per-IP limits
+//     alone are no use against a client with an IPv6 /64 — 2^64 fresh
+//     buckets, which also evict legitimate entries from the LRU.
 //   - RPS limiting and NXDOMAIN-flood detection are tracked separately.
 //     A busy household with several devices can legitimately generate a
 //     high query rate; that's not the same signal as a high proportion of
@@ -24,22 +31,27 @@
 package limiter
 
 import (
-	"sync"
+	"net/netip"
 	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/errors"
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/geoblock"
 	"golang.org/x/time/rate"
 )
 
 type Reason string
 
 const (
-	ReasonNone         Reason = ""
-	ReasonExceededRPS  Reason = "exceeded_rps"
-	ReasonNXDOMAIFlood Reason = "nxdomain_flood"
-	ReasonBanned       Reason = "banned"
+	ReasonNone              Reason = ""
+	ReasonExceededRPS       Reason = "exceeded_rps"
+	ReasonSubnetExceededRPS Reason = "subnet_exceeded_rps"
+	ReasonASNExceededRPS    Reason = "asn_exceeded_rps"
+	ReasonNXDOMAIFlood      Reason = "nxdomain_flood"
+	ReasonBanned            Reason = "banned"
+	ReasonManualBan         Reason = "manual_ban"
 )
 
 // Metrics is the minimal surface the limiter needs from a metrics backend.
@@ -49,13 +61,8 @@ const (
 type Metrics interface {
 	IncRateLimited(reason Reason)
 	SetTrackedIPs(n int)
-}
-
-// bucketEntry pairs a token bucket with a last-seen timestamp so the reaper
-// can evict idle IPs without waiting for the LRU to fill up.
-type bucketEntry struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
+	IncResponseLimited(action ResponseAction)
+	SetTrackedResponses(n int)
 }
 
 // nxEntry tracks a rolling count of total vs NXDOMAIN responses for one IP.
@@ -79,11 +86,13 @@ type nxResult struct {
 
 // Limiter is safe for concurrent use.
 type Limiter struct {
-	cfg     *config.RateLimitConfig
-	metrics Metrics
+	cfg         *config.RateLimitConfig
+	metrics     Metrics
+	geoIpLookup geoblock.GeoIpLookup
 
-	bucketsMu sync.Mutex
-	buckets   *lru.Cache[string, *bucketEntry]
+	// store holds the token buckets, keyed by client IP, subnet and ASN,
+	// and the bans from flood detection.
+	store Store
 
 	// nxResultCh is a buffered channel for asynchronous NXDOMAIN result
 	// processing. The processNxResults goroutine is the sole owner of the
@@ -91,30 +100,61 @@ type Limiter struct {
 	nxResultCh chan nxResult
 	reapCh     chan struct{}
 
-	bansMu sync.RWMutex
-	bans   map[string]time.Time // ip -> ban expiry
+	// access holds the bans and exemptions made through the admin API.
+	access *AccessList
+
+	// rrl is nil unless Response Rate Limiting is enabled.
+	rrl *responseLimiter
 
 	// closed is set to true once Close has been called.
 	closed atomic.Bool
 	done   chan struct{} // closed when the background goroutine exits
 }
 
-func New(cfg *config.RateLimitConfig, metrics Metrics) (*Limiter, error) {
+// New creates a limiter. geoIpLookup is only needed for per-ASN limits, and
+// may be nil otherwise. If accessList is nil, manual bans and exemptions are
+// kept in memory only, and if store is nil, so are the token buckets and the
+// bans from flood detection.
+func New(cfg *config.RateLimitConfig, metrics Metrics, geoIpLookup geoblock.GeoIpLookup, accessList *AccessList, store Store) (*Limiter, error) {
 	maxTrackedIPs := cfg.MaxTrackedIPs
 	if maxTrackedIPs <= 0 {
 		maxTrackedIPs = 10000
 	}
-	buckets, err := lru.New[string, *bucketEntry](maxTrackedIPs)
+
+	if cfg.Subnet != nil && cfg.Subnet.Enabled {
+		if err := validatePrefixes("subnet", cfg.Subnet.IPv4Prefix, cfg.Subnet.IPv6Prefix); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ASN != nil && cfg.ASN.Enabled && geoIpLookup == nil {
+		return nil, errors.New("per-ASN rate limiting requires the IPinfo geolocation database (geoblock.ipinfo)")
+	}
+
+	if store == nil {
+		memory, err := newMemoryStore(maxTrackedIPs)
+		if err != nil {
+			return nil, err
+		}
+		store = memory
+	}
+
+	rrl, err := newResponseLimiter(cfg.RRL, metrics)
 	if err != nil {
 		return nil, err
 	}
 
+	if accessList == nil {
+		accessList, _ = NewAccessList("")
+	}
+
 	l := &Limiter{
-		cfg:     cfg,
-		metrics: metrics,
-		buckets: buckets,
-		bans:    make(map[string]time.Time),
-		done:    make(chan struct{}),
+		cfg:         cfg,
+		metrics:     metrics,
+		geoIpLookup: geoIpLookup,
+		store:       store,
+		access:      accessList,
+		rrl:         rrl,
+		done:        make(chan struct{}),
 	}
 
 	// Start the NX result processing goroutine only when NXDOMAIN flood
@@ -131,16 +171,31 @@ func New(cfg *config.RateLimitConfig, metrics Metrics) (*Limiter, error) {
 // Allow reports whether a query from ip should proceed. Call this as early
 // as possible in the request path — right after extracting the client IP,
 // before any cache lookup or upstream dispatch — so rejected traffic costs
-// as little as possible.
+// as little as possible. Exempt networks are always allowed, and manually
+// banned ones never, even with rate limiting disabled. Otherwise the per-IP,
+// per-subnet and per-ASN limits are checked in that order, and the reason
+// names the level that was exceeded.
 //
 // ip should already have any port stripped (see ClientIP helper below).
 func (l *Limiter) Allow(ip string) (bool, Reason) {
+	now := time.Now()
+
+	addr, addrErr := netip.ParseAddr(ip)
+	if addrErr == nil {
+		addr = addr.WithZone("").Unmap()
+		if l.access.exempt(addr) {
+			return true, ReasonNone
+		}
+		if _, banned := l.access.banned(addr, now); banned {
+			l.metrics.IncRateLimited(ReasonManualBan)
+			return false, ReasonManualBan
+		}
+	}
+
 	if !l.cfg.Enabled {
 		return true, ReasonNone
 	}
 
-	now := time.Now()
-
 	// Cheapest check first: is this IP currently banned?
 	if until, banned := l.isBanned(ip, now); banned {
 		_ = until
@@ -148,25 +203,76 @@ func (l *Limiter) Allow(ip string) (bool, Reason) {
 		return false, ReasonBanned
 	}
 
-	if !l.tokenBucketFor(ip, now).AllowN(now, 1) {
+	allowed, tracked := l.store.Take(levelIP, ip, rate.Limit(l.cfg.RequestsPerSecond), l.cfg.Burst, now)
+	if tracked > 0 {
+		l.metrics.SetTrackedIPs(tracked)
+	}
+	if !allowed {
 		l.metrics.IncRateLimited(ReasonExceededRPS)
 		return false, ReasonExceededRPS
 	}
 
+	if subnet := l.cfg.Subnet; subnet != nil && subnet.Enabled && addrErr == nil {
+		if prefix, err := clientPrefix(addr, subnet.IPv4Prefix, subnet.IPv6Prefix); err == nil {
+			if allowed, _ := l.store.Take(levelSubnet, prefix.String(), rate.Limit(subnet.RequestsPerSecond), subnet.Burst, now); !allowed {
+				l.metrics.IncRateLimited(ReasonSubnetExceededRPS)
+				return false, ReasonSubnetExceededRPS
+			}
+		}
+	}
+
+	if asn := l.cfg.ASN; asn != nil && asn.Enabled {
+		if geoData, err := l.geoIpLookup.GetAll(ip); err == nil && geoData != nil && geoData.ASN != "" {
+			if allowed, _ := l.store.Take(levelASN, geoData.ASN, rate.Limit(asn.RequestsPerSecond), asn.Burst, now); !allowed {
+				l.metrics.IncRateLimited(ReasonASNExceededRPS)
+				return false, ReasonASNExceededRPS
+			}
+		}
+	}
+
 	return true, ReasonNone
 }
 
+// clientPrefix returns the network of addr that clients are aggregated by.
+func clientPrefix(addr netip.Addr, ipv4Prefix, ipv6Prefix int) (netip.Prefix, error) {
+	addr = addr.WithZone("").Unmap()
+	if addr.Is4() {
+		return addr.Prefix(ipv4Prefix)
+	}
+	return addr.Prefix(ipv6Prefix)
+}
+
+func validatePrefixes(name string, ipv4Prefix, ipv6Prefix int) error {
+	if ipv4Prefix < 0 || ipv4Prefix > 32 {
+		return errors.Newf("invalid %s ipv4_prefix %d (expected 0-32)", name, ipv4Prefix)
+	}
+	if ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return errors.Newf("invalid %s ipv6_prefix %d (expected 0-128)", name, ipv6Prefix)
+	}
+	return nil
+}
+
 // RetryAfter returns the suggested duration a client should wait before
 // retrying after being rejected by Allow. For banned IPs, this is the
-// remaining ban duration. For RPS exhaustion (token bucket empty), it is
-// approximately 1/RequestsPerSecond, rounded up to at least 1 second.
+// remaining ban duration (or a day, for permanent bans). For RPS exhaustion
+// (token bucket empty), it is approximately 1/RequestsPerSecond, rounded up
+// to at least 1 second.
 func (l *Limiter) RetryAfter(ip string) time.Duration {
+	now := time.Now()
+
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		if ban, banned := l.access.banned(addr.WithZone("").Unmap(), now); banned {
+			if ban.Until.IsZero() {
+				return 24 * time.Hour
+			}
+			return ban.Until.Sub(now)
+		}
+	}
+
 	if !l.cfg.Enabled {
 		return 0
 	}
 
-	now := time.Now()
-
 	if until, ok := l.isBanned(ip, now); ok {
 		return time.Until(until)
 	}
@@ -192,6 +298,9 @@ func (l *Limiter) RecordResult(ip string, isNXDOMAIN bool) {
 	if !l.cfg.Enabled || l.cfg.NXDOMAINWindow <= 0 || l.closed.Load() {
 		return
 	}
+	if addr, err := netip.ParseAddr(ip); err == nil && l.access.exempt(addr.WithZone("").Unmap()) {
+		return
+	}
 
 	select {
 	case l.nxResultCh <- nxResult{ip: ip, isNXDOMAIN: isNXDOMAIN}:
@@ -283,72 +392,29 @@ func (l *Limiter) reapNx(nx *lru.Cache[string, *nxEntry]) {
 	}
 }
 
-func (l *Limiter) tokenBucketFor(ip string, now time.Time) *rate.Limiter {
-	l.bucketsMu.Lock()
-	defer l.bucketsMu.Unlock()
-
-	entry, ok := l.buckets.Get(ip)
-	if !ok {
-		entry = &bucketEntry{
-			limiter: rate.NewLimiter(rate.Limit(l.cfg.RequestsPerSecond), l.cfg.Burst),
-		}
-		l.buckets.Add(ip, entry)
-		l.metrics.SetTrackedIPs(l.buckets.Len())
-	}
-	entry.lastSeen = now
-	return entry.limiter
-}
-
 func (l *Limiter) isBanned(ip string, now time.Time) (time.Time, bool) {
-	l.bansMu.RLock()
-	until, ok := l.bans[ip]
-	l.bansMu.RUnlock()
-	if !ok {
-		return time.Time{}, false
-	}
-	if now.After(until) {
-		// Expired — clean it up lazily rather than waiting for the reaper.
-		l.bansMu.Lock()
-		delete(l.bans, ip)
-		l.bansMu.Unlock()
-		return time.Time{}, false
-	}
-	return until, true
+	return l.store.BannedUntil(ip, now)
 }
 
 func (l *Limiter) ban(ip string, now time.Time) {
-	l.bansMu.Lock()
-	l.bans[ip] = now.Add(l.cfg.BanDuration)
-	l.bansMu.Unlock()
+	l.store.Ban(ip, now.Add(l.cfg.BanDuration))
 }
 
-// Reap evicts token-bucket, NXDOMAIN-window, and ban entries that have been
-// idle longer than the configured thresholds. Call this periodically — in
-// dot-block it is wired to the existing cron scheduler rather than running
+// Reap evicts token-bucket, NXDOMAIN-window, RRL and ban entries that have
+// been idle longer than the configured thresholds. Call this periodically —
+// in dot-block it is wired to the existing cron scheduler rather than running
 // on its own goroutine.
 func (l *Limiter) Reap() {
 	now := time.Now()
 
-	// Reap token buckets (directly — owns its own mutex).
-	l.bucketsMu.Lock()
-	for _, ip := range l.buckets.Keys() {
-		entry, ok := l.buckets.Peek(ip)
-		if ok && now.Sub(entry.lastSeen) > l.cfg.IdleTTL {
-			l.buckets.Remove(ip)
-		}
-	}
-	trackedIPs := l.buckets.Len()
-	l.bucketsMu.Unlock()
-	l.metrics.SetTrackedIPs(trackedIPs)
+	// Reap token buckets and bans (directly — the store owns its own locks).
+	l.store.Reap(now, l.cfg.IdleTTL)
+	l.metrics.SetTrackedIPs(l.store.Len(levelIP))
+	l.access.reap(now)
 
-	// Reap bans (directly — owns its own RWMutex).
-	l.bansMu.Lock()
-	for ip, until := range l.bans {
-		if now.After(until) {
-			delete(l.bans, ip)
-		}
+	if l.rrl != nil {
+		l.rrl.reap(now)
 	}
-	l.bansMu.Unlock()
 
 	// Signal the background goroutine to reap NX window entries.
 	// Non-blocking: if a reap is already pending, skip.
@@ -374,12 +440,5 @@ func (l *Limiter) Close() {
 // BannedIPs returns a snapshot of currently-banned IPs and the time their
 // ban expires. The map is a copy — safe to iterate without holding the lock.
 func (l *Limiter) BannedIPs() map[string]time.Time {
-	l.bansMu.RLock()
-	defer l.bansMu.RUnlock()
-
-	out := make(map[string]time.Time, len(l.bans))
-	for ip, until := range l.bans {
-		out[ip] = until
-	}
-	return out
+	return l.store.Bans(time.Now())
 }
@@ -5,18 +5,22 @@ import (
 	"time"
 
 	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/geoblock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 type mockMetrics struct {
-	rateLimitedCalled map[Reason]int
-	trackedIPs        int
+	rateLimitedCalled     map[Reason]int
+	trackedIPs            int
+	responseLimitedCalled map[ResponseAction]int
+	trackedResponses      int
 }
 
 func newMockMetrics() *mockMetrics {
 	return &mockMetrics{
-		rateLimitedCalled: make(map[Reason]int),
+		rateLimitedCalled:     make(map[Reason]int),
+		responseLimitedCalled: make(map[ResponseAction]int),
 	}
 }
 
@@ -28,12 +32,20 @@ func (m *mockMetrics) SetTrackedIPs(n int) {
 	m.trackedIPs = n
 }
 
+func (m *mockMetrics) IncResponseLimited(action ResponseAction) {
+	m.responseLimitedCalled[action]++
+}
+
+func (m *mockMetrics) SetTrackedResponses(n int) {
+	m.trackedResponses = n
+}
+
 func TestLimiter_Disabled(t *testing.T) {
 	metrics := newMockMetrics()
 	cfg := &config.RateLimitConfig{
 		Enabled: false,
 	}
-	l, err := New(cfg, metrics)
+	l, err := New(cfg, metrics, nil, nil, nil)
 	require.NoError(t, err)
 	defer l.Close()
 
@@ -51,7 +63,7 @@ func TestLimiter_TokenBucket_RPS(t *testing.T) {
 		BanDuration:       time.Minute,
 		MaxTrackedIPs:     100,
 	}
-	l, err := New(cfg, metrics)
+	l, err := New(cfg, metrics, nil, nil, nil)
 	require.NoError(t, err)
 	defer l.Close()
 
@@ -71,6 +83,106 @@ func TestLimiter_TokenBucket_RPS(t *testing.T) {
 	assert.Equal(t, 1, metrics.rateLimitedCalled[ReasonExceededRPS])
 }
 
+func TestLimiter_Subnet(t *testing.T) {
+	metrics := newMockMetrics()
+	cfg := &config.RateLimitConfig{
+		Enabled:           true,
+		RequestsPerSecond: 10,
+		Burst:             2,
+		MaxTrackedIPs:     100,
+		Subnet: &config.SubnetRateLimitConfig{
+			Enabled:           true,
+			RequestsPerSecond: 10,
+			Burst:             3,
+			IPv4Prefix:        24,
+			IPv6Prefix:        64,
+		},
+	}
+	l, err := New(cfg, metrics, nil, nil, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Each address is within its own limit, but the /64 is not
+	for _, ip := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"} {
+		ok, _ := l.Allow(ip)
+		assert.True(t, ok)
+	}
+	ok, reason := l.Allow("2001:db8::4")
+	assert.False(t, ok)
+	assert.Equal(t, ReasonSubnetExceededRPS, reason)
+	assert.Equal(t, 1, metrics.rateLimitedCalled[ReasonSubnetExceededRPS])
+
+	// Other subnets are unaffected
+	ok, _ = l.Allow("2001:db8:0:1::1")
+	assert.True(t, ok)
+	ok, _ = l.Allow("192.0.2.1")
+	assert.True(t, ok)
+
+	// The per-IP limit is checked first
+	ok, _ = l.Allow("192.0.2.1")
+	assert.True(t, ok)
+	ok, reason = l.Allow("192.0.2.1")
+	assert.False(t, ok)
+	assert.Equal(t, ReasonExceededRPS, reason)
+}
+
+func TestLimiter_Subnet_InvalidPrefix(t *testing.T) {
+	_, err := New(&config.RateLimitConfig{
+		Subnet: &config.SubnetRateLimitConfig{Enabled: true, IPv4Prefix: 24, IPv6Prefix: 129},
+	}, newMockMetrics(), nil, nil, nil)
+	assert.ErrorContains(t, err, "ipv6_prefix")
+}
+
+type mockGeoIpLookup map[string]string
+
+func (m mockGeoIpLookup) Reopen() error { return nil }
+
+func (m mockGeoIpLookup) GetAll(ipAddr string) (*geoblock.GeoData, error) {
+	asn, ok := m[ipAddr]
+	if !ok {
+		return nil, nil
+	}
+	return &geoblock.GeoData{ASN: asn}, nil
+}
+
+func (m mockGeoIpLookup) IsValid(ipAddr string) bool { return true }
+
+func TestLimiter_ASN(t *testing.T) {
+	metrics := newMockMetrics()
+	cfg := &config.RateLimitConfig{
+		Enabled:           true,
+		RequestsPerSecond: 10,
+		Burst:             10,
+		MaxTrackedIPs:     100,
+		ASN: &config.ASNRateLimitConfig{
+			Enabled:           true,
+			RequestsPerSecond: 10,
+			Burst:             2,
+		},
+	}
+	_, err := New(cfg, metrics, nil, nil, nil)
+	assert.Error(t, err, "per-ASN limits need a geolocation database")
+
+	l, err := New(cfg, metrics, mockGeoIpLookup{"192.0.2.1": "AS64500", "198.51.100.1": "AS64500"}, nil, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	ok, _ := l.Allow("192.0.2.1")
+	assert.True(t, ok)
+	ok, _ = l.Allow("198.51.100.1")
+	assert.True(t, ok)
+	ok, reason := l.Allow("198.51.100.1")
+	assert.False(t, ok)
+	assert.Equal(t, ReasonASNExceededRPS, reason)
+	assert.Equal(t, 1, metrics.rateLimitedCalled[ReasonASNExceededRPS])
+
+	// Clients whose ASN is not known are only limited per IP
+	for range 5 {
+		ok, _ = l.Allow("203.0.113.1")
+		assert.True(t, ok)
+	}
+}
+
 func TestLimiter_NXDOMAIN_Flood_And_Ban(t *testing.T) {
 	metrics := newMockMetrics()
 	cfg := &config.RateLimitConfig{
@@ -83,7 +195,7 @@ func TestLimiter_NXDOMAIN_Flood_And_Ban(t *testing.T) {
 		NXDOMAINThreshold:  0.8,
 		MaxTrackedIPs:      100,
 	}
-	l, err := New(cfg, metrics)
+	l, err := New(cfg, metrics, nil, nil, nil)
 	require.NoError(t, err)
 	defer l.Close()
 
@@ -130,7 +242,7 @@ func TestLimiter_RetryAfter_RPS(t *testing.T) {
 		Burst:             1,
 		BanDuration:       time.Minute,
 	}
-	l, err := New(cfg, metrics)
+	l, err := New(cfg, metrics, nil, nil, nil)
 	require.NoError(t, err)
 	defer l.Close()
 
@@ -159,7 +271,7 @@ func TestLimiter_Reap(t *testing.T) {
 		BanDuration:       10 * time.Millisecond,
 		MaxTrackedIPs:     100,
 	}
-	l, err := New(cfg, metrics)
+	l, err := New(cfg, metrics, nil, nil, nil)
 	require.NoError(t, err)
 	defer l.Close()
 
@@ -0,0 +1,358 @@
+package limiter
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"math"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/rm-hull/dot-block/internal/config"
+	"golang.org/x/time/rate"
+)
+
+// takeScript refills the token bucket in KEYS[1] for the time elapsed since
+// it was last used, and takes a token if one is available. The bucket expires
+// once it would have refilled, as a full bucket is no different from a
+// missing one, and is recorded in the KEYS[2] index so that buckets can be
+// counted. It returns whether a token was taken and, if the bucket was
+// created, the number of buckets in the index (0 otherwise).
+var takeScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens, ts, created = tonumber(bucket[1]), tonumber(bucket[2]), 0
+if tokens == nil or ts == nil then
+  tokens, ts, created = burst, now, 1
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * limit / 1000)
+local allowed = 0
+if tokens >= 1 then
+  tokens, allowed = tokens - 1, 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+redis.call('ZADD', KEYS[2], now, ARGV[5])
+local tracked = 0
+if created == 1 then
+  tracked = redis.call('ZCARD', KEYS[2])
+end
+return {allowed, tracked}
+`)
+
+// redisRetryInterval is how long the fallback is used after a failed Redis
+// operation, so that an outage does not add the timeout to every query.
+const redisRetryInterval = 10 * time.Second
+
+// errRedisUnavailable is returned by the access list backend while Redis is
+// skipped after a failure.
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// RedisStore keeps the limiter state in Redis, so that replicas behind a
+// load balancer share their clients' budgets and bans. Token buckets are
+// approximate: each replica refills them by its own clock.
+//
+// Redis is on the hot path of every query, so operations are bounded by a
+// short timeout. When it is unavailable, each replica falls back to its own
+// in-memory state for a while rather than failing open or closed, and bans
+// made in the meantime keep applying locally.
+type RedisStore struct {
+	client   redis.UniversalClient
+	prefix   string
+	timeout  time.Duration
+	logger   *slog.Logger
+	fallback *memoryStore
+	lastWarn atomic.Int64
+	// downUntil is when to retry Redis after a failure, in Unix nanoseconds.
+	downUntil atomic.Int64
+}
+
+// NewRedisStore connects to the Redis server. maxEntries bounds the fallback
+// in-memory state, as with the in-memory store.
+func NewRedisStore(cfg *config.RedisConfig, maxEntries int, logger *slog.Logger) (*RedisStore, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("redis address is required")
+	}
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	fallback, err := newMemoryStore(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &redis.Options{
+		Addr:     cfg.Address,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+		// Retrying within the timeout would only delay the fallback
+		MaxRetries: -1,
+	}
+	if cfg.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 100 * time.Millisecond
+	}
+
+	s := &RedisStore{
+		client:   redis.NewClient(opts),
+		prefix:   cfg.KeyPrefix,
+		timeout:  timeout,
+		logger:   logger,
+		fallback: fallback,
+	}
+
+	// An unreachable server is not fatal: the fallback takes over until it
+	// recovers.
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.failed()
+		logger.Warn("Redis server unreachable, rate limiter falling back to in-memory state", "address", cfg.Address, "error", err)
+	}
+	return s, nil
+}
+
+// Close closes the connection to the Redis server.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// available reports whether to use Redis, rather than the fallback after a
+// recent failure.
+func (s *RedisStore) available() bool {
+	return time.Now().UnixNano() >= s.downUntil.Load()
+}
+
+func (s *RedisStore) failed() {
+	s.downUntil.Store(time.Now().Add(redisRetryInterval).UnixNano())
+}
+
+// warn records a failed operation, logging it at most once a minute so that
+// an outage does not flood the logs.
+func (s *RedisStore) warn(op string, err error) {
+	s.failed()
+	now := time.Now()
+	last := s.lastWarn.Load()
+	if now.UnixNano()-last < int64(time.Minute) || !s.lastWarn.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	s.logger.Warn("Redis operation failed, rate limiter falling back to in-memory state", "op", op, "error", err)
+}
+
+func (s *RedisStore) bucketKey(level, key string) string {
+	return s.prefix + "bucket:" + level + ":" + key
+}
+
+func (s *RedisStore) indexKey(level string) string {
+	return s.prefix + "buckets:" + level
+}
+
+func (s *RedisStore) bansKey() string {
+	return s.prefix + "bans"
+}
+
+func (s *RedisStore) accessListKey() string {
+	return s.prefix + "access-list"
+}
+
+func (s *RedisStore) Take(level, key string, limit rate.Limit, burst int, now time.Time) (bool, int) {
+	// A bucket is full again after burst/limit, so it can expire then
+	ttl := 24 * time.Hour
+	if limit > 0 && !math.IsInf(float64(limit), 1) {
+		ttl = time.Duration(float64(burst)/float64(limit)*float64(time.Second)) + time.Second
+	}
+
+	if !s.available() {
+		return s.fallback.Take(level, key, limit, burst, now)
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	result, err := takeScript.Run(ctx, s.client,
+		[]string{s.bucketKey(level, key), s.indexKey(level)},
+		float64(limit), burst, now.UnixMilli(), ttl.Milliseconds(), key,
+	).Int64Slice()
+	if err != nil || len(result) != 2 {
+		s.warn("take", err)
+		return s.fallback.Take(level, key, limit, burst, now)
+	}
+	return result[0] == 1, int(result[1])
+}
+
+func (s *RedisStore) Len(level string) int {
+	if !s.available() {
+		return s.fallback.Len(level)
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	n, err := s.client.ZCard(ctx, s.indexKey(level)).Result()
+	if err != nil {
+		s.warn("len", err)
+		return s.fallback.Len(level)
+	}
+	return int(n)
+}
+
+func (s *RedisStore) Ban(ip string, until time.Time) {
+	if !s.available() {
+		s.fallback.Ban(ip, until)
+		return
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.client.ZAdd(ctx, s.bansKey(), redis.Z{Score: float64(until.UnixMilli()), Member: ip}).Err(); err != nil {
+		s.warn("ban", err)
+		s.fallback.Ban(ip, until)
+	}
+}
+
+func (s *RedisStore) BannedUntil(ip string, now time.Time) (time.Time, bool) {
+	if until, ok := s.fallback.BannedUntil(ip, now); ok {
+		return until, true
+	}
+	if !s.available() {
+		return time.Time{}, false
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	score, err := s.client.ZScore(ctx, s.bansKey(), ip).Result()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, false
+	}
+	if err != nil {
+		s.warn("banned", err)
+		return time.Time{}, false
+	}
+	until := time.UnixMilli(int64(score))
+	if now.After(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func (s *RedisStore) Unban(network netip.Prefix) bool {
+	found := s.fallback.Unban(network)
+	if !s.available() {
+		return found
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	ips, err := s.client.ZRange(ctx, s.bansKey(), 0, -1).Result()
+	if err != nil {
+		s.warn("unban", err)
+		return found
+	}
+	var members []any
+	for _, ip := range ips {
+		if addr, err := netip.ParseAddr(ip); err == nil && network.Contains(addr.WithZone("").Unmap()) {
+			members = append(members, ip)
+		}
+	}
+	if len(members) == 0 {
+		return found
+	}
+	if err := s.client.ZRem(ctx, s.bansKey(), members...).Err(); err != nil {
+		s.warn("unban", err)
+		return found
+	}
+	return true
+}
+
+func (s *RedisStore) Bans(now time.Time) map[string]time.Time {
+	out := s.fallback.Bans(now)
+	if !s.available() {
+		return out
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	bans, err := s.client.ZRangeByScoreWithScores(ctx, s.bansKey(), &redis.ZRangeBy{
+		Min: strconv.FormatInt(now.UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		s.warn("bans", err)
+		return out
+	}
+	for _, ban := range bans {
+		if ip, ok := ban.Member.(string); ok {
+			out[ip] = time.UnixMilli(int64(ban.Score))
+		}
+	}
+	return out
+}
+
+// Reap drops expired bans and the index entries of idle buckets; the buckets
+// themselves expire in Redis.
+func (s *RedisStore) Reap(now time.Time, idleTTL time.Duration) {
+	s.fallback.Reap(now, idleTTL)
+	if !s.available() {
+		return
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	pipe := s.client.Pipeline()
+	pipe.ZRemRangeByScore(ctx, s.bansKey(), "-inf", "("+strconv.FormatInt(now.UnixMilli(), 10))
+	for _, level := range []string{levelIP, levelSubnet, levelASN} {
+		pipe.ZRemRangeByScore(ctx, s.indexKey(level), "-inf", "("+strconv.FormatInt(now.Add(-idleTTL).UnixMilli(), 10))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		s.warn("reap", err)
+	}
+}
+
+// redisAccessListBackend keeps the access list as a JSON document in Redis,
+// so that manual bans and exemptions apply to all replicas.
+type redisAccessListBackend struct {
+	store *RedisStore
+}
+
+func (b redisAccessListBackend) load() ([]byte, error) {
+	if !b.store.available() {
+		return nil, errRedisUnavailable
+	}
+	ctx, cancel := b.store.context()
+	defer cancel()
+	data, err := b.store.client.Get(ctx, b.store.accessListKey()).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		b.store.warn("load access list", err)
+		return nil, errors.Wrap(err, "failed to read access list from redis")
+	}
+	return data, nil
+}
+
+func (b redisAccessListBackend) save(data []byte) error {
+	if !b.store.available() {
+		return errRedisUnavailable
+	}
+	ctx, cancel := b.store.context()
+	defer cancel()
+	if err := b.store.client.Set(ctx, b.store.accessListKey(), data, 0).Err(); err != nil {
+		b.store.warn("save access list", err)
+		return errors.Wrap(err, "failed to write access list to redis")
+	}
+	return nil
+}
+
+func (b redisAccessListBackend) shared() bool {
+	return true
+}
@@ -0,0 +1,191 @@
+package limiter
+
+import (
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func newTestRedisStore(t *testing.T, server *miniredis.Miniredis) *RedisStore {
+	t.Helper()
+	store, err := NewRedisStore(&config.RedisConfig{
+		Enabled:   true,
+		Address:   server.Addr(),
+		KeyPrefix: "test:",
+		Timeout:   time.Second,
+	}, 100, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestRedisStore_Take(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server)
+	now := time.Now()
+
+	allowed, tracked := store.Take(levelIP, "1.2.3.4", rate.Limit(1), 2, now)
+	assert.True(t, allowed)
+	assert.Equal(t, 1, tracked, "created")
+	allowed, tracked = store.Take(levelIP, "1.2.3.4", rate.Limit(1), 2, now)
+	assert.True(t, allowed)
+	assert.Zero(t, tracked, "not created")
+	allowed, _ = store.Take(levelIP, "1.2.3.4", rate.Limit(1), 2, now)
+	assert.False(t, allowed, "burst exhausted")
+
+	allowed, _ = store.Take(levelIP, "1.2.3.4", rate.Limit(1), 2, now.Add(time.Second))
+	assert.True(t, allowed, "refilled")
+
+	allowed, _ = store.Take(levelSubnet, "1.2.3.0/24", rate.Limit(1), 2, now)
+	assert.True(t, allowed, "levels have separate buckets")
+	_, tracked = store.Take(levelIP, "5.6.7.8", rate.Limit(1), 2, now)
+	assert.Equal(t, 2, tracked)
+	assert.Equal(t, 2, store.Len(levelIP))
+	assert.Equal(t, 1, store.Len(levelSubnet))
+
+	// Buckets expire once they would have refilled
+	assert.Equal(t, 3*time.Second, server.TTL("test:bucket:ip:1.2.3.4"))
+}
+
+func TestRedisStore_Bans(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server)
+	now := time.Now().Truncate(time.Millisecond)
+
+	store.Ban("10.0.0.5", now.Add(time.Hour))
+	store.Ban("192.0.2.1", now.Add(-time.Minute))
+
+	until, banned := store.BannedUntil("10.0.0.5", now)
+	assert.True(t, banned)
+	assert.Equal(t, now.Add(time.Hour), until)
+	_, banned = store.BannedUntil("192.0.2.1", now)
+	assert.False(t, banned, "expired")
+	_, banned = store.BannedUntil("10.0.0.6", now)
+	assert.False(t, banned)
+
+	assert.Equal(t, map[string]time.Time{"10.0.0.5": now.Add(time.Hour)}, store.Bans(now))
+
+	store.Reap(now, time.Minute)
+	members, err := server.ZMembers("test:bans")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.5"}, members)
+
+	assert.False(t, store.Unban(netip.MustParsePrefix("172.16.0.0/12")))
+	assert.True(t, store.Unban(netip.MustParsePrefix("10.0.0.0/8")))
+	assert.Empty(t, store.Bans(now))
+}
+
+func TestRedisStore_SharedBetweenReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	cfg := &config.RateLimitConfig{
+		Enabled:           true,
+		RequestsPerSecond: 1,
+		Burst:             2,
+		BanDuration:       time.Hour,
+	}
+	replica1, err := New(cfg, newMockMetrics(), nil, nil, newTestRedisStore(t, server))
+	require.NoError(t, err)
+	defer replica1.Close()
+	replica2, err := New(cfg, newMockMetrics(), nil, nil, newTestRedisStore(t, server))
+	require.NoError(t, err)
+	defer replica2.Close()
+
+	ok, _ := replica1.Allow("198.51.100.7")
+	assert.True(t, ok)
+	ok, _ = replica2.Allow("198.51.100.7")
+	assert.True(t, ok)
+	ok, reason := replica1.Allow("198.51.100.7")
+	assert.False(t, ok, "the budget is shared")
+	assert.Equal(t, ReasonExceededRPS, reason)
+
+	replica1.ban("203.0.113.9", time.Now())
+	ok, reason = replica2.Allow("203.0.113.9")
+	assert.False(t, ok, "bans are shared")
+	assert.Equal(t, ReasonBanned, reason)
+}
+
+func TestRedisStore_FallsBackWhenUnavailable(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server)
+	server.Close()
+	now := time.Now()
+
+	allowed, tracked := store.Take(levelIP, "1.2.3.4", rate.Limit(1), 1, now)
+	assert.True(t, allowed)
+	assert.Equal(t, 1, tracked)
+	allowed, _ = store.Take(levelIP, "1.2.3.4", rate.Limit(1), 1, now)
+	assert.False(t, allowed, "limited by the in-memory fallback")
+	assert.Equal(t, 1, store.Len(levelIP))
+
+	store.Ban("10.0.0.5", now.Add(time.Hour))
+	_, banned := store.BannedUntil("10.0.0.5", now)
+	assert.True(t, banned, "bans apply locally")
+	assert.Contains(t, store.Bans(now), "10.0.0.5")
+}
+
+func TestRedisStore_SkipsRedisWhileUnavailable(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server)
+	now := time.Now()
+
+	store.Ban("10.0.0.5", now.Add(time.Hour))
+	store.Ban("192.0.2.1", now.Add(-time.Minute))
+	store.failed()
+
+	assert.Empty(t, store.Bans(now), "only the in-memory fallback is consulted")
+	assert.False(t, store.Unban(netip.MustParsePrefix("10.0.0.0/8")))
+	store.Reap(now, time.Minute)
+
+	members, err := server.ZMembers("test:bans")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.5", "192.0.2.1"}, members, "redis is left alone until it is retried")
+}
+
+func TestRedisAccessList_SharedBetweenReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	list1 := NewRedisAccessList(newTestRedisStore(t, server))
+	list2 := NewRedisAccessList(newTestRedisStore(t, server))
+	replica1, err := New(&config.RateLimitConfig{}, newMockMetrics(), nil, list1, nil)
+	require.NoError(t, err)
+	replica2, err := New(&config.RateLimitConfig{}, newMockMetrics(), nil, list2, nil)
+	require.NoError(t, err)
+
+	_, err = replica1.Ban(netip.MustParsePrefix("192.0.2.0/24"), 0, "abuse", "admin")
+	require.NoError(t, err)
+	_, err = replica2.Exempt(netip.MustParsePrefix("198.51.100.0/24"), "office", "admin")
+	require.NoError(t, err)
+	assert.Len(t, replica2.Bans(), 1, "changes of other replicas are kept")
+
+	ok, _ := replica2.Allow("192.0.2.1")
+	assert.False(t, ok)
+
+	replica1.Reap()
+	assert.Len(t, replica1.Exemptions(), 1, "picked up on reap")
+}
+
+func TestRedisAccessList_SkipsRedisWhileUnavailable(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server)
+	l, err := New(&config.RateLimitConfig{}, newMockMetrics(), nil, NewRedisAccessList(store), nil)
+	require.NoError(t, err)
+
+	_, err = l.Ban(netip.MustParsePrefix("192.0.2.0/24"), 0, "abuse", "admin")
+	require.NoError(t, err)
+
+	server.Close()
+	l.Reap()
+	assert.False(t, store.available(), "the failed refresh marks redis as unavailable")
+	l.Reap()
+	assert.Len(t, l.Bans(), 1, "the current list is kept")
+
+	_, err = l.Exempt(netip.MustParsePrefix("198.51.100.0/24"), "office", "admin")
+	assert.ErrorIs(t, err, errRedisUnavailable)
+}
@@ -0,0 +1,151 @@
+package limiter
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/rm-hull/dot-block/internal/config"
+)
+
+// ResponseAction is the Response Rate Limiting verdict for a UDP response.
+type ResponseAction string
+
+const (
+	ResponseSend ResponseAction = ""
+	ResponseSlip ResponseAction = "slip"
+	ResponseDrop ResponseAction = "drop"
+)
+
+// rrlEntry is the account of one (client network, response) pair. Its
+// balance is replenished at the configured rate up to one second's worth of
+// responses, and can go into debt by up to a window's worth, so that a
+// network flooding the resolver has to slow down for a while before being
+// answered again.
+type rrlEntry struct {
+	balance float64
+	last    time.Time
+	limited int // rate-limited responses since the balance was last positive
+}
+
+// responseLimiter implements BIND-style Response Rate Limiting (RRL).
+// Per-IP query limits do not help against reflection attacks, where spoofed
+// queries come from many "sources" each within their budget; RRL instead
+// limits identical responses to a client network, whoever claims to be
+// asking.
+type responseLimiter struct {
+	cfg     *config.RRLConfig
+	metrics Metrics
+
+	mu      sync.Mutex
+	buckets *lru.Cache[string, *rrlEntry]
+}
+
+func newResponseLimiter(cfg *config.RRLConfig, metrics Metrics) (*responseLimiter, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.ResponsesPerSecond <= 0 {
+		return nil, errors.Newf("invalid RRL responses_per_second %v (must be positive)", cfg.ResponsesPerSecond)
+	}
+	if cfg.Window < 0 {
+		return nil, errors.Newf("invalid RRL window %s (must not be negative)", cfg.Window)
+	}
+	if cfg.Slip < 0 {
+		return nil, errors.Newf("invalid RRL slip %d (must not be negative)", cfg.Slip)
+	}
+	if err := validatePrefixes("RRL", cfg.IPv4Prefix, cfg.IPv6Prefix); err != nil {
+		return nil, err
+	}
+
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = 100_000
+	}
+	buckets, err := lru.New[string, *rrlEntry](maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &responseLimiter{cfg: cfg, metrics: metrics, buckets: buckets}, nil
+}
+
+// capacity is the most a balance can be replenished to: one second's worth
+// of responses, but at least one.
+func (r *responseLimiter) capacity() float64 {
+	return max(r.cfg.ResponsesPerSecond, 1)
+}
+
+// replenish returns the balance of the entry at the given time.
+func (r *responseLimiter) replenish(entry *rrlEntry, now time.Time) float64 {
+	elapsed := now.Sub(entry.last).Seconds()
+	return min(r.capacity(), entry.balance+elapsed*r.cfg.ResponsesPerSecond)
+}
+
+func (r *responseLimiter) allow(ip, name string, qtype uint16, rcode int, now time.Time) ResponseAction {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ResponseSend
+	}
+	prefix, err := clientPrefix(addr, r.cfg.IPv4Prefix, r.cfg.IPv6Prefix)
+	if err != nil {
+		return ResponseSend
+	}
+	key := prefix.String() + "|" + strings.ToLower(name) + "|" + strconv.Itoa(int(qtype)) + "|" + strconv.Itoa(rcode)
+
+	r.mu.Lock()
+	entry, ok := r.buckets.Get(key)
+	if !ok {
+		entry = &rrlEntry{balance: r.capacity(), last: now}
+		r.buckets.Add(key, entry)
+		r.metrics.SetTrackedResponses(r.buckets.Len())
+	}
+	entry.balance = max(r.replenish(entry, now)-1, -r.cfg.ResponsesPerSecond*r.cfg.Window.Seconds())
+	entry.last = now
+
+	if entry.balance >= 0 {
+		entry.limited = 0
+		r.mu.Unlock()
+		return ResponseSend
+	}
+	entry.limited++
+	action := ResponseDrop
+	if r.cfg.Slip > 0 && entry.limited%r.cfg.Slip == 0 {
+		action = ResponseSlip
+	}
+	r.mu.Unlock()
+
+	r.metrics.IncResponseLimited(action)
+	return action
+}
+
+// reap evicts entries whose balance has been fully replenished, as they are
+// indistinguishable from new ones.
+func (r *responseLimiter) reap(now time.Time) {
+	r.mu.Lock()
+	for _, key := range r.buckets.Keys() {
+		entry, ok := r.buckets.Peek(key)
+		if ok && r.replenish(entry, now) >= r.capacity() {
+			r.buckets.Remove(key)
+		}
+	}
+	n := r.buckets.Len()
+	r.mu.Unlock()
+	r.metrics.SetTrackedResponses(n)
+}
+
+// AllowResponse applies Response Rate Limiting to a UDP response to ip.
+// Identical responses (by name, query type and rcode) to the same client
+// network share a budget; once it is exhausted, responses are dropped,
+// except for every slip'th one, which should be sent as an empty truncated
+// response so that real clients retry over TCP. Callers choose the name and
+// type to group responses by, e.g. the zone for NXDOMAIN answers.
+func (l *Limiter) AllowResponse(ip, name string, qtype uint16, rcode int) ResponseAction {
+	if l.rrl == nil {
+		return ResponseSend
+	}
+	return l.rrl.allow(ip, name, qtype, rcode, time.Now())
+}
@@ -0,0 +1,158 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestResponseLimiter(t *testing.T, metrics Metrics, slip int) *responseLimiter {
+	t.Helper()
+	r, err := newResponseLimiter(&config.RRLConfig{
+		Enabled:            true,
+		ResponsesPerSecond: 2,
+		Window:             5 * time.Second,
+		Slip:               slip,
+		IPv4Prefix:         24,
+		IPv6Prefix:         56,
+		MaxEntries:         100,
+	}, metrics)
+	require.NoError(t, err)
+	return r
+}
+
+func TestResponseLimiter_Disabled(t *testing.T) {
+	l, err := New(&config.RateLimitConfig{RRL: &config.RRLConfig{Enabled: false}}, newMockMetrics(), nil, nil, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for range 100 {
+		assert.Equal(t, ResponseSend, l.AllowResponse("192.0.2.1", "example.com.", 1, 0))
+	}
+}
+
+func TestResponseLimiter_InvalidConfig(t *testing.T) {
+	_, err := newResponseLimiter(&config.RRLConfig{Enabled: true, ResponsesPerSecond: 5, IPv4Prefix: 33}, newMockMetrics())
+	assert.ErrorContains(t, err, "ipv4_prefix")
+
+	_, err = newResponseLimiter(&config.RRLConfig{Enabled: true}, newMockMetrics())
+	assert.ErrorContains(t, err, "responses_per_second")
+}
+
+func TestResponseLimiter_Slip(t *testing.T) {
+	metrics := newMockMetrics()
+	r := newTestResponseLimiter(t, metrics, 2)
+	now := time.Now()
+
+	// The budget is one second's worth of responses
+	assert.Equal(t, ResponseSend, r.allow("192.0.2.1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseSend, r.allow("192.0.2.1", "example.com.", 1, 0, now))
+
+	// ... after which every second response slips, and the rest are dropped
+	assert.Equal(t, ResponseDrop, r.allow("192.0.2.1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseSlip, r.allow("192.0.2.1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseDrop, r.allow("192.0.2.1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseSlip, r.allow("192.0.2.1", "example.com.", 1, 0, now))
+	assert.Equal(t, 2, metrics.responseLimitedCalled[ResponseDrop])
+	assert.Equal(t, 2, metrics.responseLimitedCalled[ResponseSlip])
+}
+
+func TestResponseLimiter_NoSlip(t *testing.T) {
+	r := newTestResponseLimiter(t, newMockMetrics(), 0)
+	now := time.Now()
+
+	r.allow("192.0.2.1", "example.com.", 1, 0, now)
+	r.allow("192.0.2.1", "example.com.", 1, 0, now)
+	for range 10 {
+		assert.Equal(t, ResponseDrop, r.allow("192.0.2.1", "example.com.", 1, 0, now))
+	}
+}
+
+func TestResponseLimiter_Keys(t *testing.T) {
+	r := newTestResponseLimiter(t, newMockMetrics(), 0)
+	now := time.Now()
+
+	// Clients in the same /24 share a budget, which names are compared
+	// case-insensitively
+	assert.Equal(t, ResponseSend, r.allow("192.0.2.1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseSend, r.allow("192.0.2.200", "EXAMPLE.com.", 1, 0, now))
+	assert.Equal(t, ResponseDrop, r.allow("192.0.2.3", "example.com.", 1, 0, now))
+
+	// ... while other networks, names, types and rcodes have their own
+	assert.Equal(t, ResponseSend, r.allow("192.0.3.1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseSend, r.allow("192.0.2.1", "example.org.", 1, 0, now))
+	assert.Equal(t, ResponseSend, r.allow("192.0.2.1", "example.com.", 28, 0, now))
+	assert.Equal(t, ResponseSend, r.allow("192.0.2.1", "example.com.", 1, 3, now))
+
+	// IPv6 clients are grouped by /56
+	assert.Equal(t, ResponseSend, r.allow("2001:db8:0:1::1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseSend, r.allow("2001:db8:0:2::1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseDrop, r.allow("2001:db8:0:3::1", "example.com.", 1, 0, now))
+	assert.Equal(t, ResponseSend, r.allow("2001:db8:0:100::1", "example.com.", 1, 0, now))
+
+	// Clients whose address is not known are not limited
+	for range 10 {
+		assert.Equal(t, ResponseSend, r.allow("unknown", "example.com.", 1, 0, now))
+	}
+}
+
+func TestResponseLimiter_Window(t *testing.T) {
+	r := newTestResponseLimiter(t, newMockMetrics(), 0)
+	now := time.Now()
+
+	// Flood for a while, running up the maximum debt of a window's worth
+	// (5s at 2/s) of responses
+	for range 100 {
+		r.allow("192.0.2.1", "example.com.", 1, 0, now)
+	}
+
+	// The debt has to be paid off before responses are sent again
+	assert.Equal(t, ResponseDrop, r.allow("192.0.2.1", "example.com.", 1, 0, now.Add(4*time.Second)))
+	assert.Equal(t, ResponseSend, r.allow("192.0.2.1", "example.com.", 1, 0, now.Add(10*time.Second)))
+}
+
+func TestResponseLimiter_Reap(t *testing.T) {
+	metrics := newMockMetrics()
+	r := newTestResponseLimiter(t, metrics, 0)
+	now := time.Now()
+
+	for range 10 {
+		r.allow("192.0.2.1", "example.com.", 1, 0, now)
+	}
+	r.allow("192.0.2.1", "example.org.", 1, 0, now.Add(6*time.Second))
+	assert.Equal(t, 2, metrics.trackedResponses)
+
+	// Only the entry that has been fully replenished is evicted
+	r.reap(now.Add(6 * time.Second))
+	assert.Equal(t, 1, metrics.trackedResponses)
+	r.reap(now.Add(7 * time.Second))
+	assert.Equal(t, 0, metrics.trackedResponses)
+}
+
+func TestLimiter_ReapWithRateLimitingDisabled(t *testing.T) {
+	metrics := newMockMetrics()
+	l, err := New(&config.RateLimitConfig{
+		Enabled: false,
+		RRL: &config.RRLConfig{
+			Enabled:            true,
+			ResponsesPerSecond: 100,
+			Window:             time.Second,
+			IPv4Prefix:         24,
+			IPv6Prefix:         56,
+			MaxEntries:         100,
+		},
+	}, metrics, nil, nil, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	assert.Equal(t, ResponseSend, l.AllowResponse("192.0.2.1", "example.com.", 1, 0))
+	assert.Equal(t, 1, metrics.trackedResponses)
+
+	// The RRL bucket refills within 10ms, after which the reaper evicts it
+	time.Sleep(50 * time.Millisecond)
+	l.Reap()
+	assert.Equal(t, 0, metrics.trackedResponses)
+}
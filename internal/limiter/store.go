@@ -0,0 +1,202 @@
+package limiter
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+)
+
+// Levels of the limit hierarchy, each with its own token buckets.
+const (
+	levelIP     = "ip"
+	levelSubnet = "subnet"
+	levelASN    = "asn"
+)
+
+// Store holds the limiter state that replicas behind a load balancer need to
+// share: the token buckets and the bans from flood detection. The in-memory
+// store is the default; with RedisStore, a client's budget and bans apply
+// across all replicas.
+type Store interface {
+	// Take takes a token from the bucket for key at the level, creating it
+	// full if need be. It reports whether a token was available and, if the
+	// bucket was created, the number of buckets now tracked at the level
+	// (0 otherwise).
+	Take(level, key string, limit rate.Limit, burst int, now time.Time) (allowed bool, tracked int)
+
+	// Len returns the number of buckets tracked at the level.
+	Len(level string) int
+
+	// Ban bans the IP until the given time.
+	Ban(ip string, until time.Time)
+
+	// BannedUntil returns when the ban of the IP expires, if it is banned.
+	BannedUntil(ip string, now time.Time) (time.Time, bool)
+
+	// Unban lifts the bans of the addresses within the network, reporting
+	// whether there were any.
+	Unban(network netip.Prefix) bool
+
+	// Bans returns the banned IPs and when their bans expire.
+	Bans(now time.Time) map[string]time.Time
+
+	// Reap evicts buckets idle for longer than idleTTL and expired bans.
+	Reap(now time.Time, idleTTL time.Duration)
+}
+
+// bucketEntry pairs a token bucket with a last-seen timestamp so the reaper
+// can evict idle IPs without waiting for the LRU to fill up.
+type bucketEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// bucketSet is a bounded set of token buckets for one level of the limit
+// hierarchy, keyed by client IP, subnet or ASN.
+type bucketSet struct {
+	mu      sync.Mutex
+	buckets *lru.Cache[string, *bucketEntry]
+}
+
+func newBucketSet(size int) (*bucketSet, error) {
+	buckets, err := lru.New[string, *bucketEntry](size)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketSet{buckets: buckets}, nil
+}
+
+// get returns the token bucket for key, and whether it had to be created.
+func (s *bucketSet) get(key string, limit rate.Limit, burst int, now time.Time) (*rate.Limiter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.buckets.Get(key)
+	if !ok {
+		entry = &bucketEntry{limiter: rate.NewLimiter(limit, burst)}
+		s.buckets.Add(key, entry)
+	}
+	entry.lastSeen = now
+	return entry.limiter, !ok
+}
+
+// reap evicts buckets idle for longer than idleTTL.
+func (s *bucketSet) reap(now time.Time, idleTTL time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.buckets.Keys() {
+		entry, ok := s.buckets.Peek(key)
+		if ok && now.Sub(entry.lastSeen) > idleTTL {
+			s.buckets.Remove(key)
+		}
+	}
+}
+
+func (s *bucketSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buckets.Len()
+}
+
+// memoryStore keeps the limiter state of a single replica. The buckets are
+// held in bounded LRUs, one per level, so a distributed flood from many
+// source IPs can't grow memory without limit.
+type memoryStore struct {
+	sets map[string]*bucketSet
+
+	bansMu sync.RWMutex
+	bans   map[string]time.Time // ip -> ban expiry
+}
+
+func newMemoryStore(maxEntries int) (*memoryStore, error) {
+	sets := make(map[string]*bucketSet, 3)
+	for _, level := range []string{levelIP, levelSubnet, levelASN} {
+		set, err := newBucketSet(maxEntries)
+		if err != nil {
+			return nil, err
+		}
+		sets[level] = set
+	}
+	return &memoryStore{sets: sets, bans: make(map[string]time.Time)}, nil
+}
+
+func (m *memoryStore) Take(level, key string, limit rate.Limit, burst int, now time.Time) (bool, int) {
+	bucket, created := m.sets[level].get(key, limit, burst, now)
+	tracked := 0
+	if created {
+		tracked = m.sets[level].len()
+	}
+	return bucket.AllowN(now, 1), tracked
+}
+
+func (m *memoryStore) Len(level string) int {
+	return m.sets[level].len()
+}
+
+func (m *memoryStore) Ban(ip string, until time.Time) {
+	m.bansMu.Lock()
+	m.bans[ip] = until
+	m.bansMu.Unlock()
+}
+
+func (m *memoryStore) BannedUntil(ip string, now time.Time) (time.Time, bool) {
+	m.bansMu.RLock()
+	until, ok := m.bans[ip]
+	m.bansMu.RUnlock()
+	if !ok {
+		return time.Time{}, false
+	}
+	if now.After(until) {
+		// Expired — clean it up lazily rather than waiting for the reaper.
+		m.bansMu.Lock()
+		delete(m.bans, ip)
+		m.bansMu.Unlock()
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func (m *memoryStore) Unban(network netip.Prefix) bool {
+	m.bansMu.Lock()
+	defer m.bansMu.Unlock()
+
+	found := false
+	for ip := range m.bans {
+		if addr, err := netip.ParseAddr(ip); err == nil && network.Contains(addr.WithZone("").Unmap()) {
+			delete(m.bans, ip)
+			found = true
+		}
+	}
+	return found
+}
+
+func (m *memoryStore) Bans(now time.Time) map[string]time.Time {
+	m.bansMu.RLock()
+	defer m.bansMu.RUnlock()
+
+	out := make(map[string]time.Time, len(m.bans))
+	for ip, until := range m.bans {
+		if !now.After(until) {
+			out[ip] = until
+		}
+	}
+	return out
+}
+
+func (m *memoryStore) Reap(now time.Time, idleTTL time.Duration) {
+	for _, set := range m.sets {
+		set.reap(now, idleTTL)
+	}
+
+	m.bansMu.Lock()
+	for ip, until := range m.bans {
+		if now.After(until) {
+			delete(m.bans, ip)
+		}
+	}
+	m.bansMu.Unlock()
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rm-hull/dot-block/internal/config"
+)
+
+// listenHost is an address a listener binds to. The zero value is the
+// wildcard address, bound dual-stack; an IPv4 or IPv6 address binds only its
+// own address family, so that e.g. 0.0.0.0 and :: can be bound side by side.
+type listenHost struct {
+	ip netip.Addr
+}
+
+// network returns the network ("udp" or "tcp") restricted to the address
+// family of the host.
+func (h listenHost) network(base string) string {
+	switch {
+	case !h.ip.IsValid():
+		return base
+	case h.ip.Is4():
+		return base + "4"
+	default:
+		return base + "6"
+	}
+}
+
+func (h listenHost) addr(port int) string {
+	if !h.ip.IsValid() {
+		return fmt.Sprintf(":%d", port)
+	}
+	return net.JoinHostPort(h.ip.String(), strconv.Itoa(port))
+}
+
+// listenHosts are the addresses each listener binds to.
+type listenHosts struct {
+	dns, dot, doq, dnscrypt, http []listenHost
+}
+
+func newListenHosts(cfg *config.ListenersConfig) (listenHosts, error) {
+	var hosts listenHosts
+	if cfg == nil {
+		cfg = &config.ListenersConfig{}
+	}
+	for _, listener := range []struct {
+		cfg   *config.ListenerConfig
+		hosts *[]listenHost
+	}{
+		{cfg.DNS, &hosts.dns},
+		{cfg.DoT, &hosts.dot},
+		{cfg.DoQ, &hosts.doq},
+		{cfg.DNSCrypt, &hosts.dnscrypt},
+		{cfg.HTTP, &hosts.http},
+	} {
+		if listener.cfg == nil || len(listener.cfg.Listen) == 0 {
+			*listener.hosts = []listenHost{{}}
+			continue
+		}
+		for _, addr := range listener.cfg.Listen {
+			ip, err := netip.ParseAddr(addr)
+			if err != nil {
+				return hosts, errors.Newf("invalid listen address %q (expected an IPv4 or IPv6 address)", addr)
+			}
+			*listener.hosts = append(*listener.hosts, listenHost{ip: ip.Unmap()})
+		}
+	}
+	return hosts, nil
+}
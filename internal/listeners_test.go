@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewListenHosts(t *testing.T) {
+	hosts, err := newListenHosts(&config.ListenersConfig{
+		DNS: &config.ListenerConfig{Listen: []string{"192.168.1.2", "fd00::2"}},
+		DoT: &config.ListenerConfig{Listen: []string{}},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, hosts.dns, 2)
+	assert.Equal(t, "udp4", hosts.dns[0].network("udp"))
+	assert.Equal(t, "192.168.1.2:53", hosts.dns[0].addr(53))
+	assert.Equal(t, "tcp6", hosts.dns[1].network("tcp"))
+	assert.Equal(t, "[fd00::2]:53", hosts.dns[1].addr(53))
+
+	// Listeners without addresses bind all interfaces, dual-stack
+	for _, h := range [][]listenHost{hosts.dot, hosts.doq, hosts.dnscrypt, hosts.http} {
+		require.Len(t, h, 1)
+		assert.Equal(t, "tcp", h[0].network("tcp"))
+		assert.Equal(t, ":853", h[0].addr(853))
+	}
+}
+
+func TestNewListenHosts_Invalid(t *testing.T) {
+	_, err := newListenHosts(&config.ListenersConfig{
+		DoT: &config.ListenerConfig{Listen: []string{"dns.example.com"}},
+	})
+	assert.ErrorContains(t, err, "dns.example.com")
+}
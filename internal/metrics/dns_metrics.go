@@ -48,30 +48,44 @@ func (s *SafeSketch) Estimate() uint64 {
 }
 
 type DnsMetrics struct {
-	Version             prometheus.Gauge
-	RequestLatency      prometheus.Histogram
-	ErrorCounts         *prometheus.CounterVec
-	RequestCounts       *prometheus.CounterVec
-	QueryCounts         *prometheus.CounterVec
-	ReplyCounts         *prometheus.CounterVec
-	ProviderCounts      *prometheus.CounterVec
-	UniqueClients       *SafeSketch
-	TopClients          *SpaceSaver
-	TopDomains          *SpaceSaver
-	TopBlockedDomains   *SpaceSaver
-	UpstreamTTLs        *prometheus.HistogramVec
-	UpstreamLatency     *prometheus.HistogramVec
-	UpstreamEMA         *prometheus.GaugeVec
-	CacheReaperCalls    prometheus.Counter
-	DroppedCacheUpdates prometheus.Counter
-	DroppedTelemetry    prometheus.Counter
-	DroppedSSEEvents    prometheus.Counter
-	RateLimited         *prometheus.CounterVec
-	TrackedIPs          prometheus.Gauge
-	PoolEvictions       *prometheus.CounterVec
-	UpstreamFailures    *prometheus.CounterVec
-	PooledConnDeaths    *prometheus.CounterVec
-	geoIpLookup         geoblock.GeoIpLookup
+	Version                 prometheus.Gauge
+	RequestLatency          prometheus.Histogram
+	ErrorCounts             *prometheus.CounterVec
+	RequestCounts           *prometheus.CounterVec
+	QueryCounts             *prometheus.CounterVec
+	ReplyCounts             *prometheus.CounterVec
+	ProviderCounts          *prometheus.CounterVec
+	UniqueClients           *SafeSketch
+	TopClients              *SpaceSaver
+	TopDomains              *SpaceSaver
+	TopBlockedDomains       *SpaceSaver
+	UpstreamTTLs            *prometheus.HistogramVec
+	UpstreamLatency         *prometheus.HistogramVec
+	UpstreamEMA             *prometheus.GaugeVec
+	CacheReaperCalls        prometheus.Counter
+	DroppedCacheUpdates     prometheus.Counter
+	DroppedTelemetry        prometheus.Counter
+	DroppedSSEEvents        prometheus.Counter
+	RateLimited             *prometheus.CounterVec
+	ACLRefused              *prometheus.CounterVec
+	TrackedIPs              prometheus.Gauge
+	ResponsesLimited        *prometheus.CounterVec
+	TrackedResponses        prometheus.Gauge
+	PoolEvictions           *prometheus.CounterVec
+	UpstreamFailures        *prometheus.CounterVec
+	PooledConnDeaths        *prometheus.CounterVec
+	RebindingFiltered       *prometheus.CounterVec
+	DNSSECValidations       *prometheus.CounterVec
+	WaterTortureMitigations prometheus.Counter
+	WaterTortureActive      prometheus.Gauge
+	WaterTortureAnswered    prometheus.Counter
+	LoadShed                prometheus.Counter
+	TLSHandshakes           *prometheus.CounterVec
+	OpenConnections         *prometheus.GaugeVec
+	RejectedConnections     *prometheus.CounterVec
+	UpstreamInFlight        prometheus.Gauge
+	UpstreamQueueTime       prometheus.Histogram
+	geoIpLookup             geoblock.GeoIpLookup
 }
 
 var latencyBuckets = []float64{
@@ -124,7 +138,7 @@ func NewDNSMetrics(cache Cache, geoIpLookup geoblock.GeoIpLookup, topK TopKConfi
 		newSpaceSaverStatsCallback(topBlockedDomains, topK.NumBlocked),
 	)
 
-	topClientsStats := NewStatsCollector("dns_top_clients", []string{"ip_addr", "asn", "iso_code"},
+	topClientsStats := NewStatsCollector("dns_top_clients", []string{"ip_addr", "asn", "iso_code", "client"},
 		fmt.Sprintf("Shows the top %d most active clients (estimate based on count - error)", topK.NumClients),
 		newSpaceSaverStatsCallback(topClients, topK.NumClients),
 	)
@@ -143,7 +157,7 @@ func NewDNSMetrics(cache Cache, geoIpLookup geoblock.GeoIpLookup, topK TopKConfi
 
 	requestCounts := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "dns_request_count",
-		Help: "Counts the number of DNS requests, broken down by type (total, errored, forwarded) and source (UDP, TCP, DoT)",
+		Help: "Counts the number of DNS requests, broken down by type (total, errored, forwarded) and source (UDP, TCP, DoT, DoQ, DoH, ODoH, DNSCrypt, Internal)",
 	}, []string{"type", "source"})
 
 	queryCounts := prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -229,6 +243,77 @@ func NewDNSMetrics(cache Cache, geoIpLookup geoblock.GeoIpLookup, topK TopKConfi
 		Help: "Total number of DNS queries rejected by the rate limiter, broken down by reason",
 	}, []string{"reason"})
 
+	aclRefused := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_acl_refused_total",
+		Help: "Total number of DNS queries from clients outside the listener's allowed networks, broken down by source",
+	}, []string{"source"})
+
+	responsesLimited := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rrl_responses_total",
+		Help: "Total number of UDP responses withheld by Response Rate Limiting, broken down by action (drop, slip)",
+	}, []string{"action"})
+
+	trackedResponses := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_rrl_tracked_responses",
+		Help: "Current number of (client network, response) pairs tracked by Response Rate Limiting",
+	})
+
+	rebindingFiltered := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rebinding_filtered_total",
+		Help: "Total number of upstream responses filtered by DNS rebinding protection, broken down by mode (strip, refuse)",
+	}, []string{"mode"})
+
+	dnssecValidations := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_dnssec_validations_total",
+		Help: "Total number of upstream responses validated with DNSSEC, broken down by result (secure, insecure, bogus)",
+	}, []string{"result"})
+
+	waterTortureMitigations := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_water_torture_mitigations_total",
+		Help: "Total number of random-subdomain attacks detected, each starting the mitigation of the target domain",
+	})
+
+	waterTortureActive := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_water_torture_active",
+		Help: "Current number of domains whose uncached subdomains are answered locally due to a random-subdomain attack",
+	})
+
+	waterTortureAnswered := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_water_torture_answered_total",
+		Help: "Total number of queries answered locally with NXDOMAIN by random-subdomain attack mitigation",
+	})
+
+	loadShed := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_load_shed_total",
+		Help: "Total number of queries not forwarded upstream because no upstream slot became free within the queue timeout",
+	})
+
+	tlsHandshakes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_tls_handshakes_total",
+		Help: "Total number of completed TLS handshakes, broken down by listener, TLS version, key exchange and whether the session was resumed",
+	}, []string{"listener", "version", "key_exchange", "resumed"})
+
+	openConnections := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_open_connections",
+		Help: "Current number of open TCP connections, broken down by source",
+	}, []string{"source"})
+
+	rejectedConnections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_connections_rejected_total",
+		Help: "Total number of TCP connections closed on arrival because a connection limit was reached, broken down by source and reason",
+	}, []string{"source", "reason"})
+
+	upstreamInFlight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_upstream_in_flight",
+		Help: "Current number of outstanding upstream queries",
+	})
+
+	upstreamQueueTime := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dns_upstream_queue_seconds",
+		Help:    "Time queries waited for an upstream slot, including those that were shed",
+		Buckets: latencyBuckets,
+	})
+
 	trackedIPs := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "dns_rate_limited_tracked_ips",
 		Help: "Number of client IPs currently being tracked by the rate limiter",
@@ -264,7 +349,21 @@ func NewDNSMetrics(cache Cache, geoIpLookup geoblock.GeoIpLookup, topK TopKConfi
 		upstreamFailures,
 		pooledConnDeaths,
 		rateLimited,
+		aclRefused,
 		trackedIPs,
+		responsesLimited,
+		trackedResponses,
+		rebindingFiltered,
+		dnssecValidations,
+		waterTortureMitigations,
+		waterTortureActive,
+		waterTortureAnswered,
+		loadShed,
+		tlsHandshakes,
+		openConnections,
+		rejectedConnections,
+		upstreamInFlight,
+		upstreamQueueTime,
 		dnsInfo,
 	); err != nil {
 		return nil, errors.Wrap(err, "failed to register DNS metrics")
@@ -273,30 +372,44 @@ func NewDNSMetrics(cache Cache, geoIpLookup geoblock.GeoIpLookup, topK TopKConfi
 	cache.OnDrop(func() { droppedCacheUpdates.Inc() })
 
 	return &DnsMetrics{
-		Version:             dnsInfo,
-		RequestLatency:      requestLatency,
-		ErrorCounts:         errorCounts,
-		RequestCounts:       requestCounts,
-		QueryCounts:         queryCounts,
-		ReplyCounts:         replyCounts,
-		ProviderCounts:      providerCounts,
-		UniqueClients:       uniqueClients,
-		TopClients:          topClients,
-		TopDomains:          topDomains,
-		TopBlockedDomains:   topBlockedDomains,
-		UpstreamTTLs:        upstreamTTLs,
-		UpstreamLatency:     upstreamLatency,
-		UpstreamEMA:         upstreamEMA,
-		CacheReaperCalls:    cacheReaperCalls,
-		DroppedCacheUpdates: droppedCacheUpdates,
-		DroppedTelemetry:    droppedTelemetry,
-		DroppedSSEEvents:    droppedSSEEvents,
-		RateLimited:         rateLimited,
-		TrackedIPs:          trackedIPs,
-		PoolEvictions:       poolEvictions,
-		UpstreamFailures:    upstreamFailures,
-		PooledConnDeaths:    pooledConnDeaths,
-		geoIpLookup:         geoIpLookup,
+		Version:                 dnsInfo,
+		RequestLatency:          requestLatency,
+		ErrorCounts:             errorCounts,
+		RequestCounts:           requestCounts,
+		QueryCounts:             queryCounts,
+		ReplyCounts:             replyCounts,
+		ProviderCounts:          providerCounts,
+		UniqueClients:           uniqueClients,
+		TopClients:              topClients,
+		TopDomains:              topDomains,
+		TopBlockedDomains:       topBlockedDomains,
+		UpstreamTTLs:            upstreamTTLs,
+		UpstreamLatency:         upstreamLatency,
+		UpstreamEMA:             upstreamEMA,
+		CacheReaperCalls:        cacheReaperCalls,
+		DroppedCacheUpdates:     droppedCacheUpdates,
+		DroppedTelemetry:        droppedTelemetry,
+		DroppedSSEEvents:        droppedSSEEvents,
+		RateLimited:             rateLimited,
+		ACLRefused:              aclRefused,
+		TrackedIPs:              trackedIPs,
+		ResponsesLimited:        responsesLimited,
+		TrackedResponses:        trackedResponses,
+		PoolEvictions:           poolEvictions,
+		UpstreamFailures:        upstreamFailures,
+		PooledConnDeaths:        pooledConnDeaths,
+		RebindingFiltered:       rebindingFiltered,
+		DNSSECValidations:       dnssecValidations,
+		WaterTortureMitigations: waterTortureMitigations,
+		WaterTortureActive:      waterTortureActive,
+		WaterTortureAnswered:    waterTortureAnswered,
+		LoadShed:                loadShed,
+		TLSHandshakes:           tlsHandshakes,
+		OpenConnections:         openConnections,
+		RejectedConnections:     rejectedConnections,
+		UpstreamInFlight:        upstreamInFlight,
+		UpstreamQueueTime:       upstreamQueueTime,
+		geoIpLookup:             geoIpLookup,
 	}, nil
 }
 
@@ -321,3 +434,15 @@ func (m *DnsMetrics) IncRateLimited(reason limiter.Reason) {
 func (m *DnsMetrics) SetTrackedIPs(n int) {
 	m.TrackedIPs.Set(float64(n))
 }
+
+// IncResponseLimited implements limiter.Metrics, incrementing the RRL
+// counter for the given action.
+func (m *DnsMetrics) IncResponseLimited(action limiter.ResponseAction) {
+	m.ResponsesLimited.WithLabelValues(string(action)).Inc()
+}
+
+// SetTrackedResponses implements limiter.Metrics, setting the gauge of
+// currently tracked RRL buckets.
+func (m *DnsMetrics) SetTrackedResponses(n int) {
+	m.TrackedResponses.Set(float64(n))
+}
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"testing"
+	"time"
 
 	"github.com/earthboundkid/versioninfo/v2"
 	cache "github.com/go-pkgz/expirable-cache/v3"
@@ -98,3 +99,17 @@ func TestDNSInfoMetric(t *testing.T) {
 	assert.NotEmpty(versionLabel, "expected version label to be set on dns_info metric")
 	assert.Equal(versioninfo.Short(), versionLabel)
 }
+
+func TestRequestSnapshot_TopClientKey(t *testing.T) {
+	home := NewRequestSnapshot(time.Now(), "dot", "192.0.2.1")
+	home.SetClient("alex-phone")
+	mobile := NewRequestSnapshot(time.Now(), "dot", "198.51.100.7")
+	mobile.SetClient("alex-phone")
+
+	// A named client is counted as one, whichever network it is on
+	assert.Equal(t, "|||alex-phone", home.topClientKey("AS64496:Home ISP", "GB"))
+	assert.Equal(t, home.topClientKey("AS64496:Home ISP", "GB"), mobile.topClientKey("AS64511:Mobile", "FR"))
+
+	anonymous := NewRequestSnapshot(time.Now(), "dot", "192.0.2.1")
+	assert.Equal(t, "192.0.2.1|AS64496:Home ISP|GB|", anonymous.topClientKey("AS64496:Home ISP", "GB"))
+}
@@ -23,6 +23,7 @@ type blockedDomain struct {
 type RequestSnapshot struct {
 	source         string
 	ipAddr         string
+	client         string
 	startTime      time.Time
 	primaryDomain  string
 	blockedDomains []blockedDomain
@@ -36,6 +37,9 @@ type RequestSnapshot struct {
 	rcode          string
 	queryType      string
 	blockCause     string
+	blockHop       string
+	rebindingMode  string
+	dnssecStatus   string
 	answerCount    int
 }
 
@@ -48,6 +52,16 @@ func (t *RequestSnapshot) IPAddr() string {
 	return t.ipAddr
 }
 
+// SetClient records the ID of the named client that made the request, if
+// any.
+func (t *RequestSnapshot) SetClient(client string) {
+	t.client = client
+}
+
+func (t *RequestSnapshot) Client() string {
+	return t.client
+}
+
 func (t *RequestSnapshot) Source() string {
 	return t.source
 }
@@ -60,6 +74,32 @@ func (t *RequestSnapshot) BlockCause() string {
 	return t.blockCause
 }
 
+// BlockHop returns the CNAME target or answer address that caused the
+// response to be blocked, or empty if the question name itself was blocked.
+func (t *RequestSnapshot) BlockHop() string {
+	return t.blockHop
+}
+
+func (t *RequestSnapshot) SetBlockHop(hop string) {
+	t.blockHop = hop
+}
+
+// SetRebinding marks the response as having been filtered by the DNS
+// rebinding guard, operating in the given mode (strip or refuse).
+func (t *RequestSnapshot) SetRebinding(mode string) {
+	t.rebindingMode = mode
+}
+
+func (t *RequestSnapshot) IsRebinding() bool {
+	return t.rebindingMode != ""
+}
+
+// SetDNSSECStatus records the outcome (secure, insecure or bogus) of
+// validating the upstream response.
+func (t *RequestSnapshot) SetDNSSECStatus(status string) {
+	t.dnssecStatus = status
+}
+
 func (t *RequestSnapshot) Latency() time.Duration {
 	return time.Since(t.startTime)
 }
@@ -140,6 +180,24 @@ func (t *RequestSnapshot) AnswerCount() int {
 	return t.answerCount
 }
 
+// topClientKey returns the dns_top_clients entry of the request. Named
+// clients are counted by their ID alone, as they may roam across IPs and
+// networks, and anonymous clients by their IP.
+func (t *RequestSnapshot) topClientKey(provider, isoCode string) string {
+	if t.client != "" {
+		return "|||" + t.client
+	}
+
+	var sb strings.Builder
+	sb.WriteString(t.ipAddr)
+	sb.WriteByte('|')
+	sb.WriteString(provider)
+	sb.WriteByte('|')
+	sb.WriteString(isoCode)
+	sb.WriteByte('|')
+	return sb.String()
+}
+
 func (t *RequestSnapshot) Record(metrics *DnsMetrics) {
 	metrics.RequestLatency.Observe(t.requestLatency)
 	metrics.RequestCounts.WithLabelValues("total", t.source).Inc()
@@ -166,14 +224,7 @@ func (t *RequestSnapshot) Record(metrics *DnsMetrics) {
 			}
 		}
 
-		var sb strings.Builder
-		sb.WriteString(t.ipAddr)
-		sb.WriteByte('|')
-		sb.WriteString(provider)
-		sb.WriteByte('|')
-		sb.WriteString(isoCode)
-
-		metrics.TopClients.Add(sb.String())
+		metrics.TopClients.Add(t.topClientKey(provider, isoCode))
 		metrics.UniqueClients.Insert([]byte(t.ipAddr))
 		metrics.ProviderCounts.WithLabelValues(provider, isoCode).Inc()
 	}
@@ -194,6 +245,12 @@ func (t *RequestSnapshot) Record(metrics *DnsMetrics) {
 	for _, upstreamTTL := range t.upstreamTTLs {
 		metrics.UpstreamTTLs.WithLabelValues(upstreamTTL.queryType).Observe(upstreamTTL.ttl)
 	}
+	if t.dnssecStatus != "" {
+		metrics.DNSSECValidations.WithLabelValues(t.dnssecStatus).Inc()
+	}
+	if t.rebindingMode != "" {
+		metrics.RebindingFiltered.WithLabelValues(t.rebindingMode).Inc()
+	}
 	if t.rcode != "" {
 		metrics.ReplyCounts.WithLabelValues(t.rcode).Inc()
 	}
@@ -34,8 +34,10 @@ type DNSBlock struct {
 }
 
 type OnDemandRule struct {
-	Action           string            `plist:"Action"`
-	ActionParameters []ActionParameter `plist:"ActionParameters,omitempty"`
+	Action             string            `plist:"Action"`
+	ActionParameters   []ActionParameter `plist:"ActionParameters,omitempty"`
+	SSIDMatch          []string          `plist:"SSIDMatch,omitempty"`
+	InterfaceTypeMatch string            `plist:"InterfaceTypeMatch,omitempty"`
 }
 
 type ActionParameter struct {
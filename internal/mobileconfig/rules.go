@@ -0,0 +1,30 @@
+package mobileconfig
+
+// NewOnDemandRules returns the rules deciding when the encrypted DNS settings
+// apply: never on the given Wi-Fi networks, never for the excluded domains
+// (e.g. captive portals, which must be resolved by the network's own
+// resolver), and otherwise always. It returns nil if there is nothing to
+// exclude, as the settings then apply unconditionally anyway.
+func NewOnDemandRules(disconnectSSIDs, excludedDomains []string) OnDemandRules {
+	if len(disconnectSSIDs) == 0 && len(excludedDomains) == 0 {
+		return nil
+	}
+
+	var rules OnDemandRules
+	if len(disconnectSSIDs) > 0 {
+		rules = append(rules, OnDemandRule{
+			Action:             "Disconnect",
+			InterfaceTypeMatch: "WiFi",
+			SSIDMatch:          disconnectSSIDs,
+		})
+	}
+	if len(excludedDomains) > 0 {
+		rules = append(rules, OnDemandRule{
+			Action: "EvaluateConnection",
+			ActionParameters: []ActionParameter{
+				{DomainAction: "NeverConnect", Domains: excludedDomains},
+			},
+		})
+	}
+	return append(rules, OnDemandRule{Action: "Connect"})
+}
@@ -0,0 +1,51 @@
+package mobileconfig
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/cockroachdb/errors"
+	"github.com/smallstep/pkcs7"
+)
+
+// Signer signs profiles (CMS SignedData with the profile attached), so that
+// iOS and macOS show them as verified rather than "Unverified".
+type Signer struct {
+	cert          *x509.Certificate
+	intermediates []*x509.Certificate
+	key           crypto.PrivateKey
+}
+
+// NewSigner loads the signing certificate, followed by any intermediate
+// certificates, and its private key from PEM files.
+func NewSigner(certFile, keyFile string) (*Signer, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load profile signing certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(pair.Certificate))
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse profile signing certificate")
+		}
+		certs = append(certs, cert)
+	}
+
+	return &Signer{cert: certs[0], intermediates: certs[1:], key: pair.PrivateKey}, nil
+}
+
+// Sign returns the DER-encoded signed profile.
+func (s *Signer) Sign(profile []byte) ([]byte, error) {
+	signed, err := pkcs7.NewSignedData(profile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create signed profile")
+	}
+	signed.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := signed.AddSignerChain(s.cert, s.key, s.intermediates, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, errors.Wrap(err, "failed to sign profile")
+	}
+	return signed.Finish()
+}
@@ -0,0 +1,227 @@
+package odoh
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/hpke"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+)
+
+// keyPair is a target's HPKE key pair, along with its serialized
+// ObliviousDoHConfigContents and the key ID derived from them.
+type keyPair struct {
+	privateKey hpke.PrivateKey
+	contents   []byte
+	keyID      []byte
+}
+
+func generateKeyPair() (*keyPair, error) {
+	privateKey, err := kem.GenerateKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate HPKE key")
+	}
+
+	contents := marshalConfigContents(privateKey.PublicKey().Bytes())
+	keyID, err := deriveKeyID(contents)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{privateKey: privateKey, contents: contents, keyID: keyID}, nil
+}
+
+// marshalConfigContents encodes an ObliviousDoHConfigContents for the
+// supported ciphersuite.
+func marshalConfigContents(publicKey []byte) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, kem.ID())
+	buf = binary.BigEndian.AppendUint16(buf, kdf.ID())
+	buf = binary.BigEndian.AppendUint16(buf, aead.ID())
+	return appendVector(buf, publicKey)
+}
+
+// deriveKeyID computes the key ID clients use to name the key a query was
+// encrypted to (RFC 9230 section 6.2).
+func deriveKeyID(contents []byte) ([]byte, error) {
+	prk, err := hkdf.Extract(sha256.New, contents, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive key ID")
+	}
+	keyID, err := hkdf.Expand(sha256.New, prk, labelKeyID, hashSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive key ID")
+	}
+	return keyID, nil
+}
+
+// KeyRing holds the target's current HPKE key pair and the one it replaced.
+// Queries encrypted to either are accepted, so that clients holding configs
+// fetched just before a rotation keep working until they refetch.
+type KeyRing struct {
+	mu       sync.RWMutex
+	current  *keyPair
+	previous *keyPair
+}
+
+// NewKeyRing returns a key ring with a freshly generated key pair.
+func NewKeyRing() (*KeyRing, error) {
+	r := &KeyRing{}
+	if err := r.Rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rotate generates a new key pair, demoting the current one and discarding
+// the one before it.
+func (r *KeyRing) Rotate() error {
+	next, err := generateKeyPair()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.previous, r.current = r.current, next
+	return nil
+}
+
+// Configs returns the serialized ObliviousDoHConfigs to publish at
+// ConfigsPath. Only the current key is published.
+func (r *KeyRing) Configs() []byte {
+	r.mu.RLock()
+	contents := r.current.contents
+	r.mu.RUnlock()
+
+	config := binary.BigEndian.AppendUint16(nil, Version)
+	config = appendVector(config, contents)
+	return appendVector(nil, config)
+}
+
+func (r *KeyRing) lookup(keyID []byte) *keyPair {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, kp := range []*keyPair{r.current, r.previous} {
+		if kp != nil && bytes.Equal(kp.keyID, keyID) {
+			return kp
+		}
+	}
+	return nil
+}
+
+// DecryptQuery decrypts a serialized ObliviousDoHMessage query, returning the
+// packed DNS query and the context needed to encrypt the response. It returns
+// ErrUnknownKey if the query was encrypted to a key not held by the ring.
+func (r *KeyRing) DecryptQuery(b []byte) ([]byte, *ResponseContext, error) {
+	msg, err := unmarshalMessage(b, messageTypeQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kp := r.lookup(msg.keyID)
+	if kp == nil {
+		return nil, nil, ErrUnknownKey
+	}
+
+	if len(msg.encrypted) < encSize {
+		return nil, nil, errors.New("truncated ODoH encrypted message")
+	}
+	recipient, err := hpke.NewRecipient(msg.encrypted[:encSize], kp.privateKey, kdf, aead, []byte(labelQuery))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to set up HPKE context")
+	}
+
+	plaintext, err := recipient.Open(msg.aad(), msg.encrypted[encSize:])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decrypt ODoH query")
+	}
+	dnsMsg, err := unmarshalPlaintext(plaintext)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid ODoH query plaintext")
+	}
+
+	secret, err := recipient.Export(labelResponse, keySize)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to export response secret")
+	}
+	return dnsMsg, &ResponseContext{secret: secret, queryPlaintext: plaintext}, nil
+}
+
+// TargetConfig is a target's public key, as parsed from its published
+// ObliviousDoHConfigs. It is used by clients to encrypt queries.
+type TargetConfig struct {
+	publicKey hpke.PublicKey
+	keyID     []byte
+}
+
+// ParseConfigs returns the first config in a serialized ObliviousDoHConfigs
+// with a supported version and ciphersuite. Unsupported configs are skipped,
+// as required by RFC 9230 section 6.
+func ParseConfigs(b []byte) (*TargetConfig, error) {
+	configs, rest, err := readVector(b)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("malformed ODoH configs")
+	}
+
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.New("malformed ODoH config")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		var contents []byte
+		if contents, configs, err = readVector(configs[2:]); err != nil {
+			return nil, errors.Wrap(err, "malformed ODoH config")
+		}
+		if version != Version || len(contents) < 6 {
+			continue
+		}
+
+		if binary.BigEndian.Uint16(contents) != kem.ID() ||
+			binary.BigEndian.Uint16(contents[2:]) != kdf.ID() ||
+			binary.BigEndian.Uint16(contents[4:]) != aead.ID() {
+			continue
+		}
+		publicKeyBytes, _, err := readVector(contents[6:])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed ODoH config public key")
+		}
+		publicKey, err := kem.NewPublicKey(publicKeyBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid ODoH config public key")
+		}
+		keyID, err := deriveKeyID(contents)
+		if err != nil {
+			return nil, err
+		}
+		return &TargetConfig{publicKey: publicKey, keyID: keyID}, nil
+	}
+
+	return nil, ErrUnsupportedConfig
+}
+
+// EncryptQuery encrypts a packed DNS query to the target, returning the
+// serialized ObliviousDoHMessage and the context needed to decrypt the
+// response.
+func (t *TargetConfig) EncryptQuery(dnsMsg []byte) ([]byte, *QueryContext, error) {
+	enc, sender, err := hpke.NewSender(t.publicKey, kdf, aead, []byte(labelQuery))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to set up HPKE context")
+	}
+
+	plaintext := marshalPlaintext(dnsMsg, queryPadding)
+	msg := &message{messageType: messageTypeQuery, keyID: t.keyID}
+	ciphertext, err := sender.Seal(msg.aad(), plaintext)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to encrypt ODoH query")
+	}
+	msg.encrypted = append(enc, ciphertext...)
+
+	secret, err := sender.Export(labelResponse, keySize)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to export response secret")
+	}
+	return msg.marshal(), &QueryContext{secret: secret, queryPlaintext: plaintext}, nil
+}
@@ -0,0 +1,244 @@
+// Package odoh implements the message format and encryption of Oblivious
+// DNS-over-HTTPS (RFC 9230). A target publishes its HPKE public keys as
+// ObliviousDoHConfigs, and clients send queries encrypted to one of those
+// keys via a relay, so that neither the relay nor the target learns both who
+// asked and what was asked.
+//
+// Only the mandatory-to-implement ciphersuite is supported:
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM.
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hpke"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ContentType is the media type of encrypted ODoH queries and responses.
+const ContentType = "application/oblivious-dns-message"
+
+// ConfigsPath is the well-known path at which targets publish their
+// ObliviousDoHConfigs.
+const ConfigsPath = "/.well-known/odohconfigs"
+
+// Version is the ObliviousDoHConfig version defined by RFC 9230.
+const Version = 0x0001
+
+const (
+	messageTypeQuery    = 0x01
+	messageTypeResponse = 0x02
+
+	labelQuery    = "odoh query"
+	labelResponse = "odoh response"
+	labelKeyID    = "odoh key id"
+	labelKey      = "odoh key"
+	labelNonce    = "odoh nonce"
+
+	// Sizes for the supported ciphersuite
+	encSize   = 32 // X25519 encapsulated key (Nenc)
+	keySize   = 16 // AES-128-GCM key (Nk)
+	nonceSize = 12 // AES-128-GCM nonce (Nn)
+	hashSize  = 32 // HKDF-SHA256 output (Nh)
+
+	// Plaintexts are padded to a multiple of these sizes, following the
+	// block-length padding policy of RFC 8467.
+	queryPadding    = 128
+	responsePadding = 468
+)
+
+var (
+	// ErrUnknownKey is returned when a query was encrypted to a key that the
+	// target does not (or no longer) hold. Clients should refetch the configs.
+	ErrUnknownKey = errors.New("ODoH query encrypted to an unknown key")
+
+	// ErrUnsupportedConfig is returned when none of the published configs
+	// use a version and ciphersuite that this package supports.
+	ErrUnsupportedConfig = errors.New("no supported ODoH config")
+)
+
+var (
+	kem  = hpke.DHKEM(ecdh.X25519())
+	kdf  = hpke.HKDFSHA256()
+	aead = hpke.AES128GCM()
+)
+
+// message is an ObliviousDoHMessage: a message type, the key ID (for queries)
+// or response nonce (for responses) and the encrypted payload.
+type message struct {
+	messageType byte
+	keyID       []byte
+	encrypted   []byte
+}
+
+func (m *message) marshal() []byte {
+	buf := []byte{m.messageType}
+	buf = appendVector(buf, m.keyID)
+	return appendVector(buf, m.encrypted)
+}
+
+func unmarshalMessage(b []byte, messageType byte) (*message, error) {
+	if len(b) < 1 {
+		return nil, errors.New("empty ODoH message")
+	}
+	if b[0] != messageType {
+		return nil, errors.Newf("unexpected ODoH message type %d", b[0])
+	}
+
+	keyID, rest, err := readVector(b[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read ODoH key ID")
+	}
+	encrypted, rest, err := readVector(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read ODoH encrypted message")
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after ODoH message")
+	}
+	if len(encrypted) == 0 {
+		return nil, errors.New("empty ODoH encrypted message")
+	}
+	return &message{messageType: messageType, keyID: keyID, encrypted: encrypted}, nil
+}
+
+// aad returns the additional authenticated data binding the message type
+// and key ID (or response nonce) to the ciphertext.
+func (m *message) aad() []byte {
+	return appendVector([]byte{m.messageType}, m.keyID)
+}
+
+// marshalPlaintext encodes an ObliviousDoHMessagePlaintext, padding the DNS
+// message with zeros up to a multiple of blockSize.
+func marshalPlaintext(dnsMsg []byte, blockSize int) []byte {
+	padding := (blockSize - len(dnsMsg)%blockSize) % blockSize
+	buf := appendVector(nil, dnsMsg)
+	return appendVector(buf, make([]byte, padding))
+}
+
+func unmarshalPlaintext(b []byte) ([]byte, error) {
+	dnsMsg, rest, err := readVector(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read DNS message")
+	}
+	padding, rest, err := readVector(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read padding")
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after padding")
+	}
+	for _, b := range padding {
+		if b != 0 {
+			return nil, errors.New("non-zero padding")
+		}
+	}
+	if len(dnsMsg) == 0 {
+		return nil, errors.New("empty DNS message")
+	}
+	return dnsMsg, nil
+}
+
+// responseKeys derives the AEAD key and nonce protecting a response, from
+// the secret exported by the query's HPKE context (RFC 9230 section 6.4).
+func responseKeys(secret, queryPlaintext, responseNonce []byte) (cipher.AEAD, []byte, error) {
+	salt := appendVector(append([]byte{}, queryPlaintext...), responseNonce)
+	prk, err := hkdf.Extract(sha256.New, secret, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := hkdf.Expand(sha256.New, prk, labelKey, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, labelNonce, nonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonce, nil
+}
+
+// ResponseContext holds what a target needs to encrypt the response to a
+// decrypted query.
+type ResponseContext struct {
+	secret         []byte
+	queryPlaintext []byte
+}
+
+// EncryptResponse encrypts a packed DNS response, returning the serialized
+// ObliviousDoHMessage to send back to the client.
+func (c *ResponseContext) EncryptResponse(dnsMsg []byte) ([]byte, error) {
+	responseNonce := make([]byte, max(keySize, nonceSize))
+	if _, err := rand.Read(responseNonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate response nonce")
+	}
+
+	gcm, nonce, err := responseKeys(c.secret, c.queryPlaintext, responseNonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive response keys")
+	}
+
+	msg := &message{messageType: messageTypeResponse, keyID: responseNonce}
+	msg.encrypted = gcm.Seal(nil, nonce, marshalPlaintext(dnsMsg, responsePadding), msg.aad())
+	return msg.marshal(), nil
+}
+
+// QueryContext holds what a client needs to decrypt the response to a query
+// it encrypted.
+type QueryContext struct {
+	secret         []byte
+	queryPlaintext []byte
+}
+
+// DecryptResponse decrypts a serialized ObliviousDoHMessage response,
+// returning the packed DNS response.
+func (c *QueryContext) DecryptResponse(b []byte) ([]byte, error) {
+	msg, err := unmarshalMessage(b, messageTypeResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, nonce, err := responseKeys(c.secret, c.queryPlaintext, msg.keyID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive response keys")
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, msg.encrypted, msg.aad())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt ODoH response")
+	}
+	return unmarshalPlaintext(plaintext)
+}
+
+func appendVector(buf, v []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(v)))
+	return append(buf, v...)
+}
+
+// readVector reads a 2-byte length-prefixed vector, returning it and the
+// remaining bytes.
+func readVector(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("truncated length")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, errors.New("truncated data")
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
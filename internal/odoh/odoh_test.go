@@ -0,0 +1,115 @@
+package odoh
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func packedQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	packed, err := req.Pack()
+	require.NoError(t, err)
+	return packed
+}
+
+func targetConfig(t *testing.T, keys *KeyRing) *TargetConfig {
+	t.Helper()
+	config, err := ParseConfigs(keys.Configs())
+	require.NoError(t, err)
+	return config
+}
+
+func TestRoundTrip(t *testing.T) {
+	keys, err := NewKeyRing()
+	require.NoError(t, err)
+
+	query := packedQuery(t, "example.com.")
+	encrypted, queryCtx, err := targetConfig(t, keys).EncryptQuery(query)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "example", "query should not be sent in the clear")
+
+	decrypted, responseCtx, err := keys.DecryptQuery(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, query, decrypted)
+
+	response := []byte("response bytes")
+	encryptedResponse, err := responseCtx.EncryptResponse(response)
+	require.NoError(t, err)
+
+	decryptedResponse, err := queryCtx.DecryptResponse(encryptedResponse)
+	require.NoError(t, err)
+	assert.Equal(t, response, decryptedResponse)
+}
+
+func TestPadding(t *testing.T) {
+	plaintext := marshalPlaintext(make([]byte, 30), queryPadding)
+	assert.Equal(t, 2+queryPadding+2, len(plaintext), "DNS message should be padded to the block size")
+
+	dnsMsg, err := unmarshalPlaintext(plaintext)
+	require.NoError(t, err)
+	assert.Len(t, dnsMsg, 30)
+
+	plaintext[len(plaintext)-1] = 1
+	_, err = unmarshalPlaintext(plaintext)
+	assert.ErrorContains(t, err, "non-zero padding")
+}
+
+func TestKeyRing_Rotate(t *testing.T) {
+	keys, err := NewKeyRing()
+	require.NoError(t, err)
+
+	config := targetConfig(t, keys)
+	encrypted, _, err := config.EncryptQuery(packedQuery(t, "example.com."))
+	require.NoError(t, err)
+
+	// The previous key is still accepted after one rotation...
+	require.NoError(t, keys.Rotate())
+	assert.NotEqual(t, config.keyID, targetConfig(t, keys).keyID, "published config should change")
+	_, _, err = keys.DecryptQuery(encrypted)
+	require.NoError(t, err)
+
+	// ...but not after two
+	require.NoError(t, keys.Rotate())
+	_, _, err = keys.DecryptQuery(encrypted)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestDecryptQuery_Tampered(t *testing.T) {
+	keys, err := NewKeyRing()
+	require.NoError(t, err)
+
+	encrypted, _, err := targetConfig(t, keys).EncryptQuery(packedQuery(t, "example.com."))
+	require.NoError(t, err)
+
+	encrypted[len(encrypted)-1] ^= 0xff
+	_, _, err = keys.DecryptQuery(encrypted)
+	assert.ErrorContains(t, err, "failed to decrypt")
+
+	_, _, err = keys.DecryptQuery([]byte{messageTypeResponse, 0, 0, 0, 1, 0})
+	assert.ErrorContains(t, err, "unexpected ODoH message type")
+}
+
+func TestParseConfigs_SkipsUnsupported(t *testing.T) {
+	keys, err := NewKeyRing()
+	require.NoError(t, err)
+	supported, _, err := readVector(keys.Configs())
+	require.NoError(t, err)
+
+	// A config with a future version precedes the supported one
+	unsupported := binary.BigEndian.AppendUint16(nil, 0xff01)
+	unsupported = appendVector(unsupported, []byte{1, 2, 3})
+	configs := appendVector(nil, append(unsupported, supported...))
+
+	config, err := ParseConfigs(configs)
+	require.NoError(t, err)
+	assert.Equal(t, targetConfig(t, keys).keyID, config.keyID)
+
+	_, err = ParseConfigs(appendVector(nil, unsupported))
+	assert.ErrorIs(t, err, ErrUnsupportedConfig)
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"github.com/pires/go-proxyproto"
+)
+
+// datagramPool holds buffers large enough for any UDP datagram, so that a
+// PROXY header never truncates the DNS message behind it.
+var datagramPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 65535)
+		return &buf
+	},
+}
+
+// proxiedAddr is the address of a client whose datagrams are relayed by a
+// proxy. It stands for the client, but responses are sent back to the proxy.
+type proxiedAddr struct {
+	client net.Addr
+	proxy  net.Addr
+}
+
+func (a proxiedAddr) Network() string {
+	return a.client.Network()
+}
+
+func (a proxiedAddr) String() string {
+	return a.client.String()
+}
+
+// proxyPacketConn strips PROXY protocol v2 headers from UDP datagrams, as
+// sent by dnsdist and HAProxy, so that queries appear to come from the client
+// rather than the proxy. Headers are only accepted from the trusted proxies,
+// whose datagrams without one are answered as they are.
+type proxyPacketConn struct {
+	net.PacketConn
+	policy proxyproto.ConnPolicyFunc
+	logger *slog.Logger
+}
+
+func (c *proxyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := datagramPool.Get().(*[]byte)
+	defer datagramPool.Put(buf)
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(*buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		payload, client, err := c.unwrap((*buf)[:n], addr)
+		if err != nil {
+			c.logger.Debug("dropping UDP datagram with invalid PROXY header", "remote_addr", addr, "error", err)
+			continue
+		}
+		return copy(p, payload), client, nil
+	}
+}
+
+// unwrap returns the DNS message in the datagram and the address of the
+// client that sent it.
+func (c *proxyPacketConn) unwrap(datagram []byte, addr net.Addr) ([]byte, net.Addr, error) {
+	policy, err := c.policy(proxyproto.ConnPolicyOptions{Upstream: addr, Downstream: c.LocalAddr()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch policy {
+	case proxyproto.USE, proxyproto.REQUIRE:
+		if policy == proxyproto.USE && !bytes.HasPrefix(datagram, proxyproto.SIGV2) {
+			return datagram, addr, nil
+		}
+		header, payload, err := proxyproto.ParseUDPDatagram(datagram)
+		if err != nil {
+			return nil, nil, err
+		}
+		// LOCAL headers are sent by the proxy itself, e.g. for health checks
+		if header.Command.IsLocal() {
+			return payload, addr, nil
+		}
+		ip, _, ok := header.IPs()
+		if !ok {
+			return nil, nil, errors.Newf("unsupported PROXY header transport protocol %v", header.TransportProtocol)
+		}
+		port, _, _ := header.Ports()
+		return payload, proxiedAddr{client: &net.UDPAddr{IP: ip, Port: port}, proxy: addr}, nil
+
+	case proxyproto.REJECT:
+		if bytes.HasPrefix(datagram, proxyproto.SIGV2) {
+			return nil, nil, proxyproto.ErrSuperfluousProxyHeader
+		}
+		return datagram, addr, nil
+
+	default:
+		return datagram, addr, nil
+	}
+}
+
+func (c *proxyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if proxied, ok := addr.(proxiedAddr); ok {
+		addr = proxied.proxy
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// listenWithProxyProtocol binds the regular DNS server's socket, accepting
+// PROXY protocol headers from the proxies trusted for DoT.
+func (app *App) listenWithProxyProtocol(srv *dns.Server) error {
+	udp := strings.HasPrefix(srv.Net, "udp")
+	// Without a whitelist, any host could send a header and pick its source
+	// IP, getting past the rate limits, access lists and bans
+	if udp && len(app.Config.Server.ProxyProtocol.TrustedProxies) == 0 {
+		return errors.New("proxy_protocol.dns over UDP requires proxy_protocol.trusted_proxies")
+	}
+	policy, err := app.proxyConnPolicy()
+	if err != nil {
+		return err
+	}
+
+	if udp {
+		conn, err := net.ListenPacket(srv.Net, srv.Addr)
+		if err != nil {
+			return errors.Wrap(err, "failed to create UDP DNS listener")
+		}
+		srv.PacketConn = &proxyPacketConn{PacketConn: conn, policy: policy, logger: app.Logger}
+		return nil
+	}
+
+	listener, err := net.Listen(srv.Net, srv.Addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to create TCP DNS listener")
+	}
+	srv.Listener = &proxyproto.Listener{Listener: listener, ConnPolicy: policy}
+	return nil
+}
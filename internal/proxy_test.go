@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pires/go-proxyproto"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newProxyTestApp(trustedProxies ...string) *App {
+	return &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Config: &config.Config{
+			Server: &config.ServerConfig{
+				ProxyProtocol: &config.ProxyProtocolConfig{DNS: true, TrustedProxies: trustedProxies},
+			},
+		},
+	}
+}
+
+// startProxiedDNSServer serves regular DNS on a loopback port with PROXY
+// protocol headers accepted, answering each query with a TXT record holding
+// the client's address.
+func startProxiedDNSServer(t *testing.T, app *App, network string) string {
+	t.Helper()
+	srv := &dns.Server{
+		Addr: "127.0.0.1:0",
+		Net:  network,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{w.RemoteAddr().String()},
+			})
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	require.NoError(t, app.listenWithProxyProtocol(srv))
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	if srv.PacketConn != nil {
+		return srv.PacketConn.LocalAddr().String()
+	}
+	return srv.Listener.Addr().String()
+}
+
+func proxyHeader(transport proxyproto.AddressFamilyAndProtocol, client string) *proxyproto.Header {
+	return &proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: transport,
+		SourceAddr:        &net.UDPAddr{IP: net.ParseIP(client), Port: 5353},
+		DestinationAddr:   &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53},
+	}
+}
+
+// exchangeUDP sends the query in a single datagram, prefixed by the header if
+// there is one, and returns the client address seen by the server, or an
+// empty string if there was no answer.
+func exchangeUDP(t *testing.T, addr string, header *proxyproto.Header) string {
+	t.Helper()
+	packed, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT).Pack()
+	require.NoError(t, err)
+	if header != nil {
+		packed, err = header.FormatUDPDatagram(packed)
+		require.NoError(t, err)
+	}
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write(packed)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(250*time.Millisecond)))
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	resp := new(dns.Msg)
+	require.NoError(t, resp.Unpack(buf[:n]))
+	require.Len(t, resp.Answer, 1)
+	return resp.Answer[0].(*dns.TXT).Txt[0]
+}
+
+func TestProxyProtocol_UDPTrustedProxy(t *testing.T) {
+	addr := startProxiedDNSServer(t, newProxyTestApp("127.0.0.1/32"), "udp")
+
+	// The response goes back to the proxy, but the query is from the client
+	assert.Equal(t, "198.51.100.7:5353", exchangeUDP(t, addr, proxyHeader(proxyproto.UDPv4, "198.51.100.7")))
+	assert.Equal(t, "[2001:db8::7]:5353", exchangeUDP(t, addr, proxyHeader(proxyproto.UDPv6, "2001:db8::7")))
+
+	// Health checks from the proxy itself
+	local := &proxyproto.Header{Version: 2, Command: proxyproto.LOCAL, TransportProtocol: proxyproto.UNSPEC}
+	assert.Contains(t, exchangeUDP(t, addr, local), "127.0.0.1:")
+
+	// Queries without a header are answered as they are
+	assert.Contains(t, exchangeUDP(t, addr, nil), "127.0.0.1:")
+}
+
+func TestProxyProtocol_UDPUntrustedSender(t *testing.T) {
+	addr := startProxiedDNSServer(t, newProxyTestApp("192.0.2.0/24"), "udp")
+
+	assert.Contains(t, exchangeUDP(t, addr, nil), "127.0.0.1:")
+	// A forged header must not let the sender pick its source IP
+	assert.Empty(t, exchangeUDP(t, addr, proxyHeader(proxyproto.UDPv4, "198.51.100.7")))
+}
+
+func TestProxyProtocol_UDPRequiresTrustedProxies(t *testing.T) {
+	srv := &dns.Server{Addr: "127.0.0.1:0", Net: "udp"}
+	err := newProxyTestApp().listenWithProxyProtocol(srv)
+	assert.ErrorContains(t, err, "requires proxy_protocol.trusted_proxies")
+	assert.Nil(t, srv.PacketConn)
+
+	// TCP headers are detected on the stream, so they remain optional
+	srv = &dns.Server{Addr: "127.0.0.1:0", Net: "tcp"}
+	require.NoError(t, newProxyTestApp().listenWithProxyProtocol(srv))
+	require.NoError(t, srv.Listener.Close())
+}
+
+func TestProxyProtocol_TCP(t *testing.T) {
+	addr := startProxiedDNSServer(t, newProxyTestApp("127.0.0.1/32"), "tcp")
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	header := proxyproto.HeaderProxyFromAddrs(2,
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 5353},
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53})
+	_, err = header.WriteTo(conn)
+	require.NoError(t, err)
+
+	client := &dns.Conn{Conn: conn}
+	require.NoError(t, client.WriteMsg(new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT)))
+	resp, err := client.ReadMsg()
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "198.51.100.7:5353", resp.Answer[0].(*dns.TXT).Txt[0])
+}
@@ -0,0 +1,169 @@
+package setup
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// addressCacheTTL is how long looked up addresses are reused for.
+	addressCacheTTL = 5 * time.Minute
+	// addressLookupTimeout bounds a lookup shared by concurrent callers, which
+	// may each give up on it sooner.
+	addressLookupTimeout = 10 * time.Second
+)
+
+// AddressResolver determines the server's own IP addresses, for the snippets
+// and profiles that need them. Statically configured addresses are used if
+// there are any; otherwise the server name is resolved, either through a DNS
+// handler (i.e. dot-block's own dispatcher, which works in split-horizon
+// setups and when the host's resolver is dot-block itself) or the system
+// resolver, and the result is cached.
+type AddressResolver struct {
+	serverName string
+	static     []string
+	handler    dns.Handler
+	lookups    singleflight.Group
+
+	mu      sync.Mutex
+	cached  []string
+	expires time.Time
+}
+
+// NewAddressResolver returns a resolver for the server name. handler may be
+// nil, in which case the system resolver is used.
+func NewAddressResolver(serverName string, static []string, handler dns.Handler) (*AddressResolver, error) {
+	for _, addr := range static {
+		if _, err := netip.ParseAddr(addr); err != nil {
+			return nil, errors.Wrapf(err, "invalid public address %q", addr)
+		}
+	}
+	return &AddressResolver{
+		serverName: serverName,
+		static:     static,
+		handler:    handler,
+	}, nil
+}
+
+// Lookup returns the server's addresses, or none if they cannot be
+// determined. A failed lookup falls back to the previous result, if any, as
+// does one that is still in progress when ctx is done. Concurrent callers
+// share a single lookup.
+func (r *AddressResolver) Lookup(ctx context.Context) []string {
+	if len(r.static) > 0 {
+		return slices.Clone(r.static)
+	}
+
+	r.mu.Lock()
+	if r.cached != nil && time.Now().Before(r.expires) {
+		defer r.mu.Unlock()
+		return slices.Clone(r.cached)
+	}
+	r.mu.Unlock()
+
+	done := r.lookups.DoChan(r.serverName, func() (any, error) {
+		// Detached from ctx, so that the caller giving up does not fail the
+		// lookup for the others sharing it
+		lookupCtx, cancel := context.WithTimeout(context.Background(), addressLookupTimeout)
+		defer cancel()
+		addresses := r.lookup(lookupCtx)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if len(addresses) > 0 {
+			r.cached = addresses
+			r.expires = time.Now().Add(addressCacheTTL)
+		}
+		return nil, nil
+	})
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.cached)
+}
+
+func (r *AddressResolver) lookup(ctx context.Context) []string {
+	if r.handler != nil {
+		return r.lookupHandler(ctx)
+	}
+	addresses, _ := net.DefaultResolver.LookupHost(ctx, r.serverName)
+	return addresses
+}
+
+func (r *AddressResolver) lookupHandler(ctx context.Context) []string {
+	var addresses []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if ctx.Err() != nil {
+			break
+		}
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(r.serverName), qtype)
+
+		w := &responseWriter{}
+		r.handler.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		for _, rr := range w.msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addresses = append(addresses, rr.A.String())
+			case *dns.AAAA:
+				addresses = append(addresses, rr.AAAA.String())
+			}
+		}
+	}
+	return addresses
+}
+
+// responseWriter captures the response to a lookup made through a DNS
+// handler.
+type responseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *responseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+func (w *responseWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.msg = new(dns.Msg)
+	return len(b), w.msg.Unpack(b)
+}
+
+func (w *responseWriter) Close() error {
+	return nil
+}
+
+func (w *responseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *responseWriter) TsigTimersOnly(bool) {
+
+}
+
+func (w *responseWriter) Hijack() {
+
+}
@@ -0,0 +1,134 @@
+package setup
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingHandler answers A and AAAA queries for dns.example.com, or
+// SERVFAIL if failing is set.
+type countingHandler struct {
+	queries int
+	failing bool
+}
+
+func (h *countingHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	h.queries++
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if h.failing {
+		m.Rcode = dns.RcodeServerFailure
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	hdr := dns.RR_Header{Name: r.Question[0].Name, Rrtype: r.Question[0].Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch r.Question[0].Qtype {
+	case dns.TypeA:
+		m.Answer = append(m.Answer,
+			&dns.CNAME{Hdr: dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "edge.example.net."},
+			&dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")})
+	case dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+	}
+	_ = w.WriteMsg(m)
+}
+
+func TestAddressResolver_Static(t *testing.T) {
+	handler := &countingHandler{}
+	resolver, err := NewAddressResolver("dns.example.com", []string{"198.51.100.1", "2001:db8::2"}, handler)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"198.51.100.1", "2001:db8::2"}, resolver.Lookup(context.Background()))
+	assert.Zero(t, handler.queries, "static addresses should not be looked up")
+}
+
+func TestAddressResolver_InvalidStatic(t *testing.T) {
+	_, err := NewAddressResolver("dns.example.com", []string{"dns.example.com"}, nil)
+	assert.Error(t, err)
+}
+
+func TestAddressResolver_Handler(t *testing.T) {
+	handler := &countingHandler{}
+	resolver, err := NewAddressResolver("dns.example.com", nil, handler)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1"}, resolver.Lookup(context.Background()))
+	assert.Equal(t, 2, handler.queries)
+
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1"}, resolver.Lookup(context.Background()))
+	assert.Equal(t, 2, handler.queries, "addresses should be cached")
+}
+
+func TestAddressResolver_Failure(t *testing.T) {
+	handler := &countingHandler{failing: true}
+	resolver, err := NewAddressResolver("dns.example.com", nil, handler)
+	require.NoError(t, err)
+	assert.Empty(t, resolver.Lookup(context.Background()))
+
+	handler.failing = false
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1"}, resolver.Lookup(context.Background()), "failures should not be cached")
+
+	// Once the cache expires, a failed lookup falls back to the previous result
+	handler.failing = true
+	resolver.expires = resolver.expires.Add(-2 * addressCacheTTL)
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1"}, resolver.Lookup(context.Background()))
+}
+
+// blockingHandler answers A queries for dns.example.com once released.
+type blockingHandler struct {
+	release chan struct{}
+	queries atomic.Int32
+}
+
+func (h *blockingHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	h.queries.Add(1)
+	<-h.release
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.Question[0].Qtype == dns.TypeA {
+		hdr := dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")})
+	}
+	_ = w.WriteMsg(m)
+}
+
+func TestAddressResolver_Timeout(t *testing.T) {
+	handler := &blockingHandler{release: make(chan struct{})}
+	resolver, err := NewAddressResolver("dns.example.com", nil, handler)
+	require.NoError(t, err)
+
+	// Callers waiting on a slow lookup give up when their context is done,
+	// sharing the lookup rather than queueing behind each other
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			assert.Empty(t, resolver.Lookup(ctx))
+			assert.Less(t, time.Since(start), time.Second)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), handler.queries.Load(), "concurrent lookups should be shared")
+
+	// The lookup completes in the background, and its result is cached
+	close(handler.release)
+	assert.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		return slices.Equal([]string{"192.0.2.1"}, resolver.Lookup(ctx))
+	}, time.Second, 10*time.Millisecond)
+}
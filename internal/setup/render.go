@@ -0,0 +1,46 @@
+package setup
+
+import (
+	"embed"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/cockroachdb/errors"
+	"rsc.io/qr"
+)
+
+//go:embed templates
+var templates embed.FS
+
+var funcs = map[string]any{
+	"placeholder": func() string { return AddressPlaceholder },
+	"indent": func(s string) string {
+		return "  " + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n  ") + "\n"
+	},
+}
+
+var (
+	textTemplate = texttemplate.Must(texttemplate.New("guide.txt.tmpl").Funcs(funcs).ParseFS(templates, "templates/guide.txt.tmpl"))
+	htmlTemplate = htmltemplate.Must(htmltemplate.New("guide.html.tmpl").Funcs(funcs).ParseFS(templates, "templates/guide.html.tmpl"))
+)
+
+// WriteText renders the guide as plain text, for the setup command.
+func (g *Guide) WriteText(w io.Writer) error {
+	return errors.Wrap(textTemplate.Execute(w, g), "failed to render setup guide")
+}
+
+// WriteHTML renders the guide as an HTML page, for the /setup endpoint.
+func (g *Guide) WriteHTML(w io.Writer) error {
+	return errors.Wrap(htmlTemplate.Execute(w, g), "failed to render setup guide")
+}
+
+// QRCode returns a PNG QR code of the DoH URL.
+func (g *Generator) QRCode() ([]byte, error) {
+	code, err := qr.Encode(g.DoHURL(), qr.M)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode QR code")
+	}
+	return code.PNG(), nil
+}
@@ -0,0 +1,253 @@
+// Package setup derives client configuration instructions — DNS stamps for
+// every enabled listener and snippets for the common platforms — from the
+// server configuration, for the /setup endpoint and the setup command.
+package setup
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/dnscrypt"
+	"github.com/rm-hull/dot-block/internal/stamps"
+)
+
+// AddressPlaceholder stands in for the server's IP address in snippets when
+// it could not be determined.
+const AddressPlaceholder = "<server-ip>"
+
+const (
+	defaultHTTPSPort = 443
+	defaultDoTPort   = 853
+	dohPath          = "/dns-query"
+)
+
+// Endpoint is an encrypted DNS listener that clients can be pointed at.
+type Endpoint struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Stamp    string `json:"stamp"`
+}
+
+// Guide holds the setup instructions for all supported clients.
+type Guide struct {
+	ServerName string     `json:"server_name"`
+	DoHURL     string     `json:"doh_url"`
+	Addresses  []string   `json:"addresses"`
+	Endpoints  []Endpoint `json:"endpoints"`
+	// AndroidPrivateDNS is the Private DNS hostname, which is only usable
+	// if DoT is served on the standard port.
+	AndroidPrivateDNS string   `json:"android_private_dns,omitempty"`
+	WindowsNetsh      []string `json:"windows_netsh"`
+	WindowsPowerShell []string `json:"windows_powershell"`
+	SystemdResolved   string   `json:"systemd_resolved"`
+	NetworkManager    string   `json:"network_manager"`
+}
+
+// Generator builds guides for a server configuration.
+type Generator struct {
+	cfg        *config.Config
+	serverName string
+	provider   *dnscrypt.Provider
+}
+
+// New returns a generator for the configuration. provider is nil if DNSCrypt
+// is disabled.
+func New(cfg *config.Config, provider *dnscrypt.Provider) (*Generator, error) {
+	if len(cfg.Server.LetsEncrypt.AllowedHosts) == 0 {
+		return nil, errors.New("cannot create setup guide: at least one hostname must be configured via server.lets_encrypt.allowed_hosts")
+	}
+	return &Generator{
+		cfg:        cfg,
+		serverName: cfg.Server.LetsEncrypt.AllowedHosts[0],
+		provider:   provider,
+	}, nil
+}
+
+// ServerName returns the hostname clients are configured with.
+func (g *Generator) ServerName() string {
+	return g.serverName
+}
+
+// BaseURL returns the scheme, host and port of the HTTPS endpoints. Unless
+// the built-in HTTPS server is enabled on another port, they are assumed to be
+// served on 443 by a TLS-terminating proxy.
+func (g *Generator) BaseURL() string {
+	return "https://" + g.hostWithPort(g.cfg.Server.HttpsPort, defaultHTTPSPort)
+}
+
+// DoHURL returns the DoH URL.
+func (g *Generator) DoHURL() string {
+	return g.BaseURL() + dohPath
+}
+
+// hostWithPort returns the server name, with the port if it is set and not
+// the protocol default.
+func (g *Generator) hostWithPort(port, defaultPort int) string {
+	if port == 0 || port == defaultPort {
+		return g.serverName
+	}
+	return net.JoinHostPort(g.serverName, strconv.Itoa(port))
+}
+
+func (g *Generator) props() stamps.Props {
+	var props stamps.Props
+	if g.cfg.DNS.DNSSEC.Enabled {
+		props |= stamps.PropDNSSEC
+	}
+	return props
+}
+
+// Guide returns the setup instructions, using the given server IP addresses
+// in the snippets that need them (or a placeholder if there are none).
+func (g *Generator) Guide(addresses []string) *Guide {
+	server := g.cfg.Server
+	guide := &Guide{
+		ServerName: g.serverName,
+		DoHURL:     g.DoHURL(),
+		Addresses:  append([]string{}, addresses...),
+	}
+	if len(addresses) == 0 {
+		addresses = []string{AddressPlaceholder}
+	}
+
+	guide.Endpoints = append(guide.Endpoints, Endpoint{
+		Protocol: "DoH",
+		Address:  guide.DoHURL,
+		Stamp: stamps.Stamp{
+			Protocol: stamps.ProtocolDoH,
+			Props:    g.props(),
+			Hostname: g.hostWithPort(server.HttpsPort, defaultHTTPSPort),
+			Path:     dohPath,
+		}.String(),
+	})
+
+	if server.DotPort != 0 {
+		guide.Endpoints = append(guide.Endpoints, Endpoint{
+			Protocol: "DoT",
+			Address:  net.JoinHostPort(g.serverName, strconv.Itoa(server.DotPort)),
+			Stamp: stamps.Stamp{
+				Protocol: stamps.ProtocolDoT,
+				Props:    g.props(),
+				Hostname: g.hostWithPort(server.DotPort, defaultDoTPort),
+			}.String(),
+		})
+		if server.DotPort == defaultDoTPort {
+			guide.AndroidPrivateDNS = g.serverName
+		}
+	}
+
+	// DoQ needs a real certificate, see RunServer
+	if server.DoqPort != 0 && (server.LetsEncrypt.Enabled || server.TLS.CertFile != "") {
+		guide.Endpoints = append(guide.Endpoints, Endpoint{
+			Protocol: "DoQ",
+			Address:  "quic://" + net.JoinHostPort(g.serverName, strconv.Itoa(server.DoqPort)),
+			Stamp: stamps.Stamp{
+				Protocol: stamps.ProtocolDoQ,
+				Props:    g.props(),
+				Hostname: g.hostWithPort(server.DoqPort, defaultDoTPort),
+			}.String(),
+		})
+	}
+
+	if g.provider != nil {
+		guide.Endpoints = append(guide.Endpoints, Endpoint{
+			Protocol: "DNSCrypt",
+			Address:  g.dnscryptAddress(),
+			Stamp:    g.DNSCryptStamp(),
+		})
+	}
+
+	if server.ODoH.Enabled {
+		guide.Endpoints = append(guide.Endpoints, Endpoint{
+			Protocol: "ODoH",
+			Address:  guide.DoHURL,
+			Stamp: stamps.Stamp{
+				Protocol: stamps.ProtocolODoHTarget,
+				Props:    g.props(),
+				Hostname: g.hostWithPort(server.HttpsPort, defaultHTTPSPort),
+				Path:     dohPath,
+			}.String(),
+		})
+	}
+
+	for _, addr := range addresses {
+		guide.WindowsNetsh = append(guide.WindowsNetsh, fmt.Sprintf(
+			"netsh dns add encryption server=%s dohtemplate=%s autoupgrade=yes udpfallback=no", addr, guide.DoHURL))
+		guide.WindowsPowerShell = append(guide.WindowsPowerShell, fmt.Sprintf(
+			"Add-DnsClientDohServerAddress -ServerAddress '%s' -DohTemplate '%s' -AllowFallbackToUdp $False -AutoUpgrade $True", addr, guide.DoHURL))
+	}
+
+	guide.SystemdResolved = g.systemdResolved(addresses)
+	guide.NetworkManager = g.networkManager(addresses)
+	return guide
+}
+
+// dnscryptAddress is the address advertised in the DNSCrypt stamp. Most
+// clients require an IP address, so the hostname is only a fallback.
+func (g *Generator) dnscryptAddress() string {
+	if addr := g.cfg.Server.DNSCrypt.StampAddress; addr != "" {
+		return addr
+	}
+	return net.JoinHostPort(g.serverName, strconv.Itoa(g.cfg.Server.DNSCryptPort))
+}
+
+// DNSCryptStamp returns the stamp of the DNSCrypt listener, or "" if it is
+// disabled.
+func (g *Generator) DNSCryptStamp() string {
+	if g.provider == nil {
+		return ""
+	}
+	return stamps.Stamp{
+		Protocol:     stamps.ProtocolDNSCrypt,
+		Props:        g.props(),
+		Address:      g.dnscryptAddress(),
+		PublicKey:    g.provider.PublicKey(),
+		ProviderName: strings.TrimSuffix(g.provider.Name(), "."),
+	}.String()
+}
+
+// dotServer formats an address in the address[:port]#server_name syntax
+// understood by systemd-resolved and NetworkManager.
+func (g *Generator) dotServer(addr string) string {
+	port := g.cfg.Server.DotPort
+	if port != defaultDoTPort {
+		if ip, err := netip.ParseAddr(addr); err == nil && ip.Is6() {
+			addr = "[" + addr + "]"
+		}
+		addr += ":" + strconv.Itoa(port)
+	}
+	return addr + "#" + g.serverName
+}
+
+func (g *Generator) systemdResolved(addresses []string) string {
+	servers := make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		servers = append(servers, g.dotServer(addr))
+	}
+	return fmt.Sprintf("[Resolve]\nDNS=%s\nDNSOverTLS=yes\nDomains=~.\n", strings.Join(servers, " "))
+}
+
+func (g *Generator) networkManager(addresses []string) string {
+	var v4, v6 []string
+	for _, addr := range addresses {
+		if ip, err := netip.ParseAddr(addr); err == nil && ip.Is6() {
+			v6 = append(v6, g.dotServer(addr))
+		} else {
+			v4 = append(v4, g.dotServer(addr))
+		}
+	}
+
+	cmd := `nmcli connection modify "<connection>"`
+	if len(v4) > 0 {
+		cmd += fmt.Sprintf(` ipv4.dns "%s" ipv4.ignore-auto-dns yes`, strings.Join(v4, ","))
+	}
+	if len(v6) > 0 {
+		cmd += fmt.Sprintf(` ipv6.dns "%s" ipv6.ignore-auto-dns yes`, strings.Join(v6, ","))
+	}
+	return cmd + " connection.dns-over-tls yes"
+}
@@ -0,0 +1,131 @@
+package setup
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/rm-hull/dot-block/internal/dnscrypt"
+	"github.com/rm-hull/dot-block/internal/stamps"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig() *config.Config {
+	cfg := config.DefaultConfig()
+	cfg.Server.LetsEncrypt.AllowedHosts = []string{"dns.example.com"}
+	cfg.DNS.DNSSEC.Enabled = false
+	return cfg
+}
+
+func protocols(guide *Guide) []string {
+	var names []string
+	for _, endpoint := range guide.Endpoints {
+		names = append(names, endpoint.Protocol)
+	}
+	return names
+}
+
+func TestNew_RequiresAllowedHosts(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.LetsEncrypt.AllowedHosts = nil
+
+	_, err := New(cfg, nil)
+	assert.Error(t, err)
+}
+
+func TestGuide_Defaults(t *testing.T) {
+	generator, err := New(testConfig(), nil)
+	require.NoError(t, err)
+
+	guide := generator.Guide([]string{"192.0.2.1", "2001:db8::1"})
+	assert.Equal(t, "https://dns.example.com/dns-query", guide.DoHURL)
+	assert.Equal(t, []string{"DoH", "DoT"}, protocols(guide))
+	assert.Equal(t, stamps.Stamp{Protocol: stamps.ProtocolDoH, Hostname: "dns.example.com", Path: "/dns-query"}.String(), guide.Endpoints[0].Stamp)
+	assert.Equal(t, stamps.Stamp{Protocol: stamps.ProtocolDoT, Hostname: "dns.example.com"}.String(), guide.Endpoints[1].Stamp)
+	assert.Equal(t, "dns.example.com", guide.AndroidPrivateDNS)
+
+	assert.Equal(t, []string{
+		"netsh dns add encryption server=192.0.2.1 dohtemplate=https://dns.example.com/dns-query autoupgrade=yes udpfallback=no",
+		"netsh dns add encryption server=2001:db8::1 dohtemplate=https://dns.example.com/dns-query autoupgrade=yes udpfallback=no",
+	}, guide.WindowsNetsh)
+	assert.Len(t, guide.WindowsPowerShell, 2)
+	assert.Equal(t, "[Resolve]\nDNS=192.0.2.1#dns.example.com 2001:db8::1#dns.example.com\nDNSOverTLS=yes\nDomains=~.\n", guide.SystemdResolved)
+	assert.Equal(t, `nmcli connection modify "<connection>" ipv4.dns "192.0.2.1#dns.example.com" ipv4.ignore-auto-dns yes ipv6.dns "2001:db8::1#dns.example.com" ipv6.ignore-auto-dns yes connection.dns-over-tls yes`, guide.NetworkManager)
+}
+
+func TestGuide_NonStandardPorts(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.DotPort = 8853
+	cfg.Server.HttpsPort = 8443
+	cfg.DNS.DNSSEC.Enabled = true
+	generator, err := New(cfg, nil)
+	require.NoError(t, err)
+
+	guide := generator.Guide([]string{"2001:db8::1"})
+	assert.Equal(t, "https://dns.example.com:8443/dns-query", guide.DoHURL)
+	assert.Equal(t, stamps.Stamp{Protocol: stamps.ProtocolDoT, Props: stamps.PropDNSSEC, Hostname: "dns.example.com:8853"}.String(), guide.Endpoints[1].Stamp)
+	assert.Empty(t, guide.AndroidPrivateDNS, "Android only supports DoT on port 853")
+	assert.Contains(t, guide.SystemdResolved, "DNS=[2001:db8::1]:8853#dns.example.com\n")
+}
+
+func TestGuide_OptionalListeners(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.DoqPort = 853
+	cfg.Server.LetsEncrypt.Enabled = true
+	cfg.Server.DNSCryptPort = 5443
+	cfg.Server.DNSCrypt.StampAddress = "192.0.2.1:5443"
+	cfg.Server.ODoH.Enabled = true
+
+	provider, err := dnscrypt.NewProvider(dnscrypt.ProviderName("dns.example.com"), filepath.Join(t.TempDir(), "provider.key"), time.Hour)
+	require.NoError(t, err)
+	generator, err := New(cfg, provider)
+	require.NoError(t, err)
+
+	guide := generator.Guide(nil)
+	assert.Equal(t, []string{"DoH", "DoT", "DoQ", "DNSCrypt", "ODoH"}, protocols(guide))
+	assert.Equal(t, stamps.Stamp{
+		Protocol:     stamps.ProtocolDNSCrypt,
+		Address:      "192.0.2.1:5443",
+		PublicKey:    provider.PublicKey(),
+		ProviderName: "2.dnscrypt-cert.dns.example.com",
+	}.String(), guide.Endpoints[3].Stamp)
+	assert.Equal(t, generator.DNSCryptStamp(), guide.Endpoints[3].Stamp)
+}
+
+func TestGuide_PlaceholderAddress(t *testing.T) {
+	generator, err := New(testConfig(), nil)
+	require.NoError(t, err)
+
+	guide := generator.Guide(nil)
+	assert.Empty(t, guide.Addresses)
+	assert.Contains(t, guide.WindowsNetsh[0], "server="+AddressPlaceholder)
+	assert.Contains(t, guide.SystemdResolved, AddressPlaceholder+"#dns.example.com")
+
+	var buf bytes.Buffer
+	require.NoError(t, guide.WriteText(&buf))
+	assert.Contains(t, buf.String(), "could not be resolved")
+	assert.Contains(t, buf.String(), guide.Endpoints[0].Stamp)
+}
+
+func TestGuide_WriteHTML(t *testing.T) {
+	generator, err := New(testConfig(), nil)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, generator.Guide([]string{"192.0.2.1"}).WriteHTML(&buf))
+	assert.Contains(t, buf.String(), "<h1>dot-block setup for dns.example.com</h1>")
+	assert.Contains(t, buf.String(), `src="setup/qr.png"`)
+	assert.NotContains(t, buf.String(), "could not be resolved")
+}
+
+func TestGenerator_QRCode(t *testing.T) {
+	generator, err := New(testConfig(), nil)
+	require.NoError(t, err)
+
+	png, err := generator.QRCode()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("\x89PNG"), png[:4])
+}
@@ -0,0 +1,83 @@
+// Package stamps encodes DNS stamps (sdns:// URIs), which bundle everything a
+// client needs to connect to a resolver into a single string. See
+// https://dnscrypt.info/stamps-specifications for the format.
+package stamps
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+)
+
+// Protocol identifies the transport described by a stamp.
+type Protocol byte
+
+const (
+	ProtocolDNSCrypt   Protocol = 0x01
+	ProtocolDoH        Protocol = 0x02
+	ProtocolDoT        Protocol = 0x03
+	ProtocolDoQ        Protocol = 0x04
+	ProtocolODoHTarget Protocol = 0x05
+)
+
+// Props are the informal properties a resolver advertises about itself.
+type Props uint64
+
+const (
+	PropDNSSEC   Props = 1 << 0 // the resolver validates DNSSEC
+	PropNoLog    Props = 1 << 1 // the resolver does not keep logs
+	PropNoFilter Props = 1 << 2 // the resolver does not block domains
+)
+
+// Stamp describes a resolver.
+type Stamp struct {
+	Protocol Protocol
+	Props    Props
+	// Address is the resolver's IP address, optionally with a port if it is
+	// not the protocol's default. It may be empty for the TLS-based
+	// protocols, in which case clients resolve Hostname.
+	Address string
+	// PublicKey is the DNSCrypt provider's Ed25519 public key.
+	PublicKey []byte
+	// ProviderName is the DNSCrypt provider name, e.g.
+	// 2.dnscrypt-cert.example.com.
+	ProviderName string
+	// Hostname is the TLS server name, optionally with a port if it is not
+	// the protocol's default (DoH, DoT, DoQ and ODoH).
+	Hostname string
+	// Path is the HTTP path, e.g. /dns-query (DoH and ODoH).
+	Path string
+}
+
+// String returns the sdns:// URI for the stamp.
+func (s Stamp) String() string {
+	buf := []byte{byte(s.Protocol)}
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(s.Props))
+
+	switch s.Protocol {
+	case ProtocolDNSCrypt:
+		buf = appendLP(buf, []byte(s.Address))
+		buf = appendLP(buf, s.PublicKey)
+		buf = appendLP(buf, []byte(s.ProviderName))
+	case ProtocolDoH:
+		buf = appendLP(buf, []byte(s.Address))
+		buf = append(buf, 0) // no certificate hashes
+		buf = appendLP(buf, []byte(s.Hostname))
+		buf = appendLP(buf, []byte(s.Path))
+	case ProtocolDoT, ProtocolDoQ:
+		buf = appendLP(buf, []byte(s.Address))
+		buf = append(buf, 0) // no certificate hashes
+		buf = appendLP(buf, []byte(s.Hostname))
+	case ProtocolODoHTarget:
+		buf = appendLP(buf, []byte(s.Hostname))
+		buf = appendLP(buf, []byte(s.Path))
+	}
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// appendLP appends a length-prefixed string, as used throughout the stamp
+// format.
+func appendLP(buf, v []byte) []byte {
+	buf = append(buf, byte(len(v)))
+	return append(buf, v...)
+}
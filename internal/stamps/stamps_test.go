@@ -0,0 +1,83 @@
+package stamps
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStamp_DNSCrypt(t *testing.T) {
+	pk := make([]byte, 32)
+	for i := range pk {
+		pk[i] = byte(i)
+	}
+
+	stamp := Stamp{
+		Protocol:     ProtocolDNSCrypt,
+		Props:        PropDNSSEC | PropNoLog,
+		Address:      "192.0.2.1:5443",
+		PublicKey:    pk,
+		ProviderName: "2.dnscrypt-cert.example.com",
+	}.String()
+
+	require.True(t, strings.HasPrefix(stamp, "sdns://"))
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, "sdns://"))
+	require.NoError(t, err)
+
+	expected := []byte{0x01, 0x03, 0, 0, 0, 0, 0, 0, 0}
+	expected = append(expected, 14)
+	expected = append(expected, "192.0.2.1:5443"...)
+	expected = append(expected, 32)
+	expected = append(expected, pk...)
+	expected = append(expected, 27)
+	expected = append(expected, "2.dnscrypt-cert.example.com"...)
+	assert.Equal(t, expected, raw)
+}
+
+func TestStamp_TLSProtocols(t *testing.T) {
+	header := func(protocol Protocol, props byte) []byte {
+		return []byte{byte(protocol), props, 0, 0, 0, 0, 0, 0, 0}
+	}
+	lp := func(buf []byte, v string) []byte {
+		return append(append(buf, byte(len(v))), v...)
+	}
+	noHashes := func(buf []byte) []byte { return append(buf, 0) }
+
+	tests := []struct {
+		name     string
+		stamp    Stamp
+		expected []byte
+	}{
+		{
+			name:     "DoH",
+			stamp:    Stamp{Protocol: ProtocolDoH, Props: PropDNSSEC, Hostname: "dns.example.com", Path: "/dns-query"},
+			expected: lp(lp(noHashes(lp(header(ProtocolDoH, 1), "")), "dns.example.com"), "/dns-query"),
+		},
+		{
+			name:     "DoT",
+			stamp:    Stamp{Protocol: ProtocolDoT, Address: "192.0.2.1", Hostname: "dns.example.com"},
+			expected: lp(noHashes(lp(header(ProtocolDoT, 0), "192.0.2.1")), "dns.example.com"),
+		},
+		{
+			name:     "DoQ",
+			stamp:    Stamp{Protocol: ProtocolDoQ, Hostname: "dns.example.com:8853"},
+			expected: lp(noHashes(lp(header(ProtocolDoQ, 0), "")), "dns.example.com:8853"),
+		},
+		{
+			name:     "ODoH",
+			stamp:    Stamp{Protocol: ProtocolODoHTarget, Hostname: "dns.example.com", Path: "/dns-query"},
+			expected: lp(lp(header(ProtocolODoHTarget, 0), "dns.example.com"), "/dns-query"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(tt.stamp.String(), "sdns://"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, raw)
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Package tlspolicy builds the TLS configuration shared by the encrypted
+// listeners (DoT, DoQ, HTTPS and HTTP/3) from the configured policy, and
+// manages the session ticket keys that let clients resume their sessions.
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rm-hull/dot-block/internal/config"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// curves are the key exchange mechanisms that can be configured, hybrid
+// post-quantum ones first.
+var curves = []tls.CurveID{
+	tls.X25519MLKEM768,
+	tls.SecP256r1MLKEM768,
+	tls.SecP384r1MLKEM1024,
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+	tls.CurveP521,
+}
+
+// Policy builds the TLS configuration of each encrypted listener.
+type Policy struct {
+	minVersion     uint16
+	maxVersion     uint16
+	cipherSuites   []uint16
+	curves         []tls.CurveID
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	tickets        *TicketKeys
+	handshakes     *prometheus.CounterVec
+}
+
+// New returns the policy for the config, serving the certificates from
+// getCertificate. Session tickets are disabled if tickets is nil, and
+// handshakes are counted in handshakes if it is not nil.
+func New(cfg *config.TLSConfig, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), tickets *TicketKeys, handshakes *prometheus.CounterVec) (*Policy, error) {
+	if cfg == nil {
+		cfg = &config.TLSConfig{}
+	}
+	p := &Policy{
+		minVersion:     tls.VersionTLS12,
+		maxVersion:     tls.VersionTLS13,
+		getCertificate: getCertificate,
+		tickets:        tickets,
+		handshakes:     handshakes,
+	}
+
+	var err error
+	if cfg.MinVersion != "" {
+		if p.minVersion, err = parseVersion(cfg.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MaxVersion != "" {
+		if p.maxVersion, err = parseVersion(cfg.MaxVersion); err != nil {
+			return nil, err
+		}
+	}
+	if p.minVersion > p.maxVersion {
+		return nil, errors.Newf("TLS min_version %s is greater than max_version %s", cfg.MinVersion, cfg.MaxVersion)
+	}
+	if p.cipherSuites, err = parseCipherSuites(cfg.CipherSuites); err != nil {
+		return nil, err
+	}
+	if p.curves, err = parseCurves(cfg.Curves); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseVersion(version string) (uint16, error) {
+	v, ok := versions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !ok {
+		return 0, errors.Newf("invalid TLS version %q (expected 1.0, 1.1, 1.2 or 1.3)", version)
+	}
+	return v, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		idx := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool {
+			return strings.EqualFold(suite.Name, name)
+		})
+		if idx < 0 {
+			return nil, errors.Newf("unknown or insecure TLS cipher suite %q", name)
+		}
+		suite := tls.CipherSuites()[idx]
+		if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return nil, errors.Newf("TLS 1.3 cipher suite %q is not configurable", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range names {
+		idx := slices.IndexFunc(curves, func(id tls.CurveID) bool {
+			return strings.EqualFold(id.String(), name) || strings.EqualFold(strings.TrimPrefix(id.String(), "Curve"), name)
+		})
+		if idx < 0 {
+			return nil, errors.Newf("unknown TLS curve %q", name)
+		}
+		ids = append(ids, curves[idx])
+	}
+	return ids, nil
+}
+
+// Config returns the TLS configuration for the named listener, negotiating
+// one of nextProtos with ALPN.
+func (p *Policy) Config(listener string, nextProtos ...string) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:       p.minVersion,
+		MaxVersion:       p.maxVersion,
+		CipherSuites:     p.cipherSuites,
+		CurvePreferences: p.curves,
+		NextProtos:       nextProtos,
+		GetCertificate:   p.getCertificate,
+	}
+	if p.handshakes != nil {
+		// Called for every completed handshake, including resumptions
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			keyExchange := "none"
+			if state.CurveID != 0 {
+				keyExchange = state.CurveID.String()
+			}
+			p.handshakes.WithLabelValues(listener, tls.VersionName(state.Version), keyExchange, strconv.FormatBool(state.DidResume)).Inc()
+			return nil
+		}
+	}
+	if p.tickets != nil {
+		p.tickets.register(cfg)
+		// net/http, quic-go and http3 serve from clones of the config, which
+		// keep the session ticket keys it had at the time. Handing them the
+		// registered config for every handshake applies rotated keys as well.
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return cfg, nil
+		}
+	} else {
+		cfg.SessionTicketsDisabled = true
+	}
+	return cfg
+}
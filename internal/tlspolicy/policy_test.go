@@ -0,0 +1,196 @@
+package tlspolicy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rm-hull/dot-block/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_Defaults(t *testing.T) {
+	policy, err := New(nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	cfg := policy.Config("dot", "dot")
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MaxVersion)
+	assert.Empty(t, cfg.CipherSuites)
+	assert.Empty(t, cfg.CurvePreferences)
+	assert.Equal(t, []string{"dot"}, cfg.NextProtos)
+	assert.True(t, cfg.SessionTicketsDisabled)
+}
+
+func TestNew_Policy(t *testing.T) {
+	policy, err := New(&config.TLSConfig{
+		MinVersion:   "1.3",
+		MaxVersion:   "TLS1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+		Curves:       []string{"X25519MLKEM768", "x25519", "P256"},
+	}, nil, nil, nil)
+	require.NoError(t, err)
+
+	cfg := policy.Config("doq")
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, cfg.CipherSuites)
+	assert.Equal(t, []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256}, cfg.CurvePreferences)
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for name, cfg := range map[string]*config.TLSConfig{
+		"unknown version":   {MinVersion: "1.4"},
+		"inverted versions": {MinVersion: "1.3", MaxVersion: "1.2"},
+		"insecure cipher":   {CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		"TLS 1.3 cipher":    {CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		"unknown curve":     {Curves: []string{"X448"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(cfg, nil, nil, nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func selfSignedCertificate(t *testing.T) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		DNSNames:     []string{"dns.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake connects to a TLS server with the config, returning whether the
+// session was resumed.
+func handshake(t *testing.T, serverConfig *tls.Config, clientConfig *tls.Config) bool {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		// Complete the handshake and send the session ticket
+		_ = conn.(*tls.Conn).Handshake()
+		_, _ = conn.Write([]byte{0})
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Read(make([]byte, 1))
+	require.NoError(t, err)
+	return conn.ConnectionState().DidResume
+}
+
+func TestPolicy_SessionResumptionAcrossReplicas(t *testing.T) {
+	cert := selfSignedCertificate(t)
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }
+	keyFile := filepath.Join(t.TempDir(), "tls", "session-ticket-keys.json")
+	handshakes := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "handshakes"}, []string{"listener", "version", "key_exchange", "resumed"})
+
+	// Two replicas sharing the key file
+	var replicas []*tls.Config
+	for range 2 {
+		tickets, err := NewTicketKeys(keyFile, time.Hour)
+		require.NoError(t, err)
+		policy, err := New(&config.TLSConfig{Curves: []string{"X25519"}}, getCertificate, tickets, handshakes)
+		require.NoError(t, err)
+		replicas = append(replicas, policy.Config("dot", "dot"))
+	}
+
+	roots := x509.NewCertPool()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	roots.AddCert(leaf)
+	clientConfig := &tls.Config{
+		ServerName:         "dns.example.com",
+		RootCAs:            roots,
+		NextProtos:         []string{"dot"},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	assert.False(t, handshake(t, replicas[0], clientConfig))
+	assert.True(t, handshake(t, replicas[1], clientConfig))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(handshakes.WithLabelValues("dot", "TLS 1.3", "X25519", "false")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(handshakes.WithLabelValues("dot", "TLS 1.3", "X25519", "true")))
+}
+
+func TestPolicy_ClonedConfigUsesRotatedKeys(t *testing.T) {
+	cert := selfSignedCertificate(t)
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }
+	keyFile := filepath.Join(t.TempDir(), "session-ticket-keys.json")
+	tickets, err := NewTicketKeys(keyFile, time.Hour)
+	require.NoError(t, err)
+	policy, err := New(nil, getCertificate, tickets, nil)
+	require.NoError(t, err)
+
+	// Served from a clone, as by http.Server.ServeTLS and quic-go
+	served := policy.Config("https", "h2").Clone()
+
+	// Another replica rotates the key
+	rotated := ticketKey{Created: time.Now().Add(time.Minute).UTC(), Key: make([]byte, 32)}
+	rotated.Key[0] = 42
+	writeTicketKeys(t, keyFile, append([]ticketKey{rotated}, readTicketKeys(t, keyFile)...))
+	_, err = tickets.Refresh()
+	require.NoError(t, err)
+
+	// A server that only knows the new key resumes the session
+	replica := &tls.Config{GetCertificate: getCertificate, NextProtos: []string{"h2"}}
+	replica.SetSessionTicketKeys([][32]byte{[32]byte(rotated.Key)})
+
+	clientConfig := &tls.Config{
+		ServerName:         "dns.example.com",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	assert.False(t, handshake(t, served, clientConfig))
+	assert.True(t, handshake(t, replica, clientConfig), "the ticket was issued with the rotated key")
+}
+
+func TestPolicy_NoCertificate(t *testing.T) {
+	policy, err := New(nil, func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nil, assert.AnError
+	}, nil, nil)
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", policy.Config("dot"))
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	assert.Error(t, tls.Client(conn, &tls.Config{ServerName: "dns.example.com"}).Handshake())
+}
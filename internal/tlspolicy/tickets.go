@@ -0,0 +1,156 @@
+package tlspolicy
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// retainedKeys is the number of session ticket keys kept: the current key,
+// which encrypts new tickets, and the previous ones, which still decrypt the
+// tickets they issued.
+const retainedKeys = 3
+
+type ticketKey struct {
+	Created time.Time `json:"created"`
+	Key     []byte    `json:"key"`
+}
+
+// TicketKeys are the session ticket keys of the TLS listeners. They are kept
+// in a file so that sessions survive restarts, and replicas that share the
+// file can resume each other's sessions: each one reloads it periodically,
+// and whichever first finds the current key too old rotates it.
+type TicketKeys struct {
+	file     string
+	rotation time.Duration
+
+	mu      sync.Mutex
+	keys    []ticketKey
+	configs []*tls.Config
+}
+
+// NewTicketKeys loads the session ticket keys from the file, generating a
+// key if there is none or the newest is older than the rotation interval.
+func NewTicketKeys(file string, rotation time.Duration) (*TicketKeys, error) {
+	if rotation <= 0 {
+		return nil, errors.New("session ticket rotation must be positive")
+	}
+	k := &TicketKeys{file: file, rotation: rotation}
+	if _, err := k.Refresh(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Refresh reloads the keys from the file, picking up keys rotated by other
+// replicas, and rotates them if the newest key is older than the rotation
+// interval. It reports whether a new key was generated.
+func (k *TicketKeys) Refresh() (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys, err := k.load()
+	if err != nil {
+		return false, err
+	}
+
+	rotated := false
+	if len(keys) == 0 || time.Since(keys[0].Created) >= k.rotation {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return false, errors.Wrap(err, "failed to generate session ticket key")
+		}
+		keys = append([]ticketKey{{Created: time.Now().UTC(), Key: key}}, keys...)
+		if len(keys) > retainedKeys {
+			keys = keys[:retainedKeys]
+		}
+		if err := k.save(keys); err != nil {
+			return false, err
+		}
+		rotated = true
+	}
+
+	if !slices.EqualFunc(keys, k.keys, func(a, b ticketKey) bool { return bytes.Equal(a.Key, b.Key) }) {
+		k.keys = keys
+		for _, cfg := range k.configs {
+			cfg.SetSessionTicketKeys(k.sessionTicketKeys())
+		}
+	}
+	return rotated, nil
+}
+
+// load reads the keys from the file, newest first.
+func (k *TicketKeys) load() ([]ticketKey, error) {
+	data, err := os.ReadFile(k.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read session ticket keys %s", k.file)
+	}
+
+	var keys []ticketKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse session ticket keys %s", k.file)
+	}
+	for _, key := range keys {
+		if len(key.Key) != 32 {
+			return nil, errors.Newf("invalid session ticket key in %s (expected 32 bytes, got %d)", k.file, len(key.Key))
+		}
+	}
+	slices.SortFunc(keys, func(a, b ticketKey) int {
+		return cmp.Compare(b.Created.UnixNano(), a.Created.UnixNano())
+	})
+	return keys, nil
+}
+
+// save writes the keys to the file, replacing it atomically so that other
+// replicas never read a partial file.
+func (k *TicketKeys) save(keys []ticketKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(k.file), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory for session ticket keys %s", k.file)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.file), filepath.Base(k.file)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to write session ticket keys %s", k.file)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "failed to write session ticket keys %s", k.file)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write session ticket keys %s", k.file)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), k.file), "failed to write session ticket keys %s", k.file)
+}
+
+func (k *TicketKeys) sessionTicketKeys() [][32]byte {
+	keys := make([][32]byte, len(k.keys))
+	for i, key := range k.keys {
+		copy(keys[i][:], key.Key)
+	}
+	return keys
+}
+
+// register makes the config use the keys, updating it as they are rotated.
+func (k *TicketKeys) register(cfg *tls.Config) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	cfg.SetSessionTicketKeys(k.sessionTicketKeys())
+	k.configs = append(k.configs, cfg)
+}
@@ -0,0 +1,102 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTicketKeys(t *testing.T, file string) []ticketKey {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	var keys []ticketKey
+	require.NoError(t, json.Unmarshal(data, &keys))
+	return keys
+}
+
+func writeTicketKeys(t *testing.T, file string, keys []ticketKey) {
+	t.Helper()
+	data, err := json.Marshal(keys)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file, data, 0600))
+}
+
+func TestNewTicketKeys_CreatesAndReusesKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tls", "session-ticket-keys.json")
+
+	_, err := NewTicketKeys(file, time.Hour)
+	require.NoError(t, err)
+	keys := readTicketKeys(t, file)
+	require.Len(t, keys, 1)
+	assert.Len(t, keys[0].Key, 32)
+
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A restart keeps the current key
+	_, err = NewTicketKeys(file, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, keys, readTicketKeys(t, file))
+}
+
+func TestTicketKeys_Rotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session-ticket-keys.json")
+	var stale []ticketKey
+	for i := range 3 {
+		stale = append(stale, ticketKey{Created: time.Now().Add(-time.Duration(i+2) * time.Hour).UTC(), Key: make([]byte, 32)})
+		stale[i].Key[0] = byte(i + 1)
+	}
+	writeTicketKeys(t, file, stale)
+
+	keys, err := NewTicketKeys(file, time.Hour)
+	require.NoError(t, err)
+	cfg := &tls.Config{}
+	keys.register(cfg)
+
+	// The oldest key is dropped once a new one is generated
+	saved := readTicketKeys(t, file)
+	require.Len(t, saved, retainedKeys)
+	assert.True(t, saved[0].Created.After(stale[0].Created))
+	assert.Equal(t, stale[:2], saved[1:])
+
+	rotated, err := keys.Refresh()
+	require.NoError(t, err)
+	assert.False(t, rotated)
+}
+
+func TestTicketKeys_PicksUpKeysRotatedElsewhere(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session-ticket-keys.json")
+	keys, err := NewTicketKeys(file, time.Hour)
+	require.NoError(t, err)
+	before := keys.sessionTicketKeys()
+
+	other := ticketKey{Created: time.Now().Add(time.Minute).UTC(), Key: make([]byte, 32)}
+	other.Key[0] = 42
+	writeTicketKeys(t, file, append([]ticketKey{other}, readTicketKeys(t, file)...))
+
+	rotated, err := keys.Refresh()
+	require.NoError(t, err)
+	assert.False(t, rotated)
+	after := keys.sessionTicketKeys()
+	require.Len(t, after, 2)
+	assert.Equal(t, byte(42), after[0][0])
+	assert.Equal(t, before[0], after[1])
+}
+
+func TestNewTicketKeys_Invalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session-ticket-keys.json")
+	_, err := NewTicketKeys(file, 0)
+	assert.Error(t, err)
+
+	writeTicketKeys(t, file, []ticketKey{{Created: time.Now(), Key: []byte("short")}})
+	_, err = NewTicketKeys(file, time.Hour)
+	assert.ErrorContains(t, err, "invalid session ticket key")
+}
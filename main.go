@@ -92,6 +92,27 @@ func main() {
 	rootCmd.Flags().StringVar(&configPath, "config", "", "Path to config.yaml file (optional, searches default locations if not provided)")
 	rootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "Print version and exit")
 
+	var setupFormat string
+	setupCmd := &cobra.Command{
+		Use:   "setup",
+		Short: "Print client setup instructions",
+		Long:  "Prints DNS stamps for every enabled listener and setup instructions for Android, Windows and Linux clients, derived from the configured allowed_hosts and ports.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load(configPath)
+			if err != nil {
+				return err
+			}
+			config.ApplyEnvOverrides(cfg)
+			app.Config = cfg
+
+			return app.WriteSetupGuide(cmd.Context(), os.Stdout, setupFormat)
+		},
+	}
+	setupCmd.Flags().StringVar(&configPath, "config", "", "Path to config.yaml file (optional, searches default locations if not provided)")
+	setupCmd.Flags().StringVar(&setupFormat, "format", "text", "Output format: text or json")
+	rootCmd.AddCommand(setupCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		app.Logger.Error("Failed to execute command", "error", err)
 		os.Exit(1)
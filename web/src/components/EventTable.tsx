@@ -67,6 +67,13 @@ function EventRow({ event, index, filterText }: EventRowProps) {
         <Highlight query={filterText} styles={{ bg: "yellow.subtle", color: "yellow.fg" }}>
           {event.ip}
         </Highlight>
+        {event.client && (
+          <Badge ml={2} colorPalette="blue">
+            <Highlight query={filterText} styles={{ bg: "yellow.subtle", color: "yellow.fg" }}>
+              {event.client}
+            </Highlight>
+          </Badge>
+        )}
       </Table.Cell>
       <Table.Cell truncate maxWidth={200}>
         <ASN ipAddr={event.ip} />
@@ -86,7 +93,8 @@ export function EventTable({ events, filterText }: EventTableProps) {
     if (!trimmedFilterText) return true;
     return (
       event.domain.toLowerCase().includes(trimmedFilterText) ||
-      event.ip.toLowerCase().includes(trimmedFilterText)
+      event.ip.toLowerCase().includes(trimmedFilterText) ||
+      (event.client?.toLowerCase().includes(trimmedFilterText) ?? false)
     );
   });
 
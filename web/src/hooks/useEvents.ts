@@ -33,7 +33,7 @@ const rrTypes = [
 ] as const;
 export type RRType = (typeof rrTypes)[number];
 
-const sources = ["TCP", "UDP", "DoH", "DoT"] as const;
+const sources = ["TCP", "UDP", "DoH", "DoT", "DoQ", "ODoH", "DNSCrypt", "Internal"] as const;
 export type Source = (typeof sources)[number];
 
 export interface DnsEvent {
@@ -43,6 +43,7 @@ export interface DnsEvent {
   domain: string;
   result: RCode;
   ip: string;
+  client?: string;
   src: Source;
   blocked: boolean;
   cached: boolean;